@@ -0,0 +1,350 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+)
+
+const (
+	// batchRetryMin and batchRetryMax bound the backoff between attempts to
+	// send a batch; max_backoff overrides the upper bound.
+	batchRetryMin = time.Second
+	batchRetryMax = 5 * time.Minute
+
+	// batchCloseTimeout bounds the last attempt to send on shutdown.
+	batchCloseTimeout = 5 * time.Second
+)
+
+// BatchConfig are the batching settings shared by the outputs that send to a
+// remote service.
+type BatchConfig struct {
+	// BatchSize is the most records sent at once.
+	BatchSize int `yaml:"batch_size"`
+	// FlushInterval is how long records are collected before sending.
+	FlushInterval time.Duration `yaml:"flush_interval"`
+	// MaxBuffered bounds the records kept while the service is unreachable.
+	MaxBuffered int `yaml:"max_buffered"`
+	// BufferFile keeps unsent records across restarts.
+	BufferFile string `yaml:"buffer_file"`
+	// MaxRetries drops a batch after this many failed attempts. Without it
+	// batches are retried until the buffer is full.
+	MaxRetries int `yaml:"max_retries"`
+	// MaxBackoff is the longest wait between attempts.
+	MaxBackoff time.Duration `yaml:"max_backoff"`
+}
+
+func (c BatchConfig) batchSize() int {
+	if c.BatchSize == 0 {
+		return 1000
+	}
+	return c.BatchSize
+}
+
+func (c BatchConfig) flushInterval() time.Duration {
+	if c.FlushInterval == 0 {
+		return 10 * time.Second
+	}
+	return c.FlushInterval
+}
+
+func (c BatchConfig) maxBuffered() int {
+	if c.MaxBuffered == 0 {
+		return 100000
+	}
+	return c.MaxBuffered
+}
+
+func (c BatchConfig) maxBackoff() time.Duration {
+	if c.MaxBackoff == 0 {
+		return batchRetryMax
+	}
+	return c.MaxBackoff
+}
+
+func (c BatchConfig) validate() error {
+	if c.BatchSize < 0 || c.MaxBuffered < 0 || c.FlushInterval < 0 || c.MaxRetries < 0 {
+		return fmt.Errorf("batch_size, max_buffered, flush_interval and max_retries must not be negative")
+	}
+	if c.MaxBackoff < 0 || (c.MaxBackoff > 0 && c.MaxBackoff < batchRetryMin) {
+		return fmt.Errorf("max_backoff must be at least %v", batchRetryMin)
+	}
+	if c.MaxBuffered > 0 && c.MaxBuffered < c.batchSize() {
+		return fmt.Errorf("max_buffered must be at least batch_size")
+	}
+	return nil
+}
+
+// permanentError marks a batch the service rejected. It is dropped rather
+// than retried.
+type permanentError struct{ err error }
+
+func (e permanentError) Error() string { return e.err.Error() }
+func (e permanentError) Unwrap() error { return e.err }
+
+// checkResponse turns an unsuccessful HTTP response into an error. When the
+// service rejects the data itself, sending it again will not help and the
+// error is permanent. Anything else, including authentication failures, may
+// be fixed on the other end and is retried.
+func checkResponse(resp *http.Response) error {
+	if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+		return nil
+	}
+	body, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+	err := fmt.Errorf("%s: %s", resp.Status, bytes.TrimSpace(body))
+	switch resp.StatusCode {
+	case http.StatusBadRequest, http.StatusRequestEntityTooLarge, http.StatusUnprocessableEntity:
+		return permanentError{err}
+	}
+	return err
+}
+
+// batcher collects records and sends them in batches on its own goroutine,
+// retrying with backoff while the service is unreachable. Records are opaque
+// single lines; with a buffer file they survive restarts.
+type batcher struct {
+	name string
+	cfg  BatchConfig
+	send func(ctx context.Context, records [][]byte) error
+
+	ctx    context.Context
+	cancel context.CancelFunc
+	wake   chan struct{}
+	done   chan struct{}
+
+	mu      sync.Mutex
+	pending [][]byte
+	dropped int
+	// sending is the size of the batch at the front being sent.
+	sending int
+	// saved is set while the buffer file holds records.
+	saved bool
+}
+
+// newBatcher loads the records left in the buffer file and starts sending.
+func newBatcher(name string, cfg BatchConfig, send func(ctx context.Context, records [][]byte) error) *batcher {
+	ctx, cancel := context.WithCancel(context.Background())
+	b := &batcher{
+		name:   name,
+		cfg:    cfg,
+		send:   send,
+		ctx:    ctx,
+		cancel: cancel,
+		wake:   make(chan struct{}, 1),
+		done:   make(chan struct{}),
+	}
+	b.load()
+	go b.run()
+	return b
+}
+
+// Add queues records. When the buffer is full they are dropped.
+func (b *batcher) Add(records ...[]byte) {
+	b.mu.Lock()
+	room := b.cfg.maxBuffered() - len(b.pending)
+	if room < len(records) {
+		if b.dropped == 0 {
+			log.Printf("[%s] Buffer full, dropping readings", b.name)
+		}
+		b.dropped += len(records) - max(room, 0)
+		records = records[:max(room, 0)]
+	}
+	b.pending = append(b.pending, records...)
+	full := len(b.pending) >= b.cfg.batchSize()
+	b.mu.Unlock()
+
+	if full {
+		select {
+		case b.wake <- struct{}{}:
+		default:
+		}
+	}
+}
+
+func (b *batcher) run() {
+	defer close(b.done)
+	ticker := time.NewTicker(b.cfg.flushInterval())
+	defer ticker.Stop()
+	var backoff time.Duration
+	failures := 0
+	for {
+		select {
+		case <-b.ctx.Done():
+			return
+		case <-ticker.C:
+		case <-b.wake:
+		}
+		for {
+			more, err := b.flush(b.ctx)
+			if b.ctx.Err() != nil {
+				return
+			}
+			if err == nil {
+				if backoff > 0 {
+					log.Printf("[%s] Sending again after a failure", b.name)
+				}
+				backoff, failures = 0, 0
+				if more {
+					continue
+				}
+				break
+			}
+			if failures++; b.cfg.MaxRetries > 0 && failures > b.cfg.MaxRetries {
+				b.discard()
+				log.Printf("[%s] Dropped a batch after %d failed attempts: %v", b.name, failures, err)
+				backoff, failures = 0, 0
+				continue
+			}
+			backoff = min(max(2*backoff, batchRetryMin), b.cfg.maxBackoff())
+			log.Printf("[%s] Failed to send, retrying in %v: %v", b.name, backoff, err)
+			b.save()
+			select {
+			case <-b.ctx.Done():
+				return
+			case <-time.After(backoff):
+			}
+		}
+	}
+}
+
+// flush sends the oldest batch and reports whether a full batch is left.
+// Only the run goroutine removes records, so the batch stays at the front
+// while it is sent.
+func (b *batcher) flush(ctx context.Context) (more bool, err error) {
+	b.mu.Lock()
+	n := min(len(b.pending), b.cfg.batchSize())
+	batch := b.pending[:n:n]
+	b.sending = n
+	if b.dropped > 0 {
+		log.Printf("[%s] Dropped %d readings while the buffer was full", b.name, b.dropped)
+		b.dropped = 0
+	}
+	b.mu.Unlock()
+	if n == 0 {
+		return false, nil
+	}
+
+	err = b.send(ctx, batch)
+	var perm permanentError
+	if errors.As(err, &perm) {
+		log.Printf("[%s] Dropping %d readings the receiver rejected: %v", b.name, n, err)
+		err = nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return b.discard(), nil
+}
+
+// discard removes the batch sent last and reports whether a full batch is
+// left.
+func (b *batcher) discard() (more bool) {
+	b.mu.Lock()
+	b.pending = b.pending[b.sending:]
+	b.sending = 0
+	more = len(b.pending) >= b.cfg.batchSize()
+	saved := b.saved
+	b.mu.Unlock()
+	if saved {
+		b.save()
+	}
+	return more
+}
+
+// load reads the buffer file of a previous run.
+func (b *batcher) load() {
+	if b.cfg.BufferFile == "" {
+		return
+	}
+	f, err := os.Open(b.cfg.BufferFile)
+	if err != nil {
+		if !errors.Is(err, os.ErrNotExist) {
+			log.Printf("[%s] Failed to read buffer file: %v", b.name, err)
+		}
+		return
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(nil, 1<<20)
+	for scanner.Scan() && len(b.pending) < b.cfg.maxBuffered() {
+		if len(scanner.Bytes()) > 0 {
+			b.pending = append(b.pending, bytes.Clone(scanner.Bytes()))
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		log.Printf("[%s] Failed to read buffer file: %v", b.name, err)
+	}
+	if len(b.pending) > 0 {
+		log.Printf("[%s] Loaded %d buffered readings from %s", b.name, len(b.pending), b.cfg.BufferFile)
+		b.saved = true
+	}
+}
+
+// save writes the unsent records to the buffer file, or removes it once
+// everything was sent.
+func (b *batcher) save() {
+	if b.cfg.BufferFile == "" {
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if len(b.pending) == 0 {
+		if err := os.Remove(b.cfg.BufferFile); err != nil && !errors.Is(err, os.ErrNotExist) {
+			log.Printf("[%s] Failed to remove buffer file: %v", b.name, err)
+		}
+		b.saved = false
+		return
+	}
+	tmp := b.cfg.BufferFile + ".tmp"
+	data := bytes.Join(b.pending, []byte("\n"))
+	data = append(data, '\n')
+	if err := os.WriteFile(tmp, data, 0600); err != nil {
+		log.Printf("[%s] Failed to write buffer file: %v", b.name, err)
+		return
+	}
+	if err := os.Rename(tmp, b.cfg.BufferFile); err != nil {
+		log.Printf("[%s] Failed to write buffer file: %v", b.name, err)
+		return
+	}
+	b.saved = true
+}
+
+func (b *batcher) len() int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return len(b.pending)
+}
+
+// Close makes a last attempt to send what is left and keeps the rest in the
+// buffer file.
+func (b *batcher) Close() error {
+	b.cancel()
+	<-b.done
+
+	ctx, cancel := context.WithTimeout(context.Background(), batchCloseTimeout)
+	defer cancel()
+	var err error
+	for err == nil && b.len() > 0 {
+		_, err = b.flush(ctx)
+	}
+	b.save()
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if n := len(b.pending); n > 0 {
+		if b.cfg.BufferFile != "" {
+			log.Printf("[%s] Kept %d unsent readings in %s", b.name, n, b.cfg.BufferFile)
+		} else {
+			log.Printf("[%s] Dropped %d unsent readings: %v", b.name, n, err)
+		}
+	}
+	return nil
+}
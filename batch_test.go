@@ -0,0 +1,148 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+// recordingSender collects sent batches and fails while err is set.
+type recordingSender struct {
+	mu      sync.Mutex
+	err     error
+	batches [][]string
+}
+
+func (s *recordingSender) send(_ context.Context, records [][]byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.err != nil {
+		return s.err
+	}
+	var batch []string
+	for _, r := range records {
+		batch = append(batch, string(r))
+	}
+	s.batches = append(s.batches, batch)
+	return nil
+}
+
+func (s *recordingSender) setErr(err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.err = err
+}
+
+func (s *recordingSender) sent() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	n := 0
+	for _, b := range s.batches {
+		n += len(b)
+	}
+	return n
+}
+
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+// ---------------------------------------------------------------------------
+// Batching
+// ---------------------------------------------------------------------------
+
+func TestBatcher_SendsFullBatches(t *testing.T) {
+	s := &recordingSender{}
+	b := newBatcher("test", BatchConfig{BatchSize: 2, FlushInterval: time.Hour}, s.send)
+	defer b.Close()
+
+	b.Add([]byte("a"), []byte("b"), []byte("c"))
+	waitFor(t, "a full batch", func() bool { return s.sent() == 2 })
+	if s.batches[0][0] != "a" || s.batches[0][1] != "b" {
+		t.Fatalf("unexpected batch %v", s.batches[0])
+	}
+
+	b.Close()
+	if s.sent() != 3 {
+		t.Fatalf("Close should send the rest, sent %v", s.batches)
+	}
+}
+
+func TestBatcher_RetriesAndDropsRejected(t *testing.T) {
+	s := &recordingSender{err: errors.New("unreachable")}
+	b := newBatcher("test", BatchConfig{FlushInterval: 10 * time.Millisecond}, s.send)
+	defer b.Close()
+
+	b.Add([]byte("a"))
+	time.Sleep(30 * time.Millisecond)
+	s.setErr(nil)
+	waitFor(t, "the retry", func() bool { return s.sent() == 1 })
+
+	s.setErr(permanentError{errors.New("bad line")})
+	b.Add([]byte("b"))
+	waitFor(t, "the rejected batch to be dropped", func() bool { return b.len() == 0 })
+}
+
+func TestBatcher_MaxRetries(t *testing.T) {
+	s := &recordingSender{err: errors.New("unreachable")}
+	b := newBatcher("test", BatchConfig{FlushInterval: 10 * time.Millisecond, MaxRetries: 1, MaxBackoff: time.Second}, s.send)
+	defer b.Close()
+
+	b.Add([]byte("a"))
+	waitFor(t, "the batch to be dropped", func() bool { return b.len() == 0 })
+	if s.sent() != 0 {
+		t.Fatalf("nothing should be sent, got %v", s.batches)
+	}
+}
+
+func TestBatcher_BufferLimit(t *testing.T) {
+	s := &recordingSender{err: errors.New("unreachable")}
+	b := newBatcher("test", BatchConfig{BatchSize: 2, MaxBuffered: 3, FlushInterval: time.Hour}, s.send)
+	defer b.Close()
+
+	b.Add([]byte("a"), []byte("b"))
+	b.Add([]byte("c"), []byte("d"))
+	if n := b.len(); n != 3 {
+		t.Fatalf("buffered %d records, want 3", n)
+	}
+}
+
+// ---------------------------------------------------------------------------
+// Buffer file
+// ---------------------------------------------------------------------------
+
+func TestBatcher_BufferFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "buffer")
+	s := &recordingSender{err: errors.New("unreachable")}
+	cfg := BatchConfig{FlushInterval: time.Hour, BufferFile: path}
+
+	b := newBatcher("test", cfg, s.send)
+	b.Add([]byte("a 1"), []byte("b 2"))
+	b.Close()
+	data, err := os.ReadFile(path)
+	if err != nil || string(data) != "a 1\nb 2\n" {
+		t.Fatalf("buffer file = %q, %v", data, err)
+	}
+
+	// The next run picks the records up and removes the file once sent
+	s.setErr(nil)
+	b = newBatcher("test", cfg, s.send)
+	b.Close()
+	if s.sent() != 2 || s.batches[0][1] != "b 2" {
+		t.Fatalf("buffered records not sent: %v", s.batches)
+	}
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Fatalf("buffer file should be removed, got %v", err)
+	}
+}
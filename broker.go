@@ -0,0 +1,353 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/eclipse/paho.golang/autopaho"
+	"github.com/eclipse/paho.golang/paho"
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+)
+
+// brokerClient is the connection a Publisher talks through. It hides the
+// differences between the MQTT 3.1.1 and MQTT 5 clients.
+type brokerClient interface {
+	Publish(msg outgoingMessage) token
+	Subscribe(filter string, qos byte, handler messageHandler) token
+	Unsubscribe(filter string) token
+	Disconnect()
+	// IsConnected reports whether the connection is currently up.
+	IsConnected() bool
+}
+
+// token is the completion handle of an asynchronous operation. mqtt.Token
+// satisfies it.
+type token interface {
+	WaitTimeout(time.Duration) bool
+	Error() error
+}
+
+type outgoingMessage struct {
+	Topic   string
+	QoS     byte
+	Retain  bool
+	Payload []byte
+
+	// MQTT 5 properties, ignored by the 3.1.1 client
+	ContentType     string
+	Expiry          time.Duration
+	UserProperties  []userProperty
+	CorrelationData []byte
+}
+
+type userProperty struct {
+	Key, Value string
+}
+
+type receivedMessage struct {
+	Topic    string
+	Payload  []byte
+	Retained bool
+
+	// MQTT 5 request/response properties, empty with the 3.1.1 client
+	ResponseTopic   string
+	CorrelationData []byte
+}
+
+type messageHandler func(receivedMessage)
+
+// topicMatches reports whether topic matches an MQTT filter with + and #
+// wildcards.
+func topicMatches(filter, topic string) bool {
+	f := strings.Split(filter, "/")
+	t := strings.Split(topic, "/")
+	for i, part := range f {
+		if part == "#" {
+			return true
+		}
+		if i >= len(t) || (part != "+" && part != t[i]) {
+			return false
+		}
+	}
+	return len(f) == len(t)
+}
+
+// will is the Last Will registered with the broker on connect.
+type will struct {
+	topic   string
+	payload string
+}
+
+// connectBroker connects to the broker using the configured protocol version
+// and blocks until the first connection is up. onConnect is called after
+// every successful (re)connect.
+func connectBroker(cfg MQTTConfig, w will, onConnect func()) (brokerClient, error) {
+	if cfg.ProtocolVersion == 5 {
+		return connectV5(cfg, w, onConnect)
+	}
+	return connectV3(cfg, w, onConnect)
+}
+
+// ---------------------------------------------------------------------------
+// MQTT 3.1.1
+// ---------------------------------------------------------------------------
+
+type v3Client struct {
+	client mqtt.Client
+}
+
+func connectV3(cfg MQTTConfig, w will, onConnect func()) (brokerClient, error) {
+	opts := mqtt.NewClientOptions().
+		AddBroker(cfg.Broker).
+		SetClientID(cfg.ClientID).
+		SetAutoReconnect(true).
+		SetConnectRetry(true).
+		SetConnectRetryInterval(5*time.Second).
+		SetWill(w.topic, w.payload, 1, true).
+		SetOnConnectHandler(func(mqtt.Client) { onConnect() })
+
+	if cfg.ProtocolVersion != 0 {
+		opts.SetProtocolVersion(uint(cfg.ProtocolVersion))
+	}
+	if cfg.Username != "" {
+		opts.SetUsername(cfg.Username)
+		opts.SetPassword(cfg.Password)
+	}
+
+	tlsConfig, err := cfg.TLSClientConfig()
+	if err != nil {
+		return nil, err
+	}
+	if tlsConfig != nil {
+		opts.SetTLSConfig(tlsConfig)
+	}
+
+	c := &v3Client{client: mqtt.NewClient(opts)}
+	if token := c.client.Connect(); token.Wait() && token.Error() != nil {
+		return nil, token.Error()
+	}
+	return c, nil
+}
+
+func (c *v3Client) Publish(msg outgoingMessage) token {
+	return c.client.Publish(msg.Topic, msg.QoS, msg.Retain, msg.Payload)
+}
+
+func (c *v3Client) Subscribe(filter string, qos byte, handler messageHandler) token {
+	return c.client.Subscribe(filter, qos, func(_ mqtt.Client, m mqtt.Message) {
+		handler(receivedMessage{Topic: m.Topic(), Payload: m.Payload(), Retained: m.Retained()})
+	})
+}
+
+func (c *v3Client) Unsubscribe(filter string) token {
+	return c.client.Unsubscribe(filter)
+}
+
+func (c *v3Client) Disconnect() {
+	c.client.Disconnect(1000)
+}
+
+func (c *v3Client) IsConnected() bool {
+	return c.client.IsConnectionOpen()
+}
+
+// ---------------------------------------------------------------------------
+// MQTT 5
+// ---------------------------------------------------------------------------
+
+// v5Timeout bounds every request made through the MQTT 5 client.
+const v5Timeout = 30 * time.Second
+
+type v5Client struct {
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	mu       sync.Mutex
+	cm       *autopaho.ConnectionManager
+	handlers map[string]messageHandler
+
+	connected atomic.Bool
+}
+
+func connectV5(cfg MQTTConfig, w will, onConnect func()) (brokerClient, error) {
+	u, err := url.Parse(cfg.Broker)
+	if err != nil {
+		return nil, fmt.Errorf("invalid broker URL %q: %w", cfg.Broker, err)
+	}
+	tlsConfig, err := cfg.TLSClientConfig()
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	c := &v5Client{
+		ctx:      ctx,
+		cancel:   cancel,
+		handlers: make(map[string]messageHandler),
+	}
+
+	pc := autopaho.ClientConfig{
+		ServerUrls:                    []*url.URL{u},
+		TlsCfg:                        tlsConfig,
+		KeepAlive:                     30,
+		CleanStartOnInitialConnection: true,
+		ReconnectBackoff:              autopaho.NewConstantBackoff(5 * time.Second),
+		OnConnectionUp: func(cm *autopaho.ConnectionManager, _ *paho.Connack) {
+			// The manager is stored here as well because the first
+			// connection can come up before NewConnection returns.
+			c.mu.Lock()
+			c.cm = cm
+			c.mu.Unlock()
+			c.connected.Store(true)
+			onConnect()
+		},
+		ClientConfig: paho.ClientConfig{
+			ClientID:           cfg.ClientID,
+			OnPublishReceived:  []func(paho.PublishReceived) (bool, error){c.dispatch},
+			OnClientError:      func(error) { c.connected.Store(false) },
+			OnServerDisconnect: func(*paho.Disconnect) { c.connected.Store(false) },
+		},
+	}
+	pc.SetWillMessage(w.topic, []byte(w.payload), 1, true)
+	if cfg.Username != "" {
+		pc.SetUsernamePassword(cfg.Username, []byte(cfg.Password))
+	}
+
+	cm, err := autopaho.NewConnection(ctx, pc)
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	c.mu.Lock()
+	c.cm = cm
+	c.mu.Unlock()
+	if err := cm.AwaitConnection(ctx); err != nil {
+		cancel()
+		return nil, err
+	}
+	return c, nil
+}
+
+func (c *v5Client) manager() *autopaho.ConnectionManager {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.cm
+}
+
+func (c *v5Client) dispatch(pr paho.PublishReceived) (bool, error) {
+	msg := receivedMessage{Topic: pr.Packet.Topic, Payload: pr.Packet.Payload, Retained: pr.Packet.Retain}
+	if props := pr.Packet.Properties; props != nil {
+		msg.ResponseTopic = props.ResponseTopic
+		msg.CorrelationData = props.CorrelationData
+	}
+	c.mu.Lock()
+	var matched []messageHandler
+	for filter, handler := range c.handlers {
+		if topicMatches(filter, msg.Topic) {
+			matched = append(matched, handler)
+		}
+	}
+	c.mu.Unlock()
+	for _, handler := range matched {
+		handler(msg)
+	}
+	return len(matched) > 0, nil
+}
+
+// run executes fn in the background and returns a token for its result.
+func (c *v5Client) run(fn func(ctx context.Context) error) token {
+	t := &asyncToken{done: make(chan struct{})}
+	go func() {
+		ctx, cancel := context.WithTimeout(c.ctx, v5Timeout)
+		defer cancel()
+		t.err = fn(ctx)
+		close(t.done)
+	}()
+	return t
+}
+
+func (c *v5Client) Publish(msg outgoingMessage) token {
+	pub := &paho.Publish{
+		Topic:   msg.Topic,
+		QoS:     msg.QoS,
+		Retain:  msg.Retain,
+		Payload: msg.Payload,
+	}
+	props := &paho.PublishProperties{ContentType: msg.ContentType, CorrelationData: msg.CorrelationData}
+	if msg.Expiry > 0 {
+		expiry := uint32(msg.Expiry / time.Second)
+		props.MessageExpiry = &expiry
+	}
+	for _, up := range msg.UserProperties {
+		props.User = append(props.User, paho.UserProperty{Key: up.Key, Value: up.Value})
+	}
+	pub.Properties = props
+
+	return c.run(func(ctx context.Context) error {
+		_, err := c.manager().Publish(ctx, pub)
+		return err
+	})
+}
+
+func (c *v5Client) Subscribe(filter string, qos byte, handler messageHandler) token {
+	c.mu.Lock()
+	c.handlers[filter] = handler
+	c.mu.Unlock()
+	return c.run(func(ctx context.Context) error {
+		_, err := c.manager().Subscribe(ctx, &paho.Subscribe{
+			Subscriptions: []paho.SubscribeOptions{{Topic: filter, QoS: qos}},
+		})
+		return err
+	})
+}
+
+func (c *v5Client) Unsubscribe(filter string) token {
+	c.mu.Lock()
+	delete(c.handlers, filter)
+	c.mu.Unlock()
+	return c.run(func(ctx context.Context) error {
+		_, err := c.manager().Unsubscribe(ctx, &paho.Unsubscribe{Topics: []string{filter}})
+		return err
+	})
+}
+
+func (c *v5Client) Disconnect() {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	c.manager().Disconnect(ctx)
+	c.cancel()
+	c.connected.Store(false)
+}
+
+func (c *v5Client) IsConnected() bool {
+	return c.connected.Load()
+}
+
+// asyncToken is the token returned by the MQTT 5 client.
+type asyncToken struct {
+	done chan struct{}
+	err  error
+}
+
+func (t *asyncToken) WaitTimeout(d time.Duration) bool {
+	select {
+	case <-t.done:
+		return true
+	case <-time.After(d):
+		return false
+	}
+}
+
+func (t *asyncToken) Error() error {
+	select {
+	case <-t.done:
+		return t.err
+	default:
+		return nil
+	}
+}
@@ -0,0 +1,389 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"slices"
+	"sync"
+	"time"
+)
+
+const (
+	// maxQueuedStates bounds the state messages waiting for one broker.
+	// Further states are dropped until the broker catches up; newer readings
+	// supersede them anyway.
+	maxQueuedStates = 1000
+
+	// brokerCallTimeout bounds how long a command waits for a broker.
+	brokerCallTimeout = 30 * time.Second
+
+	// brokerCloseTimeout bounds how long shutdown waits for a broker.
+	brokerCloseTimeout = 5 * time.Second
+)
+
+// brokerOp is an operation on the Publisher of one broker. State operations
+// may be dropped while the broker is backlogged, all others are kept. fail,
+// if set, is called instead of run when the broker could not be connected.
+type brokerOp struct {
+	run   func(*Publisher)
+	fail  func(error)
+	state bool
+}
+
+// brokerQueue runs the operations for one broker in order on its own
+// goroutine, so that a slow or unreachable broker never holds up the meter
+// readers or the other brokers.
+type brokerQueue struct {
+	name string
+	wake chan struct{}
+	done chan struct{}
+
+	mu      sync.Mutex
+	ops     []brokerOp
+	states  int
+	dropped int
+	closed  bool
+	// pub is set once connected, droppedTotal counts for /metrics.
+	pub          *Publisher
+	droppedTotal int
+}
+
+// errBrokerNotConnected is passed to the operations of a broker that could
+// not be connected.
+var errBrokerNotConnected = errors.New("not connected")
+
+// newBrokerQueue starts the goroutine of a broker. connect blocks until the
+// broker is reachable; operations queue up in the meantime.
+func newBrokerQueue(name string, connect func() (*Publisher, error)) *brokerQueue {
+	q := &brokerQueue{
+		name: name,
+		wake: make(chan struct{}, 1),
+		done: make(chan struct{}),
+	}
+	go q.run(connect)
+	return q
+}
+
+func (q *brokerQueue) push(op brokerOp) {
+	q.mu.Lock()
+	if q.closed {
+		q.mu.Unlock()
+		return
+	}
+	if op.state {
+		if q.states >= maxQueuedStates {
+			if q.dropped == 0 {
+				log.Printf("[%s] Broker is not keeping up, dropping state messages", q.name)
+			}
+			q.dropped++
+			q.droppedTotal++
+			q.mu.Unlock()
+			return
+		}
+		q.states++
+	}
+	q.ops = append(q.ops, op)
+	q.mu.Unlock()
+
+	select {
+	case q.wake <- struct{}{}:
+	default:
+	}
+}
+
+func (q *brokerQueue) run(connect func() (*Publisher, error)) {
+	defer close(q.done)
+	// The clients retry unreachable brokers themselves, so connect only
+	// fails on settings that will not work later either
+	pub, err := connect()
+	if err != nil {
+		log.Printf("[%s] Failed to connect to MQTT broker: %v", q.name, err)
+		err = fmt.Errorf("%w: %v", errBrokerNotConnected, err)
+	}
+	q.mu.Lock()
+	q.pub = pub
+	q.mu.Unlock()
+	warned := false
+	for range q.wake {
+		q.mu.Lock()
+		ops, dropped, closed := q.ops, q.dropped, q.closed
+		q.ops, q.states, q.dropped = nil, 0, 0
+		q.mu.Unlock()
+
+		if dropped > 0 {
+			log.Printf("[%s] Dropped %d state messages while the broker was not keeping up", q.name, dropped)
+		}
+		if pub != nil {
+			for _, op := range ops {
+				op.run(pub)
+			}
+		} else if len(ops) > 0 {
+			if !warned {
+				log.Printf("[%s] Dropping messages, the broker is not connected", q.name)
+				warned = true
+			}
+			for _, op := range ops {
+				if op.fail != nil {
+					op.fail(err)
+				}
+			}
+		}
+		if closed {
+			if pub != nil {
+				pub.Close()
+			}
+			return
+		}
+	}
+}
+
+// call runs fn on the broker's goroutine and waits for its result.
+func (q *brokerQueue) call(fn func(*Publisher) error) error {
+	errc := make(chan error, 1)
+	q.push(brokerOp{
+		run:  func(p *Publisher) { errc <- fn(p) },
+		fail: func(err error) { errc <- err },
+	})
+	select {
+	case err := <-errc:
+		return err
+	case <-time.After(brokerCallTimeout):
+		return fmt.Errorf("broker %s did not respond within %v", q.name, brokerCallTimeout)
+	}
+}
+
+// Close runs the queued operations and disconnects. It gives up on brokers
+// that do not finish in time.
+func (q *brokerQueue) Close() {
+	q.mu.Lock()
+	q.closed = true
+	q.mu.Unlock()
+	select {
+	case q.wake <- struct{}{}:
+	default:
+	}
+	select {
+	case <-q.done:
+	case <-time.After(brokerCloseTimeout):
+		log.Printf("[%s] Broker did not disconnect within %v", q.name, brokerCloseTimeout)
+	}
+}
+
+// Brokers fans the readings of all meters out to every configured broker.
+// Each broker has its own Publisher and connection state.
+type Brokers struct {
+	queues []*brokerQueue
+
+	mu           sync.Mutex
+	availability map[string]bool
+	serials      map[string]string
+}
+
+// NewBrokers starts connecting to the given brokers in the background.
+func NewBrokers(cfgs []MQTTConfig) *Brokers {
+	b := newBrokers()
+	for _, cfg := range cfgs {
+		cfg := cfg
+		b.queues = append(b.queues, newBrokerQueue(cfg.Broker, func() (*Publisher, error) {
+			return NewPublisher(cfg)
+		}))
+	}
+	return b
+}
+
+func newBrokers() *Brokers {
+	return &Brokers{
+		availability: make(map[string]bool),
+		serials:      make(map[string]string),
+	}
+}
+
+// each queues fn for every broker.
+func (b *Brokers) each(fn func(*Publisher)) {
+	for _, q := range b.queues {
+		q.push(brokerOp{run: fn})
+	}
+}
+
+// states queues fn for every broker as a state operation.
+func (b *Brokers) states(fn func(*Publisher)) {
+	for _, q := range b.queues {
+		q.push(brokerOp{run: fn, state: true})
+	}
+}
+
+func (b *Brokers) RegisterMeter(cfg MeterConfig) {
+	b.each(func(p *Publisher) { p.RegisterMeter(cfg) })
+}
+
+func (b *Brokers) UnregisterMeter(meterName string) {
+	b.mu.Lock()
+	delete(b.availability, meterName)
+	delete(b.serials, meterName)
+	b.mu.Unlock()
+	b.each(func(p *Publisher) { p.UnregisterMeter(meterName) })
+}
+
+func (b *Brokers) RemoveHomieDevice(meterName string) {
+	b.each(func(p *Publisher) { p.RemoveHomieDevice(meterName) })
+}
+
+func (b *Brokers) PublishMeterDiscovery(meterName string) {
+	b.each(func(p *Publisher) { p.PublishMeterDiscovery(meterName) })
+}
+
+func (b *Brokers) PublishBridgeDiscovery() {
+	b.each(func(p *Publisher) { p.PublishBridgeDiscovery() })
+}
+
+func (b *Brokers) Republish() {
+	b.each(func(p *Publisher) { p.Republish() })
+}
+
+func (b *Brokers) HandleCommand(name string, handler commandHandler) {
+	b.each(func(p *Publisher) { p.HandleCommand(name, handler) })
+}
+
+// RemoveStaleDiscovery cleans up the discovery configs of every broker.
+// Failures are logged.
+func (b *Brokers) RemoveStaleDiscovery(meters []MeterConfig) {
+	for _, q := range b.queues {
+		name := q.name
+		q.push(brokerOp{
+			run: func(p *Publisher) {
+				if err := p.RemoveStaleDiscovery(meters); err != nil {
+					log.Printf("[%s] Failed to clean up stale discovery: %v", name, err)
+				}
+			},
+			fail: func(err error) { log.Printf("[%s] Failed to clean up stale discovery: %v", name, err) },
+		})
+	}
+}
+
+// PublishAvailability forwards changes of a meter's availability. Readers
+// report it with every value, so repeats are filtered before they reach the
+// broker queues.
+func (b *Brokers) PublishAvailability(meterName string, online bool) {
+	b.mu.Lock()
+	prev, known := b.availability[meterName]
+	b.availability[meterName] = online
+	b.mu.Unlock()
+	if known && prev == online {
+		return
+	}
+	b.each(func(p *Publisher) { p.PublishAvailability(meterName, online) })
+}
+
+// SetMeterSerial forwards changes of a meter's serial number, which is
+// reported with every frame.
+func (b *Brokers) SetMeterSerial(meterName, serial string) {
+	b.mu.Lock()
+	prev, known := b.serials[meterName]
+	b.serials[meterName] = serial
+	b.mu.Unlock()
+	if known && prev == serial {
+		return
+	}
+	b.each(func(p *Publisher) { p.SetMeterSerial(meterName, serial) })
+}
+
+func (b *Brokers) PublishState(meterName string, val ValueConfig, value float64) {
+	b.states(func(p *Publisher) { p.PublishState(meterName, val, value) })
+}
+
+// PublishMeterState queues the values of a frame. The slice is copied, as
+// callers may reuse it.
+func (b *Brokers) PublishMeterState(meterName string, at time.Time, values []FrameValue) {
+	values = slices.Clone(values)
+	b.states(func(p *Publisher) { p.PublishMeterState(meterName, at, values) })
+}
+
+func (b *Brokers) PublishDiagnostics(meterName string, d diagnosticsPayload) {
+	b.states(func(p *Publisher) { p.PublishDiagnostics(meterName, d) })
+}
+
+// Purge removes every discovery config of this instance from the brokers
+// with discovery enabled and returns how many were removed.
+func (b *Brokers) Purge() (int, error) {
+	var (
+		wg      sync.WaitGroup
+		mu      sync.Mutex
+		removed int
+		errs    []error
+	)
+	for _, q := range b.queues {
+		wg.Add(1)
+		go func(q *brokerQueue) {
+			defer wg.Done()
+			err := q.call(func(p *Publisher) error {
+				if !p.haDiscovery {
+					return nil
+				}
+				topics, err := p.OwnedDiscoveryTopics()
+				if err != nil {
+					return err
+				}
+				p.ClearDiscovery(topics)
+				mu.Lock()
+				removed += len(topics)
+				mu.Unlock()
+				return nil
+			})
+			if err != nil {
+				mu.Lock()
+				errs = append(errs, fmt.Errorf("%s: %w", q.name, err))
+				mu.Unlock()
+			}
+		}(q)
+	}
+	wg.Wait()
+	return removed, errors.Join(errs...)
+}
+
+// metricFamilies returns the connection state, queue and publish latency of
+// every broker.
+func (b *Brokers) metricFamilies() []metricFamily {
+	connected := metricFamily{name: "zaehler2mqtt_mqtt_connected", typ: metricGauge,
+		help: "Whether the connection to the broker is up."}
+	connects := metricFamily{name: "zaehler2mqtt_mqtt_connects", typ: metricCounter,
+		help: "Connections made to the broker, including reconnects."}
+	depth := metricFamily{name: "zaehler2mqtt_mqtt_queue_depth", typ: metricGauge,
+		help: "Operations waiting for the broker."}
+	dropped := metricFamily{name: "zaehler2mqtt_mqtt_dropped_messages", typ: metricCounter,
+		help: "State messages dropped while the broker was not keeping up."}
+	latency := metricFamily{name: "zaehler2mqtt_mqtt_publish_duration_seconds", typ: metricHistogram, unit: "seconds",
+		help: "Time until a state message was written, or acknowledged for QoS 1 and 2."}
+
+	for _, q := range b.queues {
+		q.mu.Lock()
+		pub, queued, droppedTotal := q.pub, len(q.ops), q.droppedTotal
+		q.mu.Unlock()
+
+		up := 0.0
+		if pub != nil && pub.client.IsConnected() {
+			up = 1
+		}
+		connected.add(up, "broker", q.name)
+		depth.add(float64(queued), "broker", q.name)
+		dropped.add(float64(droppedTotal), "broker", q.name)
+		if pub != nil {
+			connects.add(float64(pub.connects.Load()), "broker", q.name)
+			pub.latency.collect(&latency, "broker", q.name)
+		}
+	}
+	return []metricFamily{connected, connects, depth, dropped, latency}
+}
+
+// Close disconnects from all brokers in parallel.
+func (b *Brokers) Close() {
+	var wg sync.WaitGroup
+	for _, q := range b.queues {
+		wg.Add(1)
+		go func(q *brokerQueue) {
+			defer wg.Done()
+			q.Close()
+		}(q)
+	}
+	wg.Wait()
+}
@@ -0,0 +1,265 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+// newTestBrokers fans out to already connected test publishers.
+func newTestBrokers(t *testing.T, pubs ...*Publisher) *Brokers {
+	b := newBrokers()
+	for _, p := range pubs {
+		p := p
+		b.queues = append(b.queues, newBrokerQueue("test", func() (*Publisher, error) { return p, nil }))
+	}
+	t.Cleanup(b.Close)
+	return b
+}
+
+// flush waits until every broker has run the operations queued so far.
+func (b *Brokers) flush(t *testing.T) {
+	t.Helper()
+	for _, q := range b.queues {
+		if err := q.call(func(*Publisher) error { return nil }); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+var testMeter = MeterConfig{Name: "nutzstrom", Values: []ValueConfig{{Name: "Leistung", Unit: "W"}}}
+
+// ---------------------------------------------------------------------------
+// Fan-out
+// ---------------------------------------------------------------------------
+
+func TestBrokers_FanOut(t *testing.T) {
+	local, localClient := newTestPublisher()
+	cloud, cloudClient := newTestPublisher()
+	cloud.topics, _ = NewTopicLayout(MQTTConfig{BaseTopic: "cloud/zaehler"})
+	b := newTestBrokers(t, local, cloud)
+
+	b.RegisterMeter(testMeter)
+	b.PublishState("nutzstrom", testMeter.Values[0], 246)
+	b.flush(t)
+
+	if n := len(localClient.messages("zaehler2mqtt/nutzstrom/Leistung/state")); n != 1 {
+		t.Fatalf("local broker got %d states, want 1", n)
+	}
+	if n := len(cloudClient.messages("cloud/zaehler/nutzstrom/Leistung/state")); n != 1 {
+		t.Fatalf("cloud broker got %d states, want 1", n)
+	}
+}
+
+func TestBrokers_SlowBrokerDoesNotBlock(t *testing.T) {
+	fast, fastClient := newTestPublisher()
+	slow, slowClient := newTestPublisher()
+	connected := make(chan struct{})
+
+	b := newTestBrokers(t, fast)
+	b.queues = append(b.queues, newBrokerQueue("slow", func() (*Publisher, error) {
+		<-connected
+		return slow, nil
+	}))
+
+	b.RegisterMeter(testMeter)
+	done := make(chan struct{})
+	go func() {
+		for i := 0; i < maxQueuedStates+10; i++ {
+			b.PublishState("nutzstrom", testMeter.Values[0], float64(i))
+			// keep the reachable broker's queue short
+			if i%100 == 0 {
+				b.queues[0].call(func(*Publisher) error { return nil })
+			}
+		}
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("publishing blocked on the unreachable broker")
+	}
+	b.PublishAvailability("nutzstrom", true)
+	b.queues[0].call(func(*Publisher) error { return nil })
+	if n := len(fastClient.messages("zaehler2mqtt/nutzstrom/Leistung/state")); n != maxQueuedStates+10 {
+		t.Fatalf("reachable broker got %d states, want %d", n, maxQueuedStates+10)
+	}
+
+	// Once connected, the backlog is delivered up to the limit and nothing
+	// but states was dropped
+	close(connected)
+	b.flush(t)
+	if n := len(slowClient.messages("zaehler2mqtt/nutzstrom/Leistung/state")); n != maxQueuedStates {
+		t.Fatalf("slow broker got %d states, want %d", n, maxQueuedStates)
+	}
+	if got := slowClient.payload("zaehler2mqtt/nutzstrom/availability"); got != "online" {
+		t.Fatalf("slow broker availability = %q", got)
+	}
+}
+
+func TestBrokers_FiltersRepeats(t *testing.T) {
+	p, client := newTestPublisher()
+	b := newTestBrokers(t, p)
+	b.RegisterMeter(testMeter)
+
+	for i := 0; i < 3; i++ {
+		b.PublishAvailability("nutzstrom", true)
+		b.SetMeterSerial("nutzstrom", "0a01")
+	}
+	b.flush(t)
+
+	if n := len(client.messages("zaehler2mqtt/nutzstrom/availability")); n != 1 {
+		t.Fatalf("expected 1 availability publish, got %d", n)
+	}
+	b.queues[0].call(func(p *Publisher) error {
+		if p.serials["nutzstrom"] != "0a01" {
+			t.Errorf("serial = %q", p.serials["nutzstrom"])
+		}
+		return nil
+	})
+}
+
+func TestBrokers_PublishMeterStateCopiesFrame(t *testing.T) {
+	p, client := newTestPublisher()
+	p.meterStates = true
+	b := newTestBrokers(t, p)
+
+	frame := []FrameValue{{Config: testMeter.Values[0], Value: 246}}
+	b.PublishMeterState("nutzstrom", time.Now(), frame)
+	frame[0].Value = 0
+	b.flush(t)
+
+	var state meterStatePayload
+	msgs := client.messages("zaehler2mqtt/nutzstrom/state")
+	if len(msgs) != 1 {
+		t.Fatalf("expected one meter state, got %d", len(msgs))
+	}
+	if err := json.Unmarshal(msgs[0].Payload, &state); err != nil {
+		t.Fatal(err)
+	}
+	if state.Values["Leistung"].Value != 246 {
+		t.Fatalf("meter state saw the reused frame: %+v", state)
+	}
+}
+
+func TestBrokers_Purge(t *testing.T) {
+	p, client := newTestPublisher()
+	p.scanWait = 0
+	client.retained = map[string]string{
+		"homeassistant/sensor/zaehler2mqtt_nutzstrom_Bezug/config": `{"state_topic":"zaehler2mqtt/nutzstrom/Bezug/state"}`,
+	}
+	noDiscovery, otherClient := newTestPublisher()
+	noDiscovery.haDiscovery = false
+	otherClient.retained = client.retained
+	b := newTestBrokers(t, p, noDiscovery)
+
+	removed, err := b.Purge()
+	if err != nil {
+		t.Fatalf("Purge error: %v", err)
+	}
+	if removed != 1 {
+		t.Fatalf("removed = %d, want 1", removed)
+	}
+	if len(otherClient.published) != 0 {
+		t.Fatalf("broker without discovery should be left alone, got %+v", otherClient.published)
+	}
+}
+
+func TestBrokers_CallFailsWithoutConnection(t *testing.T) {
+	b := newBrokers()
+	b.queues = append(b.queues, newBrokerQueue("broken", func() (*Publisher, error) {
+		return nil, errors.New("bad TLS settings")
+	}))
+	t.Cleanup(b.Close)
+	b.PublishBridgeDiscovery()
+
+	start := time.Now()
+	_, err := b.Purge()
+	if !errors.Is(err, errBrokerNotConnected) || !strings.Contains(err.Error(), "bad TLS settings") {
+		t.Fatalf("Purge error = %v", err)
+	}
+	if time.Since(start) > time.Second {
+		t.Fatalf("Purge took %v", time.Since(start))
+	}
+}
+
+// ---------------------------------------------------------------------------
+// Per-broker settings
+// ---------------------------------------------------------------------------
+
+func TestPublishMeterDiscovery_DiscoveryDisabled(t *testing.T) {
+	p, client := newTestPublisher()
+	p.haDiscovery = false
+	p.RegisterMeter(testMeter)
+	p.PublishMeterDiscovery("nutzstrom")
+	p.PublishBridgeDiscovery()
+
+	if len(client.published) != 0 {
+		t.Fatalf("expected no discovery, got %+v", client.published)
+	}
+	p.onConnect()
+	if _, ok := client.subs["homeassistant/status"]; ok {
+		t.Fatal("should not follow Home Assistant restarts without discovery")
+	}
+}
+
+func TestPublishState_BrokerQoSDefaults(t *testing.T) {
+	p, client := newTestPublisher()
+	p.stateQoS, p.stateRetain = 1, true
+	zero, no := 0, false
+	p.PublishState("nutzstrom", ValueConfig{Name: "Bezug"}, 1)
+	p.PublishState("nutzstrom", ValueConfig{Name: "Leistung", QoS: &zero, Retain: &no}, 1)
+
+	energy := client.messages("zaehler2mqtt/nutzstrom/Bezug/state")[0]
+	power := client.messages("zaehler2mqtt/nutzstrom/Leistung/state")[0]
+	if energy.QoS != 1 || !energy.Retain {
+		t.Fatalf("Bezug: qos %d, retain %v; want broker defaults", energy.QoS, energy.Retain)
+	}
+	if power.QoS != 0 || power.Retain {
+		t.Fatalf("Leistung: qos %d, retain %v; want value overrides", power.QoS, power.Retain)
+	}
+}
+
+func TestLoadConfig_BrokerList(t *testing.T) {
+	yaml := `
+mqtt:
+  - broker: "tcp://localhost:1883"
+  - broker: "ssl://cloud.example.org:8883"
+    client_id: "keller"
+    base_topic: "keller/strom"
+    discovery: false
+    qos: 1
+meters: []
+`
+	cfg, err := LoadConfig(writeTestConfig(t, yaml))
+	if err != nil {
+		t.Fatalf("LoadConfig error: %v", err)
+	}
+	if len(cfg.MQTT) != 2 {
+		t.Fatalf("expected 2 brokers, got %d", len(cfg.MQTT))
+	}
+	local, cloud := cfg.MQTT[0], cfg.MQTT[1]
+	if local.ClientID != "zaehler2mqtt" || !local.discovery() || !local.commands() {
+		t.Fatalf("unexpected defaults for local broker: %+v", local)
+	}
+	if cloud.ClientID != "keller" || cloud.BaseTopic != "keller/strom" || cloud.discovery() || cloud.QoS != 1 {
+		t.Fatalf("unexpected cloud broker: %+v", cloud)
+	}
+	if cloud.commands() {
+		t.Fatal("commands must be opt-in on further brokers")
+	}
+
+	bad := `
+mqtt:
+  - broker: "tcp://localhost:1883"
+  - broker: "tcp://cloud:1883"
+    qos: 3
+meters: []
+`
+	_, err = LoadConfig(writeTestConfig(t, bad))
+	if err == nil || !strings.Contains(err.Error(), "tcp://cloud:1883") {
+		t.Fatalf("expected error naming the broker, got %v", err)
+	}
+}
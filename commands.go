@@ -0,0 +1,183 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+)
+
+// Commands accepted on the command topics. Meter commands take the meter
+// name as payload.
+const (
+	cmdReconnect    = "reconnect"
+	cmdRepublish    = "republish"
+	cmdPurge        = "purge"
+	cmdReload       = "reload"
+	cmdDump         = "dump"
+	cmdCaptureStart = "capture_start"
+	cmdCaptureStop  = "capture_stop"
+)
+
+// buttonConfig is a Home Assistant button that sends a command.
+type buttonConfig struct {
+	name    string
+	command string
+	icon    string
+}
+
+// meterButtons are announced for every meter and send the meter name.
+var meterButtons = []buttonConfig{
+	{name: "Reconnect", command: cmdReconnect, icon: "mdi:restart"},
+}
+
+// bridgeButtons are announced once on the bridge device.
+var bridgeButtons = []buttonConfig{
+	{name: "Republish discovery", command: cmdRepublish, icon: "mdi:refresh"},
+	{name: "Reload config", command: cmdReload, icon: "mdi:file-refresh-outline"},
+}
+
+// commandHandler runs a command. arg is the message payload, e.g. a meter
+// name. The result is sent back as JSON.
+type commandHandler func(arg string) (interface{}, error)
+
+// commandResponse is published on the response topic for every command.
+type commandResponse struct {
+	Command string      `json:"command"`
+	Arg     string      `json:"arg,omitempty"`
+	OK      bool        `json:"ok"`
+	Error   string      `json:"error,omitempty"`
+	Result  interface{} `json:"result,omitempty"`
+}
+
+// HandleCommand registers the handler of a command.
+func (p *Publisher) HandleCommand(name string, handler commandHandler) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.commands[name] = handler
+}
+
+// onCommand runs on paho's message goroutine, so the command is handed off
+// to avoid blocking it while e.g. a reload waits for the meters to stop.
+func (p *Publisher) onCommand(msg receivedMessage) {
+	if msg.Retained {
+		// a retained command would run again on every reconnect
+		return
+	}
+	name := msg.Topic[strings.LastIndex(msg.Topic, "/")+1:]
+	arg := strings.TrimSpace(string(msg.Payload))
+
+	p.mu.Lock()
+	handler := p.commands[name]
+	p.mu.Unlock()
+
+	go func() {
+		resp := commandResponse{Command: name, Arg: arg}
+		if handler == nil {
+			resp.Error = fmt.Sprintf("unknown command %q", name)
+		} else if result, err := handler(arg); err != nil {
+			resp.Error = err.Error()
+		} else {
+			resp.OK = true
+			resp.Result = result
+		}
+		if resp.OK {
+			log.Printf("Command %s %s done", name, arg)
+		} else {
+			log.Printf("Command %s %s failed: %s", name, arg, resp.Error)
+		}
+		p.reply(msg, resp)
+	}()
+}
+
+func (p *Publisher) reply(req receivedMessage, resp commandResponse) {
+	data, _ := json.Marshal(resp)
+	topic := req.ResponseTopic
+	if topic == "" {
+		topic = p.topics.Response()
+	}
+	token := p.client.Publish(outgoingMessage{
+		Topic:           topic,
+		QoS:             1,
+		Payload:         data,
+		ContentType:     "application/json",
+		CorrelationData: req.CorrelationData,
+	})
+	token.WaitTimeout(5 * time.Second)
+	if token.Error() != nil {
+		log.Printf("Failed to publish response to %s: %v", topic, token.Error())
+	}
+}
+
+// bridgeDeviceInfo is the Home Assistant device block of the bridge itself.
+func (p *Publisher) bridgeDeviceInfo() map[string]interface{} {
+	return map[string]interface{}{
+		"identifiers":  []string{p.topics.BridgeDeviceID()},
+		"name":         "zaehler2mqtt",
+		"manufacturer": "zaehler2mqtt",
+		"model":        "Bridge",
+	}
+}
+
+// buttonPayload is the discovery config of a command button of a meter, or
+// of the bridge if meterName is empty.
+func (p *Publisher) buttonPayload(meterName string, b buttonConfig) map[string]interface{} {
+	device := p.bridgeDeviceInfo()
+	if meterName != "" {
+		device = p.deviceInfo(meterName)
+	}
+	payload := map[string]interface{}{
+		"name":            b.name,
+		"unique_id":       p.topics.ButtonID(meterName, b.command),
+		"command_topic":   p.topics.Command(b.command),
+		"payload_press":   meterName,
+		"availability":    []map[string]string{{"topic": p.topics.BridgeStatus()}},
+		"entity_category": "config",
+		"icon":            b.icon,
+		"device":          device,
+		"origin":          origin,
+	}
+	return payload
+}
+
+// buttons returns the buttons of a meter, or of the bridge if meterName is
+// empty.
+func buttons(meterName string) []buttonConfig {
+	if meterName == "" {
+		return bridgeButtons
+	}
+	return meterButtons
+}
+
+func (p *Publisher) publishButtons(meterName string) {
+	if !p.topics.commands {
+		return
+	}
+	for _, b := range buttons(meterName) {
+		id := p.topics.ButtonID(meterName, b.command)
+		data, _ := json.Marshal(p.buttonPayload(meterName, b))
+		token := p.client.Publish(outgoingMessage{
+			Topic:       p.topics.ButtonDiscovery(id),
+			QoS:         1,
+			Retain:      true,
+			Payload:     data,
+			ContentType: "application/json",
+		})
+		token.WaitTimeout(5 * time.Second)
+		if token.Error() != nil {
+			log.Printf("Failed to publish discovery for %s: %v", id, token.Error())
+		} else {
+			log.Printf("Published HA discovery: %s", id)
+		}
+	}
+}
+
+// PublishBridgeDiscovery announces the buttons of the bridge device, unless
+// commands are disabled on this broker.
+func (p *Publisher) PublishBridgeDiscovery() {
+	if !p.topics.commands {
+		return
+	}
+	p.PublishMeterDiscovery("")
+}
@@ -0,0 +1,209 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+// waitForMessages polls the fake client until a topic received n messages.
+func waitForMessages(t *testing.T, client *fakeClient, topic string, n int) []outgoingMessage {
+	t.Helper()
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		msgs := client.messages(topic)
+		if len(msgs) >= n || time.Now().After(deadline) {
+			return msgs
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestOnCommand_RunsHandlerAndReplies(t *testing.T) {
+	p, client := newTestPublisher()
+	var got string
+	p.HandleCommand(cmdReconnect, func(arg string) (interface{}, error) {
+		got = arg
+		return map[string]int{"n": 1}, nil
+	})
+
+	p.onCommand(receivedMessage{Topic: "zaehler2mqtt/cmd/reconnect", Payload: []byte("nutzstrom\n")})
+
+	msgs := waitForMessages(t, client, "zaehler2mqtt/response", 1)
+	if len(msgs) != 1 {
+		t.Fatalf("expected 1 response, got %d", len(msgs))
+	}
+	if got != "nutzstrom" {
+		t.Fatalf("handler arg = %q", got)
+	}
+	var resp struct {
+		Command string         `json:"command"`
+		Arg     string         `json:"arg"`
+		OK      bool           `json:"ok"`
+		Result  map[string]int `json:"result"`
+	}
+	if err := json.Unmarshal(msgs[0].Payload, &resp); err != nil {
+		t.Fatal(err)
+	}
+	if resp.Command != "reconnect" || resp.Arg != "nutzstrom" || !resp.OK || resp.Result["n"] != 1 {
+		t.Fatalf("unexpected response: %s", msgs[0].Payload)
+	}
+}
+
+func TestOnCommand_Errors(t *testing.T) {
+	p, client := newTestPublisher()
+	p.HandleCommand(cmdReload, func(string) (interface{}, error) {
+		return nil, errors.New("broken config")
+	})
+
+	p.onCommand(receivedMessage{Topic: "zaehler2mqtt/cmd/reload"})
+	p.onCommand(receivedMessage{Topic: "zaehler2mqtt/cmd/selfdestruct"})
+
+	msgs := waitForMessages(t, client, "zaehler2mqtt/response", 2)
+	if len(msgs) != 2 {
+		t.Fatalf("expected 2 responses, got %d", len(msgs))
+	}
+	errs := make(map[string]string)
+	for _, m := range msgs {
+		var resp commandResponse
+		if err := json.Unmarshal(m.Payload, &resp); err != nil {
+			t.Fatal(err)
+		}
+		if resp.OK {
+			t.Fatalf("expected failure: %s", m.Payload)
+		}
+		errs[resp.Command] = resp.Error
+	}
+	if errs["reload"] != "broken config" || errs["selfdestruct"] != `unknown command "selfdestruct"` {
+		t.Fatalf("unexpected errors: %v", errs)
+	}
+}
+
+func TestOnCommand_IgnoresRetained(t *testing.T) {
+	p, client := newTestPublisher()
+	p.HandleCommand(cmdRepublish, func(string) (interface{}, error) {
+		t.Error("retained command must not run")
+		return nil, nil
+	})
+	p.onCommand(receivedMessage{Topic: "zaehler2mqtt/cmd/republish", Retained: true})
+	time.Sleep(20 * time.Millisecond)
+	if n := len(client.messages("zaehler2mqtt/response")); n != 0 {
+		t.Fatalf("expected no response, got %d", n)
+	}
+}
+
+func TestOnCommand_ResponseTopic(t *testing.T) {
+	p, client := newTestPublisher()
+	p.HandleCommand(cmdDump, func(string) (interface{}, error) { return nil, nil })
+
+	p.onCommand(receivedMessage{
+		Topic:           "zaehler2mqtt/cmd/dump",
+		ResponseTopic:   "clients/42/reply",
+		CorrelationData: []byte("req-1"),
+	})
+
+	msgs := waitForMessages(t, client, "clients/42/reply", 1)
+	if len(msgs) != 1 || string(msgs[0].CorrelationData) != "req-1" {
+		t.Fatalf("expected reply with correlation data, got %+v", msgs)
+	}
+}
+
+func TestOnConnect_SubscribesToCommands(t *testing.T) {
+	p, client := newTestPublisher()
+	p.onConnect()
+	client.mu.Lock()
+	_, ok := client.subs["zaehler2mqtt/cmd/+"]
+	client.mu.Unlock()
+	if !ok {
+		t.Fatal("expected subscription to the command topics")
+	}
+}
+
+func TestOnConnect_CommandsDisabled(t *testing.T) {
+	p, client := newTestPublisher()
+	off := false
+	p.topics, _ = NewTopicLayout(MQTTConfig{Commands: &off})
+	p.RegisterMeter(sinkTestMeter)
+	p.onConnect()
+	p.PublishBridgeDiscovery()
+	p.PublishMeterDiscovery("nutzstrom")
+
+	client.mu.Lock()
+	_, ok := client.subs["zaehler2mqtt/cmd/+"]
+	client.mu.Unlock()
+	if ok {
+		t.Fatal("subscribed to commands on a broker without commands")
+	}
+	for _, msg := range client.published {
+		if strings.Contains(msg.Topic, "/button/") {
+			t.Fatalf("announced button %s", msg.Topic)
+		}
+	}
+	for topic := range p.topics.ConfiguredDiscovery([]MeterConfig{sinkTestMeter}) {
+		if strings.Contains(topic, "/button/") {
+			t.Fatalf("button %s would be kept by the discovery cleanup", topic)
+		}
+	}
+}
+
+// ---------------------------------------------------------------------------
+// Buttons
+// ---------------------------------------------------------------------------
+
+func TestPublishMeterDiscovery_Buttons(t *testing.T) {
+	p, client := newTestPublisher()
+	p.RegisterMeter(MeterConfig{Name: "nutzstrom"})
+	p.PublishMeterDiscovery("nutzstrom")
+	p.PublishBridgeDiscovery()
+
+	msgs := client.messages("homeassistant/button/zaehler2mqtt_nutzstrom_reconnect/config")
+	if len(msgs) != 1 || !msgs[0].Retain {
+		t.Fatalf("expected retained reconnect button, got %+v", msgs)
+	}
+	var button map[string]interface{}
+	if err := json.Unmarshal(msgs[0].Payload, &button); err != nil {
+		t.Fatal(err)
+	}
+	if button["command_topic"] != "zaehler2mqtt/cmd/reconnect" || button["payload_press"] != "nutzstrom" {
+		t.Fatalf("unexpected button: %s", msgs[0].Payload)
+	}
+	if !p.topics.ownsDiscovery(msgs[0].Topic, msgs[0].Payload) {
+		t.Fatal("button config should be recognised as owned")
+	}
+
+	msgs = client.messages("homeassistant/button/zaehler2mqtt_bridge_reload/config")
+	if len(msgs) != 1 {
+		t.Fatalf("expected bridge reload button, got %d", len(msgs))
+	}
+	if err := json.Unmarshal(msgs[0].Payload, &button); err != nil {
+		t.Fatal(err)
+	}
+	device := button["device"].(map[string]interface{})
+	if device["name"] != "zaehler2mqtt" || button["command_topic"] != "zaehler2mqtt/cmd/reload" {
+		t.Fatalf("unexpected bridge button: %s", msgs[0].Payload)
+	}
+}
+
+func TestPublishBridgeDiscovery_Device(t *testing.T) {
+	p, client := newDeviceTestPublisher()
+	p.PublishBridgeDiscovery()
+
+	msgs := client.messages("homeassistant/device/zaehler2mqtt_bridge/config")
+	if len(msgs) != 1 {
+		t.Fatalf("expected bridge device config, got %d", len(msgs))
+	}
+	var payload struct {
+		Components map[string]map[string]interface{} `json:"components"`
+	}
+	if err := json.Unmarshal(msgs[0].Payload, &payload); err != nil {
+		t.Fatal(err)
+	}
+	if len(payload.Components) != len(bridgeButtons) {
+		t.Fatalf("expected %d components, got %d", len(bridgeButtons), len(payload.Components))
+	}
+	if c := payload.Components["zaehler2mqtt_bridge_republish"]; c["platform"] != "button" {
+		t.Fatalf("unexpected republish component: %v", c)
+	}
+}
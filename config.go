@@ -1,25 +1,376 @@
 package main
 
 import (
+	"crypto/tls"
+	"crypto/x509"
 	"fmt"
 	"os"
+	"slices"
 	"strconv"
 	"strings"
+	"time"
 
 	"gopkg.in/yaml.v3"
 )
 
 type Config struct {
-	MQTT   MQTTConfig    `yaml:"mqtt"`
+	MQTT   MQTTBrokers   `yaml:"mqtt"`
 	HTTP   HTTPConfig    `yaml:"http"`
 	Meters []MeterConfig `yaml:"meters"`
+
+	// Outputs receive the readings; by default MQTT and the HTTP API.
+	Outputs []OutputConfig `yaml:"outputs"`
+
+	// CaptureDir is where raw captures started by command are written.
+	CaptureDir string `yaml:"capture_dir"`
+}
+
+// MQTTBrokers are the brokers readings are published to. The mqtt section may
+// be a single broker or a list of them.
+type MQTTBrokers []MQTTConfig
+
+func (b *MQTTBrokers) UnmarshalYAML(value *yaml.Node) error {
+	if value.Kind == yaml.MappingNode {
+		var single MQTTConfig
+		if err := value.Decode(&single); err != nil {
+			return err
+		}
+		*b = MQTTBrokers{single}
+		return nil
+	}
+	var list []MQTTConfig
+	if err := value.Decode(&list); err != nil {
+		return err
+	}
+	*b = list
+	return nil
 }
 
 type MQTTConfig struct {
-	Broker   string `yaml:"broker"`
-	ClientID string `yaml:"client_id"`
-	Username string `yaml:"username"`
-	Password string `yaml:"password"`
+	Broker          string        `yaml:"broker"`
+	ClientID        string        `yaml:"client_id"`
+	Username        string        `yaml:"username"`
+	Password        string        `yaml:"password"`
+	TLS             TLSConfig     `yaml:"tls"`
+	ProtocolVersion int           `yaml:"protocol_version"`
+	MessageExpiry   time.Duration `yaml:"message_expiry"`
+
+	// Topic layout, see TopicLayout
+	BaseTopic         string `yaml:"base_topic"`
+	DiscoveryPrefix   string `yaml:"discovery_prefix"`
+	StateTopic        string `yaml:"state_topic"`
+	AvailabilityTopic string `yaml:"availability_topic"`
+	MeterStateTopic   string `yaml:"meter_state_topic"`
+	DiagnosticsTopic  string `yaml:"diagnostics_topic"`
+
+	// StateFormat selects per-value topics ("value", the default), one JSON
+	// topic per meter ("json"), or both.
+	StateFormat string `yaml:"state_format"`
+
+	// DiscoveryMode selects one Home Assistant sensor config per value
+	// ("sensor", the default) or one device config per meter ("device").
+	DiscoveryMode string `yaml:"discovery_mode"`
+	// Discovery enables Home Assistant discovery on this broker, the default.
+	Discovery *bool `yaml:"discovery"`
+	// Commands subscribes to commands on this broker. It defaults to the
+	// first broker only.
+	Commands *bool `yaml:"commands"`
+
+	// QoS and Retain apply to state messages unless a value overrides them.
+	QoS    int  `yaml:"qos"`
+	Retain bool `yaml:"retain"`
+
+	// Homie additionally announces every meter as a device of the Homie
+	// convention version 4 or 5; 0 disables it.
+	Homie       int    `yaml:"homie"`
+	HomiePrefix string `yaml:"homie_prefix"`
+}
+
+const (
+	StateFormatValue = "value"
+	StateFormatJSON  = "json"
+	StateFormatBoth  = "both"
+
+	DiscoveryModeSensor = "sensor"
+	DiscoveryModeDevice = "device"
+)
+
+// discovery reports whether Home Assistant discovery is published.
+func (c MQTTConfig) discovery() bool {
+	return c.Discovery == nil || *c.Discovery
+}
+
+// commands reports whether commands are accepted and their buttons announced.
+func (c MQTTConfig) commands() bool {
+	return c.Commands == nil || *c.Commands
+}
+
+// protocolVersion returns the MQTT protocol level in use: 3 (3.1), 4 (3.1.1,
+// the default) or 5.
+func (c MQTTConfig) protocolVersion() int {
+	if c.ProtocolVersion == 0 {
+		return 4
+	}
+	return c.ProtocolVersion
+}
+
+func (c MQTTConfig) validate() error {
+	switch c.ProtocolVersion {
+	case 0, 3, 4, 5:
+	default:
+		return fmt.Errorf("mqtt.protocol_version %d is invalid (use 3, 4 or 5)", c.ProtocolVersion)
+	}
+	if c.MessageExpiry < 0 {
+		return fmt.Errorf("mqtt.message_expiry must not be negative")
+	}
+	if c.MessageExpiry > 0 && c.ProtocolVersion != 5 {
+		return fmt.Errorf("mqtt.message_expiry requires protocol_version 5")
+	}
+	if c.MessageExpiry > 0 && c.MessageExpiry < time.Second {
+		return fmt.Errorf("mqtt.message_expiry must be at least 1s")
+	}
+	if err := checkQoS(c.QoS); err != nil {
+		return fmt.Errorf("mqtt.qos: %w", err)
+	}
+	switch c.StateFormat {
+	case "", StateFormatValue, StateFormatJSON, StateFormatBoth:
+	default:
+		return fmt.Errorf("mqtt.state_format %q is invalid (use value, json or both)", c.StateFormat)
+	}
+	switch c.DiscoveryMode {
+	case "", DiscoveryModeSensor, DiscoveryModeDevice:
+	default:
+		return fmt.Errorf("mqtt.discovery_mode %q is invalid (use sensor or device)", c.DiscoveryMode)
+	}
+	switch c.Homie {
+	case 0, 4, 5:
+	default:
+		return fmt.Errorf("mqtt.homie %d is invalid (use 4 or 5)", c.Homie)
+	}
+	if _, err := NewTopicLayout(c); err != nil {
+		return err
+	}
+	_, err := c.TLSClientConfig()
+	return err
+}
+
+func checkQoS(qos int) error {
+	if qos < 0 || qos > 2 {
+		return fmt.Errorf("%d is invalid (use 0, 1 or 2)", qos)
+	}
+	return nil
+}
+
+type TLSConfig struct {
+	CAFile             string `yaml:"ca_file"`
+	CertFile           string `yaml:"cert_file"`
+	KeyFile            string `yaml:"key_file"`
+	ServerName         string `yaml:"server_name"`
+	InsecureSkipVerify bool   `yaml:"insecure_skip_verify"`
+	MinVersion         string `yaml:"min_version"`
+}
+
+var tlsVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+// isSet reports whether any TLS option was configured.
+func (t TLSConfig) isSet() bool {
+	return t != TLSConfig{}
+}
+
+// usesTLS reports whether the broker URL uses a scheme paho connects to over
+// TLS.
+func (c MQTTConfig) usesTLS() bool {
+	scheme, _, ok := strings.Cut(c.Broker, "://")
+	if !ok {
+		return false
+	}
+	switch strings.ToLower(scheme) {
+	case "ssl", "tls", "mqtts", "mqtt+ssl", "tcps", "wss":
+		return true
+	}
+	return false
+}
+
+// TLSClientConfig builds the tls.Config for the broker connection. It returns
+// nil for plain brokers. Without a CA file the system roots are used.
+func (c MQTTConfig) TLSClientConfig() (*tls.Config, error) {
+	t := c.TLS
+	if !c.usesTLS() {
+		if t.isSet() {
+			return nil, fmt.Errorf("mqtt.tls is set but broker %q does not use ssl://, mqtts:// or wss://", c.Broker)
+		}
+		return nil, nil
+	}
+
+	tc := &tls.Config{
+		ServerName:         t.ServerName,
+		InsecureSkipVerify: t.InsecureSkipVerify,
+		MinVersion:         tls.VersionTLS12,
+	}
+	if t.MinVersion != "" {
+		v, ok := tlsVersions[t.MinVersion]
+		if !ok {
+			return nil, fmt.Errorf("mqtt.tls.min_version %q is invalid (use 1.0, 1.1, 1.2 or 1.3)", t.MinVersion)
+		}
+		tc.MinVersion = v
+	}
+	if t.CAFile != "" {
+		pem, err := os.ReadFile(t.CAFile)
+		if err != nil {
+			return nil, fmt.Errorf("mqtt.tls.ca_file: %w", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("mqtt.tls.ca_file %s contains no PEM certificates", t.CAFile)
+		}
+		tc.RootCAs = pool
+	}
+	if (t.CertFile == "") != (t.KeyFile == "") {
+		return nil, fmt.Errorf("mqtt.tls.cert_file and mqtt.tls.key_file must be set together")
+	}
+	if t.CertFile != "" {
+		cert, err := tls.LoadX509KeyPair(t.CertFile, t.KeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("mqtt.tls client certificate: %w", err)
+		}
+		tc.Certificates = []tls.Certificate{cert}
+	}
+	return tc, nil
+}
+
+const (
+	OutputMQTT         = "mqtt"
+	OutputHTTP         = "http"
+	OutputInfluxDB     = "influxdb"
+	OutputHistory      = "history"
+	OutputVolkszaehler = "volkszaehler"
+	OutputWebhook      = "webhook"
+	OutputSMA          = "sma_energy_meter"
+	OutputShelly       = "shelly_pro_3em"
+	OutputModbus       = "modbus"
+)
+
+// OutputConfig configures one sink readings are written to.
+type OutputConfig struct {
+	Type string `yaml:"type"`
+
+	// Meters and Values restrict the output to some meters and to values
+	// selected by name or OBIS code. Empty lists select everything.
+	Meters []string `yaml:"meters"`
+	Values []string `yaml:"values"`
+
+	// The settings of the type, read from the same entry
+	InfluxDB     *InfluxDBConfig       `yaml:"-"`
+	History      *HistoryConfig        `yaml:"-"`
+	Volkszaehler *VolkszaehlerConfig   `yaml:"-"`
+	Webhook      *WebhookConfig        `yaml:"-"`
+	SMA          *SMAEnergyMeterConfig `yaml:"-"`
+	Shelly       *ShellyConfig         `yaml:"-"`
+	Modbus       *ModbusConfig         `yaml:"-"`
+}
+
+func (o *OutputConfig) UnmarshalYAML(value *yaml.Node) error {
+	type plain OutputConfig
+	if err := value.Decode((*plain)(o)); err != nil {
+		return err
+	}
+	switch o.Type {
+	case OutputInfluxDB:
+		o.InfluxDB = &InfluxDBConfig{}
+		return value.Decode(o.InfluxDB)
+	case OutputHistory:
+		o.History = &HistoryConfig{}
+		return value.Decode(o.History)
+	case OutputVolkszaehler:
+		o.Volkszaehler = &VolkszaehlerConfig{}
+		return value.Decode(o.Volkszaehler)
+	case OutputWebhook:
+		o.Webhook = &WebhookConfig{}
+		return value.Decode(o.Webhook)
+	case OutputSMA:
+		o.SMA = &SMAEnergyMeterConfig{}
+		return value.Decode(o.SMA)
+	case OutputShelly:
+		o.Shelly = &ShellyConfig{}
+		return value.Decode(o.Shelly)
+	case OutputModbus:
+		o.Modbus = &ModbusConfig{}
+		return value.Decode(o.Modbus)
+	}
+	return nil
+}
+
+// validateOutputs checks the outputs against the configured meters.
+func validateOutputs(outputs []OutputConfig, meters []MeterConfig) error {
+	seen := make(map[string]bool)
+	for i, o := range outputs {
+		t, ok := outputTypes[o.Type]
+		if !ok {
+			return fmt.Errorf("outputs[%d]: unknown type %q", i, o.Type)
+		}
+		if t.single && seen[o.Type] {
+			return fmt.Errorf("outputs[%d]: only one %s output is allowed", i, o.Type)
+		}
+		seen[o.Type] = true
+		if t.validate != nil {
+			if err := t.validate(o); err != nil {
+				return fmt.Errorf("outputs[%d]: %w", i, err)
+			}
+		}
+		for _, name := range o.Meters {
+			if !slices.ContainsFunc(meters, func(m MeterConfig) bool { return m.Name == name }) {
+				return fmt.Errorf("outputs[%d]: unknown meter %q", i, name)
+			}
+		}
+		for _, name := range o.Values {
+			if !valueConfigured(meters, name) {
+				return fmt.Errorf("outputs[%d]: unknown value %q", i, name)
+			}
+		}
+		if o.Webhook != nil {
+			for _, th := range o.Webhook.Thresholds {
+				if !valueConfigured(meters, th.Value) {
+					return fmt.Errorf("outputs[%d]: threshold on unknown value %q", i, th.Value)
+				}
+			}
+		}
+		if o.Volkszaehler != nil {
+			for _, ch := range o.Volkszaehler.Channels {
+				candidates := meters
+				if ch.Meter != "" {
+					j := slices.IndexFunc(meters, func(m MeterConfig) bool { return m.Name == ch.Meter })
+					if j < 0 {
+						return fmt.Errorf("outputs[%d]: channel %s has unknown meter %q", i, ch.UUID, ch.Meter)
+					}
+					candidates = meters[j : j+1]
+				}
+				if !valueConfigured(candidates, ch.Value) {
+					return fmt.Errorf("outputs[%d]: channel %s has unknown value %q", i, ch.UUID, ch.Value)
+				}
+			}
+		}
+		if o.Modbus != nil {
+			for _, r := range o.Modbus.Registers {
+				if !valueConfigured(meters, r.Value) {
+					return fmt.Errorf("outputs[%d]: register %d has unknown value %q", i, r.Address, r.Value)
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// valueConfigured reports whether a meter has a value with this name or OBIS
+// code.
+func valueConfigured(meters []MeterConfig, name string) bool {
+	return slices.ContainsFunc(meters, func(m MeterConfig) bool {
+		return slices.ContainsFunc(m.Values, func(v ValueConfig) bool { return v.Name == name || v.OBIS == name })
+	})
 }
 
 type HTTPConfig struct {
@@ -30,6 +381,10 @@ type MeterConfig struct {
 	Name   string        `yaml:"name"`
 	Device string        `yaml:"device"`
 	Values []ValueConfig `yaml:"values"`
+
+	// Home Assistant device details
+	SuggestedArea string `yaml:"suggested_area"`
+	ViaDevice     string `yaml:"via_device"`
 }
 
 type ValueConfig struct {
@@ -39,6 +394,80 @@ type ValueConfig struct {
 	StateClass  string  `yaml:"state_class"`
 	Unit        string  `yaml:"unit"`
 	Factor      float64 `yaml:"factor"`
+
+	// Change-based publishing, see changeFilter
+	Deadband    Deadband      `yaml:"deadband"`
+	MinInterval time.Duration `yaml:"min_interval"`
+	MaxInterval time.Duration `yaml:"max_interval"`
+
+	// QoS and Retain of the state messages. Unset values use the settings
+	// of each broker.
+	QoS    *int  `yaml:"qos"`
+	Retain *bool `yaml:"retain"`
+
+	// Optional Home Assistant entity settings
+	Icon                      string        `yaml:"icon"`
+	SuggestedDisplayPrecision *int          `yaml:"suggested_display_precision"`
+	EntityCategory            string        `yaml:"entity_category"`
+	EnabledByDefault          *bool         `yaml:"enabled_by_default"`
+	ObjectID                  string        `yaml:"object_id"`
+	ExpireAfter               time.Duration `yaml:"expire_after"`
+	ForceUpdate               bool          `yaml:"force_update"`
+
+	// diagnostic is the key of a built-in diagnostic sensor in the meter's
+	// diagnostics payload; empty for configured values.
+	diagnostic string
+}
+
+func (v ValueConfig) validate() error {
+	if v.MinInterval < 0 || v.MaxInterval < 0 {
+		return fmt.Errorf("min_interval and max_interval must not be negative")
+	}
+	if v.MaxInterval > 0 && v.MaxInterval < v.MinInterval {
+		return fmt.Errorf("max_interval (%v) must not be shorter than min_interval (%v)", v.MaxInterval, v.MinInterval)
+	}
+	if v.QoS != nil {
+		if err := checkQoS(*v.QoS); err != nil {
+			return fmt.Errorf("qos: %w", err)
+		}
+	}
+	if err := checkSensorClass(v.DeviceClass, v.Unit, v.StateClass); err != nil {
+		return err
+	}
+	if v.Icon != "" && !strings.Contains(v.Icon, ":") {
+		return fmt.Errorf("icon %q must have a prefix, e.g. mdi:flash", v.Icon)
+	}
+	if v.SuggestedDisplayPrecision != nil && *v.SuggestedDisplayPrecision < 0 {
+		return fmt.Errorf("suggested_display_precision must not be negative")
+	}
+	// Sensors cannot be configuration entities
+	if v.EntityCategory != "" && v.EntityCategory != "diagnostic" {
+		return fmt.Errorf("entity_category %q is invalid (use diagnostic)", v.EntityCategory)
+	}
+	if v.ObjectID != "" && v.ObjectID != strings.ToLower(sanitizeObjectID(v.ObjectID)) {
+		return fmt.Errorf("object_id %q may only contain lowercase letters, digits, _ and -", v.ObjectID)
+	}
+	if v.ExpireAfter < 0 || (v.ExpireAfter > 0 && v.ExpireAfter < time.Second) {
+		return fmt.Errorf("expire_after must be at least 1s")
+	}
+	return nil
+}
+
+// qos returns the QoS of the value's state messages, or def if unset.
+func (v ValueConfig) qos(def byte) byte {
+	if v.QoS == nil {
+		return def
+	}
+	return byte(*v.QoS)
+}
+
+// retain returns the retain flag of the value's state messages, or def if
+// unset.
+func (v ValueConfig) retain(def bool) bool {
+	if v.Retain == nil {
+		return def
+	}
+	return *v.Retain
 }
 
 func (v ValueConfig) OBISBytes() ([]byte, error) {
@@ -63,19 +492,54 @@ func LoadConfig(path string) (*Config, error) {
 	if err := yaml.Unmarshal(data, &cfg); err != nil {
 		return nil, err
 	}
-	if cfg.MQTT.Username == "CHANGE_ME" || cfg.MQTT.Password == "CHANGE_ME" {
-		return nil, fmt.Errorf("MQTT username/password still set to 'CHANGE_ME' — copy config.example.yaml to config.yaml and set real credentials")
+	if len(cfg.MQTT) == 0 {
+		cfg.MQTT = MQTTBrokers{{}}
 	}
-	if cfg.MQTT.ClientID == "" {
-		cfg.MQTT.ClientID = "zaehler2mqtt"
+	for i := range cfg.MQTT {
+		m := &cfg.MQTT[i]
+		if m.Username == "CHANGE_ME" || m.Password == "CHANGE_ME" {
+			return nil, fmt.Errorf("MQTT username/password still set to 'CHANGE_ME' — copy config.example.yaml to config.yaml and set real credentials")
+		}
+		if err := m.validate(); err != nil {
+			if len(cfg.MQTT) > 1 {
+				return nil, fmt.Errorf("broker %s: %w", m.Broker, err)
+			}
+			return nil, err
+		}
+		if m.ClientID == "" {
+			m.ClientID = "zaehler2mqtt"
+		}
+		if m.StateFormat == "" {
+			m.StateFormat = StateFormatValue
+		}
+		if m.DiscoveryMode == "" {
+			m.DiscoveryMode = DiscoveryModeSensor
+		}
+		if m.Commands == nil {
+			primary := i == 0
+			m.Commands = &primary
+		}
 	}
 	if cfg.HTTP.Listen == "" {
 		cfg.HTTP.Listen = ":8080"
 	}
+	if cfg.CaptureDir == "" {
+		cfg.CaptureDir = os.TempDir()
+	}
+	if len(cfg.Outputs) == 0 {
+		cfg.Outputs = []OutputConfig{{Type: OutputMQTT}, {Type: OutputHTTP}}
+	}
+	if err := validateOutputs(cfg.Outputs, cfg.Meters); err != nil {
+		return nil, err
+	}
 	for i := range cfg.Meters {
 		for j := range cfg.Meters[i].Values {
-			if cfg.Meters[i].Values[j].Factor == 0 {
-				cfg.Meters[i].Values[j].Factor = 1.0
+			v := &cfg.Meters[i].Values[j]
+			if err := v.validate(); err != nil {
+				return nil, fmt.Errorf("meter %s, value %s: %w", cfg.Meters[i].Name, v.Name, err)
+			}
+			if v.Factor == 0 {
+				v.Factor = 1.0
 			}
 		}
 	}
@@ -1,9 +1,19 @@
 package main
 
 import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
 	"os"
 	"path/filepath"
+	"strings"
 	"testing"
+	"time"
 )
 
 // ---------------------------------------------------------------------------
@@ -118,11 +128,11 @@ meters:
 	if err != nil {
 		t.Fatalf("LoadConfig error: %v", err)
 	}
-	if cfg.MQTT.Broker != "tcp://localhost:1883" {
-		t.Fatalf("broker = %q", cfg.MQTT.Broker)
+	if cfg.MQTT[0].Broker != "tcp://localhost:1883" {
+		t.Fatalf("broker = %q", cfg.MQTT[0].Broker)
 	}
-	if cfg.MQTT.ClientID != "zaehler2mqtt" {
-		t.Fatalf("client_id should default to zaehler2mqtt, got %q", cfg.MQTT.ClientID)
+	if cfg.MQTT[0].ClientID != "zaehler2mqtt" {
+		t.Fatalf("client_id should default to zaehler2mqtt, got %q", cfg.MQTT[0].ClientID)
 	}
 	if len(cfg.Meters) != 1 {
 		t.Fatalf("expected 1 meter, got %d", len(cfg.Meters))
@@ -201,8 +211,8 @@ meters: []
 	if err != nil {
 		t.Fatalf("LoadConfig error: %v", err)
 	}
-	if cfg.MQTT.ClientID != "my-custom-id" {
-		t.Fatalf("client_id = %q, want my-custom-id", cfg.MQTT.ClientID)
+	if cfg.MQTT[0].ClientID != "my-custom-id" {
+		t.Fatalf("client_id = %q, want my-custom-id", cfg.MQTT[0].ClientID)
 	}
 }
 
@@ -237,3 +247,457 @@ meters:
 		t.Fatalf("second meter name = %q", cfg.Meters[1].Name)
 	}
 }
+
+// ---------------------------------------------------------------------------
+// TLS
+// ---------------------------------------------------------------------------
+
+// writeTestCert writes a self-signed certificate and its key to dir and
+// returns both paths.
+func writeTestCert(t *testing.T, dir string) (string, string) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "zaehler2mqtt-test"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certPath := filepath.Join(dir, "cert.pem")
+	keyPath := filepath.Join(dir, "key.pem")
+	if err := os.WriteFile(certPath, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(keyPath, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return certPath, keyPath
+}
+
+func TestTLSClientConfig_PlainBroker(t *testing.T) {
+	tc, err := MQTTConfig{Broker: "tcp://localhost:1883"}.TLSClientConfig()
+	if err != nil {
+		t.Fatalf("TLSClientConfig error: %v", err)
+	}
+	if tc != nil {
+		t.Fatal("expected no TLS config for tcp:// broker")
+	}
+}
+
+func TestTLSClientConfig_TLSOnPlainBroker(t *testing.T) {
+	cfg := MQTTConfig{Broker: "tcp://localhost:1883", TLS: TLSConfig{InsecureSkipVerify: true}}
+	if _, err := cfg.TLSClientConfig(); err == nil {
+		t.Fatal("expected error for tls settings on tcp:// broker")
+	}
+}
+
+func TestTLSClientConfig_Defaults(t *testing.T) {
+	tc, err := MQTTConfig{Broker: "mqtts://broker:8883"}.TLSClientConfig()
+	if err != nil {
+		t.Fatalf("TLSClientConfig error: %v", err)
+	}
+	if tc == nil || tc.MinVersion != tls.VersionTLS12 {
+		t.Fatalf("expected TLS 1.2 minimum, got %+v", tc)
+	}
+	if tc.RootCAs != nil {
+		t.Fatal("expected system roots without ca_file")
+	}
+}
+
+func TestTLSClientConfig_CertificatesAndOptions(t *testing.T) {
+	certPath, keyPath := writeTestCert(t, t.TempDir())
+	cfg := MQTTConfig{
+		Broker: "ssl://broker:8883",
+		TLS: TLSConfig{
+			CAFile:     certPath,
+			CertFile:   certPath,
+			KeyFile:    keyPath,
+			ServerName: "mqtt.example.org",
+			MinVersion: "1.3",
+		},
+	}
+	tc, err := cfg.TLSClientConfig()
+	if err != nil {
+		t.Fatalf("TLSClientConfig error: %v", err)
+	}
+	if tc.RootCAs == nil {
+		t.Fatal("expected custom root CAs")
+	}
+	if len(tc.Certificates) != 1 {
+		t.Fatalf("expected 1 client certificate, got %d", len(tc.Certificates))
+	}
+	if tc.ServerName != "mqtt.example.org" {
+		t.Fatalf("server name = %q", tc.ServerName)
+	}
+	if tc.MinVersion != tls.VersionTLS13 {
+		t.Fatalf("min version = %x", tc.MinVersion)
+	}
+}
+
+func TestTLSClientConfig_Errors(t *testing.T) {
+	dir := t.TempDir()
+	certPath, _ := writeTestCert(t, dir)
+	notPEM := filepath.Join(dir, "garbage.pem")
+	if err := os.WriteFile(notPEM, []byte("not a certificate"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name string
+		tls  TLSConfig
+		want string
+	}{
+		{"missing ca", TLSConfig{CAFile: filepath.Join(dir, "missing.pem")}, "ca_file"},
+		{"invalid ca", TLSConfig{CAFile: notPEM}, "no PEM certificates"},
+		{"cert without key", TLSConfig{CertFile: certPath}, "must be set together"},
+		{"bad key", TLSConfig{CertFile: certPath, KeyFile: notPEM}, "client certificate"},
+		{"bad version", TLSConfig{MinVersion: "1.4"}, "min_version"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := MQTTConfig{Broker: "ssl://broker:8883", TLS: tt.tls}.TLSClientConfig()
+			if err == nil || !strings.Contains(err.Error(), tt.want) {
+				t.Fatalf("error = %v, want it to mention %q", err, tt.want)
+			}
+		})
+	}
+}
+
+func TestLoadConfig_RejectsInvalidTLS(t *testing.T) {
+	yaml := `
+mqtt:
+  broker: "ssl://localhost:8883"
+  username: "user"
+  password: "pass"
+  tls:
+    min_version: "2.0"
+meters: []
+`
+	if _, err := LoadConfig(writeTestConfig(t, yaml)); err == nil {
+		t.Fatal("expected error for invalid tls.min_version")
+	}
+}
+
+// ---------------------------------------------------------------------------
+// MQTT protocol version
+// ---------------------------------------------------------------------------
+
+func TestLoadConfig_ProtocolVersion5(t *testing.T) {
+	yaml := `
+mqtt:
+  broker: "tcp://localhost:1883"
+  protocol_version: 5
+  message_expiry: 2m
+meters: []
+`
+	cfg, err := LoadConfig(writeTestConfig(t, yaml))
+	if err != nil {
+		t.Fatalf("LoadConfig error: %v", err)
+	}
+	if cfg.MQTT[0].protocolVersion() != 5 {
+		t.Fatalf("protocol version = %d", cfg.MQTT[0].protocolVersion())
+	}
+	if cfg.MQTT[0].MessageExpiry != 2*time.Minute {
+		t.Fatalf("message_expiry = %v", cfg.MQTT[0].MessageExpiry)
+	}
+}
+
+func TestMQTTConfig_ValidateProtocol(t *testing.T) {
+	if v := (MQTTConfig{}).protocolVersion(); v != 4 {
+		t.Fatalf("default protocol version = %d, want 4", v)
+	}
+	tests := []struct {
+		name string
+		cfg  MQTTConfig
+	}{
+		{"unknown version", MQTTConfig{ProtocolVersion: 6}},
+		{"expiry without v5", MQTTConfig{MessageExpiry: time.Minute}},
+		{"sub-second expiry", MQTTConfig{ProtocolVersion: 5, MessageExpiry: time.Millisecond}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := tt.cfg.validate(); err == nil {
+				t.Fatal("expected validation error")
+			}
+		})
+	}
+}
+
+// ---------------------------------------------------------------------------
+// State format
+// ---------------------------------------------------------------------------
+
+func TestLoadConfig_StateFormat(t *testing.T) {
+	base := `
+mqtt:
+  broker: "tcp://localhost:1883"
+`
+	cfg, err := LoadConfig(writeTestConfig(t, base+"meters: []\n"))
+	if err != nil {
+		t.Fatalf("LoadConfig error: %v", err)
+	}
+	if cfg.MQTT[0].StateFormat != StateFormatValue {
+		t.Fatalf("default state_format = %q, want value", cfg.MQTT[0].StateFormat)
+	}
+
+	cfg, err = LoadConfig(writeTestConfig(t, base+"  state_format: both\nmeters: []\n"))
+	if err != nil {
+		t.Fatalf("LoadConfig error: %v", err)
+	}
+	if cfg.MQTT[0].StateFormat != StateFormatBoth {
+		t.Fatalf("state_format = %q, want both", cfg.MQTT[0].StateFormat)
+	}
+
+	if _, err := LoadConfig(writeTestConfig(t, base+"  state_format: xml\nmeters: []\n")); err == nil {
+		t.Fatal("expected error for unknown state_format")
+	}
+}
+
+// ---------------------------------------------------------------------------
+// Change-based publishing
+// ---------------------------------------------------------------------------
+
+func TestLoadConfig_ChangeFilter(t *testing.T) {
+	yaml := `
+mqtt:
+  broker: "tcp://localhost:1883"
+meters:
+  - name: nutzstrom
+    device: /dev/ttyUSB0
+    values:
+      - obis: "1.0.16.7.0"
+        name: Leistung
+        deadband: 2%
+        max_interval: 5m
+      - obis: "1.0.1.8.0"
+        name: Bezug
+        min_interval: 1m
+`
+	cfg, err := LoadConfig(writeTestConfig(t, yaml))
+	if err != nil {
+		t.Fatalf("LoadConfig error: %v", err)
+	}
+	power := cfg.Meters[0].Values[0]
+	if !power.Deadband.Set || !power.Deadband.Percent || power.Deadband.Amount != 2 {
+		t.Fatalf("deadband = %+v", power.Deadband)
+	}
+	if power.MaxInterval != 5*time.Minute {
+		t.Fatalf("max_interval = %v", power.MaxInterval)
+	}
+	if cfg.Meters[0].Values[1].MinInterval != time.Minute {
+		t.Fatalf("min_interval = %v", cfg.Meters[0].Values[1].MinInterval)
+	}
+}
+
+func TestLoadConfig_RejectsMaxBelowMinInterval(t *testing.T) {
+	yaml := `
+mqtt:
+  broker: "tcp://localhost:1883"
+meters:
+  - name: nutzstrom
+    device: /dev/ttyUSB0
+    values:
+      - obis: "1.0.1.8.0"
+        name: Bezug
+        min_interval: 5m
+        max_interval: 1m
+`
+	if _, err := LoadConfig(writeTestConfig(t, yaml)); err == nil {
+		t.Fatal("expected error for max_interval < min_interval")
+	}
+}
+
+// ---------------------------------------------------------------------------
+// QoS and retain
+// ---------------------------------------------------------------------------
+
+func TestLoadConfig_QoSRetainDefaults(t *testing.T) {
+	yaml := `
+mqtt:
+  broker: "tcp://localhost:1883"
+  qos: 1
+  retain: true
+meters:
+  - name: nutzstrom
+    device: /dev/ttyUSB0
+    values:
+      - obis: "1.0.1.8.0"
+        name: Bezug
+      - obis: "1.0.16.7.0"
+        name: Leistung
+        qos: 0
+        retain: false
+`
+	cfg, err := LoadConfig(writeTestConfig(t, yaml))
+	if err != nil {
+		t.Fatalf("LoadConfig error: %v", err)
+	}
+	mqtt := cfg.MQTT[0]
+	energy, power := cfg.Meters[0].Values[0], cfg.Meters[0].Values[1]
+	if energy.qos(byte(mqtt.QoS)) != 1 || !energy.retain(mqtt.Retain) {
+		t.Fatalf("Bezug: qos %d, retain %v; want mqtt defaults", energy.qos(byte(mqtt.QoS)), energy.retain(mqtt.Retain))
+	}
+	if power.qos(byte(mqtt.QoS)) != 0 || power.retain(mqtt.Retain) {
+		t.Fatalf("Leistung: qos %d, retain %v; want overrides", power.qos(byte(mqtt.QoS)), power.retain(mqtt.Retain))
+	}
+}
+
+func TestLoadConfig_RejectsInvalidQoS(t *testing.T) {
+	base := `
+mqtt:
+  broker: "tcp://localhost:1883"
+`
+	if _, err := LoadConfig(writeTestConfig(t, base+"  qos: 3\nmeters: []\n")); err == nil {
+		t.Fatal("expected error for mqtt.qos 3")
+	}
+	value := base + `meters:
+  - name: nutzstrom
+    device: /dev/ttyUSB0
+    values:
+      - obis: "1.0.1.8.0"
+        name: Bezug
+        qos: -1
+`
+	if _, err := LoadConfig(writeTestConfig(t, value)); err == nil {
+		t.Fatal("expected error for value qos -1")
+	}
+}
+
+// ---------------------------------------------------------------------------
+// Home Assistant entity settings
+// ---------------------------------------------------------------------------
+
+func TestLoadConfig_EntitySettings(t *testing.T) {
+	yaml := `
+mqtt:
+  broker: "tcp://localhost:1883"
+meters:
+  - name: nutzstrom
+    device: /dev/ttyUSB0
+    suggested_area: Keller
+    via_device: zaehler2mqtt_bridge
+    values:
+      - obis: "1.0.16.7.0"
+        name: Leistung
+        device_class: power
+        state_class: measurement
+        unit: W
+        icon: mdi:flash
+        suggested_display_precision: 0
+        entity_category: diagnostic
+        enabled_by_default: false
+        object_id: nutzstrom_leistung
+        expire_after: 2m
+        force_update: true
+`
+	cfg, err := LoadConfig(writeTestConfig(t, yaml))
+	if err != nil {
+		t.Fatalf("LoadConfig error: %v", err)
+	}
+	m := cfg.Meters[0]
+	if m.SuggestedArea != "Keller" || m.ViaDevice != "zaehler2mqtt_bridge" {
+		t.Fatalf("device settings = %q, %q", m.SuggestedArea, m.ViaDevice)
+	}
+	v := m.Values[0]
+	if v.SuggestedDisplayPrecision == nil || *v.SuggestedDisplayPrecision != 0 {
+		t.Fatalf("suggested_display_precision = %v", v.SuggestedDisplayPrecision)
+	}
+	if v.EnabledByDefault == nil || *v.EnabledByDefault {
+		t.Fatalf("enabled_by_default = %v", v.EnabledByDefault)
+	}
+	if v.ExpireAfter != 2*time.Minute || !v.ForceUpdate || v.ObjectID != "nutzstrom_leistung" {
+		t.Fatalf("unexpected value settings: %+v", v)
+	}
+}
+
+func TestLoadConfig_RejectsInvalidEntitySettings(t *testing.T) {
+	tests := map[string]string{
+		"unit for device_class": "device_class: energy\n        unit: W",
+		"state_class":           "device_class: energy\n        unit: kWh\n        state_class: measurement",
+		"device_class":          "device_class: strom",
+		"icon":                  "icon: flash",
+		"entity_category":       "entity_category: config",
+		"object_id":             "object_id: Nutzstrom Leistung",
+		"expire_after":          "expire_after: 500ms",
+		"precision":             "suggested_display_precision: -1",
+	}
+	for name, setting := range tests {
+		yaml := `
+mqtt:
+  broker: "tcp://localhost:1883"
+meters:
+  - name: nutzstrom
+    device: /dev/ttyUSB0
+    values:
+      - obis: "1.0.1.8.0"
+        name: Bezug
+        ` + setting + "\n"
+		if _, err := LoadConfig(writeTestConfig(t, yaml)); err == nil {
+			t.Errorf("%s: expected error", name)
+		}
+	}
+}
+
+// ---------------------------------------------------------------------------
+// Discovery mode
+// ---------------------------------------------------------------------------
+
+func TestLoadConfig_DiscoveryMode(t *testing.T) {
+	base := `
+mqtt:
+  broker: "tcp://localhost:1883"
+`
+	cfg, err := LoadConfig(writeTestConfig(t, base+"meters: []\n"))
+	if err != nil {
+		t.Fatalf("LoadConfig error: %v", err)
+	}
+	if cfg.MQTT[0].DiscoveryMode != DiscoveryModeSensor {
+		t.Fatalf("default discovery_mode = %q, want sensor", cfg.MQTT[0].DiscoveryMode)
+	}
+
+	cfg, err = LoadConfig(writeTestConfig(t, base+"  discovery_mode: device\nmeters: []\n"))
+	if err != nil {
+		t.Fatalf("LoadConfig error: %v", err)
+	}
+	if cfg.MQTT[0].DiscoveryMode != DiscoveryModeDevice {
+		t.Fatalf("discovery_mode = %q, want device", cfg.MQTT[0].DiscoveryMode)
+	}
+
+	if _, err := LoadConfig(writeTestConfig(t, base+"  discovery_mode: entity\nmeters: []\n")); err == nil {
+		t.Fatal("expected error for unknown discovery_mode")
+	}
+}
+
+func TestLoadConfig_Homie(t *testing.T) {
+	base := `
+mqtt:
+  broker: "tcp://localhost:1883"
+`
+	cfg, err := LoadConfig(writeTestConfig(t, base+"  homie: 5\n  homie_prefix: devices\nmeters: []\n"))
+	if err != nil {
+		t.Fatalf("LoadConfig error: %v", err)
+	}
+	if cfg.MQTT[0].Homie != 5 || cfg.MQTT[0].HomiePrefix != "devices" {
+		t.Fatalf("unexpected homie settings: %+v", cfg.MQTT[0])
+	}
+
+	if _, err := LoadConfig(writeTestConfig(t, base+"  homie: 3\nmeters: []\n")); err == nil {
+		t.Fatal("expected error for unsupported homie version")
+	}
+	if _, err := LoadConfig(writeTestConfig(t, base+"  homie: 4\n  homie_prefix: \"homie/#\"\nmeters: []\n")); err == nil {
+		t.Fatal("expected error for wildcard homie_prefix")
+	}
+}
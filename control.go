@@ -0,0 +1,271 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"sync"
+	"time"
+)
+
+// maxCaptureSize stops a raw capture that was left running.
+const maxCaptureSize = 10 << 20
+
+// meterControl lets commands act on a running meter reader.
+type meterControl struct {
+	reconnect chan struct{}
+	capture   captureWriter
+}
+
+func newMeterControl() *meterControl {
+	return &meterControl{reconnect: make(chan struct{}, 1)}
+}
+
+// Reconnect asks the reader to reopen its serial device.
+func (c *meterControl) Reconnect() {
+	select {
+	case c.reconnect <- struct{}{}:
+	default:
+	}
+}
+
+// captureWriter copies the raw bytes read from a serial device to a file
+// while a capture is running. It never fails the read it is attached to.
+type captureWriter struct {
+	mu   sync.Mutex
+	file *os.File
+	size int64
+}
+
+func (w *captureWriter) Start(path string) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.file != nil {
+		return fmt.Errorf("capture to %s is already running", w.file.Name())
+	}
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0640)
+	if err != nil {
+		return err
+	}
+	w.file, w.size = f, 0
+	return nil
+}
+
+// Stop ends the running capture and returns its file name and size.
+func (w *captureWriter) Stop() (string, int64, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.file == nil {
+		return "", 0, fmt.Errorf("no capture is running")
+	}
+	name, size := w.file.Name(), w.size
+	err := w.file.Close()
+	w.file = nil
+	return name, size, err
+}
+
+func (w *captureWriter) Write(p []byte) (int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.file == nil {
+		return len(p), nil
+	}
+	n, err := w.file.Write(p)
+	w.size += int64(n)
+	if err != nil || w.size >= maxCaptureSize {
+		log.Printf("Stopping capture %s after %d bytes (err: %v)", w.file.Name(), w.size, err)
+		w.file.Close()
+		w.file = nil
+	}
+	return len(p), nil
+}
+
+// controller runs the meter readers and carries out commands.
+type controller struct {
+	ctx        context.Context
+	configPath string
+	pub        *Brokers
+	srv        *Server
+
+	// reloadMu serializes reloads, as commands run concurrently
+	reloadMu sync.Mutex
+
+	mu       sync.Mutex
+	cfg      *Config
+	cancel   context.CancelFunc
+	wg       sync.WaitGroup
+	controls map[string]*meterControl
+	sinks    Sinks
+}
+
+func newController(ctx context.Context, configPath string, cfg *Config, pub *Brokers, srv *Server) *controller {
+	c := &controller{ctx: ctx, configPath: configPath, cfg: cfg, pub: pub, srv: srv}
+	pub.HandleCommand(cmdReconnect, c.reconnect)
+	pub.HandleCommand(cmdRepublish, c.republish)
+	pub.HandleCommand(cmdPurge, c.purge)
+	pub.HandleCommand(cmdReload, c.reload)
+	pub.HandleCommand(cmdDump, c.dump)
+	pub.HandleCommand(cmdCaptureStart, c.captureStart)
+	pub.HandleCommand(cmdCaptureStop, c.captureStop)
+	return c
+}
+
+// Start starts a reader goroutine per meter.
+func (c *controller) Start() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	sinks, err := newSinks(c.cfg.Outputs, outputEnv{brokers: c.pub, server: c.srv})
+	if err != nil {
+		return err
+	}
+	c.sinks = sinks
+	ctx, cancel := context.WithCancel(c.ctx)
+	c.cancel = cancel
+	c.controls = make(map[string]*meterControl, len(c.cfg.Meters))
+	for _, meterCfg := range c.cfg.Meters {
+		ctl := newMeterControl()
+		c.controls[meterCfg.Name] = ctl
+		c.wg.Add(1)
+		go func(mc MeterConfig) {
+			defer c.wg.Done()
+			RunMeter(ctx, mc, sinks, ctl)
+		}(meterCfg)
+	}
+	return nil
+}
+
+// Stop stops all readers and waits for them to exit.
+func (c *controller) Stop() {
+	c.mu.Lock()
+	cancel := c.cancel
+	controls := c.controls
+	sinks := c.sinks
+	c.sinks = nil
+	c.mu.Unlock()
+	if cancel != nil {
+		cancel()
+	}
+	c.wg.Wait()
+	if err := sinks.Close(); err != nil {
+		log.Printf("Failed to close outputs: %v", err)
+	}
+	for _, ctl := range controls {
+		ctl.capture.Stop()
+	}
+}
+
+func (c *controller) control(meterName string) (*meterControl, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	ctl, ok := c.controls[meterName]
+	if !ok {
+		return nil, fmt.Errorf("unknown meter %q", meterName)
+	}
+	return ctl, nil
+}
+
+func (c *controller) reconnect(meterName string) (interface{}, error) {
+	ctl, err := c.control(meterName)
+	if err != nil {
+		return nil, err
+	}
+	ctl.Reconnect()
+	return nil, nil
+}
+
+func (c *controller) republish(string) (interface{}, error) {
+	c.pub.Republish()
+	return nil, nil
+}
+
+// purge removes every entity of this instance from Home Assistant. They come
+// back with the next republish or restart.
+func (c *controller) purge(string) (interface{}, error) {
+	removed, err := c.pub.Purge()
+	if err != nil {
+		return nil, err
+	}
+	return map[string]int{"removed": removed}, nil
+}
+
+// reload restarts the meter readers with the meters from the config file.
+// Changes to the MQTT or HTTP settings need a restart.
+func (c *controller) reload(string) (interface{}, error) {
+	c.reloadMu.Lock()
+	defer c.reloadMu.Unlock()
+	cfg, err := LoadConfig(c.configPath)
+	if err != nil {
+		return nil, err
+	}
+	c.mu.Lock()
+	old := c.cfg
+	c.mu.Unlock()
+	if !reflect.DeepEqual(cfg.MQTT, old.MQTT) || cfg.HTTP != old.HTTP {
+		return nil, fmt.Errorf("mqtt and http settings cannot be reloaded, restart instead")
+	}
+
+	c.Stop()
+	kept := make(map[string]bool, len(cfg.Meters))
+	for _, m := range cfg.Meters {
+		kept[m.Name] = true
+	}
+	for _, m := range old.Meters {
+		if !kept[m.Name] {
+			c.pub.RemoveHomieDevice(m.Name)
+		}
+		c.pub.UnregisterMeter(m.Name)
+		c.srv.UnregisterMeter(m.Name)
+	}
+	c.pub.RemoveStaleDiscovery(outputMeters(cfg.Outputs, OutputMQTT, cfg.Meters))
+	c.mu.Lock()
+	c.cfg = cfg
+	c.mu.Unlock()
+	if err := c.Start(); err != nil {
+		c.mu.Lock()
+		c.cfg = old
+		c.mu.Unlock()
+		if restartErr := c.Start(); restartErr != nil {
+			log.Printf("Failed to restart meters: %v", restartErr)
+		}
+		return nil, err
+	}
+	return map[string]int{"meters": len(cfg.Meters)}, nil
+}
+
+func (c *controller) dump(string) (interface{}, error) {
+	return map[string]interface{}{"meters": c.srv.Snapshot()}, nil
+}
+
+var unsafeFileChars = regexp.MustCompile(`[^A-Za-z0-9_-]`)
+
+func (c *controller) captureStart(meterName string) (interface{}, error) {
+	ctl, err := c.control(meterName)
+	if err != nil {
+		return nil, err
+	}
+	c.mu.Lock()
+	dir := c.cfg.CaptureDir
+	c.mu.Unlock()
+	name := fmt.Sprintf("%s-%s.sml", unsafeFileChars.ReplaceAllString(meterName, "_"), time.Now().Format("20060102-150405"))
+	path := filepath.Join(dir, name)
+	if err := ctl.capture.Start(path); err != nil {
+		return nil, err
+	}
+	return map[string]string{"file": path}, nil
+}
+
+func (c *controller) captureStop(meterName string) (interface{}, error) {
+	ctl, err := c.control(meterName)
+	if err != nil {
+		return nil, err
+	}
+	path, size, err := ctl.capture.Stop()
+	if err != nil {
+		return nil, err
+	}
+	return map[string]interface{}{"file": path, "bytes": size}, nil
+}
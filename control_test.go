@@ -0,0 +1,101 @@
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// ---------------------------------------------------------------------------
+// Raw capture
+// ---------------------------------------------------------------------------
+
+func TestCaptureWriter(t *testing.T) {
+	var w captureWriter
+	path := filepath.Join(t.TempDir(), "capture.sml")
+
+	w.Write([]byte("ignored"))
+	if err := w.Start(path); err != nil {
+		t.Fatalf("Start error: %v", err)
+	}
+	if err := w.Start(path); err == nil {
+		t.Fatal("expected error for a second capture")
+	}
+	w.Write(fixtureDZG)
+	name, size, err := w.Stop()
+	if err != nil {
+		t.Fatalf("Stop error: %v", err)
+	}
+	if name != path || size != int64(len(fixtureDZG)) {
+		t.Fatalf("Stop = %q, %d", name, size)
+	}
+	w.Write([]byte("ignored"))
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != string(fixtureDZG) {
+		t.Fatalf("captured %d bytes, want the fixture", len(data))
+	}
+	if _, _, err := w.Stop(); err == nil {
+		t.Fatal("expected error when no capture is running")
+	}
+}
+
+func TestCaptureWriter_StopsAtLimit(t *testing.T) {
+	var w captureWriter
+	if err := w.Start(filepath.Join(t.TempDir(), "capture.sml")); err != nil {
+		t.Fatal(err)
+	}
+	w.Write(make([]byte, maxCaptureSize))
+	if _, _, err := w.Stop(); err == nil {
+		t.Fatal("capture should have stopped at the size limit")
+	}
+}
+
+// ---------------------------------------------------------------------------
+// Commands
+// ---------------------------------------------------------------------------
+
+func newTestController(t *testing.T) *controller {
+	p, _ := newTestPublisher()
+	cfg := &Config{CaptureDir: t.TempDir()}
+	c := newController(context.Background(), "", cfg, newTestBrokers(t, p), NewServer(":0"))
+	c.controls = map[string]*meterControl{"nutzstrom": newMeterControl()}
+	return c
+}
+
+func TestController_Reconnect(t *testing.T) {
+	c := newTestController(t)
+	if _, err := c.reconnect("nutzstrom"); err != nil {
+		t.Fatalf("reconnect error: %v", err)
+	}
+	// a second request before the reader reacts is merged with the first
+	if _, err := c.reconnect("nutzstrom"); err != nil {
+		t.Fatalf("reconnect error: %v", err)
+	}
+	if len(c.controls["nutzstrom"].reconnect) != 1 {
+		t.Fatal("expected one pending reconnect")
+	}
+	if _, err := c.reconnect("waermestrom"); err == nil {
+		t.Fatal("expected error for unknown meter")
+	}
+}
+
+func TestController_Capture(t *testing.T) {
+	c := newTestController(t)
+	result, err := c.captureStart("nutzstrom")
+	if err != nil {
+		t.Fatalf("captureStart error: %v", err)
+	}
+	file := result.(map[string]string)["file"]
+	if !strings.HasPrefix(filepath.Base(file), "nutzstrom-") || filepath.Dir(file) != c.cfg.CaptureDir {
+		t.Fatalf("capture file = %q", file)
+	}
+	if _, err := c.captureStop("nutzstrom"); err != nil {
+		t.Fatalf("captureStop error: %v", err)
+	}
+}
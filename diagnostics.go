@@ -0,0 +1,125 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+)
+
+// diagnosticsInterval is how often the reader health of a meter is published.
+const diagnosticsInterval = 30 * time.Second
+
+// diagnosticValues are the built-in Home Assistant sensors every meter gets
+// for its reader health. They read from the meter's diagnostics topic.
+var diagnosticValues = []ValueConfig{
+	{Name: "Frames per minute", diagnostic: "frames_per_minute", EntityCategory: "diagnostic", StateClass: "measurement", Unit: "frames/min", Icon: "mdi:speedometer"},
+	{Name: "CRC errors", diagnostic: "crc_errors", EntityCategory: "diagnostic", StateClass: "total_increasing", Icon: "mdi:alert-circle-outline"},
+	{Name: "Parse errors", diagnostic: "parse_errors", EntityCategory: "diagnostic", StateClass: "total_increasing", Icon: "mdi:alert-circle-outline"},
+	{Name: "Reconnects", diagnostic: "reconnects", EntityCategory: "diagnostic", StateClass: "total_increasing", Icon: "mdi:restart"},
+	{Name: "Last frame age", diagnostic: "last_frame_age", EntityCategory: "diagnostic", DeviceClass: "duration", StateClass: "measurement", Unit: "s"},
+	{Name: "Serial device", diagnostic: "device", EntityCategory: "diagnostic", Icon: "mdi:usb-port"},
+	{Name: "Meter serial", diagnostic: "serial", EntityCategory: "diagnostic", Icon: "mdi:identifier"},
+}
+
+// meterEntities returns the configured values of a meter followed by its
+// diagnostic sensors.
+func meterEntities(m MeterConfig) []ValueConfig {
+	entities := make([]ValueConfig, 0, len(m.Values)+len(diagnosticValues))
+	entities = append(entities, m.Values...)
+	return append(entities, diagnosticValues...)
+}
+
+// diagnosticsPayload is the reader health of a meter as published to its
+// diagnostics topic.
+type diagnosticsPayload struct {
+	Frames          int      `json:"frames"`
+	FramesPerMinute int      `json:"frames_per_minute"`
+	CRCErrors       int      `json:"crc_errors"`
+	ParseErrors     int      `json:"parse_errors"`
+	Reconnects      int      `json:"reconnects"`
+	LastFrameAge    *float64 `json:"last_frame_age"`
+	Device          string   `json:"device"`
+	Serial          string   `json:"serial"`
+}
+
+// readerStats counts what a meter reader sees. It is shared between the read
+// loop and the diagnostics reporter.
+type readerStats struct {
+	mu          sync.Mutex
+	frames      []time.Time // frames of the last minute
+	lastFrame   time.Time
+	total       int
+	crcErrors   int
+	parseErrors int
+	reconnects  int
+}
+
+func (s *readerStats) Frame(at time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.frames = append(s.trim(at), at)
+	s.lastFrame = at
+	s.total++
+}
+
+// FrameError counts a frame that was dropped because of err.
+func (s *readerStats) FrameError(err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if errors.Is(err, errFrameCRC) {
+		s.crcErrors++
+	} else {
+		s.parseErrors++
+	}
+}
+
+func (s *readerStats) Reconnect() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.reconnects++
+}
+
+// trim drops frames older than a minute. s.mu must be held.
+func (s *readerStats) trim(now time.Time) []time.Time {
+	i := 0
+	for i < len(s.frames) && now.Sub(s.frames[i]) >= time.Minute {
+		i++
+	}
+	return s.frames[i:]
+}
+
+// Snapshot returns the counters as of now. Device and serial are filled in
+// by the publisher.
+func (s *readerStats) Snapshot(now time.Time) diagnosticsPayload {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.frames = s.trim(now)
+	d := diagnosticsPayload{
+		Frames:          s.total,
+		FramesPerMinute: len(s.frames),
+		CRCErrors:       s.crcErrors,
+		ParseErrors:     s.parseErrors,
+		Reconnects:      s.reconnects,
+	}
+	if !s.lastFrame.IsZero() {
+		age := now.Sub(s.lastFrame).Round(time.Second).Seconds()
+		d.LastFrameAge = &age
+	}
+	return d
+}
+
+// reportDiagnostics hands the reader health of a meter periodically until
+// ctx is done.
+func reportDiagnostics(ctx context.Context, meterName string, sink Sink, stats *readerStats) {
+	ticker := time.NewTicker(diagnosticsInterval)
+	defer ticker.Stop()
+	for {
+		sink.Diagnostics(meterName, stats.Snapshot(time.Now()))
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
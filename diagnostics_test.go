@@ -0,0 +1,95 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"testing"
+	"time"
+)
+
+// ---------------------------------------------------------------------------
+// Reader stats
+// ---------------------------------------------------------------------------
+
+func TestReaderStats_Snapshot(t *testing.T) {
+	var s readerStats
+	start := time.Date(2026, 3, 1, 12, 0, 0, 0, time.UTC)
+
+	d := s.Snapshot(start)
+	if d.FramesPerMinute != 0 || d.LastFrameAge != nil {
+		t.Fatalf("fresh stats = %+v", d)
+	}
+
+	for i := 0; i < 90; i++ {
+		s.Frame(start.Add(time.Duration(i) * time.Second))
+	}
+	s.FrameError(errFrameCRC)
+	s.FrameError(fmt.Errorf("%w: truncated", errFrameParse))
+	s.FrameError(errFrameParse)
+	s.Reconnect()
+
+	d = s.Snapshot(start.Add(92 * time.Second))
+	if d.FramesPerMinute != 57 {
+		t.Fatalf("frames per minute = %d, want 57", d.FramesPerMinute)
+	}
+	if d.CRCErrors != 1 || d.ParseErrors != 2 || d.Reconnects != 1 {
+		t.Fatalf("counters = %+v", d)
+	}
+	if d.LastFrameAge == nil || *d.LastFrameAge != 3 {
+		t.Fatalf("last frame age = %v, want 3", d.LastFrameAge)
+	}
+}
+
+// ---------------------------------------------------------------------------
+// Publishing
+// ---------------------------------------------------------------------------
+
+func TestPublishDiagnostics(t *testing.T) {
+	p, client := newTestPublisher()
+	p.RegisterMeter(MeterConfig{Name: "nutzstrom", Device: "/dev/ttyUSB0"})
+	p.SetMeterSerial("nutzstrom", "0a01484c5902000424a4")
+	age := 2.0
+	p.PublishDiagnostics("nutzstrom", diagnosticsPayload{FramesPerMinute: 60, CRCErrors: 1, LastFrameAge: &age})
+
+	msgs := client.messages("zaehler2mqtt/nutzstrom/diagnostics")
+	if len(msgs) != 1 {
+		t.Fatalf("expected 1 diagnostics message, got %d", len(msgs))
+	}
+	var got map[string]interface{}
+	if err := json.Unmarshal(msgs[0].Payload, &got); err != nil {
+		t.Fatal(err)
+	}
+	if got["frames_per_minute"] != 60.0 || got["crc_errors"] != 1.0 || got["last_frame_age"] != 2.0 ||
+		got["device"] != "/dev/ttyUSB0" || got["serial"] != "0a01484c5902000424a4" {
+		t.Fatalf("unexpected diagnostics payload: %s", msgs[0].Payload)
+	}
+}
+
+func TestDiscoveryPayload_Diagnostic(t *testing.T) {
+	p, _ := newTestPublisher()
+	p.meterStates = true // diagnostics never read from the meter state
+	val := diagnosticValues[0]
+	payload, _ := p.discoveryPayload("nutzstrom", p.topics.SensorID("nutzstrom", val.Name), val)
+
+	if payload["state_topic"] != "zaehler2mqtt/nutzstrom/diagnostics" {
+		t.Fatalf("state_topic = %v", payload["state_topic"])
+	}
+	if payload["value_template"] != "{{ value_json.frames_per_minute }}" {
+		t.Fatalf("value_template = %v", payload["value_template"])
+	}
+	if payload["entity_category"] != "diagnostic" {
+		t.Fatalf("entity_category = %v", payload["entity_category"])
+	}
+	avail := payload["availability"].([]map[string]string)
+	if len(avail) != 1 || avail[0]["topic"] != "zaehler2mqtt/status" {
+		t.Fatalf("diagnostics must only depend on the bridge status, got %v", avail)
+	}
+}
+
+func TestDiagnosticValues_Valid(t *testing.T) {
+	for _, v := range diagnosticValues {
+		if err := v.validate(); err != nil {
+			t.Errorf("%s: %v", v.Name, err)
+		}
+	}
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Deadband is the change a value must make before it is published again.
+// In YAML it is written as an absolute amount ("5") or relative to the last
+// published value ("2%").
+type Deadband struct {
+	Amount  float64
+	Percent bool
+	// Set distinguishes "deadband: 0" (publish on any change) from no
+	// deadband at all (publish every reading).
+	Set bool
+}
+
+func (d *Deadband) UnmarshalYAML(node *yaml.Node) error {
+	s := strings.TrimSpace(node.Value)
+	percent := strings.HasSuffix(s, "%")
+	n, err := strconv.ParseFloat(strings.TrimSpace(strings.TrimSuffix(s, "%")), 64)
+	if err != nil {
+		return fmt.Errorf("invalid deadband %q: use a number or a percentage like 2%%", node.Value)
+	}
+	if n < 0 {
+		return fmt.Errorf("invalid deadband %q: must not be negative", node.Value)
+	}
+	*d = Deadband{Amount: n, Percent: percent, Set: true}
+	return nil
+}
+
+// exceeded reports whether value differs enough from last.
+func (d Deadband) exceeded(last, value float64) bool {
+	if !d.Set {
+		return true
+	}
+	limit := d.Amount
+	if d.Percent {
+		limit = math.Abs(last) * d.Amount / 100
+	}
+	if limit == 0 {
+		return value != last
+	}
+	return math.Abs(value-last) >= limit
+}
+
+// changeFilter decides which readings of a value are published, based on its
+// deadband, min_interval and max_interval settings.
+type changeFilter struct {
+	cfg       ValueConfig
+	published bool
+	last      float64
+	lastAt    time.Time
+}
+
+func newChangeFilter(cfg ValueConfig) *changeFilter {
+	return &changeFilter{cfg: cfg}
+}
+
+// Allow reports whether value, read at now, should be published and records
+// it as the last published value if so. The first reading is always
+// published; after that max_interval forces a heartbeat, and otherwise the
+// value must have left the deadband and min_interval must have passed.
+func (f *changeFilter) Allow(value float64, now time.Time) bool {
+	if !f.allow(value, now) {
+		return false
+	}
+	f.published = true
+	f.last = value
+	f.lastAt = now
+	return true
+}
+
+func (f *changeFilter) allow(value float64, now time.Time) bool {
+	if !f.published {
+		return true
+	}
+	elapsed := now.Sub(f.lastAt)
+	if f.cfg.MaxInterval > 0 && elapsed >= f.cfg.MaxInterval {
+		return true
+	}
+	if elapsed < f.cfg.MinInterval {
+		return false
+	}
+	return f.cfg.Deadband.exceeded(f.last, value)
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// ---------------------------------------------------------------------------
+// Deadband
+// ---------------------------------------------------------------------------
+
+func TestDeadband_Unmarshal(t *testing.T) {
+	tests := []struct {
+		in   string
+		want Deadband
+	}{
+		{"5", Deadband{Amount: 5, Set: true}},
+		{"0.5", Deadband{Amount: 0.5, Set: true}},
+		{"2%", Deadband{Amount: 2, Percent: true, Set: true}},
+		{"\"1.5 %\"", Deadband{Amount: 1.5, Percent: true, Set: true}},
+		{"0", Deadband{Set: true}},
+	}
+	for _, tt := range tests {
+		var v struct {
+			Deadband Deadband `yaml:"deadband"`
+		}
+		if err := yaml.Unmarshal([]byte("deadband: "+tt.in), &v); err != nil {
+			t.Fatalf("%s: unmarshal error: %v", tt.in, err)
+		}
+		if v.Deadband != tt.want {
+			t.Fatalf("%s: got %+v, want %+v", tt.in, v.Deadband, tt.want)
+		}
+	}
+}
+
+func TestDeadband_UnmarshalInvalid(t *testing.T) {
+	for _, in := range []string{"abc", "-1", "5W"} {
+		var v struct {
+			Deadband Deadband `yaml:"deadband"`
+		}
+		if err := yaml.Unmarshal([]byte("deadband: "+in), &v); err == nil {
+			t.Fatalf("%s: expected error", in)
+		}
+	}
+}
+
+// ---------------------------------------------------------------------------
+// changeFilter
+// ---------------------------------------------------------------------------
+
+var filterStart = time.Date(2026, 3, 1, 12, 0, 0, 0, time.UTC)
+
+func at(seconds int) time.Time {
+	return filterStart.Add(time.Duration(seconds) * time.Second)
+}
+
+func TestChangeFilter_NoSettingsPublishesEverything(t *testing.T) {
+	f := newChangeFilter(ValueConfig{})
+	for i := 0; i < 3; i++ {
+		if !f.Allow(100, at(i)) {
+			t.Fatalf("reading %d should be published", i)
+		}
+	}
+}
+
+func TestChangeFilter_AbsoluteDeadband(t *testing.T) {
+	f := newChangeFilter(ValueConfig{Deadband: Deadband{Amount: 10, Set: true}})
+	steps := []struct {
+		value float64
+		want  bool
+	}{
+		{100, true},  // first reading
+		{105, false}, // within deadband
+		{109, false}, // still within, compared to last published 100
+		{110, true},  // reaches deadband
+		{101, false},
+		{95, true},
+	}
+	for i, s := range steps {
+		if got := f.Allow(s.value, at(i)); got != s.want {
+			t.Fatalf("step %d (%v): got %v, want %v", i, s.value, got, s.want)
+		}
+	}
+}
+
+func TestChangeFilter_PercentDeadband(t *testing.T) {
+	f := newChangeFilter(ValueConfig{Deadband: Deadband{Amount: 5, Percent: true, Set: true}})
+	f.Allow(200, at(0))
+	if f.Allow(209, at(1)) {
+		t.Fatal("4.5% change should be suppressed")
+	}
+	if !f.Allow(210, at(2)) {
+		t.Fatal("5% change should be published")
+	}
+}
+
+func TestChangeFilter_ZeroDeadbandPublishesChanges(t *testing.T) {
+	f := newChangeFilter(ValueConfig{Deadband: Deadband{Set: true}})
+	f.Allow(1, at(0))
+	if f.Allow(1, at(1)) {
+		t.Fatal("unchanged value should be suppressed")
+	}
+	if !f.Allow(1.0001, at(2)) {
+		t.Fatal("changed value should be published")
+	}
+}
+
+func TestChangeFilter_MinInterval(t *testing.T) {
+	f := newChangeFilter(ValueConfig{MinInterval: time.Minute})
+	f.Allow(1, at(0))
+	if f.Allow(2, at(30)) {
+		t.Fatal("reading within min_interval should be suppressed")
+	}
+	if !f.Allow(3, at(60)) {
+		t.Fatal("reading after min_interval should be published")
+	}
+}
+
+func TestChangeFilter_MaxIntervalHeartbeat(t *testing.T) {
+	f := newChangeFilter(ValueConfig{
+		Deadband:    Deadband{Amount: 100, Set: true},
+		MaxInterval: 5 * time.Minute,
+	})
+	f.Allow(1000, at(0))
+	if f.Allow(1001, at(60)) {
+		t.Fatal("small change before max_interval should be suppressed")
+	}
+	if !f.Allow(1001, at(300)) {
+		t.Fatal("max_interval should force a heartbeat")
+	}
+	if f.Allow(1002, at(301)) {
+		t.Fatal("heartbeat should restart the interval")
+	}
+}
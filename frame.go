@@ -0,0 +1,178 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/petesahatt/gosml"
+)
+
+// maxFrameSize matches the SML file size limit of gosml.
+const maxFrameSize = 512
+
+var frameEscape = []byte{0x1b, 0x1b, 0x1b, 0x1b}
+
+// FrameValue is a configured value decoded from one SML frame.
+type FrameValue struct {
+	Config ValueConfig
+	Value  float64
+	// OBIS is the object name as reported by the meter, e.g. 1-0:1.8.0*255
+	OBIS string
+}
+
+// readFrames calls handle for every SML file read from r until r is
+// exhausted. Malformed frames are skipped like gosml.Read does and reported
+// to skipped.
+func readFrames(r *bufio.Reader, handle func(frame []byte), skipped func(err error)) error {
+	for {
+		frame, err := readFrame(r)
+		switch {
+		case err == io.EOF:
+			return nil
+		case err == gosml.ErrSequenceTooLong || err == gosml.ErrUnrecognizedSequence:
+			skipped(err)
+			continue
+		case err != nil:
+			return err
+		}
+		handle(frame)
+	}
+}
+
+// readFrame reads the next complete SML file, including its begin and end
+// escape sequences, from r. It follows the framing rules of gosml so that the
+// result can be parsed by gosml.Read, but lets the caller see where one frame
+// ends and the next begins. Malformed frames are reported with the gosml
+// errors ErrUnrecognizedSequence and ErrSequenceTooLong; the caller may keep
+// reading after them.
+func readFrame(r *bufio.Reader) ([]byte, error) {
+	buf := make([]byte, maxFrameSize)
+
+	// find begin sequence 1B 1B 1B 1B 01 01 01 01
+	n := 0
+	for n < 8 {
+		b, err := r.ReadByte()
+		if err != nil {
+			return nil, err
+		}
+		buf[n] = b
+		if (b == 0x1b && n < 4) || (b == 0x01 && n >= 4) {
+			n++
+		} else {
+			n = 0
+		}
+	}
+
+	// the body is escaped in 4 byte blocks, so the end sequence is aligned
+	for n+8 < maxFrameSize {
+		if _, err := io.ReadFull(r, buf[n:n+4]); err != nil {
+			return nil, err
+		}
+		if bytes.Equal(buf[n:n+4], frameEscape) {
+			n += 4
+			if _, err := io.ReadFull(r, buf[n:n+4]); err != nil {
+				return nil, err
+			}
+			if buf[n] == 0x1a {
+				n += 4
+				return buf[:n], nil
+			}
+			return nil, gosml.ErrUnrecognizedSequence
+		}
+		n += 4
+	}
+	return nil, gosml.ErrSequenceTooLong
+}
+
+var (
+	errFrameCRC   = errors.New("crc error")
+	errFrameParse = errors.New("parse error")
+)
+
+// obisCallback is called for every list entry whose object name starts with
+// obis, like a callback registered with gosml.WithObisCallback.
+type obisCallback struct {
+	obis gosml.OctetString
+	fn   func(entry *gosml.ListEntry)
+}
+
+// parseFrame parses the messages of a frame read by readFrame and returns the
+// entries of its list responses. Frames that gosml.Read would silently drop
+// are reported with errFrameCRC or errFrameParse.
+func parseFrame(frame []byte) (entries []*gosml.ListEntry, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			entries, err = nil, fmt.Errorf("%w: %v", errFrameParse, r)
+		}
+	}()
+	buf := &gosml.Buffer{Bytes: frame[8 : len(frame)-8]}
+	for buf.Cursor < len(buf.Bytes) {
+		if buf.GetCurrentByte() == gosml.OCTET_MESSAGE_END {
+			buf.UpdateBytesRead(1)
+			continue
+		}
+		msg, err := parseMessage(buf)
+		if err != nil {
+			return nil, err
+		}
+		if list, ok := msg.MessageBody.Data.(gosml.GetListResponse); ok {
+			entries = append(entries, list.ValList...)
+		}
+	}
+	return entries, nil
+}
+
+// parseMessage parses one message like gosml.MessageParse, but checks the
+// checksum itself, as gosml reports mismatches with a plain error.
+func parseMessage(buf *gosml.Buffer) (*gosml.Message, error) {
+	msg := &gosml.Message{}
+	start := buf.Cursor
+	err := buf.Expect(gosml.OCTET_TYPE_LIST, 6)
+	if err == nil {
+		msg.TransactionID, err = buf.OctetStringParse()
+	}
+	if err == nil {
+		msg.GroupID, err = buf.U8Parse()
+	}
+	if err == nil {
+		msg.AbortOnError, err = buf.U8Parse()
+	}
+	if err == nil {
+		msg.MessageBody, err = gosml.MessageBodyParse(buf)
+	}
+	end := buf.Cursor
+	if err == nil {
+		msg.Crc, err = buf.U16Parse()
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", errFrameParse, err)
+	}
+	if crc16(buf.Bytes[start:end]) != msg.Crc {
+		return nil, errFrameCRC
+	}
+	if buf.GetCurrentByte() == gosml.OCTET_MESSAGE_END {
+		buf.UpdateBytesRead(1)
+	}
+	return msg, nil
+}
+
+// crc16 is the CRC-16/X-25 checksum of SML messages, byte-swapped the way
+// gosml reads it.
+func crc16(data []byte) uint16 {
+	crc := uint16(0xffff)
+	for _, b := range data {
+		crc ^= uint16(b)
+		for i := 0; i < 8; i++ {
+			if crc&1 != 0 {
+				crc = crc>>1 ^ 0x8408
+			} else {
+				crc >>= 1
+			}
+		}
+	}
+	crc ^= 0xffff
+	return crc<<8 | crc>>8
+}
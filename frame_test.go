@@ -0,0 +1,132 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"testing"
+
+	"github.com/petesahatt/gosml"
+)
+
+// fixtureDZG is one SML file captured from a DZG DVS-7412.2 meter.
+var fixtureDZG = []byte{
+	0x1b, 0x1b, 0x1b, 0x1b, 0x01, 0x01, 0x01, 0x01, 0x76, 0x05, 0xf1, 0x2c, 0xad, 0x07, 0x62, 0x00,
+	0x62, 0x00, 0x72, 0x63, 0x01, 0x01, 0x76, 0x01, 0x01, 0x02, 0x31, 0x0b, 0x0a, 0x01, 0x44, 0x5a,
+	0x47, 0x00, 0x02, 0x82, 0x22, 0x5e, 0x72, 0x62, 0x01, 0x65, 0x05, 0xe7, 0x48, 0xd7, 0x62, 0x02,
+	0x63, 0x95, 0x5c, 0x00, 0x76, 0x05, 0xf2, 0x2c, 0xad, 0x07, 0x62, 0x00, 0x62, 0x00, 0x72, 0x63,
+	0x07, 0x01, 0x77, 0x01, 0x0b, 0x0a, 0x01, 0x44, 0x5a, 0x47, 0x00, 0x02, 0x82, 0x22, 0x5e, 0x07,
+	0x01, 0x00, 0x62, 0x0a, 0xff, 0xff, 0x72, 0x62, 0x01, 0x65, 0x05, 0xe7, 0x48, 0xd7, 0x75, 0x77,
+	0x07, 0x01, 0x00, 0x60, 0x32, 0x01, 0x01, 0x01, 0x72, 0x62, 0x01, 0x62, 0x00, 0x62, 0x00, 0x52,
+	0x00, 0x04, 0x44, 0x5a, 0x47, 0x01, 0x77, 0x07, 0x01, 0x00, 0x60, 0x01, 0x00, 0xff, 0x01, 0x72,
+	0x62, 0x01, 0x62, 0x00, 0x62, 0x00, 0x52, 0x00, 0x0b, 0x0a, 0x01, 0x44, 0x5a, 0x47, 0x00, 0x02,
+	0x82, 0x22, 0x5e, 0x01, 0x77, 0x07, 0x01, 0x00, 0x01, 0x08, 0x00, 0xff, 0x64, 0x1c, 0x01, 0x04,
+	0x72, 0x62, 0x01, 0x62, 0x00, 0x62, 0x1e, 0x52, 0xff, 0x65, 0x03, 0x3c, 0x93, 0x89, 0x01, 0x77,
+	0x07, 0x01, 0x00, 0x02, 0x08, 0x00, 0xff, 0x01, 0x72, 0x62, 0x01, 0x62, 0x00, 0x62, 0x1e, 0x52,
+	0xff, 0x65, 0x0f, 0xa4, 0x9a, 0x9e, 0x01, 0x77, 0x07, 0x01, 0x00, 0x10, 0x07, 0x00, 0xff, 0x01,
+	0x72, 0x62, 0x01, 0x62, 0x00, 0x62, 0x1b, 0x52, 0xfe, 0x53, 0x8b, 0x28, 0x01, 0x01, 0x01, 0x63,
+	0x6b, 0x99, 0x00, 0x76, 0x05, 0xf3, 0x2c, 0xad, 0x07, 0x62, 0x00, 0x62, 0x00, 0x72, 0x63, 0x02,
+	0x01, 0x71, 0x01, 0x63, 0xd9, 0x0c, 0x00, 0x00, 0x1b, 0x1b, 0x1b, 0x1b, 0x1a, 0x01, 0xc3, 0xe1,
+}
+
+// ---------------------------------------------------------------------------
+// Frame reading
+// ---------------------------------------------------------------------------
+
+func TestReadFrame_Single(t *testing.T) {
+	r := bufio.NewReader(bytes.NewReader(fixtureDZG))
+	frame, err := readFrame(r)
+	if err != nil {
+		t.Fatalf("readFrame error: %v", err)
+	}
+	if !bytes.Equal(frame, fixtureDZG) {
+		t.Fatalf("frame differs from fixture (len %d, want %d)", len(frame), len(fixtureDZG))
+	}
+}
+
+func TestReadFrames_SkipsGarbage(t *testing.T) {
+	var stream []byte
+	stream = append(stream, 0x00, 0x1b, 0x42)
+	stream = append(stream, fixtureDZG...)
+	stream = append(stream, 0xff, 0xff)
+	stream = append(stream, fixtureDZG...)
+
+	count := 0
+	err := readFrames(bufio.NewReader(bytes.NewReader(stream)), func(frame []byte) {
+		count++
+		if !bytes.Equal(frame, fixtureDZG) {
+			t.Fatalf("frame %d differs from fixture", count)
+		}
+	}, func(err error) {
+		t.Fatalf("unexpected skipped frame: %v", err)
+	})
+	if err != nil {
+		t.Fatalf("readFrames error: %v", err)
+	}
+	if count != 2 {
+		t.Fatalf("expected 2 frames, got %d", count)
+	}
+}
+
+func TestReadFrames_Truncated(t *testing.T) {
+	err := readFrames(bufio.NewReader(bytes.NewReader(fixtureDZG[:102])), func([]byte) {
+		t.Fatal("truncated frame must not be handled")
+	}, func(error) {})
+	if err == nil {
+		t.Fatal("expected error for truncated frame")
+	}
+}
+
+func TestReadFrame_DecodesWithGosml(t *testing.T) {
+	frame, err := readFrame(bufio.NewReader(bytes.NewReader(fixtureDZG)))
+	if err != nil {
+		t.Fatalf("readFrame error: %v", err)
+	}
+	var got []string
+	err = gosml.Read(bufio.NewReader(bytes.NewReader(frame)),
+		gosml.WithObisCallback(gosml.OctetString{1, 0, 1, 8, 0}, func(e *gosml.ListEntry) {
+			got = append(got, e.ObjectName())
+		}))
+	if err != nil {
+		t.Fatalf("gosml.Read error: %v", err)
+	}
+	if len(got) != 1 || got[0] != "1-0:1.8.0*255" {
+		t.Fatalf("decoded entries = %v", got)
+	}
+}
+
+// ---------------------------------------------------------------------------
+// Frame checks
+// ---------------------------------------------------------------------------
+
+func TestParseFrame_Valid(t *testing.T) {
+	entries, err := parseFrame(fixtureDZG)
+	if err != nil {
+		t.Fatalf("parseFrame error: %v", err)
+	}
+	found := false
+	for _, e := range entries {
+		if bytes.HasPrefix(e.ObjName, gosml.OctetString{1, 0, 1, 8, 0}) {
+			found = true
+		}
+	}
+	if !found {
+		t.Fatalf("no 1.0.1.8.0 entry in %d entries", len(entries))
+	}
+}
+
+func TestParseFrame_CRCError(t *testing.T) {
+	frame := append([]byte(nil), fixtureDZG...)
+	frame[170]++ // inside the energy value of the list response
+	if _, err := parseFrame(frame); !errors.Is(err, errFrameCRC) {
+		t.Fatalf("parseFrame error = %v, want %v", err, errFrameCRC)
+	}
+}
+
+func TestParseFrame_ParseError(t *testing.T) {
+	frame := append([]byte(nil), fixtureDZG...)
+	frame[8] = 0x42 // not a message list
+	if _, err := parseFrame(frame); !errors.Is(err, errFrameParse) {
+		t.Fatalf("parseFrame error = %v, want %v", err, errFrameParse)
+	}
+}
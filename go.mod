@@ -3,13 +3,14 @@ module github.com/petesahatt/zaehler2mqtt
 go 1.21
 
 require (
+	github.com/eclipse/paho.golang v0.22.0
 	github.com/eclipse/paho.mqtt.golang v1.4.3
 	github.com/petesahatt/gosml v0.0.2-0.20260228231832-fcbe2303c430
+	golang.org/x/net v0.27.0
 	gopkg.in/yaml.v3 v3.0.1
 )
 
 require (
-	github.com/gorilla/websocket v1.5.0 // indirect
-	golang.org/x/net v0.8.0 // indirect
+	github.com/gorilla/websocket v1.5.3 // indirect
 	golang.org/x/sync v0.1.0 // indirect
 )
@@ -0,0 +1,212 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"strings"
+	"sync"
+	"time"
+)
+
+// gridQuantity is a quantity meter emulations take from a meter, picked by
+// the OBIS code of a value.
+type gridQuantity int
+
+const (
+	gridPower       gridQuantity = iota // 16.7.0, W, positive when drawing
+	gridPowerIn                         // 1.7.0
+	gridPowerOut                        // 2.7.0
+	gridImport                          // 1.8.0, Wh
+	gridExport                          // 2.8.0
+	gridFrequency                       // 14.7.0, Hz
+	gridPowerFactor                     // 13.7.0
+	// per phase, indexed by gridPhase
+	gridPhasePower
+	gridPhasePowerIn     = gridPhasePower + 3
+	gridPhasePowerOut    = gridPhasePower + 6
+	gridPhaseCurrent     = gridPhasePower + 9  // A
+	gridPhaseVoltage     = gridPhasePower + 12 // V
+	gridPhasePowerFactor = gridPhasePower + 15
+)
+
+// gridPhase returns the quantity of a phase, 0 to 2.
+func gridPhase(q gridQuantity, phase int) gridQuantity { return q + gridQuantity(phase) }
+
+// gridQuantityFor maps an OBIS code to its quantity. The phases are 20
+// apart in C: L1 is 21 to 36, L2 41 to 56 and L3 61 to 76.
+func gridQuantityFor(obis []byte) (gridQuantity, bool) {
+	if len(obis) < 5 || obis[4] != 0 {
+		return 0, false
+	}
+	c, d := obis[2], obis[3]
+	if d == 8 {
+		switch c {
+		case 1:
+			return gridImport, true
+		case 2:
+			return gridExport, true
+		}
+		return 0, false
+	}
+	if d != 7 {
+		return 0, false
+	}
+	switch c {
+	case 16:
+		return gridPower, true
+	case 1:
+		return gridPowerIn, true
+	case 2:
+		return gridPowerOut, true
+	case 13:
+		return gridPowerFactor, true
+	case 14:
+		return gridFrequency, true
+	}
+	if c < 21 || c > 76 {
+		return 0, false
+	}
+	phase := int(c-21) / 20
+	switch (c - 21) % 20 {
+	case 15:
+		return gridPhase(gridPhasePower, phase), true
+	case 0:
+		return gridPhase(gridPhasePowerIn, phase), true
+	case 1:
+		return gridPhase(gridPhasePowerOut, phase), true
+	case 10:
+		return gridPhase(gridPhaseCurrent, phase), true
+	case 11:
+		return gridPhase(gridPhaseVoltage, phase), true
+	case 12:
+		return gridPhase(gridPhasePowerFactor, phase), true
+	}
+	return 0, false
+}
+
+// gridValues are the latest readings of a meter in W, Wh, A, V and Hz.
+type gridValues map[gridQuantity]float64
+
+func (g gridValues) get(q gridQuantity) (float64, bool) {
+	v, ok := g[q]
+	return v, ok
+}
+
+// signed returns a signed quantity, or the difference of the quantities
+// for each direction when the meter reports those instead.
+func (g gridValues) signed(q, in, out gridQuantity) (float64, bool) {
+	if v, ok := g[q]; ok {
+		return v, true
+	}
+	vin, okIn := g[in]
+	vout, okOut := g[out]
+	return vin - vout, okIn || okOut
+}
+
+// power is the power drawn from the grid, negative when feeding in. Meters
+// that only report the phases get their sum.
+func (g gridValues) power() (float64, bool) {
+	if p, ok := g.signed(gridPower, gridPowerIn, gridPowerOut); ok {
+		return p, true
+	}
+	var sum float64
+	found := false
+	for phase := 0; phase < 3; phase++ {
+		if p, ok := g.phasePower(phase); ok {
+			sum += p
+			found = true
+		}
+	}
+	return sum, found
+}
+
+func (g gridValues) phasePower(phase int) (float64, bool) {
+	return g.signed(gridPhase(gridPhasePower, phase), gridPhase(gridPhasePowerIn, phase), gridPhase(gridPhasePowerOut, phase))
+}
+
+// gridValuesOf picks the grid values from the state of a meter, by the
+// OBIS names the meter reports.
+func gridValuesOf(values map[string]MeterValue) gridValues {
+	g := make(gridValues)
+	for _, v := range values {
+		var obis [6]byte
+		if _, err := fmt.Sscanf(v.OBIS, "%d-%d:%d.%d.%d*%d", &obis[0], &obis[1], &obis[2], &obis[3], &obis[4], &obis[5]); err != nil {
+			continue
+		}
+		q, ok := gridQuantityFor(obis[:])
+		if !ok || math.IsNaN(v.Value) || math.IsInf(v.Value, 0) {
+			continue
+		}
+		g[q] = v.Value * gridUnitScale(v.Unit)
+	}
+	return g
+}
+
+// gridUnitScale converts kW and kWh readings to W and Wh.
+func gridUnitScale(unit string) float64 {
+	if strings.HasPrefix(unit, "k") {
+		return 1000
+	}
+	return 1
+}
+
+// gridMeter keeps the latest grid values of a meter for an emulation.
+type gridMeter struct {
+	mu         sync.Mutex
+	quantities map[string]gridQuantity // value name -> quantity
+	values     gridValues
+	updated    time.Time
+	online     bool
+}
+
+func newGridMeter() *gridMeter {
+	return &gridMeter{quantities: make(map[string]gridQuantity), values: make(gridValues)}
+}
+
+func (m *gridMeter) Open(meter MeterConfig) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, v := range meter.Values {
+		if obis, err := v.OBISBytes(); err == nil {
+			if q, ok := gridQuantityFor(obis); ok {
+				m.quantities[v.Name] = q
+			}
+		}
+	}
+}
+
+func (m *gridMeter) Write(_ string, readings []Reading) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, r := range readings {
+		q, ok := m.quantities[r.Name]
+		if !ok || r.Quality != QualityGood || math.IsNaN(r.Value) || math.IsInf(r.Value, 0) {
+			continue
+		}
+		m.values[q] = r.Value * gridUnitScale(r.Unit)
+		m.updated = r.Time
+	}
+}
+
+func (m *gridMeter) Status(_ string, status MeterStatus) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.online = status.Online
+}
+
+func (m *gridMeter) Diagnostics(string, diagnosticsPayload) {}
+
+// snapshot returns a copy of the values, or false while the meter is
+// offline or has not delivered any yet.
+func (m *gridMeter) snapshot() (gridValues, time.Time, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if !m.online || len(m.values) == 0 {
+		return nil, time.Time{}, false
+	}
+	values := make(gridValues, len(m.values))
+	for q, v := range m.values {
+		values[q] = v
+	}
+	return values, m.updated, true
+}
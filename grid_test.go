@@ -0,0 +1,139 @@
+package main
+
+import (
+	"math"
+	"testing"
+	"time"
+)
+
+// ---------------------------------------------------------------------------
+// OBIS mapping
+// ---------------------------------------------------------------------------
+
+func TestGridQuantityFor(t *testing.T) {
+	tests := []struct {
+		obis string
+		want gridQuantity
+		ok   bool
+	}{
+		{"1.0.16.7.0", gridPower, true},
+		{"1.0.1.7.0", gridPowerIn, true},
+		{"1.0.2.7.0", gridPowerOut, true},
+		{"1.0.1.8.0", gridImport, true},
+		{"1.0.2.8.0", gridExport, true},
+		{"1.0.14.7.0", gridFrequency, true},
+		{"1.0.13.7.0", gridPowerFactor, true},
+		{"1.0.36.7.0", gridPhase(gridPhasePower, 0), true},
+		{"1.0.56.7.0", gridPhase(gridPhasePower, 1), true},
+		{"1.0.76.7.0", gridPhase(gridPhasePower, 2), true},
+		{"1.0.21.7.0", gridPhase(gridPhasePowerIn, 0), true},
+		{"1.0.62.7.0", gridPhase(gridPhasePowerOut, 2), true},
+		{"1.0.31.7.0", gridPhase(gridPhaseCurrent, 0), true},
+		{"1.0.51.7.0", gridPhase(gridPhaseCurrent, 1), true},
+		{"1.0.72.7.0", gridPhase(gridPhaseVoltage, 2), true},
+		{"1.0.33.7.0", gridPhase(gridPhasePowerFactor, 0), true},
+		// tariff registers, other groups and unknown codes
+		{"1.0.1.8.1", 0, false},
+		{"1.0.16.8.0", 0, false},
+		{"1.0.96.1.0", 0, false},
+		{"1.0.37.7.0", 0, false},
+		{"1.0.77.7.0", 0, false},
+		{"1.0.1.8", 0, false},
+	}
+	for _, tt := range tests {
+		obis, err := ValueConfig{OBIS: tt.obis}.OBISBytes()
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, ok := gridQuantityFor(obis)
+		if ok != tt.ok || (ok && got != tt.want) {
+			t.Errorf("gridQuantityFor(%s) = %d, %v; want %d, %v", tt.obis, got, ok, tt.want, tt.ok)
+		}
+	}
+}
+
+func TestGridValuesOf(t *testing.T) {
+	g := gridValuesOf(map[string]MeterValue{
+		"Bezug":    {Value: 8782.4, Unit: "kWh", OBIS: "1-0:1.8.0*255"},
+		"Leistung": {Value: 246, Unit: "W", OBIS: "1-0:16.7.0*255"},
+		"Tarif 1":  {Value: 1, Unit: "kWh", OBIS: "1-0:1.8.1*255"},
+		"Kaputt":   {Value: math.NaN(), Unit: "W", OBIS: "1-0:2.7.0*255"},
+		"Seriell":  {OBIS: "not obis"},
+	})
+	if len(g) != 2 || g[gridImport] != 8782400 || g[gridPower] != 246 {
+		t.Fatalf("unexpected grid values %v", g)
+	}
+}
+
+// ---------------------------------------------------------------------------
+// Signs and units
+// ---------------------------------------------------------------------------
+
+func TestGridValues_Power(t *testing.T) {
+	l1 := gridPhase(gridPhasePower, 0)
+	tests := []struct {
+		name   string
+		values gridValues
+		want   float64
+		ok     bool
+	}{
+		{"signed", gridValues{gridPower: -1200, gridPowerIn: 500}, -1200, true},
+		{"import", gridValues{gridPowerIn: 500}, 500, true},
+		{"export", gridValues{gridPowerOut: 800}, -800, true},
+		{"both directions", gridValues{gridPowerIn: 500, gridPowerOut: 800}, -300, true},
+		{"phases", gridValues{l1: 100, gridPhase(gridPhasePower, 2): 50}, 150, true},
+		{"phase directions", gridValues{gridPhase(gridPhasePowerOut, 1): 400, l1: 100}, -300, true},
+		{"none", gridValues{gridImport: 1000}, 0, false},
+	}
+	for _, tt := range tests {
+		got, ok := tt.values.power()
+		if got != tt.want || ok != tt.ok {
+			t.Errorf("%s: power() = %v, %v; want %v, %v", tt.name, got, ok, tt.want, tt.ok)
+		}
+	}
+}
+
+func TestGridUnitScale(t *testing.T) {
+	tests := []struct {
+		unit string
+		want float64
+	}{
+		{"W", 1},
+		{"Wh", 1},
+		{"kW", 1000},
+		{"kWh", 1000},
+		{"V", 1},
+		{"", 1},
+	}
+	for _, tt := range tests {
+		if got := gridUnitScale(tt.unit); got != tt.want {
+			t.Errorf("gridUnitScale(%q) = %v, want %v", tt.unit, got, tt.want)
+		}
+	}
+}
+
+// ---------------------------------------------------------------------------
+// gridMeter
+// ---------------------------------------------------------------------------
+
+func TestGridMeter_Snapshot(t *testing.T) {
+	m := newGridMeter()
+	m.Open(MeterConfig{Name: "nutzstrom", Values: []ValueConfig{
+		{Name: "Bezug", OBIS: "1.0.1.8.0", Unit: "kWh"},
+		{Name: "Leistung", OBIS: "1.0.16.7.0", Unit: "W"},
+	}})
+	at := time.Date(2026, 3, 1, 12, 0, 0, 0, time.UTC)
+	m.Write("nutzstrom", []Reading{
+		{Name: "Bezug", Value: 8782.4, Unit: "kWh", Time: at, Quality: QualityGood},
+		{Name: "Leistung", Value: 246, Unit: "W", Time: at, Quality: QualityInvalid},
+	})
+	if _, _, ok := m.snapshot(); ok {
+		t.Fatal("snapshot of an offline meter")
+	}
+
+	m.Status("nutzstrom", MeterStatus{Online: true})
+	g, updated, ok := m.snapshot()
+	if !ok || !updated.Equal(at) || len(g) != 1 || g[gridImport] != 8782400 {
+		t.Fatalf("snapshot = %v, %v, %v", g, updated, ok)
+	}
+}
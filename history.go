@@ -0,0 +1,601 @@
+package main
+
+import (
+	"encoding/binary"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log"
+	"math"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// historySweepInterval is how often expired segments are removed.
+	historySweepInterval = time.Hour
+
+	// historyMaxPoints bounds the points of one query.
+	historyMaxPoints = 100000
+
+	historyRawRecord = 16 // time, value
+	historyAggRecord = 40 // time, count, sum, min, max
+)
+
+// HistoryConfig configures the history output.
+type HistoryConfig struct {
+	// Dir holds one directory per meter and value.
+	Dir string `yaml:"dir"`
+	// Tiers are the resolutions kept, from fine to coarse.
+	Tiers []HistoryTier `yaml:"tiers"`
+	// FlushInterval is how often readings are written to disk.
+	FlushInterval time.Duration `yaml:"flush_interval"`
+}
+
+// HistoryTier keeps readings at one resolution.
+type HistoryTier struct {
+	// Step is the resolution; 0 keeps every reading.
+	Step time.Duration `yaml:"step"`
+	// Retention is how long data is kept; 0 keeps it forever.
+	Retention time.Duration `yaml:"retention"`
+}
+
+// defaultHistoryTiers keep raw readings for 7 days, minutes for 90 days and
+// quarter hours forever.
+var defaultHistoryTiers = []HistoryTier{
+	{Step: 0, Retention: 7 * 24 * time.Hour},
+	{Step: time.Minute, Retention: 90 * 24 * time.Hour},
+	{Step: 15 * time.Minute},
+}
+
+func (c HistoryConfig) dir() string {
+	if c.Dir == "" {
+		return "/var/lib/zaehler2mqtt/history"
+	}
+	return c.Dir
+}
+
+func (c HistoryConfig) tiers() []HistoryTier {
+	if len(c.Tiers) == 0 {
+		return defaultHistoryTiers
+	}
+	return c.Tiers
+}
+
+func (c HistoryConfig) flushInterval() time.Duration {
+	if c.FlushInterval == 0 {
+		return time.Minute
+	}
+	return c.FlushInterval
+}
+
+func (c HistoryConfig) validate() error {
+	if c.FlushInterval < 0 {
+		return fmt.Errorf("history flush_interval must not be negative")
+	}
+	for i, t := range c.Tiers {
+		switch {
+		case t.Retention < 0:
+			return fmt.Errorf("history tier %d: retention must not be negative", i)
+		case t.Step == 0 && i > 0:
+			return fmt.Errorf("history tier %d: only the first tier may keep raw readings", i)
+		case t.Step != 0 && t.Step < time.Second:
+			return fmt.Errorf("history tier %d: step must be at least 1s", i)
+		case i > 0 && t.Step <= c.Tiers[i-1].Step:
+			return fmt.Errorf("history tier %d: steps must increase", i)
+		}
+	}
+	return nil
+}
+
+// tierName names the directory of a tier.
+func tierName(t HistoryTier) string {
+	if t.Step == 0 {
+		return "raw"
+	}
+	return fmt.Sprintf("%ds", int64(t.Step/time.Second))
+}
+
+// Segments hold a day of data, or a month for tiers of 15 minutes and more.
+// Expired data is removed a segment at a time.
+func segmentLayout(t HistoryTier) string {
+	if t.Step >= 15*time.Minute {
+		return "2006-01"
+	}
+	return "2006-01-02"
+}
+
+func segmentEnd(t HistoryTier, start time.Time) time.Time {
+	if t.Step >= 15*time.Minute {
+		return start.AddDate(0, 1, 0)
+	}
+	return start.AddDate(0, 0, 1)
+}
+
+// historyPoint is a reading, or the aggregate of the readings of one step.
+type historyPoint struct {
+	Time  time.Time
+	Count float64
+	Sum   float64
+	Min   float64
+	Max   float64
+}
+
+func (p *historyPoint) add(o historyPoint) {
+	if p.Count == 0 {
+		*p = historyPoint{Time: p.Time, Min: o.Min, Max: o.Max}
+	}
+	p.Count += o.Count
+	p.Sum += o.Sum
+	p.Min = math.Min(p.Min, o.Min)
+	p.Max = math.Max(p.Max, o.Max)
+}
+
+func encodePoint(t HistoryTier, p historyPoint) []byte {
+	ms := uint64(p.Time.UnixMilli())
+	if t.Step == 0 {
+		b := make([]byte, 0, historyRawRecord)
+		b = binary.LittleEndian.AppendUint64(b, ms)
+		return binary.LittleEndian.AppendUint64(b, math.Float64bits(p.Sum))
+	}
+	b := make([]byte, 0, historyAggRecord)
+	b = binary.LittleEndian.AppendUint64(b, ms)
+	for _, f := range []float64{p.Count, p.Sum, p.Min, p.Max} {
+		b = binary.LittleEndian.AppendUint64(b, math.Float64bits(f))
+	}
+	return b
+}
+
+func decodePoints(t HistoryTier, data []byte) []historyPoint {
+	size := historyAggRecord
+	if t.Step == 0 {
+		size = historyRawRecord
+	}
+	f := func(b []byte, i int) float64 { return math.Float64frombits(binary.LittleEndian.Uint64(b[8*i:])) }
+	points := make([]historyPoint, 0, len(data)/size)
+	// a partial record at the end is left over from a crash and ignored
+	for ; len(data) >= size; data = data[size:] {
+		p := historyPoint{Time: time.UnixMilli(int64(binary.LittleEndian.Uint64(data)))}
+		if t.Step == 0 {
+			v := f(data, 1)
+			p.Count, p.Sum, p.Min, p.Max = 1, v, v, v
+		} else {
+			p.Count, p.Sum, p.Min, p.Max = f(data, 1), f(data, 2), f(data, 3), f(data, 4)
+		}
+		points = append(points, p)
+	}
+	return points
+}
+
+// historySeries is what is kept in memory for one value.
+type historySeries struct {
+	dir  string
+	unit string
+	// buckets are the open aggregates, one per tier with a step.
+	buckets []historyPoint
+}
+
+// historyStore keeps the readings in segment files, one directory per
+// value and tier. Readings are collected in memory and appended every
+// flush interval to spare SD cards.
+type historyStore struct {
+	cfg   HistoryConfig
+	tiers []HistoryTier
+	srv   *Server
+	stop  chan struct{}
+	done  chan struct{}
+
+	// files is held for writing while segment files change and for reading
+	// while a query reads them. It is taken before mu, which only guards
+	// memory, so that readings are not held up by the disk.
+	files   sync.RWMutex
+	mu      sync.Mutex
+	series  map[string]*historySeries // meter + "/" + value
+	pending map[string][]byte         // segment file -> records
+	// lastSweep is only used by run.
+	lastSweep time.Time
+}
+
+func newHistoryStore(cfg HistoryConfig, srv *Server) (*historyStore, error) {
+	if err := os.MkdirAll(cfg.dir(), 0755); err != nil {
+		return nil, err
+	}
+	h := &historyStore{
+		cfg:     cfg,
+		tiers:   cfg.tiers(),
+		srv:     srv,
+		stop:    make(chan struct{}),
+		done:    make(chan struct{}),
+		series:  make(map[string]*historySeries),
+		pending: make(map[string][]byte),
+	}
+	go h.run()
+	if srv != nil {
+		srv.SetHistory(h)
+	}
+	return h, nil
+}
+
+func seriesKey(meter, value string) string {
+	return meter + "/" + value
+}
+
+func (h *historyStore) Open(meter MeterConfig) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for _, v := range meter.Values {
+		h.seriesLocked(meter.Name, v.Name).unit = v.Unit
+	}
+}
+
+// seriesLocked returns the series of a value. h.mu must be held.
+func (h *historyStore) seriesLocked(meter, value string) *historySeries {
+	key := seriesKey(meter, value)
+	s, ok := h.series[key]
+	if !ok {
+		s = &historySeries{
+			dir:     filepath.Join(h.cfg.dir(), url.PathEscape(meter), url.PathEscape(value)),
+			buckets: make([]historyPoint, len(h.tiers)),
+		}
+		h.series[key] = s
+	}
+	return s
+}
+
+func (h *historyStore) Write(meter string, readings []Reading) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for _, r := range readings {
+		if r.Quality != QualityGood || math.IsNaN(r.Value) || math.IsInf(r.Value, 0) {
+			continue
+		}
+		s := h.seriesLocked(meter, r.Name)
+		p := historyPoint{Time: r.Time, Count: 1, Sum: r.Value, Min: r.Value, Max: r.Value}
+		for i, t := range h.tiers {
+			if t.Step == 0 {
+				h.appendLocked(s, t, p)
+				continue
+			}
+			start := r.Time.Truncate(t.Step)
+			b := &s.buckets[i]
+			if b.Count > 0 && !b.Time.Equal(start) {
+				h.appendLocked(s, t, *b)
+				*b = historyPoint{}
+			}
+			b.Time = start
+			b.add(p)
+		}
+	}
+}
+
+// appendLocked queues a record for its segment file. h.mu must be held.
+func (h *historyStore) appendLocked(s *historySeries, t HistoryTier, p historyPoint) {
+	path := filepath.Join(s.dir, tierName(t), p.Time.UTC().Format(segmentLayout(t))+".dat")
+	h.pending[path] = append(h.pending[path], encodePoint(t, p)...)
+}
+
+func (h *historyStore) Status(string, MeterStatus)             {}
+func (h *historyStore) Diagnostics(string, diagnosticsPayload) {}
+
+func (h *historyStore) run() {
+	defer close(h.done)
+	ticker := time.NewTicker(h.cfg.flushInterval())
+	defer ticker.Stop()
+	for {
+		select {
+		case <-h.stop:
+			return
+		case <-ticker.C:
+			h.flush()
+			if time.Since(h.lastSweep) >= historySweepInterval {
+				h.lastSweep = time.Now()
+				h.sweep(h.lastSweep)
+			}
+		}
+	}
+}
+
+// flush appends the queued records to their files. The queue is taken out
+// under h.mu, and queries wait for the files, so they never miss records
+// that are on their way to disk. Records that cannot be written are queued
+// again ahead of newer ones.
+func (h *historyStore) flush() {
+	h.files.Lock()
+	defer h.files.Unlock()
+	h.mu.Lock()
+	pending := h.pending
+	h.pending = make(map[string][]byte)
+	h.mu.Unlock()
+
+	for path, data := range pending {
+		if err := appendFile(path, data); err != nil {
+			log.Printf("[history] Failed to write %s: %v", path, err)
+			h.mu.Lock()
+			h.pending[path] = append(data, h.pending[path]...)
+			h.mu.Unlock()
+		}
+	}
+}
+
+func appendFile(path string, data []byte) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(data)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// sweep removes the segments that lie entirely before the retention of their
+// tier.
+func (h *historyStore) sweep(now time.Time) {
+	h.files.Lock()
+	defer h.files.Unlock()
+	for _, t := range h.tiers {
+		if t.Retention == 0 {
+			continue
+		}
+		files, _ := filepath.Glob(filepath.Join(h.cfg.dir(), "*", "*", tierName(t), "*.dat"))
+		for _, path := range files {
+			start, err := time.Parse(segmentLayout(t), strings.TrimSuffix(filepath.Base(path), ".dat"))
+			if err != nil || segmentEnd(t, start).After(now.Add(-t.Retention)) {
+				continue
+			}
+			if err := os.Remove(path); err != nil {
+				log.Printf("[history] Failed to remove %s: %v", path, err)
+			}
+		}
+	}
+}
+
+// Close writes the open aggregates and everything queued. Aggregates of a
+// step that continues after a restart are merged when read.
+func (h *historyStore) Close() error {
+	if h.srv != nil {
+		h.srv.SetHistory(nil)
+	}
+	close(h.stop)
+	<-h.done
+	h.mu.Lock()
+	for _, s := range h.series {
+		for i, t := range h.tiers {
+			if s.buckets[i].Count > 0 {
+				h.appendLocked(s, t, s.buckets[i])
+				s.buckets[i] = historyPoint{}
+			}
+		}
+	}
+	h.mu.Unlock()
+	h.flush()
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if len(h.pending) > 0 {
+		return fmt.Errorf("history: %d segment files could not be written", len(h.pending))
+	}
+	return nil
+}
+
+// tierFor picks, among the tiers that still hold data from `from`, the
+// coarsest one that is no coarser than step, or else the finest one. The
+// last tier is used if none reaches back far enough.
+func (h *historyStore) tierFor(from time.Time, step time.Duration, now time.Time) int {
+	best := -1
+	for i, t := range h.tiers {
+		if t.Retention != 0 && from.Before(now.Add(-t.Retention)) {
+			continue
+		}
+		if best < 0 || t.Step <= step {
+			best = i
+		}
+	}
+	if best < 0 {
+		return len(h.tiers) - 1
+	}
+	return best
+}
+
+// Query returns the points of a value between from and to. With a step
+// larger than the resolution of the tier, points are aggregated per step.
+func (h *historyStore) Query(meter, value string, from, to time.Time, step time.Duration) (HistoryTier, []historyPoint, error) {
+	// records are kept in milliseconds
+	from = from.Truncate(time.Millisecond)
+	i := h.tierFor(from, step, time.Now())
+	t := h.tiers[i]
+
+	// Records not flushed yet are read from memory, and the step still
+	// being aggregated is included as far as it goes
+	var points []historyPoint
+	h.files.RLock()
+	defer h.files.RUnlock()
+	dir := filepath.Join(h.cfg.dir(), url.PathEscape(meter), url.PathEscape(value), tierName(t))
+	files, _ := filepath.Glob(filepath.Join(dir, "*.dat"))
+	h.mu.Lock()
+	unflushed := make(map[string][]byte)
+	for path, data := range h.pending {
+		if filepath.Dir(path) == dir {
+			unflushed[path] = slices.Clone(data)
+			if !slices.Contains(files, path) {
+				files = append(files, path)
+			}
+		}
+	}
+	if s, ok := h.series[seriesKey(meter, value)]; ok && s.buckets[i].Count > 0 {
+		if p := s.buckets[i]; !p.Time.Before(from) && !p.Time.After(to) {
+			points = append(points, p)
+		}
+	}
+	h.mu.Unlock()
+
+	for _, path := range files {
+		start, err := time.Parse(segmentLayout(t), strings.TrimSuffix(filepath.Base(path), ".dat"))
+		if err != nil || !segmentEnd(t, start).After(from) || start.After(to) {
+			continue
+		}
+		data, err := os.ReadFile(path)
+		if err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return t, nil, err
+		}
+		data = append(data, unflushed[path]...)
+		for _, p := range decodePoints(t, data) {
+			if !p.Time.Before(from) && !p.Time.After(to) {
+				points = append(points, p)
+			}
+		}
+	}
+	slices.SortStableFunc(points, func(a, b historyPoint) int { return a.Time.Compare(b.Time) })
+
+	// Merge aggregates written twice across a restart, and resample
+	bucket := t.Step
+	if step > bucket {
+		bucket = step
+	}
+	if bucket > 0 {
+		var merged []historyPoint
+		for _, p := range points {
+			start := p.Time.Truncate(bucket)
+			if n := len(merged); n > 0 && merged[n-1].Time.Equal(start) {
+				merged[n-1].add(p)
+				continue
+			}
+			p.Time = start
+			merged = append(merged, p)
+		}
+		points = merged
+	}
+	if len(points) > historyMaxPoints {
+		return t, nil, fmt.Errorf("%d points, use a larger step", len(points))
+	}
+	return t, points, nil
+}
+
+func (h *historyStore) unit(meter, value string) string {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if s, ok := h.series[seriesKey(meter, value)]; ok {
+		return s.unit
+	}
+	return ""
+}
+
+// parseHistoryTime accepts RFC 3339 times and Unix seconds.
+func parseHistoryTime(s string, def time.Time) (time.Time, error) {
+	if s == "" {
+		return def, nil
+	}
+	if secs, err := strconv.ParseInt(s, 10, 64); err == nil {
+		return time.Unix(secs, 0), nil
+	}
+	return time.Parse(time.RFC3339, s)
+}
+
+type historyResponse struct {
+	Meter  string              `json:"meter"`
+	Value  string              `json:"value"`
+	Unit   string              `json:"unit,omitempty"`
+	Step   string              `json:"step"`
+	Points []historyPointValue `json:"points"`
+}
+
+type historyPointValue struct {
+	Time  time.Time `json:"time"`
+	Value float64   `json:"value"`
+	Min   float64   `json:"min"`
+	Max   float64   `json:"max"`
+}
+
+// ServeHTTP answers /api/history?meter=&value=&from=&to=&step=. Values are
+// the mean of each step. format=csv, or asking for text/csv, returns CSV.
+func (h *historyStore) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	meter, value := q.Get("meter"), q.Get("value")
+	if meter == "" || value == "" {
+		http.Error(w, "meter and value are required", http.StatusBadRequest)
+		return
+	}
+	now := time.Now()
+	to, err := parseHistoryTime(q.Get("to"), now)
+	if err != nil {
+		http.Error(w, "invalid to: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	from, err := parseHistoryTime(q.Get("from"), to.Add(-24*time.Hour))
+	if err != nil {
+		http.Error(w, "invalid from: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	var step time.Duration
+	if s := q.Get("step"); s != "" {
+		if step, err = time.ParseDuration(s); err != nil || step < 0 {
+			http.Error(w, "invalid step", http.StatusBadRequest)
+			return
+		}
+	}
+
+	tier, points, err := h.Query(meter, value, from, to, step)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	step = max(step, tier.Step)
+
+	if q.Get("format") == "csv" || strings.Contains(r.Header.Get("Accept"), "text/csv") {
+		w.Header().Set("Content-Type", "text/csv; charset=utf-8")
+		cw := csv.NewWriter(w)
+		cw.Write([]string{"time", "value", "min", "max"})
+		for _, p := range points {
+			cw.Write([]string{
+				p.Time.UTC().Format(time.RFC3339),
+				strconv.FormatFloat(p.Sum/p.Count, 'f', -1, 64),
+				strconv.FormatFloat(p.Min, 'f', -1, 64),
+				strconv.FormatFloat(p.Max, 'f', -1, 64),
+			})
+		}
+		cw.Flush()
+		return
+	}
+
+	resp := historyResponse{Meter: meter, Value: value, Unit: h.unit(meter, value), Step: "raw",
+		Points: make([]historyPointValue, 0, len(points))}
+	if step > 0 {
+		resp.Step = step.String()
+	}
+	for _, p := range points {
+		resp.Points = append(resp.Points, historyPointValue{Time: p.Time.UTC(), Value: p.Sum / p.Count, Min: p.Min, Max: p.Max})
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
+
+// SetHistory serves /api/history from h, or disables it with nil.
+func (s *Server) SetHistory(h http.Handler) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.history = h
+}
+
+func (s *Server) handleHistory(w http.ResponseWriter, r *http.Request) {
+	s.mu.RLock()
+	h := s.history
+	s.mu.RUnlock()
+	if h == nil {
+		http.Error(w, "history output is not configured", http.StatusNotFound)
+		return
+	}
+	h.ServeHTTP(w, r)
+}
@@ -0,0 +1,231 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func newTestHistory(t *testing.T, tiers ...HistoryTier) (*historyStore, string) {
+	dir := t.TempDir()
+	h, err := newHistoryStore(HistoryConfig{Dir: dir, Tiers: tiers, FlushInterval: time.Hour}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	h.Open(sinkTestMeter)
+	return h, dir
+}
+
+// writePower writes a Leistung reading every 10 seconds from start.
+func writePower(h *historyStore, start time.Time, values ...float64) {
+	for i, v := range values {
+		h.Write("nutzstrom", []Reading{{Name: "Leistung", Value: v, Time: start.Add(time.Duration(i) * 10 * time.Second), Quality: QualityGood}})
+	}
+}
+
+// ---------------------------------------------------------------------------
+// Tiers
+// ---------------------------------------------------------------------------
+
+func TestHistory_Downsampling(t *testing.T) {
+	h, _ := newTestHistory(t)
+	start := time.Now().Truncate(time.Hour).Add(-time.Hour)
+	// two full minutes, and the start of a third
+	writePower(h, start, 100, 200, 300, 400, 500, 600, 10, 20, 30, 40, 50, 60, 1000)
+
+	_, raw, err := h.Query("nutzstrom", "Leistung", start, start.Add(time.Hour), 0)
+	if err != nil || len(raw) != 13 {
+		t.Fatalf("raw: %d points, %v", len(raw), err)
+	}
+
+	tier, minutes, _ := h.Query("nutzstrom", "Leistung", start, start.Add(time.Hour), time.Minute)
+	if tier.Step != time.Minute || len(minutes) != 3 {
+		t.Fatalf("minutes: tier %v, %d points", tier.Step, len(minutes))
+	}
+	m := minutes[0]
+	if !m.Time.Equal(start) || m.Sum/m.Count != 350 || m.Min != 100 || m.Max != 600 {
+		t.Fatalf("unexpected first minute %+v", m)
+	}
+
+	// a step above the tier resolution aggregates further; open steps are
+	// included
+	_, hours, _ := h.Query("nutzstrom", "Leistung", start, start.Add(time.Hour), time.Hour)
+	if len(hours) != 1 || hours[0].Count != 13 || hours[0].Max != 1000 || hours[0].Min != 10 {
+		t.Fatalf("unexpected hour %+v", hours)
+	}
+}
+
+func TestHistory_QueryDoesNotFlush(t *testing.T) {
+	h, dir := newTestHistory(t)
+	start := time.Now().Truncate(time.Hour).Add(-time.Hour)
+	writePower(h, start, 100, 200, 300)
+
+	_, points, err := h.Query("nutzstrom", "Leistung", start, start.Add(time.Hour), 0)
+	if err != nil || len(points) != 3 {
+		t.Fatalf("%d points, %v", len(points), err)
+	}
+	if files, _ := filepath.Glob(filepath.Join(dir, "*", "*", "*", "*.dat")); len(files) != 0 {
+		t.Fatalf("query wrote %v", files)
+	}
+
+	// once flushed, the points come from disk, and only once
+	h.flush()
+	_, points, err = h.Query("nutzstrom", "Leistung", start, start.Add(time.Hour), 0)
+	if err != nil || len(points) != 3 || points[2].Sum != 300 {
+		t.Fatalf("after flush: %+v, %v", points, err)
+	}
+}
+
+func TestHistory_WriteDuringFileIO(t *testing.T) {
+	h, _ := newTestHistory(t)
+	start := time.Now().Truncate(time.Hour).Add(-time.Hour)
+
+	// a flush or sweep holds the files while it works on the disk
+	h.files.Lock()
+	done := make(chan struct{})
+	go func() {
+		writePower(h, start, 100)
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("Write waited for the files")
+	}
+	h.files.Unlock()
+}
+
+func TestHistory_TierFor(t *testing.T) {
+	h, _ := newTestHistory(t)
+	now := time.Now()
+	tests := []struct {
+		ago  time.Duration
+		step time.Duration
+		want time.Duration
+	}{
+		{time.Hour, 0, 0},
+		{time.Hour, 5 * time.Minute, time.Minute},
+		{time.Hour, time.Hour, 15 * time.Minute},
+		{30 * 24 * time.Hour, 0, time.Minute},
+		{365 * 24 * time.Hour, time.Minute, 15 * time.Minute},
+	}
+	for _, tt := range tests {
+		if got := h.tiers[h.tierFor(now.Add(-tt.ago), tt.step, now)]; got.Step != tt.want {
+			t.Errorf("tierFor(-%v, %v) = %v, want %v", tt.ago, tt.step, got.Step, tt.want)
+		}
+	}
+}
+
+// ---------------------------------------------------------------------------
+// Persistence
+// ---------------------------------------------------------------------------
+
+func TestHistory_RestartMergesSteps(t *testing.T) {
+	tiers := []HistoryTier{{Step: time.Minute}}
+	h, dir := newTestHistory(t, tiers...)
+	start := time.Now().Truncate(time.Minute).Add(-time.Hour)
+	writePower(h, start, 100, 200)
+	if err := h.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// the same minute continues after the restart
+	h, err := newHistoryStore(HistoryConfig{Dir: dir, Tiers: tiers, FlushInterval: time.Hour}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	writePower(h, start.Add(20*time.Second), 600)
+	h.Close()
+
+	_, points, _ := h.Query("nutzstrom", "Leistung", start, start.Add(time.Hour), 0)
+	if len(points) != 1 || points[0].Count != 3 || points[0].Sum/points[0].Count != 300 {
+		t.Fatalf("expected one merged minute, got %+v", points)
+	}
+}
+
+func TestHistory_Retention(t *testing.T) {
+	h, dir := newTestHistory(t, HistoryTier{Retention: 48 * time.Hour})
+	now := time.Now()
+	writePower(h, now.Add(-5*24*time.Hour), 1)
+	writePower(h, now.Add(-time.Hour), 2)
+	h.Close()
+
+	h.sweep(now)
+	files, _ := filepath.Glob(filepath.Join(dir, "nutzstrom", "Leistung", "raw", "*.dat"))
+	if len(files) != 1 || !strings.HasPrefix(filepath.Base(files[0]), now.Add(-time.Hour).UTC().Format("2006-01-02")) {
+		t.Fatalf("expected only the recent segment, got %v", files)
+	}
+}
+
+func TestHistory_PartialRecord(t *testing.T) {
+	h, dir := newTestHistory(t, HistoryTier{})
+	start := time.Now().Add(-time.Minute)
+	writePower(h, start, 1, 2)
+	h.Close()
+
+	// a crash in the middle of a write leaves a partial record behind
+	files, _ := filepath.Glob(filepath.Join(dir, "nutzstrom", "Leistung", "raw", "*.dat"))
+	f, _ := os.OpenFile(files[0], os.O_APPEND|os.O_WRONLY, 0)
+	f.Write([]byte{1, 2, 3})
+	f.Close()
+
+	_, points, err := h.Query("nutzstrom", "Leistung", start, time.Now(), 0)
+	if err != nil || len(points) != 2 {
+		t.Fatalf("got %d points, %v", len(points), err)
+	}
+}
+
+// ---------------------------------------------------------------------------
+// API
+// ---------------------------------------------------------------------------
+
+func TestServer_History(t *testing.T) {
+	srv := NewServer(":0")
+	get := func(query string) *httptest.ResponseRecorder {
+		rr := httptest.NewRecorder()
+		srv.server.Handler.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/api/history?"+query, nil))
+		return rr
+	}
+	if rr := get("meter=nutzstrom&value=Leistung"); rr.Code != http.StatusNotFound {
+		t.Fatalf("without a history output: %d", rr.Code)
+	}
+
+	h, err := newHistoryStore(HistoryConfig{Dir: t.TempDir(), FlushInterval: time.Hour}, srv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer h.Close()
+	h.Open(sinkTestMeter)
+	start := time.Date(2026, 10, 19, 8, 0, 0, 0, time.UTC)
+	writePower(h, start, 100, 200, 300, 400, 500, 600, 700)
+
+	from := start.Format(time.RFC3339)
+	rr := get("meter=nutzstrom&value=Leistung&from=" + from + "&to=" + start.Add(time.Hour).Format(time.RFC3339))
+	var resp historyResponse
+	if err := json.Unmarshal(rr.Body.Bytes(), &resp); err != nil {
+		t.Fatalf("invalid JSON %q: %v", rr.Body.String(), err)
+	}
+	if resp.Unit != "W" || len(resp.Points) == 0 {
+		t.Fatalf("unexpected response %+v", resp)
+	}
+
+	rr = get("meter=nutzstrom&value=Leistung&step=1m&format=csv&from=" + from + "&to=" + start.Add(time.Hour).Format(time.RFC3339))
+	lines := strings.Split(strings.TrimSpace(rr.Body.String()), "\n")
+	if rr.Header().Get("Content-Type") != "text/csv; charset=utf-8" || lines[0] != "time,value,min,max" {
+		t.Fatalf("unexpected CSV response:\n%s", rr.Body.String())
+	}
+	if len(lines) != 3 || lines[1] != "2026-10-19T08:00:00Z,350,100,600" || lines[2] != "2026-10-19T08:01:00Z,700,700,700" {
+		t.Fatalf("unexpected CSV rows:\n%s", rr.Body.String())
+	}
+
+	for _, bad := range []string{"value=Leistung", "meter=nutzstrom&value=Leistung&from=gestern", "meter=nutzstrom&value=Leistung&step=-1m"} {
+		if rr := get(bad); rr.Code != http.StatusBadRequest {
+			t.Errorf("%s: status %d", bad, rr.Code)
+		}
+	}
+}
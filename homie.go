@@ -0,0 +1,309 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"hash/fnv"
+	"log"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// homieProperty is the single property of the Homie node of a value.
+const homieProperty = "value"
+
+// homieAlertOffline is the Homie 5 alert raised while a meter is offline.
+const homieAlertOffline = "offline"
+
+// homieNodeIDs returns the Homie node ID of each value, in order. Values whose
+// names are the same after sanitizing get a numeric suffix.
+func homieNodeIDs(values []ValueConfig) []string {
+	ids := make([]string, len(values))
+	seen := make(map[string]bool, len(values))
+	for i, v := range values {
+		base := sanitizeHomieID(v.Name)
+		if base == "" {
+			base = homieProperty
+		}
+		id := base
+		for n := 2; seen[id]; n++ {
+			id = fmt.Sprintf("%s-%d", base, n)
+		}
+		seen[id] = true
+		ids[i] = id
+	}
+	return ids
+}
+
+// homieNode returns the node topic of a value of a meter, or "" if the value
+// is unknown.
+func (p *Publisher) homieNode(meter MeterConfig, valueName string) string {
+	ids := homieNodeIDs(meter.Values)
+	for i, v := range meter.Values {
+		if v.Name == valueName {
+			return p.topics.HomieDevice(meter.Name) + "/" + ids[i]
+		}
+	}
+	return ""
+}
+
+// homieMessage is a retained Homie attribute or property message.
+func homieMessage(topic, payload string) outgoingMessage {
+	return outgoingMessage{
+		Topic:       topic,
+		QoS:         1,
+		Retain:      true,
+		Payload:     []byte(payload),
+		ContentType: "text/plain",
+	}
+}
+
+// homieAttributes returns the messages that describe a meter as a Homie
+// device, apart from its state.
+func (p *Publisher) homieAttributes(meter MeterConfig) []outgoingMessage {
+	device := p.topics.HomieDevice(meter.Name)
+	if p.topics.homie == 5 {
+		msg := homieMessage(device+"/$description", string(p.homieDescription(meter)))
+		msg.ContentType = "application/json"
+		return []outgoingMessage{msg}
+	}
+
+	ids := homieNodeIDs(meter.Values)
+	msgs := []outgoingMessage{
+		homieMessage(device+"/$homie", "4.0.0"),
+		homieMessage(device+"/$name", meter.Name),
+		homieMessage(device+"/$nodes", strings.Join(ids, ",")),
+		homieMessage(device+"/$extensions", ""),
+		homieMessage(device+"/$implementation", "zaehler2mqtt"),
+	}
+	for i, v := range meter.Values {
+		node := device + "/" + ids[i]
+		property := node + "/" + homieProperty
+		msgs = append(msgs,
+			homieMessage(node+"/$name", v.Name),
+			homieMessage(node+"/$type", v.OBIS),
+			homieMessage(node+"/$properties", homieProperty),
+			homieMessage(property+"/$name", v.Name),
+			homieMessage(property+"/$datatype", "float"),
+		)
+		if v.Unit != "" {
+			msgs = append(msgs, homieMessage(property+"/$unit", v.Unit))
+		}
+	}
+	return msgs
+}
+
+// homieDescription is the Homie 5 description document of a meter. Its
+// version is a hash of the content, so it changes whenever the values do.
+func (p *Publisher) homieDescription(meter MeterConfig) []byte {
+	type property struct {
+		Name     string `json:"name"`
+		Datatype string `json:"datatype"`
+		Unit     string `json:"unit,omitempty"`
+	}
+	type node struct {
+		Name       string              `json:"name"`
+		Type       string              `json:"type,omitempty"`
+		Properties map[string]property `json:"properties"`
+	}
+	desc := struct {
+		Homie   string          `json:"homie"`
+		Version uint32          `json:"version"`
+		Name    string          `json:"name"`
+		Nodes   map[string]node `json:"nodes"`
+	}{
+		Homie: "5.0",
+		Name:  meter.Name,
+		Nodes: make(map[string]node, len(meter.Values)),
+	}
+	ids := homieNodeIDs(meter.Values)
+	for i, v := range meter.Values {
+		desc.Nodes[ids[i]] = node{
+			Name: v.Name,
+			Type: v.OBIS,
+			Properties: map[string]property{
+				homieProperty: {Name: v.Name, Datatype: "float", Unit: v.Unit},
+			},
+		}
+	}
+	data, _ := json.Marshal(desc)
+	h := fnv.New32a()
+	h.Write(data)
+	desc.Version = h.Sum32()
+	data, _ = json.Marshal(desc)
+	return data
+}
+
+// homieStateMessages report whether a meter delivers data: Homie 4 devices
+// switch between ready and alert, Homie 5 devices stay ready and raise an
+// alert instead.
+func (p *Publisher) homieStateMessages(meterName string, online bool) []outgoingMessage {
+	device := p.topics.HomieDevice(meterName)
+	if p.topics.homie == 5 {
+		alert := homieMessage(device+"/$alert/"+homieAlertOffline, "")
+		if !online {
+			alert.Payload = []byte("The meter delivers no data")
+		}
+		return []outgoingMessage{homieMessage(device+"/$state", "ready"), alert}
+	}
+	state := "ready"
+	if !online {
+		state = "alert"
+	}
+	return []outgoingMessage{homieMessage(device+"/$state", state)}
+}
+
+// connectHomie opens the connection of a meter's Homie device. A connection
+// has only one Last Will, so every device gets its own to have the broker set
+// its $state to lost when zaehler2mqtt dies.
+func (p *Publisher) connectHomie(meterName string) {
+	p.mu.Lock()
+	_, ok := p.homieClients[meterName]
+	p.mu.Unlock()
+	if ok || p.dialHomie == nil {
+		return
+	}
+
+	// The device is announced by the caller after the first connect and
+	// again after every reconnect, as the broker may have sent the will.
+	ready := make(chan struct{})
+	defer close(ready)
+	var connected atomic.Bool
+	client, err := p.dialHomie(meterName, will{topic: p.topics.HomieDevice(meterName) + "/$state", payload: "lost"}, func() {
+		<-ready
+		if connected.Swap(true) {
+			p.publishHomieDevice(meterName)
+		}
+	})
+	if err != nil {
+		log.Printf("[%s] Failed to connect the Homie device, it is not set to lost on failure: %v", meterName, err)
+		return
+	}
+	p.mu.Lock()
+	p.homieClients[meterName] = client
+	p.mu.Unlock()
+}
+
+// disconnectHomieClient closes the connection of a meter's Homie device
+// without sending its will.
+func (p *Publisher) disconnectHomieClient(meterName string) {
+	p.mu.Lock()
+	client, ok := p.homieClients[meterName]
+	delete(p.homieClients, meterName)
+	p.mu.Unlock()
+	if ok {
+		client.Disconnect()
+	}
+}
+
+func (p *Publisher) publishHomie(meterName string, msgs []outgoingMessage) {
+	p.mu.Lock()
+	client, ok := p.homieClients[meterName]
+	p.mu.Unlock()
+	if !ok {
+		client = p.client
+	}
+	for _, msg := range msgs {
+		token := client.Publish(msg)
+		token.WaitTimeout(5 * time.Second)
+		if token.Error() != nil {
+			log.Printf("[%s] Failed to publish %s: %v", meterName, msg.Topic, token.Error())
+		}
+	}
+}
+
+// publishHomieDevice announces a meter as a Homie device. The device is in
+// the init state while its attributes change.
+func (p *Publisher) publishHomieDevice(meterName string) {
+	p.mu.Lock()
+	meter := p.meters[meterName]
+	online := p.availability[meterName]
+	p.mu.Unlock()
+
+	device := p.topics.HomieDevice(meterName)
+	msgs := []outgoingMessage{homieMessage(device+"/$state", "init")}
+	msgs = append(msgs, p.homieAttributes(meter)...)
+	msgs = append(msgs, p.homieStateMessages(meterName, online)...)
+	p.publishHomie(meterName, msgs)
+	log.Printf("Published Homie device: %s", device)
+}
+
+// homieEnabled reports whether a meter has been announced as a Homie device.
+func (p *Publisher) homieEnabled(meterName string) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.homie[meterName]
+}
+
+// homieValue returns the Homie property message of a state payload, or false
+// if the meter is not announced as a Homie device. p.mu must be held.
+func (p *Publisher) homieValue(meterName string, val ValueConfig, payload []byte) (outgoingMessage, bool) {
+	if !p.homie[meterName] {
+		return outgoingMessage{}, false
+	}
+	node := p.homieNode(p.meters[meterName], val.Name)
+	if node == "" {
+		return outgoingMessage{}, false
+	}
+	// Homie expects property values retained and at QoS 1, whatever the
+	// value's own settings
+	msg := homieMessage(node+"/"+homieProperty, string(payload))
+	msg.Expiry = p.expiry
+	return msg, true
+}
+
+// RemoveHomieDevice deletes the Homie device of a meter that was removed
+// from the config. The state goes first so controllers do not see a
+// half-removed device.
+func (p *Publisher) RemoveHomieDevice(meterName string) {
+	defer p.disconnectHomieClient(meterName)
+	p.mu.Lock()
+	meter, ok := p.meters[meterName]
+	announced := p.homie[meterName]
+	p.mu.Unlock()
+	if !ok || !announced {
+		return
+	}
+
+	device := p.topics.HomieDevice(meterName)
+	topics := []string{device + "/$state"}
+	for _, msg := range p.homieAttributes(meter) {
+		topics = append(topics, msg.Topic)
+	}
+	if p.topics.homie == 5 {
+		topics = append(topics, device+"/$alert/"+homieAlertOffline)
+	}
+	for _, v := range meter.Values {
+		topics = append(topics, p.homieNode(meter, v.Name)+"/"+homieProperty)
+	}
+	msgs := make([]outgoingMessage, len(topics))
+	for i, topic := range topics {
+		msgs[i] = outgoingMessage{Topic: topic, QoS: 1, Retain: true}
+	}
+	p.publishHomie(meterName, msgs)
+	log.Printf("Removed Homie device: %s", device)
+}
+
+// disconnectHomie marks every Homie device disconnected before a clean
+// shutdown and closes their connections.
+func (p *Publisher) disconnectHomie() {
+	p.mu.Lock()
+	var meters []string
+	for meterName := range p.homie {
+		meters = append(meters, meterName)
+	}
+	p.mu.Unlock()
+	for _, meterName := range meters {
+		p.publishHomie(meterName, []outgoingMessage{
+			homieMessage(p.topics.HomieDevice(meterName)+"/$state", "disconnected"),
+		})
+	}
+	p.mu.Lock()
+	clients := p.homieClients
+	p.homieClients = make(map[string]brokerClient)
+	p.mu.Unlock()
+	for _, client := range clients {
+		client.Disconnect()
+	}
+}
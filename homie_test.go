@@ -0,0 +1,283 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func newHomieTestPublisher(version int) (*Publisher, *fakeClient) {
+	p, client := newTestPublisher()
+	p.topics, _ = NewTopicLayout(MQTTConfig{Homie: version})
+	p.RegisterMeter(MeterConfig{Name: "nutzstrom", Values: []ValueConfig{
+		{Name: "Bezug", OBIS: "1.0.1.8.0", Unit: "Wh"},
+		{Name: "Wirkleistung L1", OBIS: "1.0.36.7.0", Unit: "W"},
+	}})
+	return p, client
+}
+
+// payload returns the last payload published to a topic, or "<none>".
+func (c *fakeClient) payload(topic string) string {
+	msgs := c.messages(topic)
+	if len(msgs) == 0 {
+		return "<none>"
+	}
+	return string(msgs[len(msgs)-1].Payload)
+}
+
+// ---------------------------------------------------------------------------
+// IDs
+// ---------------------------------------------------------------------------
+
+func TestSanitizeHomieID(t *testing.T) {
+	tests := map[string]string{
+		"zaehler2mqtt-nutzstrom": "zaehler2mqtt-nutzstrom",
+		"Wirkleistung L1":        "wirkleistung-l1",
+		"_Bezug/Tarif 1_":        "bezug-tarif-1",
+		"Zähler":                 "z-hler",
+	}
+	for in, want := range tests {
+		if got := sanitizeHomieID(in); got != want {
+			t.Errorf("sanitizeHomieID(%q) = %q, want %q", in, got, want)
+		}
+	}
+}
+
+func TestHomieNodeIDs_Unique(t *testing.T) {
+	ids := homieNodeIDs([]ValueConfig{{Name: "Bezug"}, {Name: "bezug"}, {Name: "BEZUG"}, {Name: "°"}})
+	want := []string{"bezug", "bezug-2", "bezug-3", "value"}
+	for i := range want {
+		if ids[i] != want[i] {
+			t.Fatalf("homieNodeIDs = %v, want %v", ids, want)
+		}
+	}
+}
+
+func TestTopicLayout_HomieDevice(t *testing.T) {
+	l, _ := NewTopicLayout(MQTTConfig{Homie: 4})
+	if got := l.HomieDevice("Nutzstrom"); got != "homie/zaehler2mqtt-nutzstrom" {
+		t.Fatalf("Homie 4 device topic = %q", got)
+	}
+	l, _ = NewTopicLayout(MQTTConfig{Homie: 5, HomiePrefix: "devices/", BaseTopic: "keller"})
+	if got := l.HomieDevice("nutzstrom"); got != "devices/5/keller-nutzstrom" {
+		t.Fatalf("Homie 5 device topic = %q", got)
+	}
+}
+
+// ---------------------------------------------------------------------------
+// Homie 4
+// ---------------------------------------------------------------------------
+
+func TestPublishMeterDiscovery_Homie4(t *testing.T) {
+	p, client := newHomieTestPublisher(4)
+	p.PublishMeterDiscovery("nutzstrom")
+
+	device := "homie/zaehler2mqtt-nutzstrom"
+	want := map[string]string{
+		device + "/$homie":                          "4.0.0",
+		device + "/$name":                           "nutzstrom",
+		device + "/$nodes":                          "bezug,wirkleistung-l1",
+		device + "/bezug/$name":                     "Bezug",
+		device + "/bezug/$type":                     "1.0.1.8.0",
+		device + "/bezug/$properties":               "value",
+		device + "/bezug/value/$datatype":           "float",
+		device + "/bezug/value/$unit":               "Wh",
+		device + "/wirkleistung-l1/value/$name":     "Wirkleistung L1",
+		device + "/wirkleistung-l1/value/$unit":     "W",
+		device + "/wirkleistung-l1/value/$datatype": "float",
+	}
+	for topic, payload := range want {
+		if got := client.payload(topic); got != payload {
+			t.Errorf("%s = %q, want %q", topic, got, payload)
+		}
+	}
+
+	// init while the attributes are published, then the meter's state
+	states := client.messages(device + "/$state")
+	if len(states) != 2 || string(states[0].Payload) != "init" || string(states[1].Payload) != "alert" {
+		t.Fatalf("unexpected $state sequence: %+v", states)
+	}
+	for _, m := range client.published {
+		if !m.Retain || m.QoS != 1 {
+			t.Fatalf("Homie message %s should be retained with QoS 1", m.Topic)
+		}
+	}
+	// HA discovery is still published alongside
+	if n := len(client.messages("homeassistant/sensor/zaehler2mqtt_nutzstrom_Bezug/config")); n != 1 {
+		t.Fatalf("expected HA discovery alongside Homie, got %d", n)
+	}
+}
+
+func TestPublishState_Homie(t *testing.T) {
+	p, client := newHomieTestPublisher(4)
+	p.PublishMeterDiscovery("nutzstrom")
+	p.valueStates = false
+
+	p.PublishState("nutzstrom", p.meters["nutzstrom"].Values[1], 246)
+
+	msgs := client.messages("homie/zaehler2mqtt-nutzstrom/wirkleistung-l1/value")
+	if len(msgs) != 1 || string(msgs[0].Payload) != "246.0000" || !msgs[0].Retain {
+		t.Fatalf("unexpected Homie value: %+v", msgs)
+	}
+	if n := len(client.messages("zaehler2mqtt/nutzstrom/Wirkleistung_L1/state")); n != 0 {
+		t.Fatalf("per-value state should follow state_format, got %d", n)
+	}
+
+	client.reset()
+	p.Republish()
+	if got := client.payload("homie/zaehler2mqtt-nutzstrom/wirkleistung-l1/value"); got != "246.0000" {
+		t.Fatalf("Homie value not republished, got %q", got)
+	}
+}
+
+func TestPublishAvailability_Homie4(t *testing.T) {
+	p, client := newHomieTestPublisher(4)
+	p.PublishMeterDiscovery("nutzstrom")
+	client.reset()
+
+	p.PublishAvailability("nutzstrom", true)
+	p.PublishAvailability("nutzstrom", false)
+
+	states := client.messages("homie/zaehler2mqtt-nutzstrom/$state")
+	if len(states) != 2 || string(states[0].Payload) != "ready" || string(states[1].Payload) != "alert" {
+		t.Fatalf("unexpected $state sequence: %+v", states)
+	}
+}
+
+func TestClose_HomieDisconnected(t *testing.T) {
+	p, client := newHomieTestPublisher(4)
+	p.PublishMeterDiscovery("nutzstrom")
+	p.Close()
+
+	if got := client.payload("homie/zaehler2mqtt-nutzstrom/$state"); got != "disconnected" {
+		t.Fatalf("$state after Close = %q", got)
+	}
+}
+
+func TestHomieDevice_LastWill(t *testing.T) {
+	p, client := newHomieTestPublisher(4)
+	homieClient := &fakeClient{}
+	var gotWill will
+	var onConnect func()
+	p.dialHomie = func(meterName string, w will, connected func()) (brokerClient, error) {
+		gotWill, onConnect = w, connected
+		return homieClient, nil
+	}
+	p.PublishAvailability("nutzstrom", true)
+	p.PublishMeterDiscovery("nutzstrom")
+	onConnect()
+
+	if gotWill.topic != "homie/zaehler2mqtt-nutzstrom/$state" || gotWill.payload != "lost" {
+		t.Fatalf("will = %+v", gotWill)
+	}
+	if got := homieClient.payload("homie/zaehler2mqtt-nutzstrom/$state"); got != "ready" {
+		t.Fatalf("$state = %q", got)
+	}
+	if msgs := client.messages("homie/zaehler2mqtt-nutzstrom/$state"); len(msgs) != 0 {
+		t.Fatalf("device published on the main connection: %+v", msgs)
+	}
+
+	// The broker sent the will if the device connection was lost
+	homieClient.reset()
+	onConnect()
+	if got := homieClient.payload("homie/zaehler2mqtt-nutzstrom/$state"); got != "ready" {
+		t.Fatalf("$state after reconnect = %q", got)
+	}
+
+	p.RemoveHomieDevice("nutzstrom")
+	if len(p.homieClients) != 0 {
+		t.Fatal("device connection still open after removal")
+	}
+}
+
+func TestRemoveHomieDevice(t *testing.T) {
+	p, client := newHomieTestPublisher(4)
+	p.PublishMeterDiscovery("nutzstrom")
+	p.PublishState("nutzstrom", p.meters["nutzstrom"].Values[0], 1)
+	client.reset()
+
+	p.RemoveHomieDevice("nutzstrom")
+
+	if len(client.published) == 0 || client.published[0].Topic != "homie/zaehler2mqtt-nutzstrom/$state" {
+		t.Fatalf("$state should be cleared first, got %+v", client.published)
+	}
+	for _, topic := range []string{
+		"homie/zaehler2mqtt-nutzstrom/$nodes",
+		"homie/zaehler2mqtt-nutzstrom/bezug/$name",
+		"homie/zaehler2mqtt-nutzstrom/bezug/value",
+	} {
+		msgs := client.messages(topic)
+		if len(msgs) != 1 || len(msgs[0].Payload) != 0 || !msgs[0].Retain {
+			t.Errorf("%s not cleared: %+v", topic, msgs)
+		}
+	}
+}
+
+// ---------------------------------------------------------------------------
+// Homie 5
+// ---------------------------------------------------------------------------
+
+func TestPublishMeterDiscovery_Homie5(t *testing.T) {
+	p, client := newHomieTestPublisher(5)
+	p.PublishMeterDiscovery("nutzstrom")
+
+	device := "homie/5/zaehler2mqtt-nutzstrom"
+	msgs := client.messages(device + "/$description")
+	if len(msgs) != 1 {
+		t.Fatalf("expected one $description, got %d", len(msgs))
+	}
+	var desc struct {
+		Homie   string `json:"homie"`
+		Version uint32 `json:"version"`
+		Name    string `json:"name"`
+		Nodes   map[string]struct {
+			Name       string `json:"name"`
+			Properties map[string]struct {
+				Datatype string `json:"datatype"`
+				Unit     string `json:"unit"`
+			} `json:"properties"`
+		} `json:"nodes"`
+	}
+	if err := json.Unmarshal(msgs[0].Payload, &desc); err != nil {
+		t.Fatal(err)
+	}
+	if desc.Homie != "5.0" || desc.Name != "nutzstrom" || desc.Version == 0 {
+		t.Fatalf("unexpected description: %s", msgs[0].Payload)
+	}
+	prop := desc.Nodes["bezug"].Properties["value"]
+	if desc.Nodes["bezug"].Name != "Bezug" || prop.Datatype != "float" || prop.Unit != "Wh" {
+		t.Fatalf("unexpected node: %s", msgs[0].Payload)
+	}
+	if n := len(client.messages(device + "/$nodes")); n != 0 {
+		t.Fatal("Homie 5 devices have no $nodes attribute")
+	}
+
+	if got := client.payload(device + "/$state"); got != "ready" {
+		t.Fatalf("$state = %q", got)
+	}
+	if got := client.payload(device + "/$alert/offline"); got == "" || got == "<none>" {
+		t.Fatalf("expected offline alert before the first frame, got %q", got)
+	}
+	p.PublishAvailability("nutzstrom", true)
+	if got := client.payload(device + "/$alert/offline"); got != "" {
+		t.Fatalf("offline alert should be cleared, got %q", got)
+	}
+}
+
+func TestHomieDescription_VersionChanges(t *testing.T) {
+	p, _ := newHomieTestPublisher(5)
+	meter := p.meters["nutzstrom"]
+	before := p.homieDescription(meter)
+	if string(before) != string(p.homieDescription(meter)) {
+		t.Fatal("description should be stable")
+	}
+
+	var a, b struct {
+		Version uint32 `json:"version"`
+	}
+	json.Unmarshal(before, &a)
+	meter.Values = meter.Values[:1]
+	json.Unmarshal(p.homieDescription(meter), &b)
+	if a.Version == b.Version {
+		t.Fatal("version should change with the description")
+	}
+}
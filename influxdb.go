@@ -0,0 +1,249 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"fmt"
+	"math"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// influxDBTimeout bounds one write request.
+	influxDBTimeout = 30 * time.Second
+
+	// influxDBDatagramSize keeps UDP datagrams within a typical MTU.
+	influxDBDatagramSize = 1400
+)
+
+// InfluxDBConfig configures an influxdb output.
+type InfluxDBConfig struct {
+	// URL is the server, http(s)://host:8086, or udp://host:8089 for the
+	// UDP listener of InfluxDB 1.x.
+	URL string `yaml:"url"`
+	// Version selects the HTTP write API of InfluxDB 1.x or 2.x (the
+	// default).
+	Version int `yaml:"version"`
+
+	// InfluxDB 2.x
+	Org    string `yaml:"org"`
+	Bucket string `yaml:"bucket"`
+	Token  string `yaml:"token"`
+
+	// InfluxDB 1.x
+	Database        string `yaml:"database"`
+	RetentionPolicy string `yaml:"retention_policy"`
+	Username        string `yaml:"username"`
+	Password        string `yaml:"password"`
+
+	// Measurement is the measurement readings are written to.
+	Measurement string `yaml:"measurement"`
+	// Gzip compresses HTTP requests, the default.
+	Gzip *bool `yaml:"gzip"`
+
+	BatchConfig `yaml:",inline"`
+}
+
+func (c InfluxDBConfig) udp() bool {
+	return strings.HasPrefix(c.URL, "udp://")
+}
+
+func (c InfluxDBConfig) version() int {
+	if c.Version == 0 {
+		return 2
+	}
+	return c.Version
+}
+
+func (c InfluxDBConfig) measurement() string {
+	if c.Measurement == "" {
+		return "zaehler2mqtt"
+	}
+	return c.Measurement
+}
+
+func (c InfluxDBConfig) gzip() bool {
+	return c.Gzip == nil || *c.Gzip
+}
+
+func (c InfluxDBConfig) validate() error {
+	u, err := url.Parse(c.URL)
+	if err != nil || u.Host == "" {
+		return fmt.Errorf("influxdb url %q is invalid", c.URL)
+	}
+	switch u.Scheme {
+	case "http", "https":
+	case "udp":
+		return c.BatchConfig.validate()
+	default:
+		return fmt.Errorf("influxdb url %q: use http, https or udp", c.URL)
+	}
+	switch c.version() {
+	case 1:
+		if c.Database == "" {
+			return fmt.Errorf("influxdb version 1 needs a database")
+		}
+	case 2:
+		if c.Org == "" || c.Bucket == "" {
+			return fmt.Errorf("influxdb version 2 needs an org and a bucket")
+		}
+	default:
+		return fmt.Errorf("influxdb version %d is invalid (use 1 or 2)", c.Version)
+	}
+	return c.BatchConfig.validate()
+}
+
+// writeURL returns the write endpoint of the HTTP API.
+func (c InfluxDBConfig) writeURL() string {
+	u, _ := url.Parse(c.URL)
+	q := url.Values{}
+	if c.version() == 1 {
+		u = u.JoinPath("write")
+		q.Set("db", c.Database)
+		if c.RetentionPolicy != "" {
+			q.Set("rp", c.RetentionPolicy)
+		}
+	} else {
+		u = u.JoinPath("api/v2/write")
+		q.Set("org", c.Org)
+		q.Set("bucket", c.Bucket)
+	}
+	q.Set("precision", "ns")
+	u.RawQuery = q.Encode()
+	return u.String()
+}
+
+var (
+	influxMeasurementEscaper = strings.NewReplacer(`\`, `\\`, ",", `\,`, " ", `\ `)
+	influxTagEscaper         = strings.NewReplacer(`\`, `\\`, ",", `\,`, "=", `\=`, " ", `\ `)
+)
+
+// influxLine formats a reading in line protocol. Tags are sorted by key, as
+// InfluxDB prefers, and the timestamp is when the frame arrived.
+func influxLine(measurement, meter string, r Reading) []byte {
+	var b strings.Builder
+	b.WriteString(influxMeasurementEscaper.Replace(measurement))
+	tag := func(key, value string) {
+		if value != "" {
+			b.WriteString("," + key + "=" + influxTagEscaper.Replace(value))
+		}
+	}
+	tag("meter", meter)
+	tag("obis", r.OBIS)
+	tag("unit", r.Unit)
+	tag("value", r.Name)
+	b.WriteString(" reading=")
+	b.WriteString(strconv.FormatFloat(r.Value, 'f', -1, 64))
+	b.WriteString(" ")
+	b.WriteString(strconv.FormatInt(r.Time.UnixNano(), 10))
+	return []byte(b.String())
+}
+
+// influxDBSink writes readings to InfluxDB in batches.
+type influxDBSink struct {
+	cfg      InfluxDBConfig
+	batch    *batcher
+	client   *http.Client
+	writeURL string
+	conn     net.Conn
+}
+
+func newInfluxDBSink(cfg InfluxDBConfig) (*influxDBSink, error) {
+	s := &influxDBSink{cfg: cfg}
+	u, _ := url.Parse(cfg.URL)
+	send := s.sendHTTP
+	if cfg.udp() {
+		conn, err := net.Dial("udp", u.Host)
+		if err != nil {
+			return nil, err
+		}
+		s.conn = conn
+		send = s.sendUDP
+	} else {
+		s.client = &http.Client{Timeout: influxDBTimeout}
+		s.writeURL = cfg.writeURL()
+	}
+	s.batch = newBatcher("influxdb "+u.Host, cfg.BatchConfig, send)
+	return s, nil
+}
+
+func (s *influxDBSink) Open(MeterConfig) {}
+
+func (s *influxDBSink) Write(meter string, readings []Reading) {
+	lines := make([][]byte, 0, len(readings))
+	for _, r := range readings {
+		if r.Quality != QualityGood || math.IsNaN(r.Value) || math.IsInf(r.Value, 0) {
+			continue
+		}
+		lines = append(lines, influxLine(s.cfg.measurement(), meter, r))
+	}
+	s.batch.Add(lines...)
+}
+
+func (s *influxDBSink) Status(string, MeterStatus)             {}
+func (s *influxDBSink) Diagnostics(string, diagnosticsPayload) {}
+
+func (s *influxDBSink) Close() error {
+	err := s.batch.Close()
+	if s.conn != nil {
+		s.conn.Close()
+	}
+	return err
+}
+
+func (s *influxDBSink) sendHTTP(ctx context.Context, lines [][]byte) error {
+	var body bytes.Buffer
+	data := bytes.Join(lines, []byte("\n"))
+	if s.cfg.gzip() {
+		zw := gzip.NewWriter(&body)
+		zw.Write(data)
+		zw.Close()
+	} else {
+		body.Write(data)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, s.writeURL, &body)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "text/plain; charset=utf-8")
+	if s.cfg.gzip() {
+		req.Header.Set("Content-Encoding", "gzip")
+	}
+	if s.cfg.version() == 2 && s.cfg.Token != "" {
+		req.Header.Set("Authorization", "Token "+s.cfg.Token)
+	}
+	if s.cfg.version() == 1 && s.cfg.Username != "" {
+		req.SetBasicAuth(s.cfg.Username, s.cfg.Password)
+	}
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	return checkResponse(resp)
+}
+
+// sendUDP packs the lines into datagrams. The UDP listener has no way to
+// report errors, so only local failures are retried.
+func (s *influxDBSink) sendUDP(_ context.Context, lines [][]byte) error {
+	var datagram []byte
+	for i, line := range lines {
+		datagram = append(datagram, line...)
+		datagram = append(datagram, '\n')
+		if i+1 < len(lines) && len(datagram)+len(lines[i+1])+1 <= influxDBDatagramSize {
+			continue
+		}
+		if _, err := s.conn.Write(datagram); err != nil {
+			return err
+		}
+		datagram = datagram[:0]
+	}
+	return nil
+}
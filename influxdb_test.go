@@ -0,0 +1,220 @@
+package main
+
+import (
+	"compress/gzip"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// influxStandIn records the requests of the HTTP write API.
+type influxStandIn struct {
+	mu       sync.Mutex
+	requests []*http.Request
+	bodies   []string
+	status   int
+}
+
+func newInfluxStandIn(t *testing.T) (*influxStandIn, *httptest.Server) {
+	s := &influxStandIn{status: http.StatusNoContent}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var body io.Reader = r.Body
+		if r.Header.Get("Content-Encoding") == "gzip" {
+			zr, err := gzip.NewReader(r.Body)
+			if err != nil {
+				t.Errorf("invalid gzip body: %v", err)
+				return
+			}
+			body = zr
+		}
+		data, _ := io.ReadAll(body)
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		s.requests = append(s.requests, r)
+		s.bodies = append(s.bodies, string(data))
+		w.WriteHeader(s.status)
+	}))
+	t.Cleanup(srv.Close)
+	return s, srv
+}
+
+func (s *influxStandIn) count() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.bodies)
+}
+
+var influxTestTime = time.Unix(1700000000, 123000000)
+
+func TestInfluxLine(t *testing.T) {
+	r := Reading{Name: "Wirkleistung L1", OBIS: "1-0:36.7.0*255", Unit: "W", Value: 246.5, Time: influxTestTime}
+	got := string(influxLine("strom,keller", "nutz=strom", r))
+	want := `strom\,keller,meter=nutz\=strom,obis=1-0:36.7.0*255,unit=W,value=Wirkleistung\ L1 reading=246.5 1700000000123000000`
+	if got != want {
+		t.Fatalf("got  %s\nwant %s", got, want)
+	}
+}
+
+// ---------------------------------------------------------------------------
+// HTTP write API
+// ---------------------------------------------------------------------------
+
+func TestInfluxDBSink_V2(t *testing.T) {
+	standIn, srv := newInfluxStandIn(t)
+	cfg := InfluxDBConfig{URL: srv.URL, Org: "home", Bucket: "strom", Token: "secret"}
+	if err := cfg.validate(); err != nil {
+		t.Fatal(err)
+	}
+	sink, err := newInfluxDBSink(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	readings := testReadings(influxTestTime, 8782400, 246)
+	readings = append(readings, Reading{Name: "Status", Quality: QualityInvalid, Time: influxTestTime})
+	sink.Write("nutzstrom", readings)
+	sink.Close()
+
+	if standIn.count() != 1 {
+		t.Fatalf("expected one write, got %d", standIn.count())
+	}
+	req := standIn.requests[0]
+	if req.URL.Path != "/api/v2/write" || req.URL.Query().Get("org") != "home" || req.URL.Query().Get("bucket") != "strom" {
+		t.Fatalf("unexpected request %s", req.URL)
+	}
+	if req.Header.Get("Authorization") != "Token secret" || req.Header.Get("Content-Encoding") != "gzip" {
+		t.Fatalf("unexpected headers %v", req.Header)
+	}
+	lines := strings.Split(standIn.bodies[0], "\n")
+	if len(lines) != 2 || !strings.HasPrefix(lines[0], "zaehler2mqtt,meter=nutzstrom,obis=1-0:1.8.0*255,unit=Wh,value=Bezug reading=8782400 ") {
+		t.Fatalf("unexpected body:\n%s", standIn.bodies[0])
+	}
+	if !strings.HasSuffix(lines[1], " 1700000000123000000") {
+		t.Fatalf("timestamp should be the frame arrival, got %s", lines[1])
+	}
+}
+
+func TestInfluxDBSink_V1(t *testing.T) {
+	standIn, srv := newInfluxStandIn(t)
+	no := false
+	sink, err := newInfluxDBSink(InfluxDBConfig{URL: srv.URL + "/influx", Version: 1, Database: "strom",
+		RetentionPolicy: "autogen", Username: "zaehler", Password: "pw", Gzip: &no})
+	if err != nil {
+		t.Fatal(err)
+	}
+	sink.Write("nutzstrom", testReadings(influxTestTime, 1, 2))
+	sink.Close()
+
+	req := standIn.requests[0]
+	if req.URL.Path != "/influx/write" || req.URL.Query().Get("db") != "strom" || req.URL.Query().Get("rp") != "autogen" {
+		t.Fatalf("unexpected request %s", req.URL)
+	}
+	if user, pass, ok := req.BasicAuth(); !ok || user != "zaehler" || pass != "pw" {
+		t.Fatal("expected basic auth")
+	}
+	if req.Header.Get("Content-Encoding") != "" {
+		t.Fatal("gzip should be off")
+	}
+}
+
+func TestInfluxDBSink_RetriesServerErrors(t *testing.T) {
+	standIn, srv := newInfluxStandIn(t)
+	standIn.status = http.StatusServiceUnavailable
+	sink, err := newInfluxDBSink(InfluxDBConfig{URL: srv.URL, Org: "home", Bucket: "strom",
+		BatchConfig: BatchConfig{FlushInterval: 10 * time.Millisecond}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sink.Close()
+
+	sink.Write("nutzstrom", testReadings(influxTestTime, 1, 2))
+	waitFor(t, "the first attempt", func() bool { return standIn.count() == 1 })
+	standIn.mu.Lock()
+	standIn.status = http.StatusNoContent
+	standIn.mu.Unlock()
+	waitFor(t, "the retry", func() bool { return standIn.count() == 2 && sink.batch.len() == 0 })
+}
+
+// ---------------------------------------------------------------------------
+// UDP
+// ---------------------------------------------------------------------------
+
+func TestInfluxDBSink_UDP(t *testing.T) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	sink, err := newInfluxDBSink(InfluxDBConfig{URL: "udp://" + conn.LocalAddr().String()})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// enough lines for more than one datagram
+	for i := 0; i < 20; i++ {
+		sink.Write("nutzstrom", testReadings(influxTestTime.Add(time.Duration(i)*time.Second), 1, 2))
+	}
+	sink.Close()
+
+	lines := 0
+	buf := make([]byte, 65536)
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	for lines < 40 {
+		n, _, err := conn.ReadFrom(buf)
+		if err != nil {
+			t.Fatalf("received %d lines: %v", lines, err)
+		}
+		if n > influxDBDatagramSize {
+			t.Fatalf("datagram of %d bytes", n)
+		}
+		lines += strings.Count(string(buf[:n]), "\n")
+	}
+}
+
+// ---------------------------------------------------------------------------
+// Config
+// ---------------------------------------------------------------------------
+
+func TestLoadConfig_InfluxDB(t *testing.T) {
+	base := `
+meters:
+  - name: nutzstrom
+    device: /dev/ttyUSB0
+    values:
+      - name: Leistung
+        obis: "1.0.16.7.0"
+outputs:
+`
+	cfg, err := LoadConfig(writeTestConfig(t, base+`
+  - type: influxdb
+    url: "http://localhost:8086"
+    org: home
+    bucket: strom
+    flush_interval: 30s
+    buffer_file: /var/lib/zaehler2mqtt/influxdb.buf
+    values: [Leistung]
+`))
+	if err != nil {
+		t.Fatalf("LoadConfig error: %v", err)
+	}
+	o := cfg.Outputs[0]
+	if o.InfluxDB == nil || o.InfluxDB.Bucket != "strom" || o.InfluxDB.FlushInterval != 30*time.Second ||
+		o.InfluxDB.BufferFile != "/var/lib/zaehler2mqtt/influxdb.buf" || o.Values[0] != "Leistung" {
+		t.Fatalf("unexpected output %+v", o)
+	}
+
+	for _, bad := range []string{
+		"  - type: influxdb\n    url: \"ftp://localhost\"\n",
+		"  - type: influxdb\n    url: \"http://localhost:8086\"\n    version: 1\n",
+		"  - type: influxdb\n    url: \"http://localhost:8086\"\n    org: home\n",
+	} {
+		if _, err := LoadConfig(writeTestConfig(t, base+bad)); err == nil {
+			t.Errorf("expected error for %q", bad)
+		}
+	}
+}
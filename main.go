@@ -3,22 +3,41 @@ package main
 import (
 	"context"
 	"flag"
+	"fmt"
 	"log"
 	"os"
 	"os/signal"
-	"sync"
 	"syscall"
 )
 
 func main() {
 	configPath := flag.String("config", "config.yaml", "Path to configuration file")
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "Usage: %s [-config path] [purge]\n\n", os.Args[0])
+		fmt.Fprintln(flag.CommandLine.Output(), "  purge    remove all zaehler2mqtt Home Assistant discovery configs and exit")
+		fmt.Fprintln(flag.CommandLine.Output())
+		flag.PrintDefaults()
+	}
 	flag.Parse()
 
+	command := flag.Arg(0)
+	if flag.NArg() > 1 || (command != "" && command != "purge") {
+		flag.Usage()
+		os.Exit(2)
+	}
+
 	cfg, err := LoadConfig(*configPath)
 	if err != nil {
 		log.Fatalf("Failed to load config: %v", err)
 	}
 
+	if command == "purge" {
+		if err := purge(cfg.MQTT); err != nil {
+			log.Fatalf("Purge failed: %v", err)
+		}
+		return
+	}
+
 	if len(cfg.Meters) == 0 {
 		log.Fatal("No meters configured")
 	}
@@ -26,25 +45,24 @@ func main() {
 	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
 
-	// Connect to MQTT broker
-	pub, err := NewPublisher(cfg.MQTT)
-	if err != nil {
-		log.Fatalf("Failed to connect to MQTT broker: %v", err)
-	}
+	// Connect to the MQTT brokers in the background, each at its own pace
+	pub := NewBrokers(cfg.MQTT)
 	defer pub.Close()
 
+	// Remove entities for values that are no longer configured or no longer
+	// go to MQTT
+	pub.RemoveStaleDiscovery(outputMeters(cfg.Outputs, OutputMQTT, cfg.Meters))
+	pub.PublishBridgeDiscovery()
+
 	// Start HTTP server
 	srv := NewServer(cfg.HTTP.Listen)
+	srv.AddMetrics(pub.metricFamilies)
 	go srv.Start()
 
-	// Start a reader goroutine per meter
-	var wg sync.WaitGroup
-	for _, meterCfg := range cfg.Meters {
-		wg.Add(1)
-		go func(mc MeterConfig) {
-			defer wg.Done()
-			RunMeter(ctx, mc, pub, srv)
-		}(meterCfg)
+	// Start a reader goroutine per meter, controlled by MQTT commands
+	ctl := newController(ctx, *configPath, cfg, pub, srv)
+	if err := ctl.Start(); err != nil {
+		log.Fatalf("Failed to set up outputs: %v", err)
 	}
 
 	// Wait for shutdown signal
@@ -53,8 +71,16 @@ func main() {
 	sig := <-sigCh
 	log.Printf("Received %v, shutting down...", sig)
 
-	cancel()
-	wg.Wait()
+	ctl.Stop()
 	srv.Stop(context.Background())
 	log.Println("Shutdown complete")
 }
+
+func purge(brokers []MQTTConfig) error {
+	pub := NewBrokers(brokers)
+	defer pub.Close()
+
+	removed, err := pub.Purge()
+	log.Printf("Purged %d discovery configs", removed)
+	return err
+}
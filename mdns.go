@@ -0,0 +1,232 @@
+package main
+
+import (
+	"log"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// mdnsGroup is the multicast DNS group and port.
+var mdnsGroup = &net.UDPAddr{IP: net.IPv4(224, 0, 0, 251), Port: 5353}
+
+// mdnsTTL is the time to live of the announced records in seconds.
+const mdnsTTL = 120
+
+// mdnsService describes a service announced over multicast DNS.
+type mdnsService struct {
+	// Instance is the service instance name, e.g. shellypro3em-c8f09e8a1b2c.
+	Instance string
+	// Host is the host name without .local.
+	Host string
+	Port uint16
+	// Types are the service types, e.g. _http._tcp.
+	Types []string
+	TXT   []string
+}
+
+// mdnsResponder answers multicast DNS queries for one service, enough for
+// devices that look for it by service type or host name. It shares port
+// 5353 with a system responder like Avahi.
+type mdnsResponder struct {
+	svc   mdnsService
+	conn  *net.UDPConn
+	addrs func() []net.IP
+	done  chan struct{}
+	wg    sync.WaitGroup
+}
+
+func startMDNS(svc mdnsService) (*mdnsResponder, error) {
+	conn, err := net.ListenMulticastUDP("udp4", nil, mdnsGroup)
+	if err != nil {
+		return nil, err
+	}
+	r := &mdnsResponder{svc: svc, conn: conn, addrs: localIPv4, done: make(chan struct{})}
+	r.wg.Add(2)
+	go r.serve()
+	go r.announce()
+	return r, nil
+}
+
+// Close says goodbye, so the service disappears from caches right away.
+func (r *mdnsResponder) Close() error {
+	close(r.done)
+	if msg, err := r.message(0, r.records(0), nil); err == nil {
+		r.conn.WriteToUDP(msg, mdnsGroup)
+	}
+	err := r.conn.Close()
+	r.wg.Wait()
+	return err
+}
+
+// announce sends the records twice, as RFC 6762 asks for on startup.
+func (r *mdnsResponder) announce() {
+	defer r.wg.Done()
+	for i := 0; i < 2; i++ {
+		if msg, err := r.message(0, r.records(mdnsTTL), nil); err == nil {
+			r.conn.WriteToUDP(msg, mdnsGroup)
+		}
+		select {
+		case <-r.done:
+			return
+		case <-time.After(time.Second):
+		}
+	}
+}
+
+func (r *mdnsResponder) serve() {
+	defer r.wg.Done()
+	buf := make([]byte, 9000)
+	for {
+		n, from, err := r.conn.ReadFromUDP(buf)
+		if err != nil {
+			select {
+			case <-r.done:
+			default:
+				log.Printf("[mdns] Stopped answering: %v", err)
+			}
+			return
+		}
+		reply, unicast := r.reply(buf[:n], from)
+		if reply == nil {
+			continue
+		}
+		to := mdnsGroup
+		if unicast {
+			to = from
+		}
+		r.conn.WriteToUDP(reply, to)
+	}
+}
+
+// reply answers a query, or returns nil when it does not concern the
+// service. Queries from other ports than 5353 and questions asking for a
+// unicast response are answered directly.
+func (r *mdnsResponder) reply(query []byte, from *net.UDPAddr) (reply []byte, unicast bool) {
+	var p dnsmessage.Parser
+	h, err := p.Start(query)
+	if err != nil || h.Response {
+		return nil, false
+	}
+	questions, err := p.AllQuestions()
+	if err != nil {
+		return nil, false
+	}
+	legacy := from.Port != mdnsGroup.Port
+	unicast = legacy
+
+	records := r.records(mdnsTTL)
+	var answers []dnsmessage.Resource
+	for _, q := range questions {
+		if q.Class&(1<<15) != 0 {
+			unicast = true
+		}
+		for _, rr := range records {
+			if strings.EqualFold(rr.Header.Name.String(), q.Name.String()) && (q.Type == rr.Header.Type || q.Type == dnsmessage.TypeALL) {
+				answers = append(answers, rr)
+			}
+		}
+	}
+	if len(answers) == 0 {
+		return nil, false
+	}
+	// Resolvers would ask for the rest next
+	var additionals []dnsmessage.Resource
+	for _, rr := range records {
+		if rr.Header.Type != dnsmessage.TypePTR && !containsResource(answers, rr) {
+			additionals = append(additionals, rr)
+		}
+	}
+	var id uint16
+	if legacy {
+		// legacy resolvers need the query ID and questions echoed
+		id = h.ID
+	} else {
+		questions = nil
+	}
+	msg, err := r.message(id, answers, additionals, questions...)
+	if err != nil {
+		log.Printf("[mdns] Failed to encode answer: %v", err)
+		return nil, false
+	}
+	return msg, unicast
+}
+
+func containsResource(list []dnsmessage.Resource, rr dnsmessage.Resource) bool {
+	for _, x := range list {
+		if x.Header.Name == rr.Header.Name && x.Header.Type == rr.Header.Type && x.Body.GoString() == rr.Body.GoString() {
+			return true
+		}
+	}
+	return false
+}
+
+func (r *mdnsResponder) message(id uint16, answers, additionals []dnsmessage.Resource, questions ...dnsmessage.Question) ([]byte, error) {
+	msg := dnsmessage.Message{
+		Header:      dnsmessage.Header{ID: id, Response: true, Authoritative: true},
+		Questions:   questions,
+		Answers:     answers,
+		Additionals: additionals,
+	}
+	return msg.Pack()
+}
+
+// records returns the records of the service: pointers from the service
+// types to the instance, its SRV and TXT records and the host's addresses.
+func (r *mdnsResponder) records(ttl uint32) []dnsmessage.Resource {
+	header := func(name string, typ dnsmessage.Type, unique bool) dnsmessage.ResourceHeader {
+		class := dnsmessage.ClassINET
+		if unique {
+			// the cache-flush bit
+			class |= 1 << 15
+		}
+		return dnsmessage.ResourceHeader{Name: dnsmessage.MustNewName(name), Type: typ, Class: class, TTL: ttl}
+	}
+	host := r.svc.Host + ".local."
+	var records []dnsmessage.Resource
+	for _, t := range r.svc.Types {
+		typ := t + ".local."
+		instance := r.svc.Instance + "." + typ
+		records = append(records,
+			dnsmessage.Resource{Header: header("_services._dns-sd._udp.local.", dnsmessage.TypePTR, false),
+				Body: &dnsmessage.PTRResource{PTR: dnsmessage.MustNewName(typ)}},
+			dnsmessage.Resource{Header: header(typ, dnsmessage.TypePTR, false),
+				Body: &dnsmessage.PTRResource{PTR: dnsmessage.MustNewName(instance)}},
+			dnsmessage.Resource{Header: header(instance, dnsmessage.TypeSRV, true),
+				Body: &dnsmessage.SRVResource{Port: r.svc.Port, Target: dnsmessage.MustNewName(host)}},
+			dnsmessage.Resource{Header: header(instance, dnsmessage.TypeTXT, true),
+				Body: &dnsmessage.TXTResource{TXT: r.svc.TXT}},
+		)
+	}
+	for _, ip := range r.addrs() {
+		var a [4]byte
+		copy(a[:], ip.To4())
+		records = append(records, dnsmessage.Resource{Header: header(host, dnsmessage.TypeA, true), Body: &dnsmessage.AResource{A: a}})
+	}
+	return records
+}
+
+// localIPv4 returns the IPv4 addresses of the interfaces that are up and
+// can multicast.
+func localIPv4() []net.IP {
+	ifaces, err := net.Interfaces()
+	if err != nil {
+		return nil
+	}
+	var ips []net.IP
+	for _, iface := range ifaces {
+		if iface.Flags&net.FlagUp == 0 || iface.Flags&net.FlagLoopback != 0 || iface.Flags&net.FlagMulticast == 0 {
+			continue
+		}
+		addrs, _ := iface.Addrs()
+		for _, a := range addrs {
+			if ipnet, ok := a.(*net.IPNet); ok && ipnet.IP.To4() != nil {
+				ips = append(ips, ipnet.IP)
+			}
+		}
+	}
+	return ips
+}
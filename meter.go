@@ -2,11 +2,16 @@ package main
 
 import (
 	"bufio"
+	"bytes"
 	"context"
+	"encoding/hex"
 	"fmt"
+	"io"
 	"log"
 	"os"
 	"os/exec"
+	"sync"
+	"sync/atomic"
 	"syscall"
 	"time"
 
@@ -21,10 +26,103 @@ func configureSerial(device string) error {
 	return nil
 }
 
-func RunMeter(ctx context.Context, cfg MeterConfig, pub *Publisher, srv *Server) {
+// serialOBIS are the OBIS codes meters use to report their server ID
+// (1-0:0.0.9) or device identification (1-0:96.1.0).
+var serialOBIS = []gosml.OctetString{
+	{1, 0, 0, 0, 9},
+	{1, 0, 96, 1, 0},
+}
+
+// meterSerial formats the identification carried by entry as hex.
+func meterSerial(entry *gosml.ListEntry) string {
+	return hex.EncodeToString(entry.Value.DataBytes)
+}
+
+// numeric reports whether an entry carries a number; gosml reports 0 for
+// anything else.
+func numeric(entry *gosml.ListEntry) bool {
+	t := entry.Value.Typ & gosml.OCTET_TYPE_FIELD
+	return t == gosml.OCTET_TYPE_INTEGER || t == gosml.OCTET_TYPE_UNSIGNED
+}
+
+// statusTracker keeps the status of a meter, which is updated by the reader
+// and the stale watchdog, and tells the sinks about changes only.
+type statusTracker struct {
+	meter string
+	sink  Sink
+
+	mu     sync.Mutex
+	status MeterStatus
+	known  bool
+}
+
+func (t *statusTracker) update(fn func(*MeterStatus)) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	next := t.status
+	fn(&next)
+	if t.known && next == t.status {
+		return
+	}
+	t.status, t.known = next, true
+	t.sink.Status(t.meter, next)
+}
+
+func (t *statusTracker) setOnline(online bool) {
+	t.update(func(s *MeterStatus) { s.Online = online })
+}
+
+// stop reports that the reader stopped on shutdown or reload.
+func (t *statusTracker) stop() {
+	t.update(func(s *MeterStatus) { s.Online, s.Stopped = false, true })
+}
+
+// staleTimeout is how long a meter may go without delivering a value before
+// it is reported offline. SML meters push every one to four seconds.
+const staleTimeout = 30 * time.Second
+
+// startStaleWatch watches a freshly opened device until done. The returned
+// time of the last value starts at the opening, so a device that delivers
+// nothing after a reconnect is reported offline as well.
+func startStaleWatch(status *statusTracker, timeout time.Duration, done <-chan struct{}) *atomic.Int64 {
+	lastValue := new(atomic.Int64)
+	lastValue.Store(time.Now().UnixNano())
+	go watchStale(status, lastValue, timeout, done)
+	return lastValue
+}
+
+func watchStale(status *statusTracker, lastValue *atomic.Int64, timeout time.Duration, done <-chan struct{}) {
+	ticker := time.NewTicker(timeout / 3)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+			if time.Since(time.Unix(0, lastValue.Load())) > timeout {
+				status.setOnline(false)
+			}
+		}
+	}
+}
+
+// RunMeter reads a meter until ctx is done and hands everything it sees to
+// sink.
+func RunMeter(ctx context.Context, cfg MeterConfig, sink Sink, ctl *meterControl) {
 	log.Printf("[%s] Starting meter reader on %s", cfg.Name, cfg.Device)
-	srv.RegisterMeter(cfg.Name, cfg.Device)
+	sink.Open(cfg)
 
+	// The meter is only reported online once frames are actually decoded;
+	// read errors mark it offline again, and stopping the reader marks it
+	// stopped.
+	status := &statusTracker{meter: cfg.Name, sink: sink}
+	status.setOnline(false)
+	defer status.stop()
+
+	stats := &readerStats{}
+	go reportDiagnostics(ctx, cfg.Name, sink, stats)
+
+	opened := false
 	for {
 		if ctx.Err() != nil {
 			return
@@ -50,9 +148,20 @@ func RunMeter(ctx context.Context, cfg MeterConfig, pub *Publisher, srv *Server)
 				continue
 			}
 		}
+		if opened {
+			stats.Reconnect()
+		}
+		opened = true
 
-		// Build OBIS callbacks
-		readOpts := []gosml.ReadOption{}
+		// Mark the meter offline if the device stays open but stops (or never
+		// starts) delivering data
+		readDone := make(chan struct{})
+		lastValue := startStaleWatch(status, staleTimeout, readDone)
+
+		// Build OBIS callbacks, collecting the readings of each frame
+		var readings []Reading
+		var frameTime time.Time
+		var callbacks []obisCallback
 		for _, v := range cfg.Values {
 			obis, err := v.OBISBytes()
 			if err != nil {
@@ -60,38 +169,87 @@ func RunMeter(ctx context.Context, cfg MeterConfig, pub *Publisher, srv *Server)
 				continue
 			}
 			val := v // capture for closure
-			meterName := cfg.Name
-			readOpts = append(readOpts, gosml.WithObisCallback(gosml.OctetString(obis), func(entry *gosml.ListEntry) {
-				floatVal := entry.Float() * val.Factor
-				pub.PublishState(meterName, val.Name, floatVal)
-				srv.UpdateValue(meterName, val.Name, floatVal, val.Unit, entry.ObjectName())
-			}))
+			callbacks = append(callbacks, obisCallback{gosml.OctetString(obis), func(entry *gosml.ListEntry) {
+				lastValue.Store(frameTime.UnixNano())
+				r := Reading{
+					Meter:   cfg.Name,
+					Name:    val.Name,
+					OBIS:    entry.ObjectName(),
+					Unit:    val.Unit,
+					Time:    frameTime,
+					Quality: QualityGood,
+				}
+				if numeric(entry) {
+					r.Value = entry.Float() * val.Factor
+				} else {
+					r.Quality = QualityInvalid
+				}
+				readings = append(readings, r)
+			}})
 		}
 
-		// Publish HA discovery for all values of this meter
-		for _, v := range cfg.Values {
-			sensorID := fmt.Sprintf("zaehler2mqtt_%s_%s", cfg.Name, v.Name)
-			pub.PublishDiscovery(cfg.Name, sensorID, v)
+		// Meter identification, reported as an octet string
+		for _, obis := range serialOBIS {
+			callbacks = append(callbacks, obisCallback{obis, func(entry *gosml.ListEntry) {
+				if serial := meterSerial(entry); serial != "" {
+					status.update(func(s *MeterStatus) { s.Serial = serial })
+				}
+			}})
 		}
 
 		log.Printf("[%s] Reading SML data from %s", cfg.Name, cfg.Device)
 
-		// Close file on context cancellation to unblock Read
+		// Close file on context cancellation or a reconnect command to
+		// unblock Read
+		var reconnect atomic.Bool
 		go func() {
-			<-ctx.Done()
+			select {
+			case <-ctx.Done():
+			case <-ctl.reconnect:
+				reconnect.Store(true)
+			case <-readDone:
+				return
+			}
 			f.Close()
 		}()
 
-		r := bufio.NewReader(f)
-		err = gosml.Read(r, readOpts...)
+		// Frames are decoded one at a time so that sinks get all readings
+		// of a frame together, stamped with its arrival time
+		err = readFrames(bufio.NewReader(io.TeeReader(f, &ctl.capture)), func(data []byte) {
+			entries, err := parseFrame(data)
+			if err != nil {
+				stats.FrameError(err)
+				return
+			}
+			frameTime = time.Now()
+			stats.Frame(frameTime)
+			readings = nil
+			for _, entry := range entries {
+				for _, cb := range callbacks {
+					if len(entry.ObjName) > 0 && bytes.HasPrefix(entry.ObjName, cb.obis) {
+						cb.fn(entry)
+					}
+				}
+			}
+			if len(readings) > 0 {
+				status.setOnline(true)
+				sink.Write(cfg.Name, readings)
+			}
+		}, stats.FrameError)
+		close(readDone)
 		f.Close()
 
 		if ctx.Err() != nil {
 			log.Printf("[%s] Shutting down", cfg.Name)
 			return
 		}
+		if reconnect.Load() {
+			log.Printf("[%s] Reopening %s on request", cfg.Name, cfg.Device)
+			continue
+		}
 
 		log.Printf("[%s] Read error: %v, restarting in 5s", cfg.Name, err)
+		status.setOnline(false)
 		select {
 		case <-ctx.Done():
 			return
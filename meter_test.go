@@ -0,0 +1,25 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+// ---------------------------------------------------------------------------
+// Stale detection
+// ---------------------------------------------------------------------------
+
+func TestStaleWatch_ReconnectWithoutFrames(t *testing.T) {
+	// online from before the reconnect, then the reopened device is silent
+	status := &statusTracker{meter: "nutzstrom", sink: &recordingSink{}}
+	status.setOnline(true)
+	done := make(chan struct{})
+	defer close(done)
+	startStaleWatch(status, 60*time.Millisecond, done)
+
+	waitFor(t, "the meter to go offline", func() bool {
+		status.mu.Lock()
+		defer status.mu.Unlock()
+		return !status.status.Online
+	})
+}
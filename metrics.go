@@ -0,0 +1,245 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Content types of /metrics. OpenMetrics is only served when the scraper asks
+// for it in Accept, like Prometheus does; everyone else, including Prometheus'
+// own fallback, gets the classic text format.
+const (
+	openMetricsContentType = "application/openmetrics-text; version=1.0.0; charset=utf-8"
+	textMetricsContentType = "text/plain; version=0.0.4; charset=utf-8"
+)
+
+// Metric types of the OpenMetrics text format.
+const (
+	metricGauge     = "gauge"
+	metricCounter   = "counter"
+	metricHistogram = "histogram"
+)
+
+// metricFamily is one metric with all of its samples.
+type metricFamily struct {
+	name string
+	typ  string
+	// unit must also be the last part of name, e.g. seconds.
+	unit    string
+	help    string
+	samples []metricSample
+}
+
+type metricSample struct {
+	suffix string
+	// labels alternates label names and values.
+	labels []string
+	value  float64
+}
+
+// add appends a sample. Counters get the _total suffix OpenMetrics requires.
+func (f *metricFamily) add(value float64, labels ...string) {
+	suffix := ""
+	if f.typ == metricCounter {
+		suffix = "_total"
+	}
+	f.samples = append(f.samples, metricSample{suffix: suffix, labels: labels, value: value})
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// writeMetrics writes the families in the OpenMetrics text format, or in the
+// Prometheus text format 0.0.4 if openMetrics is false. Families without
+// samples are left out.
+func writeMetrics(w io.Writer, families []metricFamily, openMetrics bool) error {
+	bw := bufio.NewWriter(w)
+	for _, f := range families {
+		if len(f.samples) == 0 {
+			continue
+		}
+		name := f.name
+		if !openMetrics && f.typ == metricCounter {
+			// The 0.0.4 format names counter families like their samples.
+			name += "_total"
+		}
+		fmt.Fprintf(bw, "# TYPE %s %s\n", name, f.typ)
+		if f.unit != "" && openMetrics {
+			fmt.Fprintf(bw, "# UNIT %s %s\n", name, f.unit)
+		}
+		fmt.Fprintf(bw, "# HELP %s %s\n", name, labelEscaper.Replace(f.help))
+		for _, s := range f.samples {
+			bw.WriteString(f.name + s.suffix)
+			if len(s.labels) > 0 {
+				bw.WriteByte('{')
+				for i := 0; i+1 < len(s.labels); i += 2 {
+					if i > 0 {
+						bw.WriteByte(',')
+					}
+					fmt.Fprintf(bw, `%s="%s"`, s.labels[i], labelEscaper.Replace(s.labels[i+1]))
+				}
+				bw.WriteByte('}')
+			}
+			bw.WriteByte(' ')
+			bw.WriteString(formatMetricValue(s.value))
+			bw.WriteByte('\n')
+		}
+	}
+	if openMetrics {
+		bw.WriteString("# EOF\n")
+	}
+	return bw.Flush()
+}
+
+func formatMetricValue(v float64) string {
+	switch {
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	case math.IsNaN(v):
+		return "NaN"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+// publishLatencyBuckets are the upper bounds in seconds of the publish
+// duration histogram.
+var publishLatencyBuckets = [...]float64{0.001, 0.005, 0.01, 0.05, 0.1, 0.5, 1, 5, 30}
+
+// latencyHistogram counts durations into publishLatencyBuckets. The zero
+// value is ready to use.
+type latencyHistogram struct {
+	mu     sync.Mutex
+	counts [len(publishLatencyBuckets)]uint64
+	count  uint64
+	sum    float64
+}
+
+func (h *latencyHistogram) Observe(d time.Duration) {
+	v := d.Seconds()
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for i, bound := range publishLatencyBuckets {
+		if v <= bound {
+			h.counts[i]++
+			break
+		}
+	}
+	h.count++
+	h.sum += v
+}
+
+// collect adds the cumulative buckets, count and sum to f.
+func (h *latencyHistogram) collect(f *metricFamily, labels ...string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	// le is appended to a copy so the samples do not share the array
+	bucket := func(le string, n uint64) {
+		l := append(slices.Clip(labels), "le", le)
+		f.samples = append(f.samples, metricSample{suffix: "_bucket", labels: l, value: float64(n)})
+	}
+	var cumulative uint64
+	for i, bound := range publishLatencyBuckets {
+		cumulative += h.counts[i]
+		bucket(formatMetricValue(bound), cumulative)
+	}
+	bucket("+Inf", h.count)
+	f.samples = append(f.samples,
+		metricSample{suffix: "_count", labels: labels, value: float64(h.count)},
+		metricSample{suffix: "_sum", labels: labels, value: h.sum},
+	)
+}
+
+// AddMetrics adds a source of metrics to /metrics. It is called on every
+// scrape.
+func (s *Server) AddMetrics(collect func() []metricFamily) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.collectors = append(s.collectors, collect)
+}
+
+func (s *Server) handleMetrics(w http.ResponseWriter, r *http.Request) {
+	families := s.meterMetrics()
+	s.mu.RLock()
+	collectors := s.collectors
+	s.mu.RUnlock()
+	for _, collect := range collectors {
+		families = append(families, collect()...)
+	}
+	openMetrics := strings.Contains(r.Header.Get("Accept"), "application/openmetrics-text")
+	if openMetrics {
+		w.Header().Set("Content-Type", openMetricsContentType)
+	} else {
+		w.Header().Set("Content-Type", textMetricsContentType)
+	}
+	writeMetrics(w, families, openMetrics)
+}
+
+// meterMetrics returns the latest readings and the reader health of every
+// meter.
+func (s *Server) meterMetrics() []metricFamily {
+	values := metricFamily{name: "zaehler2mqtt_meter_value", typ: metricGauge,
+		help: "Latest reading of a configured value."}
+	registers := metricFamily{name: "zaehler2mqtt_meter_register", typ: metricCounter,
+		help: "Latest reading of a value with state_class total_increasing, such as an energy register."}
+	up := metricFamily{name: "zaehler2mqtt_meter_up", typ: metricGauge,
+		help: "Whether the meter delivers values."}
+	lastUpdate := metricFamily{name: "zaehler2mqtt_meter_last_update_timestamp_seconds", typ: metricGauge, unit: "seconds",
+		help: "When the meter last delivered values."}
+	frames := metricFamily{name: "zaehler2mqtt_meter_frames", typ: metricCounter,
+		help: "SML frames read from the meter."}
+	crcErrors := metricFamily{name: "zaehler2mqtt_meter_crc_errors", typ: metricCounter,
+		help: "Frames dropped because of a CRC mismatch."}
+	parseErrors := metricFamily{name: "zaehler2mqtt_meter_parse_errors", typ: metricCounter,
+		help: "Frames dropped because they could not be parsed."}
+	reconnects := metricFamily{name: "zaehler2mqtt_meter_reconnects", typ: metricCounter,
+		help: "Times the serial device was reopened."}
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	meters := make([]string, 0, len(s.meters))
+	for name := range s.meters {
+		meters = append(meters, name)
+	}
+	slices.Sort(meters)
+	for _, meter := range meters {
+		state := s.meters[meter]
+		names := make([]string, 0, len(state.Values))
+		for name := range state.Values {
+			names = append(names, name)
+		}
+		slices.Sort(names)
+		for _, name := range names {
+			v := state.Values[name]
+			f := &values
+			if state.counters[name] {
+				f = &registers
+			}
+			f.add(v.Value, "meter", meter, "value", name, "obis", v.OBIS, "unit", v.Unit)
+		}
+
+		online := 0.0
+		if state.online {
+			online = 1
+		}
+		up.add(online, "meter", meter)
+		if !state.LastUpdate.IsZero() {
+			lastUpdate.add(float64(state.LastUpdate.UnixMilli())/1000, "meter", meter)
+		}
+		if d := state.diagnostics; d != nil {
+			frames.add(float64(d.Frames), "meter", meter)
+			crcErrors.add(float64(d.CRCErrors), "meter", meter)
+			parseErrors.add(float64(d.ParseErrors), "meter", meter)
+			reconnects.add(float64(d.Reconnects), "meter", meter)
+		}
+	}
+	return []metricFamily{values, registers, up, lastUpdate, frames, crcErrors, parseErrors, reconnects}
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// ---------------------------------------------------------------------------
+// Exposition format
+// ---------------------------------------------------------------------------
+
+func TestWriteMetrics(t *testing.T) {
+	gauge := metricFamily{name: "test_value", typ: metricGauge, help: "A value."}
+	gauge.add(246.5, "meter", `Keller "Nord"`, "unit", `W\h`)
+	counter := metricFamily{name: "test_frames", typ: metricCounter, help: "Frames."}
+	counter.add(12)
+	empty := metricFamily{name: "test_empty", typ: metricGauge, help: "Nothing."}
+	duration := metricFamily{name: "test_age_seconds", typ: metricGauge, unit: "seconds", help: "Age."}
+	duration.add(1.5)
+
+	var buf bytes.Buffer
+	if err := writeMetrics(&buf, []metricFamily{gauge, counter, empty, duration}, true); err != nil {
+		t.Fatal(err)
+	}
+	want := `# TYPE test_value gauge
+# HELP test_value A value.
+test_value{meter="Keller \"Nord\"",unit="W\\h"} 246.5
+# TYPE test_frames counter
+# HELP test_frames Frames.
+test_frames_total 12
+# TYPE test_age_seconds gauge
+# UNIT test_age_seconds seconds
+# HELP test_age_seconds Age.
+test_age_seconds 1.5
+# EOF
+`
+	if buf.String() != want {
+		t.Fatalf("got:\n%s\nwant:\n%s", buf.String(), want)
+	}
+
+	buf.Reset()
+	if err := writeMetrics(&buf, []metricFamily{gauge, counter, empty, duration}, false); err != nil {
+		t.Fatal(err)
+	}
+	want = `# TYPE test_value gauge
+# HELP test_value A value.
+test_value{meter="Keller \"Nord\"",unit="W\\h"} 246.5
+# TYPE test_frames_total counter
+# HELP test_frames_total Frames.
+test_frames_total 12
+# TYPE test_age_seconds gauge
+# HELP test_age_seconds Age.
+test_age_seconds 1.5
+`
+	if buf.String() != want {
+		t.Fatalf("text format got:\n%s\nwant:\n%s", buf.String(), want)
+	}
+}
+
+func TestLatencyHistogram(t *testing.T) {
+	var h latencyHistogram
+	h.Observe(2 * time.Millisecond)
+	h.Observe(2 * time.Millisecond)
+	h.Observe(time.Minute)
+
+	f := metricFamily{name: "test_duration_seconds", typ: metricHistogram}
+	h.collect(&f, "broker", "local")
+
+	buckets := map[string]float64{}
+	for _, s := range f.samples {
+		if s.suffix == "_bucket" {
+			if len(s.labels) != 4 || s.labels[1] != "local" {
+				t.Fatalf("unexpected bucket labels %v", s.labels)
+			}
+			buckets[s.labels[3]] = s.value
+		}
+	}
+	if buckets["0.001"] != 0 || buckets["0.005"] != 2 || buckets["30"] != 2 || buckets["+Inf"] != 3 {
+		t.Fatalf("buckets should be cumulative, got %v", buckets)
+	}
+	last := f.samples[len(f.samples)-1]
+	if last.suffix != "_sum" || last.value < 60 {
+		t.Fatalf("unexpected sum sample %+v", last)
+	}
+}
+
+// ---------------------------------------------------------------------------
+// Endpoint
+// ---------------------------------------------------------------------------
+
+func TestServer_Metrics(t *testing.T) {
+	srv := NewServer(":0")
+	meter := sinkTestMeter
+	meter.Values = append([]ValueConfig(nil), meter.Values...)
+	meter.Values[0].StateClass = "total_increasing"
+
+	sink := stateSink{srv}
+	sink.Open(meter)
+	sink.Status("nutzstrom", MeterStatus{Online: true})
+	sink.Write("nutzstrom", testReadings(time.Now(), 8782400, 246))
+	sink.Diagnostics("nutzstrom", diagnosticsPayload{Frames: 42, ParseErrors: 1})
+
+	p, _ := newTestPublisher()
+	b := newTestBrokers(t, p)
+	b.PublishState("nutzstrom", meter.Values[1], 246)
+	b.flush(t)
+	srv.AddMetrics(b.metricFamilies)
+
+	rr := httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodGet, "/metrics", nil)
+	req.Header.Set("Accept", "application/openmetrics-text;version=1.0.0,application/openmetrics-text;version=0.0.1;q=0.75,text/plain;version=0.0.4;q=0.5,*/*;q=0.1")
+	srv.server.Handler.ServeHTTP(rr, req)
+	if ct := rr.Header().Get("Content-Type"); !strings.HasPrefix(ct, "application/openmetrics-text") {
+		t.Fatalf("Content-Type = %q", ct)
+	}
+	body := rr.Body.String()
+	for _, line := range []string{
+		`zaehler2mqtt_meter_register_total{meter="nutzstrom",value="Bezug",obis="1-0:1.8.0*255",unit="Wh"} 8.7824e+06`,
+		`zaehler2mqtt_meter_value{meter="nutzstrom",value="Leistung",obis="1-0:16.7.0*255",unit="W"} 246`,
+		`zaehler2mqtt_meter_up{meter="nutzstrom"} 1`,
+		`zaehler2mqtt_meter_frames_total{meter="nutzstrom"} 42`,
+		`zaehler2mqtt_meter_parse_errors_total{meter="nutzstrom"} 1`,
+		`zaehler2mqtt_mqtt_connected{broker="test"} 1`,
+		`zaehler2mqtt_mqtt_queue_depth{broker="test"} 0`,
+		`zaehler2mqtt_mqtt_publish_duration_seconds_count{broker="test"} 1`,
+	} {
+		if !strings.Contains(body, line+"\n") {
+			t.Errorf("missing %s in:\n%s", line, body)
+		}
+	}
+	if !strings.HasSuffix(body, "# EOF\n") {
+		t.Fatal("exposition must end with # EOF")
+	}
+
+	rr = httptest.NewRecorder()
+	srv.server.Handler.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	if ct := rr.Header().Get("Content-Type"); ct != textMetricsContentType {
+		t.Fatalf("Content-Type without Accept = %q", ct)
+	}
+	body = rr.Body.String()
+	if strings.Contains(body, "# EOF") || !strings.Contains(body, "# TYPE zaehler2mqtt_meter_frames_total counter\n") {
+		t.Fatalf("not in the text format:\n%s", body)
+	}
+}
@@ -0,0 +1,588 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"net"
+	"slices"
+	"sync"
+)
+
+const (
+	// sunspecBase is the register where the SunSpec map starts.
+	sunspecBase = 40000
+
+	// Modbus function codes and exceptions.
+	modbusReadHolding   = 0x03
+	modbusReadInput     = 0x04
+	modbusIllegalFunc   = 0x01
+	modbusIllegalAddr   = 0x02
+	modbusIllegalValue  = 0x03
+	modbusDeviceFailure = 0x04
+	modbusNoTarget      = 0x0b
+
+	// modbusMaxRead is the most registers one request may read.
+	modbusMaxRead = 125
+)
+
+// ModbusConfig configures a modbus output, a Modbus TCP server for the one
+// meter selected with meters.
+type ModbusConfig struct {
+	// Listen is the address to listen on, default :502.
+	Listen string `yaml:"listen"`
+	// UnitID is the unit the server answers for, default 1.
+	UnitID int `yaml:"unit_id"`
+	// Model is the SunSpec meter model, 203 (integer, the default) or 213
+	// (float), or 0 with sunspec: false.
+	Model int `yaml:"model"`
+	// SunSpec serves the SunSpec map at 40000, the default.
+	SunSpec *bool `yaml:"sunspec"`
+	// Registers are served in addition to the SunSpec map.
+	Registers []ModbusRegister `yaml:"registers"`
+}
+
+// ModbusRegister maps a value to holding registers.
+type ModbusRegister struct {
+	Address uint16 `yaml:"address"`
+	// Value is the name or OBIS code of the value.
+	Value string `yaml:"value"`
+	// Type is int16, uint16, int32, uint32 or float32 (the default).
+	// Larger types use more than one register, high word first.
+	Type string `yaml:"type"`
+	// Scale multiplies the value before it is stored, default 1.
+	Scale float64 `yaml:"scale"`
+}
+
+var modbusRegisterSizes = map[string]int{"int16": 1, "uint16": 1, "int32": 2, "uint32": 2, "float32": 2}
+
+func (r ModbusRegister) typ() string {
+	if r.Type == "" {
+		return "float32"
+	}
+	return r.Type
+}
+
+func (r ModbusRegister) scale() float64 {
+	if r.Scale == 0 {
+		return 1
+	}
+	return r.Scale
+}
+
+// encode stores a value in the registers of its type. Values out of range
+// are clamped.
+func (r ModbusRegister) encode(v float64) []uint16 {
+	v *= r.scale()
+	switch r.typ() {
+	case "int16":
+		return []uint16{uint16(int16(math.Round(math.Max(math.MinInt16, math.Min(v, math.MaxInt16)))))}
+	case "uint16":
+		return []uint16{uint16(math.Round(math.Max(0, math.Min(v, math.MaxUint16))))}
+	case "int32":
+		return split32(uint32(int32(math.Round(math.Max(math.MinInt32, math.Min(v, math.MaxInt32))))))
+	case "uint32":
+		return split32(uint32(math.Round(math.Max(0, math.Min(v, math.MaxUint32)))))
+	}
+	return split32(math.Float32bits(float32(v)))
+}
+
+func split32(v uint32) []uint16 { return []uint16{uint16(v >> 16), uint16(v)} }
+
+func (c ModbusConfig) listen() string {
+	if c.Listen == "" {
+		return ":502"
+	}
+	return c.Listen
+}
+
+func (c ModbusConfig) unitID() byte {
+	if c.UnitID == 0 {
+		return 1
+	}
+	return byte(c.UnitID)
+}
+
+func (c ModbusConfig) sunspec() bool {
+	return c.SunSpec == nil || *c.SunSpec
+}
+
+func (c ModbusConfig) model() int {
+	if c.Model == 0 {
+		return 203
+	}
+	return c.Model
+}
+
+func (c ModbusConfig) validate() error {
+	if _, _, err := net.SplitHostPort(c.listen()); err != nil {
+		return fmt.Errorf("modbus listen %q is invalid: %w", c.Listen, err)
+	}
+	if c.UnitID < 0 || c.UnitID > 247 {
+		return fmt.Errorf("modbus unit_id must be 1 to 247")
+	}
+	if c.sunspec() && c.model() != 203 && c.model() != 213 {
+		return fmt.Errorf("modbus model %d is not supported (use 203 or 213)", c.Model)
+	}
+	used := make(map[uint16]bool)
+	if c.sunspec() {
+		for a := 0; a < sunspecLayout(c.model()).size; a++ {
+			used[uint16(sunspecBase+a)] = true
+		}
+	}
+	for _, r := range c.Registers {
+		size, ok := modbusRegisterSizes[r.typ()]
+		if !ok {
+			return fmt.Errorf("modbus register %d: type %q is unknown", r.Address, r.Type)
+		}
+		if r.Value == "" {
+			return fmt.Errorf("modbus register %d needs a value", r.Address)
+		}
+		for a := 0; a < size; a++ {
+			addr := int(r.Address) + a
+			if addr > math.MaxUint16 || used[uint16(addr)] {
+				return fmt.Errorf("modbus register %d overlaps another register", r.Address)
+			}
+			used[uint16(addr)] = true
+		}
+	}
+	return nil
+}
+
+// sunspecMap is where the meter model sits in the SunSpec map.
+type sunspecMap struct {
+	// meter is the offset of the meter model's data, length its length.
+	meter, length int
+	size          int
+}
+
+// sunspecLayout returns the layout of the map: the SunS marker, the common
+// model (1), the meter model and the end marker.
+func sunspecLayout(model int) sunspecMap {
+	length := 105
+	if model == 213 {
+		length = 124
+	}
+	meter := 2 + 2 + sunspecCommonLength + 2
+	return sunspecMap{meter: meter, length: length, size: meter + length + 2}
+}
+
+// sunspecCommonLength is the length of the common model: manufacturer,
+// model, options, version, serial number and device address.
+const sunspecCommonLength = 65
+
+// SunSpec values for points a meter does not have.
+const (
+	sunspecNotInt16 = 0x8000
+	sunspecNotAcc32 = 0
+)
+
+// sunspecString stores a string in a number of registers.
+func sunspecString(s string, registers int) []uint16 {
+	b := make([]byte, 2*registers)
+	copy(b, s)
+	out := make([]uint16, registers)
+	for i := range out {
+		out[i] = binary.BigEndian.Uint16(b[2*i:])
+	}
+	return out
+}
+
+// sunspecCommon is the common model.
+func sunspecCommon(meter, serial string, unit byte) []uint16 {
+	regs := []uint16{1, sunspecCommonLength}
+	regs = append(regs, sunspecString("zaehler2mqtt", 16)...)
+	regs = append(regs, sunspecString(meter, 16)...)
+	regs = append(regs, sunspecString("", 8)...)
+	regs = append(regs, sunspecString("", 8)...)
+	regs = append(regs, sunspecString(serial, 16)...)
+	return append(regs, uint16(unit))
+}
+
+// sunspecGroup is a group of int16 points sharing a scale factor in model
+// 203: the total or average, then phases A to C.
+type sunspecGroup struct {
+	values [4]float64
+	known  [4]bool
+}
+
+// encode picks the smallest scale factor, from minSF up, at which all values
+// fit.
+func (g sunspecGroup) encode(minSF int) (points [4]uint16, sf uint16) {
+	maxAbs := 0.0
+	found := false
+	for i, v := range g.values {
+		if g.known[i] {
+			maxAbs = math.Max(maxAbs, math.Abs(v))
+			found = true
+		}
+	}
+	if !found {
+		return [4]uint16{sunspecNotInt16, sunspecNotInt16, sunspecNotInt16, sunspecNotInt16}, sunspecNotInt16
+	}
+	e := minSF
+	for maxAbs/math.Pow10(e) > math.MaxInt16 && e < 10 {
+		e++
+	}
+	for i, v := range g.values {
+		points[i] = sunspecNotInt16
+		if g.known[i] {
+			points[i] = uint16(int16(math.Round(v / math.Pow10(e))))
+		}
+	}
+	return points, uint16(int16(e))
+}
+
+// sunspecMeterValues are the points of the wye meter models, in SI units
+// and the power factor in percent.
+type sunspecMeterValues struct {
+	current, voltage, power, pf sunspecGroup
+	freq                        float64
+	hasFreq                     bool
+	imported, exported          float64
+	hasImport, hasExport        bool
+}
+
+func newSunspecMeterValues(g gridValues) sunspecMeterValues {
+	var m sunspecMeterValues
+	set := func(group *sunspecGroup, i int, v float64, ok bool) {
+		group.values[i], group.known[i] = v, ok
+	}
+	var currentSum, voltageSum float64
+	var currents, voltages int
+	for phase := 0; phase < 3; phase++ {
+		current, ok := g.get(gridPhase(gridPhaseCurrent, phase))
+		set(&m.current, phase+1, current, ok)
+		if ok {
+			currentSum += current
+			currents++
+		}
+		voltage, ok := g.get(gridPhase(gridPhaseVoltage, phase))
+		set(&m.voltage, phase+1, voltage, ok)
+		if ok {
+			voltageSum += voltage
+			voltages++
+		}
+		p, ok := g.phasePower(phase)
+		set(&m.power, phase+1, p, ok)
+		pf, ok := g.get(gridPhase(gridPhasePowerFactor, phase))
+		set(&m.pf, phase+1, 100*pf, ok)
+	}
+	// the total current and the average voltage
+	set(&m.current, 0, currentSum, currents > 0)
+	set(&m.voltage, 0, voltageSum/float64(max(voltages, 1)), voltages > 0)
+	p, ok := g.power()
+	set(&m.power, 0, p, ok)
+	pf, ok := g.get(gridPowerFactor)
+	set(&m.pf, 0, 100*pf, ok)
+	m.freq, m.hasFreq = g.get(gridFrequency)
+	m.imported, m.hasImport = g.get(gridImport)
+	m.exported, m.hasExport = g.get(gridExport)
+	return m
+}
+
+// model203 encodes the integer wye meter model, scale factors included.
+func (m sunspecMeterValues) model203() []uint16 {
+	regs := make([]uint16, 105)
+	put := func(offset int, g sunspecGroup, minSF int) {
+		points, sf := g.encode(minSF)
+		copy(regs[offset:], points[:])
+		regs[offset+4] = sf
+	}
+	put(0, m.current, -2)
+	// phase to neutral voltages; the phase to phase ones (9 to 12) stay
+	// unimplemented
+	voltage, sf := m.voltage.encode(-1)
+	copy(regs[5:9], voltage[:])
+	for i := 9; i <= 12; i++ {
+		regs[i] = sunspecNotInt16
+	}
+	regs[13] = sf
+	freq := sunspecGroup{values: [4]float64{m.freq}, known: [4]bool{m.hasFreq}}
+	points, sf := freq.encode(-2)
+	regs[14], regs[15] = points[0], sf
+	put(16, m.power, 0)
+	put(21, sunspecGroup{}, 0)
+	put(26, sunspecGroup{}, 0)
+	put(31, m.pf, -2)
+
+	// energy counters as acc32 in Wh with a common scale factor; only the
+	// totals are known
+	e := 0
+	for math.Max(m.imported, m.exported)/math.Pow10(e) > math.MaxUint32 && e < 10 {
+		e++
+	}
+	acc := func(offset int, v float64, ok bool) {
+		c := uint32(sunspecNotAcc32)
+		if ok {
+			c = uint32(math.Round(v / math.Pow10(e)))
+		}
+		regs[offset], regs[offset+1] = uint16(c>>16), uint16(c)
+	}
+	acc(36, m.exported, m.hasExport)
+	acc(44, m.imported, m.hasImport)
+	regs[52] = uint16(int16(e))
+	for _, sfOffset := range []int{69, 102} {
+		regs[sfOffset] = sunspecNotInt16
+	}
+	return regs
+}
+
+// model213 encodes the float wye meter model. Points the meter does not
+// have are NaN.
+func (m sunspecMeterValues) model213() []uint16 {
+	regs := make([]uint16, 124)
+	nan := math.Float32bits(float32(math.NaN()))
+	for i := 0; i < 122; i += 2 {
+		regs[i], regs[i+1] = uint16(nan>>16), uint16(nan)
+	}
+	put := func(offset int, v float64, ok bool) {
+		if ok {
+			copy(regs[offset:], split32(math.Float32bits(float32(v))))
+		}
+	}
+	group := func(offset int, g sunspecGroup) {
+		for i := range g.values {
+			put(offset+2*i, g.values[i], g.known[i])
+		}
+	}
+	group(0, m.current)
+	group(8, m.voltage)
+	put(24, m.freq, m.hasFreq)
+	group(26, m.power)
+	group(50, m.pf)
+	put(58, m.exported, m.hasExport)
+	put(66, m.imported, m.hasImport)
+	return regs
+}
+
+// modbusSink serves the readings of a meter over Modbus TCP, as a SunSpec
+// meter and in a register map of its own. The registers are updated with
+// every frame; while the meter is offline reads of them fail.
+type modbusSink struct {
+	*gridMeter
+	cfg      ModbusConfig
+	meter    string
+	layout   sunspecMap
+	listener net.Listener
+
+	mu     sync.Mutex
+	regs   map[uint16]uint16
+	live   map[uint16]bool // registers that fail while offline
+	raw    map[string][]ModbusRegister
+	serial string
+	conns  map[net.Conn]bool
+	closed bool
+	wg     sync.WaitGroup
+}
+
+func newModbusSink(cfg ModbusConfig, meter string) (*modbusSink, error) {
+	l, err := net.Listen("tcp", cfg.listen())
+	if err != nil {
+		return nil, err
+	}
+	s := &modbusSink{
+		gridMeter: newGridMeter(),
+		cfg:       cfg,
+		meter:     meter,
+		layout:    sunspecLayout(cfg.model()),
+		listener:  l,
+		regs:      make(map[uint16]uint16),
+		live:      make(map[uint16]bool),
+		raw:       make(map[string][]ModbusRegister),
+		conns:     make(map[net.Conn]bool),
+	}
+	s.update()
+	log.Printf("[modbus] Serving %s as unit %d on %s", meter, cfg.unitID(), l.Addr())
+	s.wg.Add(1)
+	go s.serve()
+	return s, nil
+}
+
+func (s *modbusSink) Open(meter MeterConfig) {
+	s.gridMeter.Open(meter)
+	s.mu.Lock()
+	for _, r := range s.cfg.Registers {
+		for _, v := range meter.Values {
+			if r.Value == v.Name || r.Value == v.OBIS {
+				s.raw[v.Name] = append(s.raw[v.Name], r)
+			}
+		}
+	}
+	s.mu.Unlock()
+	s.update()
+}
+
+func (s *modbusSink) Write(meter string, readings []Reading) {
+	s.gridMeter.Write(meter, readings)
+	s.mu.Lock()
+	for _, r := range readings {
+		if r.Quality != QualityGood || math.IsNaN(r.Value) || math.IsInf(r.Value, 0) {
+			continue
+		}
+		for _, reg := range s.raw[r.Name] {
+			for i, v := range reg.encode(r.Value) {
+				s.regs[reg.Address+uint16(i)] = v
+			}
+		}
+	}
+	s.mu.Unlock()
+	s.update()
+}
+
+func (s *modbusSink) Status(meter string, status MeterStatus) {
+	s.gridMeter.Status(meter, status)
+	s.mu.Lock()
+	s.serial = status.Serial
+	s.mu.Unlock()
+	s.update()
+}
+
+// update rebuilds the SunSpec map from the latest values. While the meter
+// is offline the last values are kept.
+func (s *modbusSink) update() {
+	grid, _, ok := s.snapshot()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, built := s.regs[sunspecBase]; s.cfg.sunspec() && (ok || !built) {
+		serial := s.serial
+		if serial == "" {
+			serial = s.meter
+		}
+		values := newSunspecMeterValues(grid)
+		regs := []uint16{0x5375, 0x6e53}
+		regs = append(regs, sunspecCommon(s.meter, serial, s.cfg.unitID())...)
+		regs = append(regs, uint16(s.cfg.model()), uint16(s.layout.length))
+		if s.cfg.model() == 213 {
+			regs = append(regs, values.model213()...)
+		} else {
+			regs = append(regs, values.model203()...)
+		}
+		regs = append(regs, 0xffff, 0)
+		for i, v := range regs {
+			s.regs[uint16(sunspecBase+i)] = v
+		}
+		for i := s.layout.meter; i < s.layout.meter+s.layout.length; i++ {
+			s.live[uint16(sunspecBase+i)] = true
+		}
+	}
+	// raw registers read 0 until their value arrives
+	for _, r := range s.cfg.Registers {
+		for i := 0; i < modbusRegisterSizes[r.typ()]; i++ {
+			if _, ok := s.regs[r.Address+uint16(i)]; !ok {
+				s.regs[r.Address+uint16(i)] = 0
+			}
+			s.live[r.Address+uint16(i)] = true
+		}
+	}
+}
+
+func (s *modbusSink) Close() error {
+	err := s.listener.Close()
+	s.mu.Lock()
+	s.closed = true
+	for conn := range s.conns {
+		conn.Close()
+	}
+	s.mu.Unlock()
+	s.wg.Wait()
+	return err
+}
+
+func (s *modbusSink) serve() {
+	defer s.wg.Done()
+	for {
+		conn, err := s.listener.Accept()
+		if err != nil {
+			if !errors.Is(err, net.ErrClosed) {
+				log.Printf("[modbus] Stopped accepting connections: %v", err)
+			}
+			return
+		}
+		// a connection accepted while closing is not seen by Close
+		s.mu.Lock()
+		if s.closed {
+			s.mu.Unlock()
+			conn.Close()
+			continue
+		}
+		s.conns[conn] = true
+		s.wg.Add(1)
+		s.mu.Unlock()
+		go s.handle(conn)
+	}
+}
+
+// handle answers the requests of one client.
+func (s *modbusSink) handle(conn net.Conn) {
+	defer s.wg.Done()
+	defer func() {
+		s.mu.Lock()
+		delete(s.conns, conn)
+		s.mu.Unlock()
+		conn.Close()
+	}()
+	header := make([]byte, 7)
+	for {
+		if _, err := io.ReadFull(conn, header); err != nil {
+			return
+		}
+		// the length counts the unit ID and the PDU
+		length := int(binary.BigEndian.Uint16(header[4:]))
+		if binary.BigEndian.Uint16(header[2:]) != 0 || length < 2 || length > 254 {
+			return
+		}
+		pdu := make([]byte, length-1)
+		if _, err := io.ReadFull(conn, pdu); err != nil {
+			return
+		}
+		resp := s.respond(header[6], pdu)
+		frame := append(slices.Clone(header[:4]), 0, 0, header[6])
+		binary.BigEndian.PutUint16(frame[4:], uint16(len(resp)+1))
+		if _, err := conn.Write(append(frame, resp...)); err != nil {
+			return
+		}
+	}
+}
+
+// respond answers a request PDU with a response or an exception.
+func (s *modbusSink) respond(unit byte, pdu []byte) []byte {
+	fc := pdu[0]
+	exception := func(code byte) []byte { return []byte{fc | 0x80, code} }
+	if unit != s.cfg.unitID() {
+		return exception(modbusNoTarget)
+	}
+	if fc != modbusReadHolding && fc != modbusReadInput {
+		return exception(modbusIllegalFunc)
+	}
+	if len(pdu) != 5 {
+		return exception(modbusIllegalValue)
+	}
+	start := int(binary.BigEndian.Uint16(pdu[1:]))
+	count := int(binary.BigEndian.Uint16(pdu[3:]))
+	if count < 1 || count > modbusMaxRead {
+		return exception(modbusIllegalValue)
+	}
+
+	_, _, online := s.snapshot()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	resp := []byte{fc, byte(2 * count)}
+	for a := start; a < start+count; a++ {
+		if a > math.MaxUint16 {
+			return exception(modbusIllegalAddr)
+		}
+		v, ok := s.regs[uint16(a)]
+		if !ok {
+			return exception(modbusIllegalAddr)
+		}
+		if s.live[uint16(a)] && !online {
+			return exception(modbusDeviceFailure)
+		}
+		resp = binary.BigEndian.AppendUint16(resp, v)
+	}
+	return resp
+}
@@ -0,0 +1,304 @@
+package main
+
+import (
+	"encoding/binary"
+	"io"
+	"math"
+	"net"
+	"slices"
+	"testing"
+	"time"
+)
+
+func newTestModbus(t *testing.T, cfg ModbusConfig) (*modbusSink, net.Conn) {
+	t.Helper()
+	cfg.Listen = "127.0.0.1:0"
+	s, err := newModbusSink(cfg, "nutzstrom")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { s.Close() })
+	s.Open(modbusTestMeter)
+	conn, err := net.Dial("tcp", s.listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return s, conn
+}
+
+// modbusRead reads holding registers, or returns the exception code.
+func modbusRead(t *testing.T, conn net.Conn, unit byte, addr, count uint16) ([]uint16, byte) {
+	t.Helper()
+	req := []byte{0x12, 0x34, 0, 0, 0, 6, unit, modbusReadHolding}
+	req = binary.BigEndian.AppendUint16(req, addr)
+	req = binary.BigEndian.AppendUint16(req, count)
+	conn.SetDeadline(time.Now().Add(2 * time.Second))
+	if _, err := conn.Write(req); err != nil {
+		t.Fatal(err)
+	}
+	header := make([]byte, 7)
+	if _, err := io.ReadFull(conn, header); err != nil {
+		t.Fatal(err)
+	}
+	if header[0] != 0x12 || header[1] != 0x34 || header[6] != unit {
+		t.Fatalf("unexpected header % x", header)
+	}
+	pdu := make([]byte, binary.BigEndian.Uint16(header[4:])-1)
+	if _, err := io.ReadFull(conn, pdu); err != nil {
+		t.Fatal(err)
+	}
+	if pdu[0] == modbusReadHolding|0x80 {
+		return nil, pdu[1]
+	}
+	if pdu[0] != modbusReadHolding || int(pdu[1]) != 2*int(count) || len(pdu) != 2+2*int(count) {
+		t.Fatalf("unexpected response % x", pdu)
+	}
+	regs := make([]uint16, count)
+	for i := range regs {
+		regs[i] = binary.BigEndian.Uint16(pdu[2+2*i:])
+	}
+	return regs, 0
+}
+
+// modbusTestMeter adds power factors to smaTestMeter.
+var modbusTestMeter = func() MeterConfig {
+	meter := smaTestMeter
+	meter.Values = append(slices.Clone(meter.Values),
+		ValueConfig{Name: "Leistungsfaktor", OBIS: "1.0.13.7.0"},
+		ValueConfig{Name: "Leistungsfaktor L1", OBIS: "1.0.33.7.0"})
+	return meter
+}()
+
+var modbusTestReadings = []Reading{
+	{Name: "Bezug", Value: 8782400.5, Unit: "Wh", Quality: QualityGood},
+	{Name: "Einspeisung", Value: 1234.5, Unit: "kWh", Quality: QualityGood},
+	{Name: "Leistung", Value: -1500.25, Unit: "W", Quality: QualityGood},
+	{Name: "Leistung L1", Value: -1500.25, Unit: "W", Quality: QualityGood},
+	{Name: "Spannung L1", Value: 230.1, Unit: "V", Quality: QualityGood},
+	{Name: "Leistungsfaktor", Value: 0.95, Quality: QualityGood},
+	{Name: "Leistungsfaktor L1", Value: 0.9, Quality: QualityGood},
+}
+
+// ---------------------------------------------------------------------------
+// SunSpec
+// ---------------------------------------------------------------------------
+
+func TestModbusSink_Model203(t *testing.T) {
+	s, conn := newTestModbus(t, ModbusConfig{})
+
+	// the header and the common model are there before the first reading
+	regs, exc := modbusRead(t, conn, 1, sunspecBase, 4)
+	if exc != 0 || regs[0] != 0x5375 || regs[1] != 0x6e53 || regs[2] != 1 || regs[3] != sunspecCommonLength {
+		t.Fatalf("unexpected header %x (exception %d)", regs, exc)
+	}
+	if regs, _ := modbusRead(t, conn, 1, sunspecBase+4, 8); string(registerBytes(regs)[:12]) != "zaehler2mqtt" {
+		t.Fatalf("unexpected manufacturer %q", registerBytes(regs))
+	}
+	meter := uint16(sunspecBase + s.layout.meter)
+	if _, exc := modbusRead(t, conn, 1, meter, 20); exc != modbusDeviceFailure {
+		t.Fatalf("read while offline: exception %d", exc)
+	}
+
+	s.Status("nutzstrom", MeterStatus{Online: true, Serial: "1EMH0012345678"})
+	s.Write("nutzstrom", modbusTestReadings)
+
+	if regs, _ := modbusRead(t, conn, 1, meter-2, 2); regs[0] != 203 || regs[1] != 105 {
+		t.Fatalf("unexpected model header %v", regs)
+	}
+	if regs, _ := modbusRead(t, conn, 1, sunspecBase+52, 16); string(registerBytes(regs)[:14]) != "1EMH0012345678" {
+		t.Fatalf("unexpected serial %q", registerBytes(regs))
+	}
+	regs, exc = modbusRead(t, conn, 1, meter, 105)
+	if exc != 0 {
+		t.Fatalf("exception %d", exc)
+	}
+	// voltage 230.1 V with V_SF -1, power with W_SF 0
+	if regs[5] != 2301 || regs[6] != 2301 || regs[7] != sunspecNotInt16 || int16(regs[13]) != -1 {
+		t.Fatalf("unexpected voltages %v", regs[5:14])
+	}
+	if int16(regs[16]) != -1500 || int16(regs[17]) != -1500 || regs[18] != sunspecNotInt16 || regs[20] != 0 {
+		t.Fatalf("unexpected power %v", regs[16:21])
+	}
+	// power factors in percent with PF_SF -2
+	if regs[31] != 9500 || regs[32] != 9000 || regs[33] != sunspecNotInt16 || int16(regs[35]) != -2 {
+		t.Fatalf("unexpected power factors %v", regs[31:36])
+	}
+	acc := func(offset int) uint32 { return uint32(regs[offset])<<16 | uint32(regs[offset+1]) }
+	if acc(36) != 1234500 || acc(44) != 8782401 || regs[52] != 0 {
+		t.Fatalf("unexpected energy %d %d (SF %d)", acc(36), acc(44), int16(regs[52]))
+	}
+	if end, _ := modbusRead(t, conn, 1, meter+105, 2); end[0] != 0xffff || end[1] != 0 {
+		t.Fatalf("unexpected end marker %v", end)
+	}
+
+	s.Status("nutzstrom", MeterStatus{Online: false})
+	if _, exc := modbusRead(t, conn, 1, meter, 1); exc != modbusDeviceFailure {
+		t.Fatalf("read after going offline: exception %d", exc)
+	}
+}
+
+func TestModbusSink_Model213(t *testing.T) {
+	s, conn := newTestModbus(t, ModbusConfig{Model: 213})
+	s.Status("nutzstrom", MeterStatus{Online: true})
+	s.Write("nutzstrom", modbusTestReadings)
+
+	meter := uint16(sunspecBase + s.layout.meter)
+	if regs, _ := modbusRead(t, conn, 1, meter-2, 2); regs[0] != 213 || regs[1] != 124 {
+		t.Fatalf("unexpected model header %v", regs)
+	}
+	regs, exc := modbusRead(t, conn, 1, meter, 124)
+	if exc != 0 {
+		t.Fatalf("exception %d", exc)
+	}
+	float := func(offset int) float32 {
+		return math.Float32frombits(uint32(regs[offset])<<16 | uint32(regs[offset+1]))
+	}
+	if float(26) != -1500.25 || float(28) != -1500.25 || !math.IsNaN(float64(float(30))) {
+		t.Fatalf("unexpected power %v %v %v", float(26), float(28), float(30))
+	}
+	if float(50) != 95 || float(52) != 90 || !math.IsNaN(float64(float(54))) {
+		t.Fatalf("unexpected power factors %v %v %v", float(50), float(52), float(54))
+	}
+	if float(10) != 230.1 || float(58) != 1234500 || float(66) != 8782400.5 {
+		t.Fatalf("unexpected values %v %v %v", float(10), float(58), float(66))
+	}
+}
+
+func TestSunspecGroup_Encode(t *testing.T) {
+	g := sunspecGroup{values: [4]float64{123456, 40000, 0, 0}, known: [4]bool{true, true, false, false}}
+	points, sf := g.encode(0)
+	if points[0] != 12346 || points[1] != 4000 || points[2] != sunspecNotInt16 || sf != 1 {
+		t.Fatalf("unexpected encoding %v, SF %d", points, int16(sf))
+	}
+	points, sf = sunspecGroup{}.encode(-2)
+	if points[0] != sunspecNotInt16 || sf != sunspecNotInt16 {
+		t.Fatalf("unexpected encoding of an empty group %v, SF %d", points, int16(sf))
+	}
+}
+
+// ---------------------------------------------------------------------------
+// Raw registers and errors
+// ---------------------------------------------------------------------------
+
+func TestModbusSink_Registers(t *testing.T) {
+	no := false
+	s, conn := newTestModbus(t, ModbusConfig{UnitID: 3, SunSpec: &no, Registers: []ModbusRegister{
+		{Address: 0, Value: "Leistung", Type: "int32"},
+		{Address: 2, Value: "1.0.1.8.0", Type: "uint32", Scale: 0.001},
+		{Address: 4, Value: "Spannung L1", Type: "uint16", Scale: 10},
+		{Address: 10, Value: "Leistung"},
+	}})
+	s.Status("nutzstrom", MeterStatus{Online: true})
+	s.Write("nutzstrom", modbusTestReadings)
+
+	regs, exc := modbusRead(t, conn, 3, 0, 5)
+	if exc != 0 {
+		t.Fatalf("exception %d", exc)
+	}
+	if int32(uint32(regs[0])<<16|uint32(regs[1])) != -1500 || uint32(regs[2])<<16|uint32(regs[3]) != 8782 || regs[4] != 2301 {
+		t.Fatalf("unexpected registers %v", regs)
+	}
+	if regs, _ := modbusRead(t, conn, 3, 10, 2); math.Float32frombits(uint32(regs[0])<<16|uint32(regs[1])) != -1500.25 {
+		t.Fatalf("unexpected float registers %v", regs)
+	}
+
+	for _, tc := range []struct {
+		unit        byte
+		addr, count uint16
+		exception   byte
+	}{
+		{1, 0, 1, modbusNoTarget},
+		{3, 5, 1, modbusIllegalAddr},
+		{3, 4, 2, modbusIllegalAddr},
+		{3, sunspecBase, 2, modbusIllegalAddr},
+		{3, 0, 0, modbusIllegalValue},
+		{3, 0, 126, modbusIllegalValue},
+	} {
+		if _, exc := modbusRead(t, conn, tc.unit, tc.addr, tc.count); exc != tc.exception {
+			t.Errorf("unit %d, %d registers at %d: exception %d, want %d", tc.unit, tc.count, tc.addr, exc, tc.exception)
+		}
+	}
+
+	// writes are not supported
+	conn.Write([]byte{0, 1, 0, 0, 0, 6, 3, 0x06, 0, 0, 0, 1})
+	resp := make([]byte, 9)
+	if _, err := io.ReadFull(conn, resp); err != nil || resp[7] != 0x86 || resp[8] != modbusIllegalFunc {
+		t.Fatalf("unexpected response % x: %v", resp, err)
+	}
+}
+
+func TestModbusRegister_Encode(t *testing.T) {
+	for _, tc := range []struct {
+		reg  ModbusRegister
+		v    float64
+		want []uint16
+	}{
+		{ModbusRegister{Type: "int16"}, -2.6, []uint16{0xfffd}},
+		{ModbusRegister{Type: "int16"}, 1e6, []uint16{0x7fff}},
+		{ModbusRegister{Type: "uint16"}, -5, []uint16{0}},
+		{ModbusRegister{Type: "int32", Scale: 10}, -1.5, []uint16{0xffff, 0xfff1}},
+		{ModbusRegister{Type: "uint32"}, 70000, []uint16{1, 4464}},
+		{ModbusRegister{}, 1, []uint16{0x3f80, 0}},
+	} {
+		if got := tc.reg.encode(tc.v); !slices.Equal(got, tc.want) {
+			t.Errorf("%+v of %v: got %x, want %x", tc.reg, tc.v, got, tc.want)
+		}
+	}
+}
+
+// registerBytes returns the bytes of registers, as strings are stored.
+func registerBytes(regs []uint16) []byte {
+	var b []byte
+	for _, r := range regs {
+		b = binary.BigEndian.AppendUint16(b, r)
+	}
+	return b
+}
+
+// ---------------------------------------------------------------------------
+// Config
+// ---------------------------------------------------------------------------
+
+func TestLoadConfig_Modbus(t *testing.T) {
+	base := `
+meters:
+  - name: nutzstrom
+    device: /dev/ttyUSB0
+    values:
+      - name: Leistung
+        obis: "1.0.16.7.0"
+outputs:
+`
+	cfg, err := LoadConfig(writeTestConfig(t, base+`
+  - type: modbus
+    meters: [nutzstrom]
+    listen: ":1502"
+    model: 213
+    registers:
+      - address: 100
+        value: Leistung
+        type: int32
+`))
+	if err != nil {
+		t.Fatalf("LoadConfig error: %v", err)
+	}
+	if o := cfg.Outputs[0]; o.Modbus == nil || o.Modbus.listen() != ":1502" || o.Modbus.model() != 213 || o.Modbus.unitID() != 1 ||
+		len(o.Modbus.Registers) != 1 || o.Modbus.Registers[0].Address != 100 {
+		t.Fatalf("unexpected output %+v", o)
+	}
+
+	for _, bad := range []string{
+		"  - type: modbus\n",
+		"  - type: modbus\n    meters: [nutzstrom]\n    model: 201\n",
+		"  - type: modbus\n    meters: [nutzstrom]\n    unit_id: 300\n",
+		"  - type: modbus\n    meters: [nutzstrom]\n    registers:\n      - {address: 1, value: Bezug}\n",
+		"  - type: modbus\n    meters: [nutzstrom]\n    registers:\n      - {address: 1, value: Leistung, type: int64}\n",
+		"  - type: modbus\n    meters: [nutzstrom]\n    registers:\n      - {address: 1, value: Leistung}\n      - {address: 2, value: Leistung}\n",
+		"  - type: modbus\n    meters: [nutzstrom]\n    registers:\n      - {address: 40010, value: Leistung}\n",
+	} {
+		if _, err := LoadConfig(writeTestConfig(t, base+bad)); err == nil {
+			t.Errorf("expected error for %q", bad)
+		}
+	}
+}
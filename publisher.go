@@ -2,65 +2,503 @@ package main
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
+	"math"
+	"runtime/debug"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
+)
+
+const (
+	payloadOnline     = "online"
+	payloadOffline    = "offline"
+	discoveryScanWait = 2 * time.Second
 
-	mqtt "github.com/eclipse/paho.mqtt.golang"
+	// stateAckTimeout bounds how long the acknowledgement of a QoS 1 or 2
+	// state message is awaited in the background.
+	stateAckTimeout = 30 * time.Second
 )
 
 type Publisher struct {
-	client mqtt.Client
+	client brokerClient
+	topics *TopicLayout
+
+	// expiry is the MQTT 5 message expiry interval for state messages.
+	expiry time.Duration
+	// valueStates and meterStates select per-value topics and the
+	// aggregated JSON topic per meter.
+	valueStates bool
+	meterStates bool
+	// stateQoS and stateRetain apply to the JSON meter state and to values
+	// without their own settings.
+	stateQoS    byte
+	stateRetain bool
+	// scanWait is how long OwnedDiscoveryTopics collects retained messages.
+	scanWait time.Duration
+	// haDiscovery publishes Home Assistant discovery configs.
+	haDiscovery bool
+	// dialHomie connects a Homie device with its own Last Will. Homie
+	// messages go through the main connection if it is nil.
+	dialHomie func(meterName string, w will, onConnect func()) (brokerClient, error)
+
+	// connects and latency are exposed on /metrics.
+	connects atomic.Int64
+	latency  latencyHistogram
+
+	mu           sync.Mutex
+	meters       map[string]MeterConfig
+	availability map[string]bool
+	serials      map[string]string
+	discovery    map[string]discoveryEntry
+	devices      map[string]bool
+	buttons      map[string]bool
+	migrations   map[string][]string
+	homie        map[string]bool
+	homieClients map[string]brokerClient
+	states       map[string]outgoingMessage
+	commands     map[string]commandHandler
+}
+
+// discoveryEntry remembers what was announced so it can be replayed when Home
+// Assistant restarts or the broker loses its retained messages.
+type discoveryEntry struct {
+	meterName string
+	val       ValueConfig
 }
 
 func NewPublisher(cfg MQTTConfig) (*Publisher, error) {
-	opts := mqtt.NewClientOptions().
-		AddBroker(cfg.Broker).
-		SetClientID(cfg.ClientID).
-		SetAutoReconnect(true).
-		SetConnectRetry(true).
-		SetConnectRetryInterval(5 * time.Second)
+	topics, err := NewTopicLayout(cfg)
+	if err != nil {
+		return nil, err
+	}
+	p := &Publisher{
+		topics:       topics,
+		expiry:       cfg.MessageExpiry,
+		valueStates:  cfg.StateFormat != StateFormatJSON,
+		meterStates:  cfg.StateFormat == StateFormatJSON || cfg.StateFormat == StateFormatBoth,
+		stateQoS:     byte(cfg.QoS),
+		stateRetain:  cfg.Retain,
+		scanWait:     discoveryScanWait,
+		haDiscovery:  cfg.discovery(),
+		meters:       make(map[string]MeterConfig),
+		availability: make(map[string]bool),
+		serials:      make(map[string]string),
+		discovery:    make(map[string]discoveryEntry),
+		devices:      make(map[string]bool),
+		buttons:      make(map[string]bool),
+		migrations:   make(map[string][]string),
+		homie:        make(map[string]bool),
+		homieClients: make(map[string]brokerClient),
+		states:       make(map[string]outgoingMessage),
+		commands:     make(map[string]commandHandler),
+	}
+	p.dialHomie = func(meterName string, w will, onConnect func()) (brokerClient, error) {
+		homieCfg := cfg
+		homieCfg.ClientID = cfg.ClientID + "-homie-" + sanitizeHomieID(meterName)
+		return connectBroker(homieCfg, w, onConnect)
+	}
+
+	// onConnect can fire before connectBroker returns, so it waits until the
+	// client has been assigned.
+	ready := make(chan struct{})
+	client, err := connectBroker(cfg, will{topic: topics.BridgeStatus(), payload: payloadOffline}, func() {
+		<-ready
+		p.onConnect()
+	})
+	if err != nil {
+		return nil, err
+	}
+	p.client = client
+	close(ready)
+	log.Printf("Connected to MQTT broker %s (protocol version %d)", cfg.Broker, cfg.protocolVersion())
+	return p, nil
+}
+
+// onConnect runs on the initial connection and after every reconnect. The
+// broker may have fired our Last Will or dropped retained messages in between,
+// so availability and discovery are re-announced each time. Subscriptions do
+// not survive a clean-session reconnect and are renewed here as well.
+func (p *Publisher) onConnect() {
+	p.connects.Add(1)
+	p.client.Publish(statusMessage(p.topics.BridgeStatus(), true))
+
+	p.mu.Lock()
+	for meterName, online := range p.availability {
+		if topic, err := p.topics.Availability(meterName, p.serials[meterName]); err == nil {
+			p.client.Publish(statusMessage(topic, online))
+		}
+	}
+	p.mu.Unlock()
+
+	if p.haDiscovery {
+		haStatus := p.topics.HAStatus()
+		if token := p.client.Subscribe(haStatus, 1, p.onHAStatus); token.WaitTimeout(5*time.Second) && token.Error() != nil {
+			log.Printf("Failed to subscribe to %s: %v", haStatus, token.Error())
+		}
+	}
+	if p.topics.commands {
+		commands := p.topics.CommandFilter()
+		if token := p.client.Subscribe(commands, 1, p.onCommand); token.WaitTimeout(5*time.Second) && token.Error() != nil {
+			log.Printf("Failed to subscribe to %s: %v", commands, token.Error())
+		}
+	}
+	p.Republish()
+}
+
+// onHAStatus handles the Home Assistant birth message. It runs on paho's
+// message goroutine, so the republish is handed off to avoid blocking it.
+func (p *Publisher) onHAStatus(msg receivedMessage) {
+	if string(msg.Payload) != payloadOnline {
+		return
+	}
+	log.Printf("Home Assistant is online, republishing discovery")
+	go p.Republish()
+}
 
-	if cfg.Username != "" {
-		opts.SetUsername(cfg.Username)
-		opts.SetPassword(cfg.Password)
+// Republish sends all known discovery configs followed by the last state of
+// every value, so entities reappear with data immediately.
+func (p *Publisher) Republish() {
+	p.mu.Lock()
+	entries := make(map[string]discoveryEntry, len(p.discovery))
+	for id, e := range p.discovery {
+		entries[id] = e
+	}
+	var devices, buttons, homie []string
+	for meterName := range p.devices {
+		devices = append(devices, meterName)
+	}
+	for meterName := range p.buttons {
+		buttons = append(buttons, meterName)
 	}
+	for meterName := range p.homie {
+		homie = append(homie, meterName)
+	}
+	states := make([]outgoingMessage, 0, len(p.states))
+	for _, msg := range p.states {
+		states = append(states, msg)
+	}
+	p.mu.Unlock()
 
-	client := mqtt.NewClient(opts)
-	if token := client.Connect(); token.Wait() && token.Error() != nil {
-		return nil, token.Error()
+	for id, e := range entries {
+		p.publishDiscovery(e.meterName, id, e.val)
+	}
+	for _, meterName := range devices {
+		p.publishDeviceDiscovery(meterName)
+	}
+	for _, meterName := range buttons {
+		p.publishButtons(meterName)
+	}
+	for _, meterName := range homie {
+		p.publishHomieDevice(meterName)
+	}
+	for _, msg := range states {
+		p.client.Publish(msg)
 	}
-	log.Printf("Connected to MQTT broker %s", cfg.Broker)
-	return &Publisher{client: client}, nil
 }
 
+// Close marks the bridge and the Homie devices offline and disconnects. The
+// broker does not send the Last Will on a clean disconnect, so the offline
+// status is published explicitly.
 func (p *Publisher) Close() {
-	p.client.Disconnect(1000)
+	p.disconnectHomie()
+	token := p.client.Publish(statusMessage(p.topics.BridgeStatus(), false))
+	token.WaitTimeout(2 * time.Second)
+	p.client.Disconnect()
+}
+
+// RegisterMeter makes the device details of a meter known for its discovery
+// configs.
+func (p *Publisher) RegisterMeter(cfg MeterConfig) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.meters[cfg.Name] = cfg
+}
+
+// UnregisterMeter forgets a meter that was removed from the config, so that
+// it is not announced again on reconnect.
+func (p *Publisher) UnregisterMeter(meterName string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for _, topic := range p.meterTopicsLocked(meterName, p.serials[meterName]) {
+		delete(p.states, topic)
+	}
+	for _, v := range p.meters[meterName].Values {
+		if msg, ok := p.homieValue(meterName, v, nil); ok {
+			delete(p.states, msg.Topic)
+		}
+	}
+	delete(p.homie, meterName)
+	for id, e := range p.discovery {
+		if e.meterName == meterName {
+			delete(p.discovery, id)
+		}
+	}
+	delete(p.devices, meterName)
+	delete(p.buttons, meterName)
+	delete(p.availability, meterName)
+	delete(p.serials, meterName)
+	delete(p.meters, meterName)
+}
+
+// meterTopicsLocked returns the state, meter state and diagnostics topics of
+// a meter that can be rendered with the given serial number.
+func (p *Publisher) meterTopicsLocked(meterName, serial string) []string {
+	var topics []string
+	add := func(topic string, err error) {
+		if err == nil {
+			topics = append(topics, topic)
+		}
+	}
+	for _, v := range p.meters[meterName].Values {
+		add(p.topics.State(meterName, v, serial))
+	}
+	add(p.topics.MeterState(meterName, serial))
+	add(p.topics.Diagnostics(meterName, serial))
+	return topics
+}
+
+// topicError logs why a topic could not be rendered. Topics waiting for the
+// meter's serial number are published once it is known.
+func topicError(meterName string, err error) {
+	if !errors.Is(err, errSerialUnknown) {
+		log.Printf("[%s] %v", meterName, err)
+	}
+}
+
+func availabilityPayload(online bool) string {
+	if online {
+		return payloadOnline
+	}
+	return payloadOffline
+}
+
+// statusMessage is a retained online/offline message.
+func statusMessage(topic string, online bool) outgoingMessage {
+	return outgoingMessage{
+		Topic:       topic,
+		QoS:         1,
+		Retain:      true,
+		Payload:     []byte(availabilityPayload(online)),
+		ContentType: "text/plain",
+	}
+}
+
+// PublishAvailability publishes the reader health of a meter. Repeated calls
+// with an unchanged state are not sent again.
+func (p *Publisher) PublishAvailability(meterName string, online bool) {
+	p.mu.Lock()
+	prev, known := p.availability[meterName]
+	p.availability[meterName] = online
+	topic, err := p.topics.Availability(meterName, p.serials[meterName])
+	p.mu.Unlock()
+	if known && prev == online {
+		return
+	}
+
+	if err != nil {
+		topicError(meterName, err)
+	} else {
+		token := p.client.Publish(statusMessage(topic, online))
+		token.WaitTimeout(5 * time.Second)
+		if token.Error() != nil {
+			log.Printf("[%s] Failed to publish availability: %v", meterName, token.Error())
+		}
+	}
+	if p.homieEnabled(meterName) {
+		p.publishHomie(meterName, p.homieStateMessages(meterName, online))
+	}
 }
 
-func (p *Publisher) PublishDiscovery(meterName string, sensorID string, val ValueConfig) {
-	topic := fmt.Sprintf("homeassistant/sensor/%s/config", sensorID)
+// deviceInfo is the Home Assistant device block of a meter.
+func (p *Publisher) deviceInfo(meterName string) map[string]interface{} {
+	p.mu.Lock()
+	meter := p.meters[meterName]
+	p.mu.Unlock()
 
+	device := map[string]interface{}{
+		"identifiers":  []string{fmt.Sprintf("zaehler2mqtt_%s", meterName)},
+		"name":         meterName,
+		"manufacturer": "zaehler2mqtt",
+		"model":        "SML Meter Reader",
+	}
+	if meter.SuggestedArea != "" {
+		device["suggested_area"] = meter.SuggestedArea
+	}
+	if meter.ViaDevice != "" {
+		device["via_device"] = meter.ViaDevice
+	}
+	return device
+}
+
+func (p *Publisher) discoveryPayload(meterName string, sensorID string, val ValueConfig) (map[string]interface{}, error) {
+	p.mu.Lock()
+	serial := p.serials[meterName]
+	p.mu.Unlock()
+
+	stateTopic, err := p.topics.State(meterName, val, serial)
+	if err != nil {
+		return nil, err
+	}
+	availabilityTopic, err := p.topics.Availability(meterName, serial)
+	if err != nil {
+		return nil, err
+	}
 	payload := map[string]interface{}{
-		"name":                val.Name,
-		"unique_id":           sensorID,
-		"state_topic":         fmt.Sprintf("zaehler2mqtt/%s/%s/state", meterName, val.Name),
-		"value_template":      "{{ value }}",
-		"device_class":        val.DeviceClass,
-		"unit_of_measurement": val.Unit,
-		"device": map[string]interface{}{
-			"identifiers":  []string{fmt.Sprintf("zaehler2mqtt_%s", meterName)},
-			"name":         meterName,
-			"manufacturer": "zaehler2mqtt",
-			"model":        "SML Meter Reader",
+		"name":           val.Name,
+		"unique_id":      sensorID,
+		"state_topic":    stateTopic,
+		"value_template": "{{ value }}",
+		"availability": []map[string]string{
+			{"topic": p.topics.BridgeStatus()},
+			{"topic": availabilityTopic},
 		},
+		"availability_mode": "all",
+		"device":            p.deviceInfo(meterName),
+		"origin":            origin,
+	}
+	if val.DeviceClass != "" {
+		payload["device_class"] = val.DeviceClass
+	}
+	if val.Unit != "" {
+		payload["unit_of_measurement"] = val.Unit
 	}
 	if val.StateClass != "" {
 		payload["state_class"] = val.StateClass
 	}
+	if val.Icon != "" {
+		payload["icon"] = val.Icon
+	}
+	if val.SuggestedDisplayPrecision != nil {
+		payload["suggested_display_precision"] = *val.SuggestedDisplayPrecision
+	}
+	if val.EntityCategory != "" {
+		payload["entity_category"] = val.EntityCategory
+	}
+	if val.EnabledByDefault != nil {
+		payload["enabled_by_default"] = *val.EnabledByDefault
+	}
+	if val.ObjectID != "" {
+		payload["object_id"] = val.ObjectID
+	}
+	if val.ExpireAfter > 0 {
+		payload["expire_after"] = int(val.ExpireAfter / time.Second)
+	}
+	if val.ForceUpdate {
+		payload["force_update"] = true
+	}
+	// Diagnostics stay available while the meter is offline, that is when
+	// they matter most
+	if val.diagnostic != "" {
+		diagnosticsTopic, err := p.topics.Diagnostics(meterName, serial)
+		if err != nil {
+			return nil, err
+		}
+		payload["state_topic"] = diagnosticsTopic
+		payload["value_template"] = fmt.Sprintf("{{ value_json.%s }}", val.diagnostic)
+		payload["availability"] = []map[string]string{{"topic": p.topics.BridgeStatus()}}
+		return payload, nil
+	}
+	// The JSON topic keeps all values of a frame in sync, so entities read
+	// from it whenever it is published
+	if p.meterStates {
+		meterTopic, err := p.topics.MeterState(meterName, serial)
+		if err != nil {
+			return nil, err
+		}
+		entry := fmt.Sprintf("value_json['values'][%s]", jinjaString(val.Name))
+		payload["state_topic"] = meterTopic
+		payload["value_template"] = fmt.Sprintf("{{ %s['value'] }}", entry)
+		payload["json_attributes_topic"] = meterTopic
+		payload["json_attributes_template"] = fmt.Sprintf("{{ %s | tojson }}", entry)
+	}
+	return payload, nil
+}
+
+// origin identifies zaehler2mqtt as the source of its discovery configs.
+var origin = discoveryOrigin()
+
+func discoveryOrigin() map[string]string {
+	o := map[string]string{
+		"name":        "zaehler2mqtt",
+		"support_url": "https://github.com/petesahatt/zaehler2mqtt",
+	}
+	if info, ok := debug.ReadBuildInfo(); ok && info.Main.Version != "" && info.Main.Version != "(devel)" {
+		o["sw_version"] = info.Main.Version
+	}
+	return o
+}
+
+// jinjaString quotes s as a Jinja string literal.
+func jinjaString(s string) string {
+	return "'" + strings.NewReplacer(`\`, `\\`, `'`, `\'`).Replace(s) + "'"
+}
+
+// PublishMeterDiscovery announces all values and buttons of a registered
+// meter, or the bridge buttons if meterName is empty, as one device config or
+// one config per entity depending on the discovery mode. Configs of the other
+// mode are removed afterwards. Meters are also announced as Homie devices if
+// enabled.
+func (p *Publisher) PublishMeterDiscovery(meterName string) {
+	if p.topics.homie != 0 && meterName != "" {
+		p.mu.Lock()
+		p.homie[meterName] = true
+		p.mu.Unlock()
+		p.connectHomie(meterName)
+		p.publishHomieDevice(meterName)
+	}
+	if !p.haDiscovery {
+		return
+	}
+	if p.topics.deviceDiscovery {
+		p.mu.Lock()
+		p.devices[meterName] = true
+		p.mu.Unlock()
+		p.publishDeviceDiscovery(meterName)
+	} else {
+		p.mu.Lock()
+		var entities []ValueConfig
+		if meterName != "" {
+			entities = meterEntities(p.meters[meterName])
+		}
+		p.buttons[meterName] = true
+		p.mu.Unlock()
+		for _, v := range entities {
+			p.PublishDiscovery(meterName, v)
+		}
+		p.publishButtons(meterName)
+	}
+	p.finishMigration(meterName)
+}
+
+func (p *Publisher) PublishDiscovery(meterName string, val ValueConfig) {
+	sensorID := p.topics.SensorID(meterName, val.Name)
+	p.mu.Lock()
+	p.discovery[sensorID] = discoveryEntry{meterName: meterName, val: val}
+	p.mu.Unlock()
+	p.publishDiscovery(meterName, sensorID, val)
+}
+
+func (p *Publisher) publishDiscovery(meterName string, sensorID string, val ValueConfig) {
+	topic := p.topics.Discovery(sensorID)
 
+	payload, err := p.discoveryPayload(meterName, sensorID, val)
+	if err != nil {
+		topicError(meterName, err)
+		return
+	}
 	data, _ := json.Marshal(payload)
-	token := p.client.Publish(topic, 1, true, data)
+	token := p.client.Publish(outgoingMessage{
+		Topic:       topic,
+		QoS:         1,
+		Retain:      true,
+		Payload:     data,
+		ContentType: "application/json",
+	})
 	token.WaitTimeout(5 * time.Second)
 	if token.Error() != nil {
 		log.Printf("Failed to publish discovery for %s: %v", sensorID, token.Error())
@@ -69,9 +507,403 @@ func (p *Publisher) PublishDiscovery(meterName string, sensorID string, val Valu
 	}
 }
 
-func (p *Publisher) PublishState(meterName string, valueName string, value float64) {
-	topic := fmt.Sprintf("zaehler2mqtt/%s/%s/state", meterName, valueName)
-	payload := fmt.Sprintf("%.4f", value)
-	token := p.client.Publish(topic, 0, false, payload)
-	token.WaitTimeout(50 * time.Millisecond)
+// devicePayload is the device discovery config of a meter: the shared device
+// and origin blocks with one sensor component per value and one button
+// component per command. An empty meter name selects the bridge device,
+// which only has buttons.
+func (p *Publisher) devicePayload(meterName string) (map[string]interface{}, error) {
+	device := p.bridgeDeviceInfo()
+	var entities []ValueConfig
+	if meterName != "" {
+		device = p.deviceInfo(meterName)
+		p.mu.Lock()
+		entities = meterEntities(p.meters[meterName])
+		p.mu.Unlock()
+	}
+
+	components := make(map[string]interface{}, len(entities))
+	for _, v := range entities {
+		sensorID := p.topics.SensorID(meterName, v.Name)
+		c, err := p.discoveryPayload(meterName, sensorID, v)
+		if err != nil {
+			return nil, err
+		}
+		delete(c, "device")
+		delete(c, "origin")
+		c["platform"] = "sensor"
+		components[sensorID] = c
+	}
+	var commandButtons []buttonConfig
+	if p.topics.commands {
+		commandButtons = buttons(meterName)
+	}
+	for _, b := range commandButtons {
+		c := p.buttonPayload(meterName, b)
+		delete(c, "device")
+		delete(c, "origin")
+		c["platform"] = "button"
+		components[p.topics.ButtonID(meterName, b.command)] = c
+	}
+	return map[string]interface{}{
+		"device":     device,
+		"origin":     origin,
+		"components": components,
+	}, nil
+}
+
+func (p *Publisher) publishDeviceDiscovery(meterName string) {
+	deviceID := p.topics.BridgeDeviceID()
+	if meterName != "" {
+		deviceID = p.topics.DeviceID(meterName)
+	}
+	payload, err := p.devicePayload(meterName)
+	if err != nil {
+		topicError(meterName, err)
+		return
+	}
+	data, _ := json.Marshal(payload)
+	token := p.client.Publish(outgoingMessage{
+		Topic:       p.topics.DeviceDiscovery(deviceID),
+		QoS:         1,
+		Retain:      true,
+		Payload:     data,
+		ContentType: "application/json",
+	})
+	token.WaitTimeout(5 * time.Second)
+	if token.Error() != nil {
+		log.Printf("Failed to publish device discovery for %s: %v", deviceID, token.Error())
+	} else {
+		log.Printf("Published HA device discovery: %s", deviceID)
+	}
+}
+
+// SetMeterSerial records the serial number reported by a meter. It is sent
+// as a user property with MQTT 5 state messages and may be part of topics, so
+// the meter's discovery and availability are republished when it changes and
+// retained messages left on topics of the old serial number are cleared.
+func (p *Publisher) SetMeterSerial(meterName, serial string) {
+	p.mu.Lock()
+	prev := p.serials[meterName]
+	p.serials[meterName] = serial
+	var entries []discoveryEntry
+	var stale []string
+	device := false
+	online, announce := p.availability[meterName]
+	if prev != serial {
+		for _, e := range p.discovery {
+			if e.meterName == meterName {
+				entries = append(entries, e)
+			}
+		}
+		device = p.devices[meterName]
+
+		current := make(map[string]bool)
+		for _, topic := range p.meterTopicsLocked(meterName, serial) {
+			current[topic] = true
+		}
+		for _, topic := range p.meterTopicsLocked(meterName, prev) {
+			if msg, ok := p.states[topic]; ok && !current[topic] {
+				delete(p.states, topic)
+				if msg.Retain {
+					stale = append(stale, topic)
+				}
+			}
+		}
+	}
+	oldTopic, oldErr := p.topics.Availability(meterName, prev)
+	topic, err := p.topics.Availability(meterName, serial)
+	p.mu.Unlock()
+
+	if announce && err == nil && (oldErr != nil || oldTopic != topic) {
+		if oldErr == nil {
+			stale = append(stale, oldTopic)
+		}
+		token := p.client.Publish(statusMessage(topic, online))
+		token.WaitTimeout(5 * time.Second)
+		if token.Error() != nil {
+			log.Printf("[%s] Failed to publish availability: %v", meterName, token.Error())
+		}
+	}
+	for _, topic := range stale {
+		token := p.client.Publish(outgoingMessage{Topic: topic, QoS: 1, Retain: true})
+		token.WaitTimeout(5 * time.Second)
+		if token.Error() != nil {
+			log.Printf("[%s] Failed to clear %s: %v", meterName, topic, token.Error())
+		}
+	}
+
+	for _, e := range entries {
+		p.publishDiscovery(e.meterName, p.topics.SensorID(e.meterName, e.val.Name), e.val)
+	}
+	if device {
+		p.publishDeviceDiscovery(meterName)
+	}
+}
+
+func (p *Publisher) PublishState(meterName string, val ValueConfig, value float64) {
+	payload := []byte(fmt.Sprintf("%.4f", value))
+	p.mu.Lock()
+	homie, ok := p.homieValue(meterName, val, payload)
+	if ok {
+		p.states[homie.Topic] = homie
+	}
+	p.mu.Unlock()
+	if ok {
+		p.publishState(meterName, homie)
+	}
+
+	if !p.valueStates {
+		return
+	}
+	msg := outgoingMessage{
+		QoS:         val.qos(p.stateQoS),
+		Retain:      val.retain(p.stateRetain),
+		Payload:     payload,
+		ContentType: "text/plain",
+		Expiry:      p.expiry,
+		UserProperties: []userProperty{
+			{Key: "obis", Value: val.OBIS},
+		},
+	}
+	if val.Unit != "" {
+		msg.UserProperties = append(msg.UserProperties, userProperty{Key: "unit", Value: val.Unit})
+	}
+
+	p.mu.Lock()
+	serial := p.serials[meterName]
+	if serial != "" {
+		msg.UserProperties = append(msg.UserProperties, userProperty{Key: "serial", Value: serial})
+	}
+	topic, err := p.topics.State(meterName, val, serial)
+	if err == nil {
+		msg.Topic = topic
+		p.states[msg.Topic] = msg
+	}
+	p.mu.Unlock()
+	if err != nil {
+		topicError(meterName, err)
+		return
+	}
+
+	p.publishState(meterName, msg)
+}
+
+// publishState sends a state message without holding up the meter reader.
+// QoS 0 messages are only given a moment to be written; acknowledgements of
+// QoS 1 and 2 messages are awaited in the background so that failures are
+// still logged. The time until a message is written or acknowledged goes
+// into the latency histogram.
+func (p *Publisher) publishState(meterName string, msg outgoingMessage) {
+	start := time.Now()
+	token := p.client.Publish(msg)
+	if msg.QoS == 0 {
+		if token.WaitTimeout(50 * time.Millisecond) {
+			p.latency.Observe(time.Since(start))
+		}
+		return
+	}
+	go func() {
+		if !token.WaitTimeout(stateAckTimeout) {
+			log.Printf("[%s] No acknowledgement for %s within %v", meterName, msg.Topic, stateAckTimeout)
+		} else if err := token.Error(); err != nil {
+			log.Printf("[%s] Failed to publish %s: %v", meterName, msg.Topic, err)
+		} else {
+			p.latency.Observe(time.Since(start))
+		}
+	}()
+}
+
+// meterStatePayload is the aggregated JSON state of a meter.
+type meterStatePayload struct {
+	Timestamp time.Time                  `json:"timestamp"`
+	Serial    string                     `json:"serial,omitempty"`
+	Values    map[string]meterStateValue `json:"values"`
+}
+
+type meterStateValue struct {
+	Value float64 `json:"value"`
+	Unit  string  `json:"unit,omitempty"`
+	OBIS  string  `json:"obis"`
+}
+
+// PublishMeterState publishes all values of one SML frame as a single JSON
+// message, so consumers see a consistent snapshot.
+func (p *Publisher) PublishMeterState(meterName string, at time.Time, values []FrameValue) {
+	if !p.meterStates {
+		return
+	}
+	p.mu.Lock()
+	serial := p.serials[meterName]
+	p.mu.Unlock()
+	topic, err := p.topics.MeterState(meterName, serial)
+	if err != nil {
+		topicError(meterName, err)
+		return
+	}
+
+	state := meterStatePayload{
+		Timestamp: at.UTC(),
+		Serial:    serial,
+		Values:    make(map[string]meterStateValue, len(values)),
+	}
+	for _, v := range values {
+		state.Values[v.Config.Name] = meterStateValue{
+			Value: math.Round(v.Value*1e4) / 1e4,
+			Unit:  v.Config.Unit,
+			OBIS:  v.OBIS,
+		}
+	}
+	data, _ := json.Marshal(state)
+
+	msg := outgoingMessage{
+		Topic:       topic,
+		QoS:         p.stateQoS,
+		Retain:      p.stateRetain,
+		Payload:     data,
+		ContentType: "application/json",
+		Expiry:      p.expiry,
+	}
+	if serial != "" {
+		msg.UserProperties = []userProperty{{Key: "serial", Value: serial}}
+	}
+
+	p.mu.Lock()
+	p.states[msg.Topic] = msg
+	p.mu.Unlock()
+
+	p.publishState(meterName, msg)
+}
+
+// PublishDiagnostics publishes the reader health of a meter for its
+// diagnostic sensors.
+func (p *Publisher) PublishDiagnostics(meterName string, d diagnosticsPayload) {
+	p.mu.Lock()
+	d.Device = p.meters[meterName].Device
+	d.Serial = p.serials[meterName]
+	p.mu.Unlock()
+	topic, err := p.topics.Diagnostics(meterName, d.Serial)
+	if err != nil {
+		topicError(meterName, err)
+		return
+	}
+
+	data, _ := json.Marshal(d)
+	msg := outgoingMessage{
+		Topic:       topic,
+		Payload:     data,
+		ContentType: "application/json",
+	}
+	p.mu.Lock()
+	p.states[msg.Topic] = msg
+	p.mu.Unlock()
+
+	p.publishState(meterName, msg)
+}
+
+// OwnedDiscoveryTopics returns the retained discovery topics on the broker that
+// belong to zaehler2mqtt. Retained messages are delivered right after
+// subscribing, so collecting for a short while is enough to see all of them.
+func (p *Publisher) OwnedDiscoveryTopics() ([]string, error) {
+	var mu sync.Mutex
+	seen := make(map[string]bool)
+	handler := func(msg receivedMessage) {
+		if !msg.Retained || !p.topics.ownsDiscovery(msg.Topic, msg.Payload) {
+			return
+		}
+		mu.Lock()
+		seen[msg.Topic] = true
+		mu.Unlock()
+	}
+
+	filters := p.topics.DiscoveryFilters()
+	for _, filter := range filters {
+		token := p.client.Subscribe(filter, 1, handler)
+		if !token.WaitTimeout(5 * time.Second) {
+			return nil, fmt.Errorf("timeout subscribing to %s", filter)
+		}
+		if token.Error() != nil {
+			return nil, token.Error()
+		}
+	}
+	time.Sleep(p.scanWait)
+	for _, filter := range filters {
+		p.client.Unsubscribe(filter).WaitTimeout(5 * time.Second)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	topics := make([]string, 0, len(seen))
+	for topic := range seen {
+		topics = append(topics, topic)
+	}
+	sort.Strings(topics)
+	return topics, nil
+}
+
+// ClearDiscovery removes retained discovery configs by publishing empty
+// retained payloads, which makes Home Assistant delete the entities.
+func (p *Publisher) ClearDiscovery(topics []string) {
+	for _, topic := range topics {
+		token := p.client.Publish(outgoingMessage{Topic: topic, QoS: 1, Retain: true})
+		token.WaitTimeout(5 * time.Second)
+		if token.Error() != nil {
+			log.Printf("Failed to clear discovery %s: %v", topic, token.Error())
+		} else {
+			log.Printf("Removed HA discovery: %s", topic)
+		}
+	}
+}
+
+// RemoveStaleDiscovery clears owned discovery configs the given meters no
+// longer announce, e.g. values that were renamed or removed from the config.
+// Configs left over from the other discovery mode are marked for migration
+// instead, so that Home Assistant hands their entities over to the new
+// configs, and are cleared once the meter's discovery has been published.
+func (p *Publisher) RemoveStaleDiscovery(meters []MeterConfig) error {
+	if !p.haDiscovery {
+		return nil
+	}
+	owned, err := p.OwnedDiscoveryTopics()
+	if err != nil {
+		return err
+	}
+	keep := p.topics.ConfiguredDiscovery(meters)
+	migrated := p.topics.MigratedDiscovery(meters)
+	var stale []string
+	for _, topic := range owned {
+		if keep[topic] {
+			continue
+		}
+		meterName, ok := migrated[topic]
+		if !ok {
+			stale = append(stale, topic)
+			continue
+		}
+		token := p.client.Publish(outgoingMessage{
+			Topic:       topic,
+			QoS:         1,
+			Retain:      true,
+			Payload:     []byte(`{"migrate_discovery":true}`),
+			ContentType: "application/json",
+		})
+		token.WaitTimeout(5 * time.Second)
+		if token.Error() != nil {
+			log.Printf("Failed to mark %s for migration: %v", topic, token.Error())
+			continue
+		}
+		p.mu.Lock()
+		p.migrations[meterName] = append(p.migrations[meterName], topic)
+		p.mu.Unlock()
+	}
+	p.ClearDiscovery(stale)
+	return nil
+}
+
+// finishMigration clears the migrated discovery configs of a meter.
+func (p *Publisher) finishMigration(meterName string) {
+	p.mu.Lock()
+	topics := p.migrations[meterName]
+	delete(p.migrations, meterName)
+	p.mu.Unlock()
+	p.ClearDiscovery(topics)
 }
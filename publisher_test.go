@@ -0,0 +1,652 @@
+package main
+
+import (
+	"encoding/json"
+	"sync"
+	"testing"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+)
+
+// fakeClient records publishes instead of talking to a broker.
+type fakeClient struct {
+	mu        sync.Mutex
+	published []outgoingMessage
+	subs      map[string]messageHandler
+	retained  map[string]string
+}
+
+func (c *fakeClient) Publish(msg outgoingMessage) token {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.published = append(c.published, msg)
+	return &mqtt.DummyToken{}
+}
+
+func (c *fakeClient) Subscribe(filter string, qos byte, handler messageHandler) token {
+	c.mu.Lock()
+	if c.subs == nil {
+		c.subs = make(map[string]messageHandler)
+	}
+	c.subs[filter] = handler
+	c.mu.Unlock()
+	for topic, payload := range c.retained {
+		if topicMatches(filter, topic) {
+			handler(receivedMessage{Topic: topic, Payload: []byte(payload), Retained: true})
+		}
+	}
+	return &mqtt.DummyToken{}
+}
+
+func (c *fakeClient) Unsubscribe(filter string) token {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	delete(c.subs, filter)
+	return &mqtt.DummyToken{}
+}
+
+func (c *fakeClient) Disconnect() {}
+
+func (c *fakeClient) IsConnected() bool { return true }
+
+// messages returns the recorded publishes for a topic.
+func (c *fakeClient) messages(topic string) []outgoingMessage {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	var out []outgoingMessage
+	for _, m := range c.published {
+		if m.Topic == topic {
+			out = append(out, m)
+		}
+	}
+	return out
+}
+
+func (c *fakeClient) reset() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.published = nil
+}
+
+func newTestPublisher() (*Publisher, *fakeClient) {
+	client := &fakeClient{}
+	topics, _ := NewTopicLayout(MQTTConfig{})
+	p := &Publisher{
+		client:       client,
+		topics:       topics,
+		valueStates:  true,
+		haDiscovery:  true,
+		meters:       make(map[string]MeterConfig),
+		availability: make(map[string]bool),
+		serials:      make(map[string]string),
+		discovery:    make(map[string]discoveryEntry),
+		devices:      make(map[string]bool),
+		buttons:      make(map[string]bool),
+		migrations:   make(map[string][]string),
+		homie:        make(map[string]bool),
+		homieClients: make(map[string]brokerClient),
+		states:       make(map[string]outgoingMessage),
+		commands:     make(map[string]commandHandler),
+	}
+	return p, client
+}
+
+// ---------------------------------------------------------------------------
+// Discovery payload
+// ---------------------------------------------------------------------------
+
+func TestDiscoveryPayload_Availability(t *testing.T) {
+	val := ValueConfig{Name: "Leistung", DeviceClass: "power", StateClass: "measurement", Unit: "W"}
+	p, _ := newTestPublisher()
+	payload, _ := p.discoveryPayload("nutzstrom", "zaehler2mqtt_nutzstrom_Leistung", val)
+
+	avail, ok := payload["availability"].([]map[string]string)
+	if !ok {
+		t.Fatalf("availability has unexpected type %T", payload["availability"])
+	}
+	if len(avail) != 2 {
+		t.Fatalf("expected 2 availability entries, got %d", len(avail))
+	}
+	if avail[0]["topic"] != "zaehler2mqtt/status" {
+		t.Fatalf("bridge availability topic = %q", avail[0]["topic"])
+	}
+	if avail[1]["topic"] != "zaehler2mqtt/nutzstrom/availability" {
+		t.Fatalf("meter availability topic = %q", avail[1]["topic"])
+	}
+	if payload["availability_mode"] != "all" {
+		t.Fatalf("availability_mode = %v", payload["availability_mode"])
+	}
+}
+
+func TestDiscoveryPayload_StateClassOptional(t *testing.T) {
+	p, _ := newTestPublisher()
+	payload, _ := p.discoveryPayload("nutzstrom", "id", ValueConfig{Name: "Bezug"})
+	if _, ok := payload["state_class"]; ok {
+		t.Fatal("state_class should be omitted when empty")
+	}
+	if payload["state_topic"] != "zaehler2mqtt/nutzstrom/Bezug/state" {
+		t.Fatalf("state_topic = %v", payload["state_topic"])
+	}
+}
+
+func TestDiscoveryPayload_EntitySettings(t *testing.T) {
+	p, _ := newTestPublisher()
+	p.RegisterMeter(MeterConfig{Name: "nutzstrom", SuggestedArea: "Keller", ViaDevice: "bridge"})
+	precision, enabled := 0, false
+	val := ValueConfig{
+		Name:                      "Leistung",
+		Icon:                      "mdi:flash",
+		SuggestedDisplayPrecision: &precision,
+		EntityCategory:            "diagnostic",
+		EnabledByDefault:          &enabled,
+		ObjectID:                  "nutzstrom_leistung",
+		ExpireAfter:               2 * time.Minute,
+		ForceUpdate:               true,
+	}
+	config, err := p.discoveryPayload("nutzstrom", "id", val)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, _ := json.Marshal(config)
+	var payload struct {
+		Icon             string `json:"icon"`
+		Precision        *int   `json:"suggested_display_precision"`
+		EntityCategory   string `json:"entity_category"`
+		EnabledByDefault *bool  `json:"enabled_by_default"`
+		ObjectID         string `json:"object_id"`
+		ExpireAfter      int    `json:"expire_after"`
+		ForceUpdate      bool   `json:"force_update"`
+		Device           struct {
+			SuggestedArea string `json:"suggested_area"`
+			ViaDevice     string `json:"via_device"`
+		} `json:"device"`
+		Origin struct {
+			Name string `json:"name"`
+		} `json:"origin"`
+	}
+	if err := json.Unmarshal(data, &payload); err != nil {
+		t.Fatal(err)
+	}
+	if payload.Icon != "mdi:flash" || payload.Precision == nil || *payload.Precision != 0 ||
+		payload.EntityCategory != "diagnostic" || payload.EnabledByDefault == nil || *payload.EnabledByDefault ||
+		payload.ObjectID != "nutzstrom_leistung" || payload.ExpireAfter != 120 || !payload.ForceUpdate {
+		t.Fatalf("unexpected entity settings: %s", data)
+	}
+	if payload.Device.SuggestedArea != "Keller" || payload.Device.ViaDevice != "bridge" {
+		t.Fatalf("unexpected device settings: %s", data)
+	}
+	if payload.Origin.Name != "zaehler2mqtt" {
+		t.Fatalf("origin = %+v", payload.Origin)
+	}
+}
+
+func TestDiscoveryPayload_EntitySettingsOptional(t *testing.T) {
+	p, _ := newTestPublisher()
+	payload, _ := p.discoveryPayload("nutzstrom", "id", ValueConfig{Name: "Bezug"})
+	for _, key := range []string{"icon", "suggested_display_precision", "entity_category", "enabled_by_default", "object_id", "expire_after", "force_update"} {
+		if _, ok := payload[key]; ok {
+			t.Errorf("%s should be omitted when not configured", key)
+		}
+	}
+}
+
+func TestAvailabilityPayload(t *testing.T) {
+	if availabilityPayload(true) != "online" || availabilityPayload(false) != "offline" {
+		t.Fatal("unexpected availability payloads")
+	}
+}
+
+// ---------------------------------------------------------------------------
+// Availability
+// ---------------------------------------------------------------------------
+
+func TestPublishAvailability_Deduplicates(t *testing.T) {
+	p, client := newTestPublisher()
+	p.PublishAvailability("nutzstrom", true)
+	p.PublishAvailability("nutzstrom", true)
+	p.PublishAvailability("nutzstrom", false)
+
+	msgs := client.messages("zaehler2mqtt/nutzstrom/availability")
+	if len(msgs) != 2 {
+		t.Fatalf("expected 2 availability publishes, got %d", len(msgs))
+	}
+	if string(msgs[0].Payload) != "online" || string(msgs[1].Payload) != "offline" {
+		t.Fatalf("unexpected payloads: %+v", msgs)
+	}
+	if !msgs[0].Retain {
+		t.Fatal("availability should be retained")
+	}
+}
+
+func TestPublishAvailability_SerialTopic(t *testing.T) {
+	p, client := newTestPublisher()
+	p.topics, _ = NewTopicLayout(MQTTConfig{
+		AvailabilityTopic: "{{.Base}}/{{.Serial}}/availability",
+		StateTopic:        "{{.Base}}/{{.Serial}}/{{.Value}}",
+	})
+	p.stateRetain = true
+	val := ValueConfig{OBIS: "1.0.16.7.0", Name: "Leistung"}
+	p.RegisterMeter(MeterConfig{Name: "nutzstrom", Values: []ValueConfig{val}})
+
+	// Nothing is published before the serial number is known
+	p.PublishAvailability("nutzstrom", true)
+	p.PublishState("nutzstrom", val, 246)
+	if len(client.published) != 0 {
+		t.Fatalf("published without serial: %+v", client.published)
+	}
+
+	p.SetMeterSerial("nutzstrom", "0a01")
+	p.PublishState("nutzstrom", val, 246)
+	if msgs := client.messages("zaehler2mqtt/0a01/availability"); len(msgs) != 1 || string(msgs[0].Payload) != "online" {
+		t.Fatalf("availability = %+v", msgs)
+	}
+
+	// A new meter on the same reader leaves no retained messages behind
+	p.SetMeterSerial("nutzstrom", "0b02")
+	for _, topic := range []string{"zaehler2mqtt/0a01/availability", "zaehler2mqtt/0a01/Leistung"} {
+		msgs := client.messages(topic)
+		if last := msgs[len(msgs)-1]; !last.Retain || len(last.Payload) != 0 {
+			t.Fatalf("%s not cleared: %+v", topic, msgs)
+		}
+	}
+	if msgs := client.messages("zaehler2mqtt/0b02/availability"); len(msgs) != 1 || string(msgs[0].Payload) != "online" {
+		t.Fatalf("availability = %+v", msgs)
+	}
+	if _, ok := p.states["zaehler2mqtt/0a01/Leistung"]; ok {
+		t.Fatal("state of the old serial is still republished")
+	}
+}
+
+// ---------------------------------------------------------------------------
+// Republish
+// ---------------------------------------------------------------------------
+
+func TestRepublish_DiscoveryAndStates(t *testing.T) {
+	p, client := newTestPublisher()
+	p.PublishDiscovery("nutzstrom", ValueConfig{Name: "Leistung"})
+	p.PublishState("nutzstrom", ValueConfig{Name: "Leistung"}, 246)
+	client.reset()
+
+	p.Republish()
+
+	if n := len(client.messages("homeassistant/sensor/zaehler2mqtt_nutzstrom_Leistung/config")); n != 1 {
+		t.Fatalf("expected discovery to be republished once, got %d", n)
+	}
+	states := client.messages("zaehler2mqtt/nutzstrom/Leistung/state")
+	if len(states) != 1 || string(states[0].Payload) != "246.0000" {
+		t.Fatalf("unexpected republished state: %+v", states)
+	}
+}
+
+func TestOnConnect_SubscribesToHAStatus(t *testing.T) {
+	p, client := newTestPublisher()
+	p.onConnect()
+
+	if _, ok := client.subs["homeassistant/status"]; !ok {
+		t.Fatal("expected subscription to homeassistant/status")
+	}
+	msgs := client.messages("zaehler2mqtt/status")
+	if len(msgs) != 1 || string(msgs[0].Payload) != "online" {
+		t.Fatalf("expected bridge online status, got %+v", msgs)
+	}
+}
+
+// ---------------------------------------------------------------------------
+// Discovery cleanup
+// ---------------------------------------------------------------------------
+
+// ownedConfig is a retained discovery payload as published by this instance.
+const ownedConfig = `{"state_topic":"zaehler2mqtt/nutzstrom/Bezug/state","availability":[{"topic":"zaehler2mqtt/status"}]}`
+
+func TestOwnedDiscoveryTopics(t *testing.T) {
+	p, client := newTestPublisher()
+	client.retained = map[string]string{
+		"homeassistant/sensor/zaehler2mqtt_nutzstrom_Bezug/config":   ownedConfig,
+		"homeassistant/sensor/zaehler2mqtt_nutzstrom_Altwert/config": `{"state_topic":"zaehler2mqtt/nutzstrom/Altwert/state"}`,
+		"homeassistant/sensor/zaehler2mqtt_nutzstrom_Leer/config":    "",
+		"homeassistant/sensor/zaehler2mqtt_2_nutzstrom_Bezug/config": `{"availability":[{"topic":"zaehler2mqtt_2/status"}]}`,
+		"homeassistant/sensor/other_sensor/config":                   ownedConfig,
+	}
+
+	topics, err := p.OwnedDiscoveryTopics()
+	if err != nil {
+		t.Fatalf("OwnedDiscoveryTopics error: %v", err)
+	}
+	want := []string{
+		"homeassistant/sensor/zaehler2mqtt_nutzstrom_Altwert/config",
+		"homeassistant/sensor/zaehler2mqtt_nutzstrom_Bezug/config",
+	}
+	if len(topics) != len(want) {
+		t.Fatalf("got %v, want %v", topics, want)
+	}
+	for i := range want {
+		if topics[i] != want[i] {
+			t.Fatalf("got %v, want %v", topics, want)
+		}
+	}
+}
+
+func TestRemoveStaleDiscovery(t *testing.T) {
+	p, client := newTestPublisher()
+	client.retained = map[string]string{
+		"homeassistant/sensor/zaehler2mqtt_nutzstrom_Bezug/config":   ownedConfig,
+		"homeassistant/sensor/zaehler2mqtt_nutzstrom_Altwert/config": ownedConfig,
+	}
+	meters := []MeterConfig{{Name: "nutzstrom", Values: []ValueConfig{{Name: "Bezug"}}}}
+
+	if err := p.RemoveStaleDiscovery(meters); err != nil {
+		t.Fatalf("RemoveStaleDiscovery error: %v", err)
+	}
+
+	stale := client.messages("homeassistant/sensor/zaehler2mqtt_nutzstrom_Altwert/config")
+	if len(stale) != 1 || len(stale[0].Payload) != 0 || !stale[0].Retain {
+		t.Fatalf("expected empty retained payload for stale config, got %+v", stale)
+	}
+	if kept := client.messages("homeassistant/sensor/zaehler2mqtt_nutzstrom_Bezug/config"); len(kept) != 0 {
+		t.Fatalf("configured value should not be cleared, got %+v", kept)
+	}
+}
+
+func TestRemoveStaleDiscovery_FilteredOutput(t *testing.T) {
+	cfg, err := LoadConfig(writeTestConfig(t, `
+meters:
+  - name: nutzstrom
+    device: /dev/ttyUSB0
+    values:
+      - name: Bezug
+        obis: "1.0.1.8.0"
+      - name: Leistung
+        obis: "1.0.16.7.0"
+  - name: waermestrom
+    device: /dev/ttyUSB1
+    values:
+      - name: Bezug
+        obis: "1.0.1.8.0"
+outputs:
+  - type: mqtt
+    meters: ["nutzstrom"]
+    values: ["Leistung"]
+`))
+	if err != nil {
+		t.Fatalf("LoadConfig error: %v", err)
+	}
+	p, client := newTestPublisher()
+	client.retained = map[string]string{
+		"homeassistant/sensor/zaehler2mqtt_nutzstrom_Bezug/config":       ownedConfig,
+		"homeassistant/sensor/zaehler2mqtt_nutzstrom_Leistung/config":    ownedConfig,
+		"homeassistant/sensor/zaehler2mqtt_waermestrom_Bezug/config":     ownedConfig,
+		"homeassistant/button/zaehler2mqtt_waermestrom_reconnect/config": ownedConfig,
+	}
+
+	if err := p.RemoveStaleDiscovery(outputMeters(cfg.Outputs, OutputMQTT, cfg.Meters)); err != nil {
+		t.Fatalf("RemoveStaleDiscovery error: %v", err)
+	}
+
+	for _, topic := range []string{
+		"homeassistant/sensor/zaehler2mqtt_nutzstrom_Bezug/config",
+		"homeassistant/sensor/zaehler2mqtt_waermestrom_Bezug/config",
+		"homeassistant/button/zaehler2mqtt_waermestrom_reconnect/config",
+	} {
+		if msgs := client.messages(topic); len(msgs) != 1 || len(msgs[0].Payload) != 0 {
+			t.Errorf("%s filtered from the mqtt output but not cleared: %+v", topic, msgs)
+		}
+	}
+	if kept := client.messages("homeassistant/sensor/zaehler2mqtt_nutzstrom_Leistung/config"); len(kept) != 0 {
+		t.Fatalf("value of the mqtt output should not be cleared, got %+v", kept)
+	}
+}
+
+// ---------------------------------------------------------------------------
+// Device discovery
+// ---------------------------------------------------------------------------
+
+func newDeviceTestPublisher() (*Publisher, *fakeClient) {
+	p, client := newTestPublisher()
+	p.topics, _ = NewTopicLayout(MQTTConfig{DiscoveryMode: DiscoveryModeDevice})
+	p.RegisterMeter(MeterConfig{Name: "nutzstrom", Values: []ValueConfig{
+		{Name: "Bezug", DeviceClass: "energy", Unit: "Wh"},
+		{Name: "Leistung", DeviceClass: "power", Unit: "W"},
+	}})
+	return p, client
+}
+
+func TestPublishMeterDiscovery_Device(t *testing.T) {
+	p, client := newDeviceTestPublisher()
+	p.PublishMeterDiscovery("nutzstrom")
+
+	msgs := client.messages("homeassistant/device/zaehler2mqtt_nutzstrom/config")
+	if len(msgs) != 1 || !msgs[0].Retain {
+		t.Fatalf("expected one retained device config, got %+v", msgs)
+	}
+	if n := len(client.messages("homeassistant/sensor/zaehler2mqtt_nutzstrom_Bezug/config")); n != 0 {
+		t.Fatalf("expected no sensor configs in device mode, got %d", n)
+	}
+
+	var payload struct {
+		Device     map[string]interface{} `json:"device"`
+		Origin     map[string]string      `json:"origin"`
+		Components map[string]map[string]interface{}
+	}
+	if err := json.Unmarshal(msgs[0].Payload, &payload); err != nil {
+		t.Fatal(err)
+	}
+	if payload.Device["name"] != "nutzstrom" || payload.Origin["name"] != "zaehler2mqtt" {
+		t.Fatalf("unexpected device or origin: %s", msgs[0].Payload)
+	}
+	if want := 2 + len(diagnosticValues) + len(meterButtons); len(payload.Components) != want {
+		t.Fatalf("expected %d components, got %d", want, len(payload.Components))
+	}
+	c := payload.Components["zaehler2mqtt_nutzstrom_Leistung"]
+	if c["platform"] != "sensor" || c["unique_id"] != "zaehler2mqtt_nutzstrom_Leistung" ||
+		c["state_topic"] != "zaehler2mqtt/nutzstrom/Leistung/state" || c["device_class"] != "power" {
+		t.Fatalf("unexpected component: %v", c)
+	}
+	if _, ok := c["device"]; ok {
+		t.Fatal("components must not repeat the device block")
+	}
+	if !p.topics.ownsDiscovery(msgs[0].Topic, msgs[0].Payload) {
+		t.Fatal("published device config should be recognised as owned")
+	}
+}
+
+func TestRemoveStaleDiscovery_MigratesToDevice(t *testing.T) {
+	p, client := newDeviceTestPublisher()
+	old := "homeassistant/sensor/zaehler2mqtt_nutzstrom_Bezug/config"
+	removed := "homeassistant/sensor/zaehler2mqtt_nutzstrom_Altwert/config"
+	device := "homeassistant/device/zaehler2mqtt_nutzstrom/config"
+	client.retained = map[string]string{old: ownedConfig, removed: ownedConfig}
+
+	p.mu.Lock()
+	meters := []MeterConfig{p.meters["nutzstrom"]}
+	p.mu.Unlock()
+	if err := p.RemoveStaleDiscovery(meters); err != nil {
+		t.Fatalf("RemoveStaleDiscovery error: %v", err)
+	}
+	if msgs := client.messages(removed); len(msgs) != 1 || len(msgs[0].Payload) != 0 {
+		t.Fatalf("expected removed value to be cleared, got %+v", msgs)
+	}
+	msgs := client.messages(old)
+	if len(msgs) != 1 || string(msgs[0].Payload) != `{"migrate_discovery":true}` {
+		t.Fatalf("expected migration marker, got %+v", msgs)
+	}
+
+	p.PublishMeterDiscovery("nutzstrom")
+	client.mu.Lock()
+	var order []string
+	for _, m := range client.published {
+		if m.Topic == old || m.Topic == device {
+			order = append(order, m.Topic+" "+string(m.Payload[:min(len(m.Payload), 1)]))
+		}
+	}
+	client.mu.Unlock()
+	want := []string{old + " {", device + " {", old + " "}
+	if len(order) != len(want) {
+		t.Fatalf("got publish order %q, want %q", order, want)
+	}
+	for i := range want {
+		if order[i] != want[i] {
+			t.Fatalf("got publish order %q, want %q", order, want)
+		}
+	}
+
+	// The migration is only finished once
+	client.reset()
+	p.PublishMeterDiscovery("nutzstrom")
+	if n := len(client.messages(old)); n != 0 {
+		t.Fatalf("old config cleared again: %d messages", n)
+	}
+}
+
+func TestRemoveStaleDiscovery_MigratesToSensor(t *testing.T) {
+	p, client := newTestPublisher()
+	device := "homeassistant/device/zaehler2mqtt_nutzstrom/config"
+	client.retained = map[string]string{
+		device: `{"components":{"zaehler2mqtt_nutzstrom_Bezug":{"availability":[{"topic":"zaehler2mqtt/status"}]}}}`,
+	}
+	meter := MeterConfig{Name: "nutzstrom", Values: []ValueConfig{{Name: "Bezug"}}}
+	p.RegisterMeter(meter)
+
+	if err := p.RemoveStaleDiscovery([]MeterConfig{meter}); err != nil {
+		t.Fatalf("RemoveStaleDiscovery error: %v", err)
+	}
+	if msgs := client.messages(device); len(msgs) != 1 || string(msgs[0].Payload) != `{"migrate_discovery":true}` {
+		t.Fatalf("expected migration marker, got %+v", msgs)
+	}
+	p.PublishMeterDiscovery("nutzstrom")
+	if n := len(client.messages("homeassistant/sensor/zaehler2mqtt_nutzstrom_Bezug/config")); n != 1 {
+		t.Fatalf("expected sensor config, got %d messages", n)
+	}
+	if msgs := client.messages(device); len(msgs) != 2 || len(msgs[1].Payload) != 0 {
+		t.Fatalf("expected device config to be cleared, got %+v", msgs)
+	}
+}
+
+// ---------------------------------------------------------------------------
+// MQTT 5 properties
+// ---------------------------------------------------------------------------
+
+func TestPublishState_Properties(t *testing.T) {
+	p, client := newTestPublisher()
+	p.expiry = 30 * time.Second
+	p.SetMeterSerial("nutzstrom", "0a01484c5902000424a4")
+	p.PublishState("nutzstrom", ValueConfig{OBIS: "1.0.16.7.0", Name: "Leistung", Unit: "W"}, 246)
+
+	msgs := client.messages("zaehler2mqtt/nutzstrom/Leistung/state")
+	if len(msgs) != 1 {
+		t.Fatalf("expected 1 state message, got %d", len(msgs))
+	}
+	msg := msgs[0]
+	if msg.Expiry != 30*time.Second {
+		t.Fatalf("expiry = %v", msg.Expiry)
+	}
+	if msg.ContentType != "text/plain" {
+		t.Fatalf("content type = %q", msg.ContentType)
+	}
+	props := make(map[string]string)
+	for _, up := range msg.UserProperties {
+		props[up.Key] = up.Value
+	}
+	if props["obis"] != "1.0.16.7.0" || props["unit"] != "W" || props["serial"] != "0a01484c5902000424a4" {
+		t.Fatalf("unexpected user properties: %v", props)
+	}
+}
+
+func TestPublishState_QoSRetain(t *testing.T) {
+	p, client := newTestPublisher()
+	qos, retain := 1, true
+	p.PublishState("nutzstrom", ValueConfig{OBIS: "1.0.1.8.0", Name: "Bezug", QoS: &qos, Retain: &retain}, 1)
+	p.PublishState("nutzstrom", ValueConfig{OBIS: "1.0.16.7.0", Name: "Leistung"}, 246)
+
+	energy := client.messages("zaehler2mqtt/nutzstrom/Bezug/state")
+	if len(energy) != 1 || energy[0].QoS != 1 || !energy[0].Retain {
+		t.Fatalf("Bezug: expected one retained QoS 1 message, got %+v", energy)
+	}
+	power := client.messages("zaehler2mqtt/nutzstrom/Leistung/state")
+	if len(power) != 1 || power[0].QoS != 0 || power[0].Retain {
+		t.Fatalf("Leistung: expected one unretained QoS 0 message, got %+v", power)
+	}
+}
+
+func TestTopicMatches(t *testing.T) {
+	tests := []struct {
+		filter, topic string
+		want          bool
+	}{
+		{"homeassistant/sensor/+/config", "homeassistant/sensor/x/config", true},
+		{"homeassistant/sensor/+/config", "homeassistant/sensor/x/y/config", false},
+		{"zaehler2mqtt/#", "zaehler2mqtt/a/b", true},
+		{"homeassistant/status", "homeassistant/status", true},
+		{"homeassistant/status", "homeassistant/status/x", false},
+	}
+	for _, tt := range tests {
+		if got := topicMatches(tt.filter, tt.topic); got != tt.want {
+			t.Errorf("topicMatches(%q, %q) = %v, want %v", tt.filter, tt.topic, got, tt.want)
+		}
+	}
+}
+
+// ---------------------------------------------------------------------------
+// JSON meter state
+// ---------------------------------------------------------------------------
+
+func TestPublishMeterState(t *testing.T) {
+	p, client := newTestPublisher()
+	p.valueStates = false
+	p.meterStates = true
+	p.SetMeterSerial("nutzstrom", "0a01")
+
+	at := time.Date(2026, 3, 1, 12, 0, 0, 0, time.UTC)
+	p.PublishMeterState("nutzstrom", at, []FrameValue{
+		{Config: ValueConfig{Name: "Bezug", Unit: "Wh"}, Value: 8782412.34567, OBIS: "1-0:1.8.0*255"},
+		{Config: ValueConfig{Name: "Leistung", Unit: "W"}, Value: 246, OBIS: "1-0:16.7.0*255"},
+	})
+	p.PublishState("nutzstrom", ValueConfig{Name: "Leistung"}, 246)
+
+	if msgs := client.messages("zaehler2mqtt/nutzstrom/Leistung/state"); len(msgs) != 0 {
+		t.Fatal("per-value state must not be published in json mode")
+	}
+	msgs := client.messages("zaehler2mqtt/nutzstrom/state")
+	if len(msgs) != 1 {
+		t.Fatalf("expected 1 meter state, got %d", len(msgs))
+	}
+	var state meterStatePayload
+	if err := json.Unmarshal(msgs[0].Payload, &state); err != nil {
+		t.Fatalf("invalid JSON: %v", err)
+	}
+	if !state.Timestamp.Equal(at) || state.Serial != "0a01" {
+		t.Fatalf("unexpected header: %+v", state)
+	}
+	bezug := state.Values["Bezug"]
+	if bezug.Value != 8782412.3457 || bezug.Unit != "Wh" || bezug.OBIS != "1-0:1.8.0*255" {
+		t.Fatalf("unexpected Bezug: %+v", bezug)
+	}
+	if state.Values["Leistung"].Value != 246 {
+		t.Fatalf("unexpected Leistung: %+v", state.Values["Leistung"])
+	}
+}
+
+func TestPublishMeterState_DisabledByDefault(t *testing.T) {
+	p, client := newTestPublisher()
+	p.PublishMeterState("nutzstrom", time.Now(), []FrameValue{{Config: ValueConfig{Name: "Bezug"}}})
+	if msgs := client.messages("zaehler2mqtt/nutzstrom/state"); len(msgs) != 0 {
+		t.Fatal("meter state must not be published in value mode")
+	}
+}
+
+func TestDiscoveryPayload_JSONState(t *testing.T) {
+	p, _ := newTestPublisher()
+	p.meterStates = true
+	payload, _ := p.discoveryPayload("nutzstrom", "id", ValueConfig{Name: "Bezug 'HT'"})
+
+	if payload["state_topic"] != "zaehler2mqtt/nutzstrom/state" {
+		t.Fatalf("state_topic = %v", payload["state_topic"])
+	}
+	if payload["json_attributes_topic"] != "zaehler2mqtt/nutzstrom/state" {
+		t.Fatalf("json_attributes_topic = %v", payload["json_attributes_topic"])
+	}
+	want := `{{ value_json['values']['Bezug \'HT\'']['value'] }}`
+	if payload["value_template"] != want {
+		t.Fatalf("value_template = %v, want %v", payload["value_template"], want)
+	}
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+)
+
+// sensorClass lists what Home Assistant accepts for a sensor device class.
+// Empty lists accept anything; an empty string in units allows no unit.
+type sensorClass struct {
+	units        []string
+	stateClasses []string
+}
+
+var (
+	energyUnits = []string{"J", "kJ", "MJ", "GJ", "mWh", "Wh", "kWh", "MWh", "GWh", "TWh", "cal", "kcal", "Mcal", "Gcal"}
+	volumeUnits = []string{"L", "mL", "gal", "fl. oz.", "m³", "ft³", "CCF"}
+	totals      = []string{"total", "total_increasing"}
+)
+
+// sensorClasses follows the device class tables of Home Assistant's sensor
+// integration.
+var sensorClasses = map[string]sensorClass{
+	"apparent_power":             {units: []string{"mVA", "VA", "kVA"}},
+	"aqi":                        {},
+	"area":                       {},
+	"atmospheric_pressure":       {},
+	"battery":                    {units: []string{"%"}},
+	"carbon_dioxide":             {units: []string{"ppm"}},
+	"carbon_monoxide":            {units: []string{"ppm"}},
+	"conductivity":               {},
+	"current":                    {units: []string{"A", "mA"}},
+	"data_rate":                  {},
+	"data_size":                  {},
+	"distance":                   {},
+	"duration":                   {units: []string{"d", "h", "min", "s", "ms"}},
+	"energy":                     {units: energyUnits, stateClasses: totals},
+	"energy_distance":            {},
+	"energy_storage":             {units: energyUnits, stateClasses: []string{"measurement"}},
+	"frequency":                  {units: []string{"Hz", "kHz", "MHz", "GHz"}},
+	"gas":                        {units: []string{"L", "m³", "ft³", "CCF"}, stateClasses: totals},
+	"humidity":                   {units: []string{"%"}},
+	"illuminance":                {units: []string{"lx"}},
+	"irradiance":                 {},
+	"moisture":                   {units: []string{"%"}},
+	"monetary":                   {stateClasses: []string{"total"}},
+	"nitrogen_dioxide":           {},
+	"nitrogen_monoxide":          {},
+	"nitrous_oxide":              {},
+	"ozone":                      {},
+	"ph":                         {units: []string{""}},
+	"pm1":                        {},
+	"pm10":                       {},
+	"pm25":                       {},
+	"power":                      {units: []string{"mW", "W", "kW", "MW", "GW", "TW"}},
+	"power_factor":               {units: []string{"", "%"}},
+	"precipitation":              {},
+	"precipitation_intensity":    {},
+	"pressure":                   {},
+	"reactive_power":             {units: []string{"mvar", "var", "kvar"}},
+	"signal_strength":            {units: []string{"dB", "dBm"}},
+	"sound_pressure":             {},
+	"speed":                      {},
+	"sulphur_dioxide":            {},
+	"temperature":                {units: []string{"°C", "°F", "K"}},
+	"volatile_organic_compounds": {},
+	"voltage":                    {units: []string{"µV", "mV", "V", "kV", "MV"}},
+	"volume":                     {units: volumeUnits},
+	"volume_flow_rate":           {},
+	"volume_storage":             {units: volumeUnits, stateClasses: []string{"measurement"}},
+	"water":                      {units: []string{"L", "gal", "m³", "ft³", "CCF"}, stateClasses: totals},
+	"weight":                     {},
+	"wind_speed":                 {},
+}
+
+var stateClasses = []string{"measurement", "total", "total_increasing"}
+
+// checkSensorClass reports device class, unit and state class combinations
+// that Home Assistant would reject or warn about.
+func checkSensorClass(deviceClass, unit, stateClass string) error {
+	if stateClass != "" && !slices.Contains(stateClasses, stateClass) {
+		return fmt.Errorf("state_class %q is invalid (use %s)", stateClass, strings.Join(stateClasses, ", "))
+	}
+	if deviceClass == "" {
+		return nil
+	}
+	sc, ok := sensorClasses[deviceClass]
+	if !ok {
+		return fmt.Errorf("device_class %q is not a Home Assistant sensor device class", deviceClass)
+	}
+	if len(sc.units) > 0 && !slices.Contains(sc.units, unit) {
+		if unit == "" {
+			return fmt.Errorf("device_class %s requires a unit (use %s)", deviceClass, unitList(sc.units))
+		}
+		return fmt.Errorf("unit %q is invalid for device_class %s (use %s)", unit, deviceClass, unitList(sc.units))
+	}
+	if stateClass != "" && len(sc.stateClasses) > 0 && !slices.Contains(sc.stateClasses, stateClass) {
+		return fmt.Errorf("state_class %s is invalid for device_class %s (use %s)", stateClass, deviceClass, strings.Join(sc.stateClasses, ", "))
+	}
+	return nil
+}
+
+// unitList formats units for error messages.
+func unitList(units []string) string {
+	names := make([]string, len(units))
+	for i, u := range units {
+		if u == "" {
+			u = "no unit"
+		}
+		names[i] = u
+	}
+	return strings.Join(names, ", ")
+}
@@ -0,0 +1,32 @@
+package main
+
+import "testing"
+
+func TestCheckSensorClass(t *testing.T) {
+	tests := []struct {
+		deviceClass, unit, stateClass string
+		ok                            bool
+	}{
+		{"energy", "kWh", "total_increasing", true},
+		{"energy", "Wh", "total", true},
+		{"power", "W", "measurement", true},
+		{"power_factor", "", "measurement", true},
+		{"power_factor", "%", "measurement", true},
+		{"aqi", "", "", true},
+		{"", "", "", true},
+		{"", "W", "measurement", true},
+		{"energy", "W", "total_increasing", false},
+		{"energy", "kWh", "measurement", false},
+		{"energy", "", "total_increasing", false},
+		{"power", "kWh", "measurement", false},
+		{"powr", "W", "measurement", false},
+		{"power", "W", "average", false},
+		{"monetary", "EUR", "total_increasing", false},
+	}
+	for _, tt := range tests {
+		err := checkSensorClass(tt.deviceClass, tt.unit, tt.stateClass)
+		if (err == nil) != tt.ok {
+			t.Errorf("checkSensorClass(%q, %q, %q) = %v, want ok=%v", tt.deviceClass, tt.unit, tt.stateClass, err, tt.ok)
+		}
+	}
+}
@@ -5,6 +5,7 @@ import (
 	"encoding/json"
 	"log"
 	"net/http"
+	"strings"
 	"sync"
 	"time"
 )
@@ -19,13 +20,21 @@ type MeterState struct {
 	Device     string                `json:"device"`
 	LastUpdate time.Time             `json:"last_update"`
 	Values     map[string]MeterValue `json:"values"`
+
+	// For /metrics: the values exposed as counters, and the reader status
+	counters    map[string]bool
+	online      bool
+	diagnostics *diagnosticsPayload
 }
 
 type Server struct {
-	listen string
-	server *http.Server
-	mu     sync.RWMutex
-	meters map[string]*MeterState
+	listen     string
+	server     *http.Server
+	mu         sync.RWMutex
+	meters     map[string]*MeterState
+	collectors []func() []metricFamily
+	history    http.Handler
+	shelly     http.Handler
 }
 
 func NewServer(listen string) *Server {
@@ -35,6 +44,12 @@ func NewServer(listen string) *Server {
 	}
 	mux := http.NewServeMux()
 	mux.HandleFunc("/", s.handleRoot)
+	mux.HandleFunc("/metrics", s.handleMetrics)
+	mux.HandleFunc("/api/history", s.handleHistory)
+	mux.HandleFunc("/api/meters/", s.handleMeterGrid)
+	mux.HandleFunc("/rpc", s.handleShelly)
+	mux.HandleFunc("/rpc/", s.handleShelly)
+	mux.HandleFunc("/shelly", s.handleShelly)
 	s.server = &http.Server{
 		Addr:    listen,
 		Handler: mux,
@@ -66,6 +81,56 @@ func (s *Server) RegisterMeter(meterName string, device string) {
 	}
 }
 
+// RegisterCounters sets the values of a meter that only ever increase.
+func (s *Server) RegisterCounters(meterName string, valueNames []string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if state, ok := s.meters[meterName]; ok {
+		state.counters = make(map[string]bool, len(valueNames))
+		for _, name := range valueNames {
+			state.counters[name] = true
+		}
+	}
+}
+
+func (s *Server) SetOnline(meterName string, online bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if state, ok := s.meters[meterName]; ok {
+		state.online = online
+	}
+}
+
+func (s *Server) UpdateDiagnostics(meterName string, d diagnosticsPayload) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if state, ok := s.meters[meterName]; ok {
+		state.diagnostics = &d
+	}
+}
+
+func (s *Server) UnregisterMeter(meterName string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.meters, meterName)
+}
+
+// Snapshot returns a copy of the current state of all meters.
+func (s *Server) Snapshot() map[string]MeterState {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	meters := make(map[string]MeterState, len(s.meters))
+	for name, state := range s.meters {
+		c := *state
+		c.Values = make(map[string]MeterValue, len(state.Values))
+		for k, v := range state.Values {
+			c.Values[k] = v
+		}
+		meters[name] = c
+	}
+	return meters
+}
+
 func (s *Server) UpdateValue(meterName, valueName string, value float64, unit string, obis string) {
 	s.mu.Lock()
 	defer s.mu.Unlock()
@@ -90,3 +155,76 @@ func (s *Server) handleRoot(w http.ResponseWriter, r *http.Request) {
 		"meters": s.meters,
 	})
 }
+
+// gridResponse is what /api/meters/<name>/grid returns: power in W,
+// positive when drawing from the grid, energy in kWh, and currents, voltages
+// and powers of the three phases. Quantities the meter does not report are
+// left out.
+type gridResponse struct {
+	Power        *float64  `json:"power,omitempty"`
+	EnergyImport *float64  `json:"energy_import,omitempty"`
+	EnergyExport *float64  `json:"energy_export,omitempty"`
+	Powers       []float64 `json:"powers,omitempty"`
+	Currents     []float64 `json:"currents,omitempty"`
+	Voltages     []float64 `json:"voltages,omitempty"`
+	LastUpdate   time.Time `json:"last_update"`
+}
+
+func newGridResponse(g gridValues, updated time.Time) gridResponse {
+	resp := gridResponse{LastUpdate: updated}
+	if p, ok := g.power(); ok {
+		resp.Power = &p
+	}
+	if v, ok := g.get(gridImport); ok {
+		resp.EnergyImport = ptr(v / 1000)
+	}
+	if v, ok := g.get(gridExport); ok {
+		resp.EnergyExport = ptr(v / 1000)
+	}
+	// phases only come as a set of three
+	phases := func(get func(phase int) (float64, bool)) []float64 {
+		var values []float64
+		for phase := 0; phase < 3; phase++ {
+			v, ok := get(phase)
+			if !ok {
+				return nil
+			}
+			values = append(values, v)
+		}
+		return values
+	}
+	resp.Powers = phases(g.phasePower)
+	resp.Currents = phases(func(phase int) (float64, bool) { return g.get(gridPhase(gridPhaseCurrent, phase)) })
+	resp.Voltages = phases(func(phase int) (float64, bool) { return g.get(gridPhase(gridPhaseVoltage, phase)) })
+	return resp
+}
+
+// handleMeterGrid serves /api/meters/<name>/grid, the grid values of a
+// meter for evcc and similar. While the meter is offline it fails with 503,
+// so no stale values are used.
+func (s *Server) handleMeterGrid(w http.ResponseWriter, r *http.Request) {
+	name, ok := strings.CutSuffix(strings.TrimPrefix(r.URL.Path, "/api/meters/"), "/grid")
+	if !ok || name == "" || strings.Contains(name, "/") {
+		http.NotFound(w, r)
+		return
+	}
+	s.mu.RLock()
+	state, ok := s.meters[name]
+	var g gridValues
+	var online bool
+	var updated time.Time
+	if ok {
+		g, online, updated = gridValuesOf(state.Values), state.online, state.LastUpdate
+	}
+	s.mu.RUnlock()
+	switch {
+	case !ok:
+		http.Error(w, "unknown meter "+name, http.StatusNotFound)
+	case !online:
+		http.Error(w, "meter "+name+" is offline", http.StatusServiceUnavailable)
+	case len(g) == 0:
+		http.Error(w, "meter "+name+" has no grid values", http.StatusServiceUnavailable)
+	default:
+		writeJSON(w, http.StatusOK, newGridResponse(g, updated))
+	}
+}
@@ -171,3 +171,54 @@ func TestServer_RegisterIdempotent(t *testing.T) {
 		t.Fatal("re-registering meter should not reset values")
 	}
 }
+
+// ---------------------------------------------------------------------------
+// Grid endpoint
+// ---------------------------------------------------------------------------
+
+func TestServer_MeterGrid(t *testing.T) {
+	srv := NewServer(":0")
+	get := func(path string) *httptest.ResponseRecorder {
+		rr := httptest.NewRecorder()
+		srv.server.Handler.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, path, nil))
+		return rr
+	}
+	srv.RegisterMeter("nutzstrom", "/dev/ttyUSB0")
+	srv.UpdateValue("nutzstrom", "Bezug", 8782.4, "kWh", "1-0:1.8.0*255")
+	srv.UpdateValue("nutzstrom", "Einspeisung", 1234500, "Wh", "1-0:2.8.0*255")
+	srv.UpdateValue("nutzstrom", "Leistung", -1500, "W", "1-0:16.7.0*255")
+	srv.UpdateValue("nutzstrom", "Spannung L1", 230, "V", "1-0:32.7.0*255")
+	srv.UpdateValue("nutzstrom", "Spannung L2", 231, "V", "1-0:52.7.0*255")
+	srv.UpdateValue("nutzstrom", "Spannung L3", 232, "V", "1-0:72.7.0*255")
+	srv.UpdateValue("nutzstrom", "Strom L1", 6.5, "A", "1-0:31.7.0*255")
+
+	if rr := get("/api/meters/nutzstrom/grid"); rr.Code != http.StatusServiceUnavailable {
+		t.Fatalf("while the meter is offline: %d", rr.Code)
+	}
+	srv.SetOnline("nutzstrom", true)
+
+	rr := get("/api/meters/nutzstrom/grid")
+	if rr.Code != http.StatusOK {
+		t.Fatalf("status = %d: %s", rr.Code, rr.Body.String())
+	}
+	var resp map[string]any
+	if err := json.Unmarshal(rr.Body.Bytes(), &resp); err != nil {
+		t.Fatalf("invalid JSON %q: %v", rr.Body.String(), err)
+	}
+	if resp["power"] != -1500.0 || resp["energy_import"] != 8782.4 || resp["energy_export"] != 1234.5 {
+		t.Fatalf("unexpected response %v", resp)
+	}
+	if v, ok := resp["voltages"].([]any); !ok || len(v) != 3 || v[2] != 232.0 {
+		t.Fatalf("unexpected voltages %v", resp["voltages"])
+	}
+	// only L1 has a current, so there are no currents
+	if _, ok := resp["currents"]; ok {
+		t.Fatalf("unexpected currents %v", resp["currents"])
+	}
+
+	for _, path := range []string{"/api/meters/other/grid", "/api/meters/nutzstrom", "/api/meters/nutzstrom/power"} {
+		if rr := get(path); rr.Code != http.StatusNotFound {
+			t.Errorf("%s: status = %d, want 404", path, rr.Code)
+		}
+	}
+}
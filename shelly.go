@@ -0,0 +1,375 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"net"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+const (
+	// What a Shelly Pro 3EM reports about itself.
+	shellyModel    = "SPEM-003CEBEU"
+	shellyApp      = "Pro3EM"
+	shellyVersion  = "1.4.4"
+	shellyFirmware = "20241011-114455/1.4.4-g6d2a586"
+)
+
+// ShellyConfig configures a shelly_pro_3em output, which emulates a Shelly
+// Pro 3EM for the one meter selected with meters.
+type ShellyConfig struct {
+	// MAC is the MAC address reported, default: derived from the meter name.
+	MAC string `yaml:"mac"`
+	// UDPPort serves the RPC over UDP, e.g. 1010 for Marstek batteries.
+	UDPPort int `yaml:"udp_port"`
+	// MDNS announces the device on the network, the default.
+	MDNS *bool `yaml:"mdns"`
+}
+
+var macPattern = regexp.MustCompile(`^[0-9A-Fa-f]{2}(:?[0-9A-Fa-f]{2}){5}$`)
+
+// mac returns the MAC address as 12 upper case hex digits.
+func (c ShellyConfig) mac(meter string) string {
+	if c.MAC != "" {
+		return strings.ToUpper(strings.ReplaceAll(c.MAC, ":", ""))
+	}
+	sum := sha256.Sum256([]byte(meter))
+	// a locally administered address
+	return strings.ToUpper(hex.EncodeToString(append([]byte{0x02}, sum[:5]...)))
+}
+
+func (c ShellyConfig) mdns() bool {
+	return c.MDNS == nil || *c.MDNS
+}
+
+func (c ShellyConfig) validate() error {
+	if c.MAC != "" && !macPattern.MatchString(c.MAC) {
+		return fmt.Errorf("shelly_pro_3em mac %q is invalid", c.MAC)
+	}
+	if c.UDPPort < 0 || c.UDPPort > 65535 {
+		return fmt.Errorf("shelly_pro_3em udp_port %d is invalid", c.UDPPort)
+	}
+	return nil
+}
+
+// shellyError is an RPC error as Shelly devices report it.
+type shellyError struct {
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+}
+
+func (e *shellyError) Error() string { return e.Message }
+
+// status is the HTTP status of the error.
+func (e *shellyError) status() int {
+	if e.Code == http.StatusNotFound {
+		return http.StatusNotFound
+	}
+	return http.StatusServiceUnavailable
+}
+
+// shellyUnavailable is the error code of Shelly devices for missing data.
+const shellyUnavailable = -114
+
+// shellyRequest is an RPC request frame.
+type shellyRequest struct {
+	ID     json.RawMessage `json:"id"`
+	Src    string          `json:"src"`
+	Method string          `json:"method"`
+}
+
+// shellyResponse is an RPC response frame.
+type shellyResponse struct {
+	ID     json.RawMessage `json:"id"`
+	Src    string          `json:"src"`
+	Dst    string          `json:"dst,omitempty"`
+	Result any             `json:"result,omitempty"`
+	Error  *shellyError    `json:"error,omitempty"`
+}
+
+// shellySink emulates a Shelly Pro 3EM, which many battery and zero-export
+// controllers poll for the grid power. It serves the RPC on /rpc of the
+// HTTP server and optionally over UDP, and announces itself over mDNS.
+type shellySink struct {
+	*gridMeter
+	cfg   ShellyConfig
+	meter string
+	mac   string
+	id    string
+	srv   *Server
+	udp   *net.UDPConn
+	mdns  *mdnsResponder
+	wg    sync.WaitGroup
+}
+
+func newShellySink(cfg ShellyConfig, meter string, srv *Server) (*shellySink, error) {
+	s := &shellySink{
+		gridMeter: newGridMeter(),
+		cfg:       cfg,
+		meter:     meter,
+		mac:       cfg.mac(meter),
+		srv:       srv,
+	}
+	s.id = "shellypro3em-" + strings.ToLower(s.mac)
+	if cfg.UDPPort != 0 {
+		conn, err := net.ListenUDP("udp", &net.UDPAddr{Port: cfg.UDPPort})
+		if err != nil {
+			return nil, err
+		}
+		s.udp = conn
+		s.wg.Add(1)
+		go s.serveUDP()
+	}
+	if srv != nil {
+		srv.SetShelly(s)
+		if cfg.mdns() {
+			s.announce(srv.port())
+		}
+	}
+	log.Printf("[shelly] Emulating Shelly Pro 3EM %s for %s", s.id, meter)
+	return s, nil
+}
+
+// announce starts the mDNS responder. Without it the device can still be
+// added by address.
+func (s *shellySink) announce(port int) {
+	mdns, err := startMDNS(mdnsService{
+		Instance: s.id,
+		Host:     s.id,
+		Port:     uint16(port),
+		Types:    []string{"_shelly._tcp", "_http._tcp"},
+		TXT:      []string{"gen=2", "app=" + shellyApp, "ver=" + shellyVersion},
+	})
+	if err != nil {
+		log.Printf("[shelly] mDNS announcement failed: %v", err)
+		return
+	}
+	s.mdns = mdns
+}
+
+func (s *shellySink) Close() error {
+	if s.srv != nil {
+		s.srv.SetShelly(nil)
+	}
+	if s.mdns != nil {
+		s.mdns.Close()
+	}
+	if s.udp != nil {
+		s.udp.Close()
+	}
+	s.wg.Wait()
+	return nil
+}
+
+// call runs an RPC method. Method names are case insensitive, as on the
+// device.
+func (s *shellySink) call(method string) (any, *shellyError) {
+	switch strings.ToLower(method) {
+	case "shelly.getdeviceinfo":
+		return s.deviceInfo(), nil
+	}
+
+	grid, _, ok := s.snapshot()
+	if !ok {
+		return nil, &shellyError{Code: shellyUnavailable, Message: "meter " + s.meter + " is offline"}
+	}
+	switch strings.ToLower(method) {
+	case "em.getstatus":
+		return shellyEMStatus(grid), nil
+	case "emdata.getstatus":
+		return shellyEMDataStatus(grid), nil
+	case "shelly.getstatus":
+		return map[string]any{"em:0": shellyEMStatus(grid), "emdata:0": shellyEMDataStatus(grid)}, nil
+	}
+	return nil, &shellyError{Code: http.StatusNotFound, Message: "No handler for " + method}
+}
+
+func (s *shellySink) deviceInfo() map[string]any {
+	return map[string]any{
+		"name":        s.meter,
+		"id":          s.id,
+		"mac":         s.mac,
+		"slot":        0,
+		"model":       shellyModel,
+		"gen":         2,
+		"fw_id":       shellyFirmware,
+		"ver":         shellyVersion,
+		"app":         shellyApp,
+		"auth_en":     false,
+		"auth_domain": nil,
+		"profile":     "triphase",
+	}
+}
+
+// shellyRound rounds to a number of decimals, as the device reports.
+func shellyRound(v float64, decimals int) float64 {
+	p := math.Pow(10, float64(decimals))
+	return math.Round(v*p) / p
+}
+
+// shellyEMStatus is the EM component status. Meters that only report the
+// total power have it on phase A.
+func shellyEMStatus(g gridValues) map[string]any {
+	status := map[string]any{"id": 0, "n_current": nil, "user_calibrated_phase": []string{}}
+	power, _ := g.power()
+	hasPhases := false
+	for phase := 0; phase < 3; phase++ {
+		if _, ok := g.phasePower(phase); ok {
+			hasPhases = true
+		}
+	}
+	freq, _ := g.get(gridFrequency)
+	var totalCurrent, totalApparent float64
+	for phase, prefix := range []string{"a_", "b_", "c_"} {
+		p, _ := g.phasePower(phase)
+		if !hasPhases && phase == 0 {
+			p = power
+		}
+		current, _ := g.get(gridPhase(gridPhaseCurrent, phase))
+		voltage, _ := g.get(gridPhase(gridPhaseVoltage, phase))
+		pf, ok := g.get(gridPhase(gridPhasePowerFactor, phase))
+		if !ok {
+			pf = 1
+		}
+		apparent := math.Abs(p)
+		if current > 0 && voltage > 0 {
+			apparent = math.Max(apparent, current*voltage)
+		}
+		status[prefix+"current"] = shellyRound(current, 3)
+		status[prefix+"voltage"] = shellyRound(voltage, 1)
+		status[prefix+"act_power"] = shellyRound(p, 1)
+		status[prefix+"aprt_power"] = shellyRound(apparent, 1)
+		status[prefix+"pf"] = shellyRound(pf, 2)
+		status[prefix+"freq"] = shellyRound(freq, 1)
+		totalCurrent += current
+		totalApparent += apparent
+	}
+	status["total_current"] = shellyRound(totalCurrent, 3)
+	status["total_act_power"] = shellyRound(power, 3)
+	status["total_aprt_power"] = shellyRound(totalApparent, 3)
+	return status
+}
+
+// shellyEMDataStatus is the EMData component status with the energy
+// counters in Wh, all on phase A.
+func shellyEMDataStatus(g gridValues) map[string]any {
+	imported, _ := g.get(gridImport)
+	exported, _ := g.get(gridExport)
+	status := map[string]any{
+		"id":            0,
+		"total_act":     shellyRound(imported, 2),
+		"total_act_ret": shellyRound(exported, 2),
+	}
+	for phase, prefix := range []string{"a_", "b_", "c_"} {
+		imp, exp := 0.0, 0.0
+		if phase == 0 {
+			imp, exp = imported, exported
+		}
+		status[prefix+"total_act_energy"] = shellyRound(imp, 2)
+		status[prefix+"total_act_ret_energy"] = shellyRound(exp, 2)
+	}
+	return status
+}
+
+// ServeHTTP serves GET /rpc/<method>, JSON-RPC frames POSTed to /rpc and
+// the device info on /shelly.
+func (s *shellySink) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path == "/shelly" {
+		writeJSON(w, http.StatusOK, s.deviceInfo())
+		return
+	}
+	if r.URL.Path == "/rpc" {
+		if r.Method != http.MethodPost {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		var req shellyRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "invalid request: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		writeJSON(w, http.StatusOK, s.respond(req))
+		return
+	}
+	result, rpcErr := s.call(strings.TrimPrefix(r.URL.Path, "/rpc/"))
+	if rpcErr != nil {
+		writeJSON(w, rpcErr.status(), rpcErr)
+		return
+	}
+	writeJSON(w, http.StatusOK, result)
+}
+
+func (s *shellySink) respond(req shellyRequest) shellyResponse {
+	result, rpcErr := s.call(req.Method)
+	return shellyResponse{ID: req.ID, Src: s.id, Dst: req.Src, Result: result, Error: rpcErr}
+}
+
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+// serveUDP answers RPC frames sent over UDP.
+func (s *shellySink) serveUDP() {
+	defer s.wg.Done()
+	buf := make([]byte, 2048)
+	for {
+		n, from, err := s.udp.ReadFromUDP(buf)
+		if err != nil {
+			if !errors.Is(err, net.ErrClosed) {
+				log.Printf("[shelly] Stopped answering UDP: %v", err)
+			}
+			return
+		}
+		var req shellyRequest
+		if err := json.Unmarshal(buf[:n], &req); err != nil || req.Method == "" {
+			continue
+		}
+		data, err := json.Marshal(s.respond(req))
+		if err != nil {
+			continue
+		}
+		s.udp.WriteToUDP(data, from)
+	}
+}
+
+// SetShelly serves the Shelly RPC from h, or disables it with nil.
+func (s *Server) SetShelly(h http.Handler) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.shelly = h
+}
+
+func (s *Server) handleShelly(w http.ResponseWriter, r *http.Request) {
+	s.mu.RLock()
+	h := s.shelly
+	s.mu.RUnlock()
+	if h == nil {
+		http.Error(w, "shelly_pro_3em output is not configured", http.StatusNotFound)
+		return
+	}
+	h.ServeHTTP(w, r)
+}
+
+// port returns the port the HTTP server listens on.
+func (s *Server) port() int {
+	_, port, err := net.SplitHostPort(s.listen)
+	if err != nil {
+		return 80
+	}
+	n, err := strconv.Atoi(port)
+	if err != nil {
+		return 80
+	}
+	return n
+}
@@ -0,0 +1,217 @@
+package main
+
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+func newTestShelly(t *testing.T, cfg ShellyConfig, srv *Server) *shellySink {
+	t.Helper()
+	no := false
+	cfg.MDNS = &no
+	s, err := newShellySink(cfg, "nutzstrom", srv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { s.Close() })
+	s.Open(smaTestMeter)
+	return s
+}
+
+// ---------------------------------------------------------------------------
+// RPC
+// ---------------------------------------------------------------------------
+
+func TestShellySink_HTTP(t *testing.T) {
+	srv := NewServer(":0")
+	get := func(path string) *httptest.ResponseRecorder {
+		rr := httptest.NewRecorder()
+		srv.server.Handler.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, path, nil))
+		return rr
+	}
+	if rr := get("/rpc/EM.GetStatus?id=0"); rr.Code != http.StatusNotFound {
+		t.Fatalf("without a shelly output: %d", rr.Code)
+	}
+
+	s := newTestShelly(t, ShellyConfig{MAC: "c8:f0:9e:8a:1b:2c"}, srv)
+	if rr := get("/rpc/EM.GetStatus?id=0"); rr.Code != http.StatusServiceUnavailable {
+		t.Fatalf("while the meter is offline: %d", rr.Code)
+	}
+	s.Status("nutzstrom", MeterStatus{Online: true})
+	s.Write("nutzstrom", []Reading{
+		{Name: "Bezug", Value: 8782400.5, Unit: "Wh", Quality: QualityGood},
+		{Name: "Leistung", Value: -1500.25, Unit: "W", Quality: QualityGood},
+		{Name: "Leistung L1", Value: -1500.25, Unit: "W", Quality: QualityGood},
+		{Name: "Spannung L1", Value: 230.1, Unit: "V", Quality: QualityGood},
+	})
+
+	var status map[string]any
+	rr := get("/rpc/EM.GetStatus?id=0")
+	if err := json.Unmarshal(rr.Body.Bytes(), &status); err != nil {
+		t.Fatalf("invalid JSON %q: %v", rr.Body.String(), err)
+	}
+	if status["total_act_power"] != -1500.25 || status["a_act_power"] != -1500.3 || status["a_voltage"] != 230.1 || status["b_act_power"] != 0.0 {
+		t.Fatalf("unexpected status %v", status)
+	}
+
+	var info map[string]any
+	json.Unmarshal(get("/shelly").Body.Bytes(), &info)
+	if info["id"] != "shellypro3em-c8f09e8a1b2c" || info["mac"] != "C8F09E8A1B2C" || info["gen"] != 2.0 || info["app"] != "Pro3EM" {
+		t.Fatalf("unexpected device info %v", info)
+	}
+
+	// JSON-RPC frames, with the energy counters
+	rr = httptest.NewRecorder()
+	srv.server.Handler.ServeHTTP(rr, httptest.NewRequest(http.MethodPost, "/rpc",
+		strings.NewReader(`{"id":7,"src":"test","method":"EMData.GetStatus","params":{"id":0}}`)))
+	var resp struct {
+		ID     int            `json:"id"`
+		Src    string         `json:"src"`
+		Dst    string         `json:"dst"`
+		Result map[string]any `json:"result"`
+	}
+	if err := json.Unmarshal(rr.Body.Bytes(), &resp); err != nil {
+		t.Fatalf("invalid JSON %q: %v", rr.Body.String(), err)
+	}
+	if resp.ID != 7 || resp.Dst != "test" || resp.Src != "shellypro3em-c8f09e8a1b2c" || resp.Result["total_act"] != 8782400.5 {
+		t.Fatalf("unexpected response %s", rr.Body.String())
+	}
+
+	if rr := get("/rpc/Switch.Set"); rr.Code != http.StatusNotFound {
+		t.Fatalf("unknown method: %d", rr.Code)
+	}
+}
+
+func TestShellySink_UDP(t *testing.T) {
+	// find a free port
+	probe, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	port := probe.LocalAddr().(*net.UDPAddr).Port
+	probe.Close()
+
+	s := newTestShelly(t, ShellyConfig{UDPPort: port}, nil)
+	s.Status("nutzstrom", MeterStatus{Online: true})
+	s.Write("nutzstrom", []Reading{{Name: "Leistung", Value: 420, Unit: "W", Quality: QualityGood}})
+
+	conn, err := net.Dial("udp", net.JoinHostPort("127.0.0.1", strconv.Itoa(port)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.Write([]byte(`{"id":1,"src":"marstek","method":"EM.GetStatus","params":{"id":0}}`))
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	buf := make([]byte, 2048)
+	n, err := conn.Read(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var resp struct {
+		Result map[string]any `json:"result"`
+	}
+	if err := json.Unmarshal(buf[:n], &resp); err != nil || resp.Result["total_act_power"] != 420.0 || resp.Result["a_act_power"] != 420.0 {
+		t.Fatalf("unexpected response %s: %v", buf[:n], err)
+	}
+}
+
+// ---------------------------------------------------------------------------
+// mDNS
+// ---------------------------------------------------------------------------
+
+func TestMDNSResponder_Reply(t *testing.T) {
+	r := &mdnsResponder{
+		svc: mdnsService{Instance: "shellypro3em-c8f09e8a1b2c", Host: "shellypro3em-c8f09e8a1b2c", Port: 8081,
+			Types: []string{"_shelly._tcp"}, TXT: []string{"gen=2"}},
+		addrs: func() []net.IP { return []net.IP{net.IPv4(192, 168, 1, 20)} },
+	}
+	query := func(name string, typ dnsmessage.Type) []byte {
+		msg := dnsmessage.Message{Header: dnsmessage.Header{ID: 42}, Questions: []dnsmessage.Question{
+			{Name: dnsmessage.MustNewName(name), Type: typ, Class: dnsmessage.ClassINET}}}
+		data, err := msg.Pack()
+		if err != nil {
+			t.Fatal(err)
+		}
+		return data
+	}
+
+	reply, unicast := r.reply(query("_shelly._tcp.local.", dnsmessage.TypePTR), mdnsGroup)
+	var msg dnsmessage.Message
+	if err := msg.Unpack(reply); err != nil {
+		t.Fatal(err)
+	}
+	if unicast || len(msg.Answers) != 1 || msg.Answers[0].Body.(*dnsmessage.PTRResource).PTR.String() != "shellypro3em-c8f09e8a1b2c._shelly._tcp.local." {
+		t.Fatalf("unexpected answer %+v", msg.Answers)
+	}
+	var port uint16
+	var a [4]byte
+	for _, rr := range msg.Additionals {
+		switch body := rr.Body.(type) {
+		case *dnsmessage.SRVResource:
+			port = body.Port
+		case *dnsmessage.AResource:
+			a = body.A
+		}
+	}
+	if port != 8081 || a != [4]byte{192, 168, 1, 20} {
+		t.Fatalf("unexpected additionals %+v", msg.Additionals)
+	}
+
+	// a legacy resolver gets a unicast answer with the query's ID
+	reply, unicast = r.reply(query("SHELLYPRO3EM-C8F09E8A1B2C.local.", dnsmessage.TypeA), &net.UDPAddr{Port: 40000})
+	if err := msg.Unpack(reply); err != nil {
+		t.Fatal(err)
+	}
+	if !unicast || msg.ID != 42 || len(msg.Questions) != 1 || len(msg.Answers) != 1 {
+		t.Fatalf("unexpected legacy answer %+v", msg)
+	}
+
+	if reply, _ := r.reply(query("_hue._tcp.local.", dnsmessage.TypePTR), mdnsGroup); reply != nil {
+		t.Fatal("answered a query for another service")
+	}
+}
+
+// ---------------------------------------------------------------------------
+// Config
+// ---------------------------------------------------------------------------
+
+func TestLoadConfig_Shelly(t *testing.T) {
+	base := `
+meters:
+  - name: nutzstrom
+    device: /dev/ttyUSB0
+    values:
+      - name: Leistung
+        obis: "1.0.16.7.0"
+outputs:
+`
+	cfg, err := LoadConfig(writeTestConfig(t, base+`
+  - type: shelly_pro_3em
+    meters: [nutzstrom]
+    udp_port: 1010
+`))
+	if err != nil {
+		t.Fatalf("LoadConfig error: %v", err)
+	}
+	if o := cfg.Outputs[0]; o.Shelly == nil || o.Shelly.UDPPort != 1010 || !o.Shelly.mdns() {
+		t.Fatalf("unexpected output %+v", o)
+	}
+
+	for _, bad := range []string{
+		"  - type: shelly_pro_3em\n",
+		"  - type: shelly_pro_3em\n    meters: [nutzstrom]\n    mac: \"c8:f0:9e\"\n",
+		"  - type: shelly_pro_3em\n    meters: [nutzstrom]\n  - type: shelly_pro_3em\n    meters: [nutzstrom]\n",
+	} {
+		if _, err := LoadConfig(writeTestConfig(t, base+bad)); err == nil {
+			t.Errorf("expected error for %q", bad)
+		}
+	}
+}
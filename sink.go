@@ -0,0 +1,389 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"slices"
+	"sync"
+	"time"
+)
+
+// Quality tells sinks whether a reading can be used.
+type Quality string
+
+const (
+	QualityGood Quality = "good"
+	// QualityInvalid marks entries that did not carry a number, e.g. a
+	// meter reporting an octet string for a configured OBIS code.
+	QualityInvalid Quality = "invalid"
+)
+
+// Reading is one configured value decoded from a meter frame.
+type Reading struct {
+	Meter string
+	Name  string
+	// OBIS is the object name as reported by the meter, e.g. 1-0:1.8.0*255
+	OBIS  string
+	Value float64
+	Unit  string
+	// Time is when the frame arrived
+	Time    time.Time
+	Quality Quality
+}
+
+// MeterStatus is what a reader knows about its meter besides the readings.
+type MeterStatus struct {
+	// Online is true while the meter delivers values.
+	Online bool
+	// Serial is the meter's server ID, empty until the meter has reported it.
+	Serial string
+	// Stopped is set, along with Online false, when the reader stops on
+	// shutdown or reload rather than losing the meter.
+	Stopped bool
+}
+
+// Sink receives what the meter readers see. Its methods are called from the
+// reader goroutines and must not block; sinks that talk to the network
+// queue the work.
+type Sink interface {
+	// Open is called when the reader of a meter starts.
+	Open(meter MeterConfig)
+	// Write receives the readings of one frame. Sinks may keep the slice.
+	Write(meter string, readings []Reading)
+	// Status is called whenever the status of a meter changes.
+	Status(meter string, status MeterStatus)
+	// Diagnostics receives the reader health of a meter periodically.
+	Diagnostics(meter string, d diagnosticsPayload)
+}
+
+// Sinks passes everything on to each of its sinks.
+type Sinks []Sink
+
+func (s Sinks) Open(meter MeterConfig) {
+	for _, sink := range s {
+		sink.Open(meter)
+	}
+}
+
+func (s Sinks) Write(meter string, readings []Reading) {
+	for _, sink := range s {
+		sink.Write(meter, readings)
+	}
+}
+
+func (s Sinks) Status(meter string, status MeterStatus) {
+	for _, sink := range s {
+		sink.Status(meter, status)
+	}
+}
+
+func (s Sinks) Diagnostics(meter string, d diagnosticsPayload) {
+	for _, sink := range s {
+		sink.Diagnostics(meter, d)
+	}
+}
+
+// Close closes the sinks that hold connections or buffers.
+func (s Sinks) Close() error {
+	var errs []error
+	for _, sink := range s {
+		if c, ok := sink.(io.Closer); ok {
+			errs = append(errs, c.Close())
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// outputEnv holds what the built-in outputs are connected to.
+type outputEnv struct {
+	brokers *Brokers
+	server  *Server
+}
+
+// outputType builds the sink of an output.
+type outputType struct {
+	// single types share one connection or store and may only be
+	// configured once.
+	single bool
+	// validate checks the settings of the type when the config is loaded.
+	validate func(o OutputConfig) error
+	build    func(o OutputConfig, env outputEnv) (Sink, error)
+}
+
+var outputTypes = map[string]outputType{
+	OutputMQTT: {single: true, build: func(_ OutputConfig, env outputEnv) (Sink, error) {
+		return newMQTTSink(env.brokers), nil
+	}},
+	OutputHTTP: {single: true, build: func(_ OutputConfig, env outputEnv) (Sink, error) {
+		return stateSink{env.server}, nil
+	}},
+	OutputInfluxDB: {
+		validate: func(o OutputConfig) error { return o.InfluxDB.validate() },
+		build:    func(o OutputConfig, _ outputEnv) (Sink, error) { return newInfluxDBSink(*o.InfluxDB) },
+	},
+	OutputHistory: {
+		single:   true,
+		validate: func(o OutputConfig) error { return o.History.validate() },
+		build:    func(o OutputConfig, env outputEnv) (Sink, error) { return newHistoryStore(*o.History, env.server) },
+	},
+	OutputVolkszaehler: {
+		validate: func(o OutputConfig) error { return o.Volkszaehler.validate() },
+		build:    func(o OutputConfig, _ outputEnv) (Sink, error) { return newVolkszaehlerSink(*o.Volkszaehler), nil },
+	},
+	OutputWebhook: {
+		validate: func(o OutputConfig) error { return o.Webhook.validate() },
+		build:    func(o OutputConfig, _ outputEnv) (Sink, error) { return newWebhookSink(*o.Webhook) },
+	},
+	OutputSMA: {
+		validate: func(o OutputConfig) error {
+			if len(o.Meters) != 1 {
+				return fmt.Errorf("sma_energy_meter needs exactly one meter in meters")
+			}
+			return o.SMA.validate()
+		},
+		build: func(o OutputConfig, _ outputEnv) (Sink, error) { return newSMAEnergyMeterSink(*o.SMA, o.Meters[0]) },
+	},
+	OutputShelly: {
+		single: true,
+		validate: func(o OutputConfig) error {
+			if len(o.Meters) != 1 {
+				return fmt.Errorf("shelly_pro_3em needs exactly one meter in meters")
+			}
+			return o.Shelly.validate()
+		},
+		build: func(o OutputConfig, env outputEnv) (Sink, error) {
+			return newShellySink(*o.Shelly, o.Meters[0], env.server)
+		},
+	},
+	OutputModbus: {
+		validate: func(o OutputConfig) error {
+			if len(o.Meters) != 1 {
+				return fmt.Errorf("modbus needs exactly one meter in meters")
+			}
+			return o.Modbus.validate()
+		},
+		build: func(o OutputConfig, _ outputEnv) (Sink, error) { return newModbusSink(*o.Modbus, o.Meters[0]) },
+	},
+}
+
+// newSinks builds the configured outputs.
+func newSinks(outputs []OutputConfig, env outputEnv) (Sinks, error) {
+	sinks := make(Sinks, 0, len(outputs))
+	for _, o := range outputs {
+		sink, err := outputTypes[o.Type].build(o, env)
+		if err != nil {
+			sinks.Close()
+			return nil, fmt.Errorf("output %s: %w", o.Type, err)
+		}
+		if len(o.Meters) > 0 || len(o.Values) > 0 {
+			sink = &filteredSink{Sink: sink, meters: o.Meters, values: o.Values, allowed: make(map[string]map[string]bool)}
+		}
+		sinks = append(sinks, sink)
+	}
+	return sinks, nil
+}
+
+// filteredSink restricts a sink to some meters and values. Values are
+// selected by name or OBIS code.
+type filteredSink struct {
+	Sink
+	meters []string
+	values []string
+
+	mu      sync.Mutex
+	allowed map[string]map[string]bool // meter -> value names
+}
+
+func (f *filteredSink) meterAllowed(meter string) bool {
+	return len(f.meters) == 0 || slices.Contains(f.meters, meter)
+}
+
+// filterMeter returns a meter with the values an output filtered by meters
+// and values receives, or false if the output does not receive the meter.
+func filterMeter(meter MeterConfig, meters, values []string) (MeterConfig, bool) {
+	if len(meters) > 0 && !slices.Contains(meters, meter.Name) {
+		return meter, false
+	}
+	var selected []ValueConfig
+	for _, v := range meter.Values {
+		if len(values) == 0 || slices.Contains(values, v.Name) || slices.Contains(values, v.OBIS) {
+			selected = append(selected, v)
+		}
+	}
+	meter.Values = selected
+	return meter, true
+}
+
+// outputMeters returns the meters and values the output of a single type,
+// such as mqtt, receives; none if it is not configured.
+func outputMeters(outputs []OutputConfig, typ string, meters []MeterConfig) []MeterConfig {
+	i := slices.IndexFunc(outputs, func(o OutputConfig) bool { return o.Type == typ })
+	if i < 0 {
+		return nil
+	}
+	var result []MeterConfig
+	for _, m := range meters {
+		if m, ok := filterMeter(m, outputs[i].Meters, outputs[i].Values); ok {
+			result = append(result, m)
+		}
+	}
+	return result
+}
+
+func (f *filteredSink) Open(meter MeterConfig) {
+	meter, ok := filterMeter(meter, f.meters, f.values)
+	if !ok {
+		return
+	}
+	allowed := make(map[string]bool, len(meter.Values))
+	for _, v := range meter.Values {
+		allowed[v.Name] = true
+	}
+	f.mu.Lock()
+	f.allowed[meter.Name] = allowed
+	f.mu.Unlock()
+
+	f.Sink.Open(meter)
+}
+
+func (f *filteredSink) Write(meter string, readings []Reading) {
+	f.mu.Lock()
+	allowed := f.allowed[meter]
+	f.mu.Unlock()
+	var selected []Reading
+	for _, r := range readings {
+		if allowed[r.Name] {
+			selected = append(selected, r)
+		}
+	}
+	if len(selected) > 0 {
+		f.Sink.Write(meter, selected)
+	}
+}
+
+func (f *filteredSink) Status(meter string, status MeterStatus) {
+	if f.meterAllowed(meter) {
+		f.Sink.Status(meter, status)
+	}
+}
+
+func (f *filteredSink) Close() error {
+	if c, ok := f.Sink.(io.Closer); ok {
+		return c.Close()
+	}
+	return nil
+}
+
+func (f *filteredSink) Diagnostics(meter string, d diagnosticsPayload) {
+	if f.meterAllowed(meter) {
+		f.Sink.Diagnostics(meter, d)
+	}
+}
+
+// mqttSink publishes to the brokers of the mqtt section. The change filters
+// of the values decide which readings are published.
+type mqttSink struct {
+	brokers *Brokers
+
+	mu     sync.Mutex
+	meters map[string]mqttMeter
+}
+
+type mqttMeter struct {
+	values  map[string]ValueConfig
+	filters map[string]*changeFilter
+}
+
+func newMQTTSink(brokers *Brokers) *mqttSink {
+	return &mqttSink{brokers: brokers, meters: make(map[string]mqttMeter)}
+}
+
+// Open announces the meter. Change filters start over with every reader.
+func (s *mqttSink) Open(meter MeterConfig) {
+	m := mqttMeter{
+		values:  make(map[string]ValueConfig, len(meter.Values)),
+		filters: make(map[string]*changeFilter, len(meter.Values)),
+	}
+	for _, v := range meter.Values {
+		m.values[v.Name] = v
+		m.filters[v.Name] = newChangeFilter(v)
+	}
+	s.mu.Lock()
+	s.meters[meter.Name] = m
+	s.mu.Unlock()
+
+	s.brokers.RegisterMeter(meter)
+	s.brokers.PublishMeterDiscovery(meter.Name)
+}
+
+// Write publishes the readings that passed their filters, and the whole
+// frame as JSON state if any of them did.
+func (s *mqttSink) Write(meter string, readings []Reading) {
+	s.mu.Lock()
+	m := s.meters[meter]
+	s.mu.Unlock()
+
+	var frame []FrameValue
+	changed := false
+	for _, r := range readings {
+		val, ok := m.values[r.Name]
+		if !ok || r.Quality != QualityGood {
+			continue
+		}
+		if m.filters[r.Name].Allow(r.Value, r.Time) {
+			s.brokers.PublishState(meter, val, r.Value)
+			changed = true
+		}
+		frame = append(frame, FrameValue{Config: val, Value: r.Value, OBIS: r.OBIS})
+	}
+	if changed {
+		s.brokers.PublishMeterState(meter, readings[0].Time, frame)
+	}
+}
+
+// Status publishes the serial first, since it may be part of the
+// availability topic.
+func (s *mqttSink) Status(meter string, status MeterStatus) {
+	if status.Serial != "" {
+		s.brokers.SetMeterSerial(meter, status.Serial)
+	}
+	s.brokers.PublishAvailability(meter, status.Online)
+}
+
+func (s *mqttSink) Diagnostics(meter string, d diagnosticsPayload) {
+	s.brokers.PublishDiagnostics(meter, d)
+}
+
+// stateSink keeps the latest readings and the reader health for the HTTP
+// API and /metrics.
+type stateSink struct {
+	srv *Server
+}
+
+func (s stateSink) Open(meter MeterConfig) {
+	s.srv.RegisterMeter(meter.Name, meter.Device)
+	var counters []string
+	for _, v := range meter.Values {
+		if v.StateClass == "total_increasing" {
+			counters = append(counters, v.Name)
+		}
+	}
+	s.srv.RegisterCounters(meter.Name, counters)
+}
+
+func (s stateSink) Write(meter string, readings []Reading) {
+	for _, r := range readings {
+		if r.Quality == QualityGood {
+			s.srv.UpdateValue(meter, r.Name, r.Value, r.Unit, r.OBIS)
+		}
+	}
+}
+
+func (s stateSink) Status(meter string, status MeterStatus) {
+	s.srv.SetOnline(meter, status.Online)
+}
+
+func (s stateSink) Diagnostics(meter string, d diagnosticsPayload) {
+	s.srv.UpdateDiagnostics(meter, d)
+}
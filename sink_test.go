@@ -0,0 +1,208 @@
+package main
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+)
+
+// recordingSink remembers everything it was handed.
+type recordingSink struct {
+	opened   []MeterConfig
+	written  [][]Reading
+	statuses []MeterStatus
+}
+
+func (r *recordingSink) Open(meter MeterConfig) { r.opened = append(r.opened, meter) }
+func (r *recordingSink) Write(_ string, readings []Reading) {
+	r.written = append(r.written, readings)
+}
+func (r *recordingSink) Status(_ string, status MeterStatus) {
+	r.statuses = append(r.statuses, status)
+}
+func (r *recordingSink) Diagnostics(string, diagnosticsPayload) {}
+
+var sinkTestMeter = MeterConfig{Name: "nutzstrom", Device: "/dev/ttyUSB0", Values: []ValueConfig{
+	{Name: "Bezug", OBIS: "1.0.1.8.0", Unit: "Wh"},
+	{Name: "Leistung", OBIS: "1.0.16.7.0", Unit: "W"},
+}}
+
+func testReadings(at time.Time, bezug, leistung float64) []Reading {
+	return []Reading{
+		{Meter: "nutzstrom", Name: "Bezug", OBIS: "1-0:1.8.0*255", Value: bezug, Unit: "Wh", Time: at, Quality: QualityGood},
+		{Meter: "nutzstrom", Name: "Leistung", OBIS: "1-0:16.7.0*255", Value: leistung, Unit: "W", Time: at, Quality: QualityGood},
+	}
+}
+
+// ---------------------------------------------------------------------------
+// Filters
+// ---------------------------------------------------------------------------
+
+func TestFilteredSink_Values(t *testing.T) {
+	for _, selector := range []string{"Leistung", "1.0.16.7.0"} {
+		rec := &recordingSink{}
+		sinks := Sinks{&filteredSink{Sink: rec, values: []string{selector}, allowed: make(map[string]map[string]bool)}}
+
+		sinks.Open(sinkTestMeter)
+		sinks.Write("nutzstrom", testReadings(time.Now(), 1, 246))
+
+		if len(rec.opened) != 1 || len(rec.opened[0].Values) != 1 || rec.opened[0].Values[0].Name != "Leistung" {
+			t.Fatalf("%s: sink opened with %+v", selector, rec.opened)
+		}
+		if len(rec.written) != 1 || len(rec.written[0]) != 1 || rec.written[0][0].Value != 246 {
+			t.Fatalf("%s: sink got %+v", selector, rec.written)
+		}
+	}
+}
+
+func TestFilteredSink_Meters(t *testing.T) {
+	rec := &recordingSink{}
+	sink := &filteredSink{Sink: rec, meters: []string{"waermepumpe"}, allowed: make(map[string]map[string]bool)}
+
+	sink.Open(sinkTestMeter)
+	sink.Write("nutzstrom", testReadings(time.Now(), 1, 246))
+	sink.Status("nutzstrom", MeterStatus{Online: true})
+
+	if len(rec.opened)+len(rec.written)+len(rec.statuses) != 0 {
+		t.Fatalf("other meters should be filtered, got %+v", rec)
+	}
+}
+
+// ---------------------------------------------------------------------------
+// Built-in sinks
+// ---------------------------------------------------------------------------
+
+func TestMQTTSink_ChangeFilters(t *testing.T) {
+	p, client := newTestPublisher()
+	p.meterStates = true
+	sink := newMQTTSink(newTestBrokers(t, p))
+
+	meter := sinkTestMeter
+	meter.Values = append([]ValueConfig(nil), meter.Values...)
+	meter.Values[0].Deadband = Deadband{Amount: 10, Set: true}
+	sink.Open(meter)
+
+	at := time.Now()
+	sink.Write("nutzstrom", testReadings(at, 100, 246))
+	sink.Write("nutzstrom", testReadings(at.Add(time.Second), 105, 250))
+	invalid := testReadings(at.Add(2*time.Second), 200, 0)
+	invalid[1].Quality = QualityInvalid
+	sink.Write("nutzstrom", invalid)
+	sink.brokers.flush(t)
+
+	if n := len(client.messages("zaehler2mqtt/nutzstrom/Bezug/state")); n != 2 {
+		t.Fatalf("Bezug published %d times, want 2 (deadband)", n)
+	}
+	if n := len(client.messages("zaehler2mqtt/nutzstrom/Leistung/state")); n != 2 {
+		t.Fatalf("Leistung published %d times, want 2 (invalid reading skipped)", n)
+	}
+
+	msgs := client.messages("zaehler2mqtt/nutzstrom/state")
+	if len(msgs) != 3 {
+		t.Fatalf("expected 3 meter states, got %d", len(msgs))
+	}
+	var state meterStatePayload
+	if err := json.Unmarshal(msgs[2].Payload, &state); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := state.Values["Leistung"]; ok || state.Values["Bezug"].Value != 200 {
+		t.Fatalf("unexpected meter state: %s", msgs[2].Payload)
+	}
+}
+
+func TestMQTTSink_Status(t *testing.T) {
+	p, client := newTestPublisher()
+	sink := newMQTTSink(newTestBrokers(t, p))
+	sink.Open(sinkTestMeter)
+
+	sink.Status("nutzstrom", MeterStatus{Online: true, Serial: "0a01"})
+	sink.brokers.flush(t)
+
+	if got := client.payload("zaehler2mqtt/nutzstrom/availability"); got != "online" {
+		t.Fatalf("availability = %q", got)
+	}
+}
+
+func TestStateSink(t *testing.T) {
+	srv := NewServer(":0")
+	sink := stateSink{srv}
+	sink.Open(sinkTestMeter)
+
+	readings := testReadings(time.Now(), 8782.4, 246)
+	readings[1].Quality = QualityInvalid
+	sink.Write("nutzstrom", readings)
+
+	state := srv.meters["nutzstrom"]
+	if state.Device != "/dev/ttyUSB0" || len(state.Values) != 1 || state.Values["Bezug"].Value != 8782.4 {
+		t.Fatalf("unexpected state: %+v", state)
+	}
+}
+
+func TestStatusTracker_ReportsChanges(t *testing.T) {
+	rec := &recordingSink{}
+	status := &statusTracker{meter: "nutzstrom", sink: rec}
+
+	status.setOnline(false)
+	status.setOnline(false)
+	status.setOnline(true)
+	status.update(func(s *MeterStatus) { s.Serial = "0a01" })
+	status.update(func(s *MeterStatus) { s.Serial = "0a01" })
+	status.setOnline(true)
+
+	want := []MeterStatus{{}, {Online: true}, {Online: true, Serial: "0a01"}}
+	if len(rec.statuses) != len(want) {
+		t.Fatalf("statuses = %+v, want %+v", rec.statuses, want)
+	}
+	for i := range want {
+		if rec.statuses[i] != want[i] {
+			t.Fatalf("statuses = %+v, want %+v", rec.statuses, want)
+		}
+	}
+}
+
+// ---------------------------------------------------------------------------
+// Config
+// ---------------------------------------------------------------------------
+
+func TestLoadConfig_Outputs(t *testing.T) {
+	base := `
+meters:
+  - name: nutzstrom
+    device: /dev/ttyUSB0
+    values:
+      - name: Leistung
+        obis: "1.0.16.7.0"
+`
+	cfg, err := LoadConfig(writeTestConfig(t, base))
+	if err != nil {
+		t.Fatalf("LoadConfig error: %v", err)
+	}
+	if len(cfg.Outputs) != 2 || cfg.Outputs[0].Type != OutputMQTT || cfg.Outputs[1].Type != OutputHTTP {
+		t.Fatalf("unexpected default outputs: %+v", cfg.Outputs)
+	}
+
+	cfg, err = LoadConfig(writeTestConfig(t, base+`
+outputs:
+  - type: mqtt
+    values: ["1.0.16.7.0"]
+`))
+	if err != nil {
+		t.Fatalf("LoadConfig error: %v", err)
+	}
+	if len(cfg.Outputs) != 1 || cfg.Outputs[0].Values[0] != "1.0.16.7.0" {
+		t.Fatalf("unexpected outputs: %+v", cfg.Outputs)
+	}
+
+	bad := map[string]string{
+		"unknown type":   "  - type: kafka\n",
+		"duplicate mqtt": "  - type: mqtt\n  - type: mqtt\n",
+		"unknown meter":  "  - type: http\n    meters: [waermepumpe]\n",
+		"unknown value":  "  - type: http\n    values: [Bezug]\n",
+	}
+	for name, outputs := range bad {
+		if _, err := LoadConfig(writeTestConfig(t, base+"outputs:\n"+outputs)); err == nil || !strings.Contains(err.Error(), "outputs[") {
+			t.Errorf("%s: expected outputs error, got %v", name, err)
+		}
+	}
+}
@@ -0,0 +1,272 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"log"
+	"math"
+	"net"
+	"sync"
+	"time"
+)
+
+const (
+	// smaMulticastAddress is where SMA Energy Meters send their datagrams.
+	smaMulticastAddress = "239.12.255.254:9522"
+
+	// smaSusyID identifies an SMA Energy Meter (EMETER-20).
+	smaSusyID = 270
+
+	// smaSoftwareVersion is the firmware reported, 2.3.4.R.
+	smaSoftwareVersion = 0x02030452
+)
+
+// SMAEnergyMeterConfig configures an sma_energy_meter output, which emulates
+// an SMA Energy Meter for the one meter selected with meters.
+type SMAEnergyMeterConfig struct {
+	// Address is the destination, default: the Speedwire multicast group.
+	Address string `yaml:"address"`
+	// Interface is the network interface to send on, default: by route.
+	Interface string `yaml:"interface"`
+	// Serial is the serial number inverters are paired with. The default is
+	// derived from the meter name.
+	Serial uint32 `yaml:"serial"`
+	// Interval is the time between datagrams, default 1s.
+	Interval time.Duration `yaml:"interval"`
+}
+
+func (c SMAEnergyMeterConfig) address() string {
+	if c.Address == "" {
+		return smaMulticastAddress
+	}
+	return c.Address
+}
+
+func (c SMAEnergyMeterConfig) interval() time.Duration {
+	if c.Interval == 0 {
+		return time.Second
+	}
+	return c.Interval
+}
+
+// serial returns the configured serial number, or a stable one in the range
+// of real meters.
+func (c SMAEnergyMeterConfig) serial(meter string) uint32 {
+	if c.Serial != 0 {
+		return c.Serial
+	}
+	return 1900000000 + crc32.ChecksumIEEE([]byte(meter))%100000000
+}
+
+func (c SMAEnergyMeterConfig) validate() error {
+	if _, _, err := net.SplitHostPort(c.address()); err != nil {
+		return fmt.Errorf("sma_energy_meter address %q is invalid: %w", c.Address, err)
+	}
+	if c.Interval < 0 || (c.Interval > 0 && c.Interval < 100*time.Millisecond) {
+		return fmt.Errorf("sma_energy_meter interval must be at least 100ms")
+	}
+	return nil
+}
+
+// smaRecord is the OBIS header of a measurement in an EMETER datagram:
+// channel, index, type and tariff.
+type smaRecord uint32
+
+const (
+	smaTypeActual  = 4
+	smaTypeCounter = 8
+)
+
+func smaActual(index byte) smaRecord  { return smaRecord(uint32(index)<<16 | smaTypeActual<<8) }
+func smaCounter(index byte) smaRecord { return smaRecord(uint32(index)<<16 | smaTypeCounter<<8) }
+
+// smaVersion carries the software version at the end of a datagram.
+const smaVersion smaRecord = 0x90000000
+
+// smaLayout is the order of the measurements an EMETER-20 sends: the sums,
+// then each phase. Active, reactive and apparent power come as actual value
+// and counter, one index for consumption and one for feed-in.
+var smaLayout = func() []smaRecord {
+	var layout []smaRecord
+	power := func(base byte) {
+		for _, i := range []byte{1, 2, 3, 4, 9, 10} {
+			layout = append(layout, smaActual(base+i), smaCounter(base+i))
+		}
+	}
+	power(0)
+	layout = append(layout, smaActual(13), smaActual(14))
+	for _, base := range []byte{20, 40, 60} {
+		power(base)
+		// current, voltage and power factor
+		layout = append(layout, smaActual(base+11), smaActual(base+12), smaActual(base+13))
+	}
+	return append(layout, smaVersion)
+}()
+
+// smaEnergyMeterSink multicasts the readings of a meter in the Speedwire
+// EMETER protocol, so SMA inverters and battery chargers can use it as
+// their grid meter. Datagrams are only sent while the meter is online.
+type smaEnergyMeterSink struct {
+	*gridMeter
+	cfg    SMAEnergyMeterConfig
+	serial uint32
+	conn   net.Conn
+	start  time.Time
+	done   chan struct{}
+	wg     sync.WaitGroup
+}
+
+func newSMAEnergyMeterSink(cfg SMAEnergyMeterConfig, meter string) (*smaEnergyMeterSink, error) {
+	raddr, err := net.ResolveUDPAddr("udp4", cfg.address())
+	if err != nil {
+		return nil, err
+	}
+	var laddr *net.UDPAddr
+	if cfg.Interface != "" {
+		// Linux sends multicast on the interface of the source address
+		if laddr, err = interfaceAddr(cfg.Interface); err != nil {
+			return nil, err
+		}
+	}
+	conn, err := net.DialUDP("udp4", laddr, raddr)
+	if err != nil {
+		return nil, err
+	}
+	s := &smaEnergyMeterSink{
+		gridMeter: newGridMeter(),
+		cfg:       cfg,
+		serial:    cfg.serial(meter),
+		conn:      conn,
+		start:     time.Now(),
+		done:      make(chan struct{}),
+	}
+	log.Printf("[sma] Emulating SMA Energy Meter %d for %s on %s", s.serial, meter, cfg.address())
+	s.wg.Add(1)
+	go s.run()
+	return s, nil
+}
+
+// interfaceAddr returns the first IPv4 address of a network interface.
+func interfaceAddr(name string) (*net.UDPAddr, error) {
+	iface, err := net.InterfaceByName(name)
+	if err != nil {
+		return nil, err
+	}
+	addrs, err := iface.Addrs()
+	if err != nil {
+		return nil, err
+	}
+	for _, a := range addrs {
+		if ipnet, ok := a.(*net.IPNet); ok && ipnet.IP.To4() != nil {
+			return &net.UDPAddr{IP: ipnet.IP}, nil
+		}
+	}
+	return nil, fmt.Errorf("interface %s has no IPv4 address", name)
+}
+
+func (s *smaEnergyMeterSink) Close() error {
+	close(s.done)
+	s.wg.Wait()
+	return s.conn.Close()
+}
+
+func (s *smaEnergyMeterSink) run() {
+	defer s.wg.Done()
+	ticker := time.NewTicker(s.cfg.interval())
+	defer ticker.Stop()
+	failed := false
+	for {
+		select {
+		case <-s.done:
+			return
+		case <-ticker.C:
+		}
+		datagram := s.datagram()
+		if datagram == nil {
+			continue
+		}
+		if _, err := s.conn.Write(datagram); err != nil {
+			if !failed {
+				log.Printf("[sma] Failed to send: %v", err)
+			}
+			failed = true
+			continue
+		}
+		failed = false
+	}
+}
+
+// smaValues converts grid values to the units of the EMETER protocol: 0.1 W,
+// Ws, mA, mV, mHz and 0.001 for the power factor. Signed power is split
+// into consumption and feed-in.
+func smaValues(g gridValues) map[smaRecord]uint64 {
+	values := make(map[smaRecord]uint64)
+	set := func(r smaRecord, v float64, ok bool) {
+		if ok {
+			values[r] = uint64(math.Round(math.Max(v, 0)))
+		}
+	}
+	power := func(base byte, p float64, ok bool) {
+		set(smaActual(base+1), 10*p, ok)
+		set(smaActual(base+2), -10*p, ok)
+	}
+	p, ok := g.power()
+	power(0, p, ok)
+	v, ok := g.get(gridImport)
+	set(smaCounter(1), 3600*v, ok)
+	v, ok = g.get(gridExport)
+	set(smaCounter(2), 3600*v, ok)
+	v, ok = g.get(gridPowerFactor)
+	set(smaActual(13), 1000*v, ok)
+	v, ok = g.get(gridFrequency)
+	set(smaActual(14), 1000*v, ok)
+	for phase, base := range []byte{20, 40, 60} {
+		p, ok := g.phasePower(phase)
+		power(base, p, ok)
+		v, ok := g.get(gridPhase(gridPhaseCurrent, phase))
+		set(smaActual(base+11), 1000*v, ok)
+		v, ok = g.get(gridPhase(gridPhaseVoltage, phase))
+		set(smaActual(base+12), 1000*v, ok)
+		v, ok = g.get(gridPhase(gridPhasePowerFactor, phase))
+		set(smaActual(base+13), 1000*v, ok)
+	}
+	return values
+}
+
+// datagram encodes the latest values, or returns nil while the meter is
+// offline.
+func (s *smaEnergyMeterSink) datagram() []byte {
+	grid, _, ok := s.snapshot()
+	if !ok {
+		return nil
+	}
+	values := smaValues(grid)
+
+	b := make([]byte, 0, 608)
+	b = append(b, "SMA\x00"...)
+	b = binary.BigEndian.AppendUint16(b, 4)
+	b = binary.BigEndian.AppendUint16(b, 0x02a0)
+	b = binary.BigEndian.AppendUint32(b, 1)
+	// the length is filled in below, it counts from the protocol ID to the
+	// end of the measurements
+	b = append(b, 0, 0)
+	b = binary.BigEndian.AppendUint16(b, 0x0010)
+	b = binary.BigEndian.AppendUint16(b, 0x6069)
+	b = binary.BigEndian.AppendUint16(b, smaSusyID)
+	b = binary.BigEndian.AppendUint32(b, s.serial)
+	b = binary.BigEndian.AppendUint32(b, uint32(time.Since(s.start).Milliseconds()))
+	for _, r := range smaLayout {
+		b = binary.BigEndian.AppendUint32(b, uint32(r))
+		switch {
+		case r == smaVersion:
+			b = binary.BigEndian.AppendUint32(b, smaSoftwareVersion)
+		case r&0xff00 == smaTypeCounter<<8:
+			b = binary.BigEndian.AppendUint64(b, values[r])
+		default:
+			b = binary.BigEndian.AppendUint32(b, uint32(min(values[r], math.MaxUint32)))
+		}
+	}
+	binary.BigEndian.PutUint16(b[12:], uint16(len(b)-16))
+	return binary.BigEndian.AppendUint32(b, 0)
+}
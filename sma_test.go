@@ -0,0 +1,143 @@
+package main
+
+import (
+	"encoding/binary"
+	"net"
+	"testing"
+	"time"
+)
+
+// smaTestMeter reports a signed total and L1 power besides the counters.
+var smaTestMeter = MeterConfig{Name: "nutzstrom", Device: "/dev/ttyUSB0", Values: []ValueConfig{
+	{Name: "Bezug", OBIS: "1.0.1.8.0", Unit: "Wh"},
+	{Name: "Einspeisung", OBIS: "1.0.2.8.0", Unit: "kWh"},
+	{Name: "Leistung", OBIS: "1.0.16.7.0", Unit: "W"},
+	{Name: "Leistung L1", OBIS: "1.0.36.7.0", Unit: "W"},
+	{Name: "Spannung L1", OBIS: "1.0.32.7.0", Unit: "V"},
+}}
+
+// parseSMADatagram returns the measurements of an EMETER datagram.
+func parseSMADatagram(t *testing.T, b []byte) (serial uint32, values map[smaRecord]uint64) {
+	t.Helper()
+	if string(b[:4]) != "SMA\x00" || binary.BigEndian.Uint16(b[16:]) != 0x6069 || binary.BigEndian.Uint16(b[18:]) != smaSusyID {
+		t.Fatalf("invalid header % x", b[:28])
+	}
+	end := 16 + int(binary.BigEndian.Uint16(b[12:]))
+	if end+4 != len(b) || binary.BigEndian.Uint32(b[end:]) != 0 {
+		t.Fatalf("length %d does not match datagram of %d bytes", end-16, len(b))
+	}
+	values = make(map[smaRecord]uint64)
+	for i := 28; i < end; {
+		r := smaRecord(binary.BigEndian.Uint32(b[i:]))
+		if r&0xff00 == smaTypeCounter<<8 {
+			values[r] = binary.BigEndian.Uint64(b[i+4:])
+			i += 12
+		} else {
+			values[r] = uint64(binary.BigEndian.Uint32(b[i+4:]))
+			i += 8
+		}
+	}
+	return binary.BigEndian.Uint32(b[20:]), values
+}
+
+func TestSMAEnergyMeterSink(t *testing.T) {
+	conn, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	sink, err := newSMAEnergyMeterSink(SMAEnergyMeterConfig{Address: conn.LocalAddr().String(), Serial: 1901234567,
+		Interval: 100 * time.Millisecond}, "nutzstrom")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sink.Close()
+
+	sink.Open(smaTestMeter)
+	sink.Write("nutzstrom", []Reading{
+		{Name: "Bezug", Value: 8782400.5, Unit: "Wh", Quality: QualityGood},
+		{Name: "Einspeisung", Value: 1234.5, Unit: "kWh", Quality: QualityGood},
+		{Name: "Leistung", Value: -1500.25, Unit: "W", Quality: QualityGood},
+		{Name: "Leistung L1", Value: 120, Unit: "W", Quality: QualityGood},
+		{Name: "Spannung L1", Value: 230.1, Unit: "V", Quality: QualityGood},
+	})
+
+	// nothing is sent until the meter is online
+	conn.SetReadDeadline(time.Now().Add(300 * time.Millisecond))
+	buf := make([]byte, 1500)
+	if _, _, err := conn.ReadFrom(buf); err == nil {
+		t.Fatal("datagram sent while the meter is offline")
+	}
+
+	sink.Status("nutzstrom", MeterStatus{Online: true})
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	n, _, err := conn.ReadFrom(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 608 {
+		t.Fatalf("datagram of %d bytes, an EMETER-20 sends 608", n)
+	}
+	serial, values := parseSMADatagram(t, buf[:n])
+	if serial != 1901234567 {
+		t.Fatalf("serial %d", serial)
+	}
+	tests := []struct {
+		record smaRecord
+		want   uint64
+	}{
+		{smaActual(1), 0},
+		{smaActual(2), 15003},
+		{smaCounter(1), 31616641800},
+		{smaCounter(2), 4444200000},
+		{smaActual(21), 1200},
+		{smaActual(22), 0},
+		{smaActual(32), 230100},
+		{smaVersion, smaSoftwareVersion},
+	}
+	for _, tt := range tests {
+		if got := values[tt.record]; got != tt.want {
+			t.Errorf("record %08x = %d, want %d", uint32(tt.record), got, tt.want)
+		}
+	}
+}
+
+func TestSMAEnergyMeterConfig_Serial(t *testing.T) {
+	cfg := SMAEnergyMeterConfig{}
+	if s := cfg.serial("nutzstrom"); s < 1900000000 || s != cfg.serial("nutzstrom") || s == cfg.serial("waermestrom") {
+		t.Fatalf("unexpected serial %d", s)
+	}
+}
+
+func TestLoadConfig_SMAEnergyMeter(t *testing.T) {
+	base := `
+meters:
+  - name: nutzstrom
+    device: /dev/ttyUSB0
+    values:
+      - name: Leistung
+        obis: "1.0.16.7.0"
+outputs:
+`
+	cfg, err := LoadConfig(writeTestConfig(t, base+`
+  - type: sma_energy_meter
+    meters: [nutzstrom]
+    serial: 1901234567
+`))
+	if err != nil {
+		t.Fatalf("LoadConfig error: %v", err)
+	}
+	if o := cfg.Outputs[0]; o.SMA == nil || o.SMA.Serial != 1901234567 || o.SMA.address() != smaMulticastAddress {
+		t.Fatalf("unexpected output %+v", o)
+	}
+
+	for _, bad := range []string{
+		"  - type: sma_energy_meter\n",
+		"  - type: sma_energy_meter\n    meters: [nutzstrom]\n    address: \"239.12.255.254\"\n",
+		"  - type: sma_energy_meter\n    meters: [nutzstrom]\n    interval: 10ms\n",
+	} {
+		if _, err := LoadConfig(writeTestConfig(t, base+bad)); err == nil {
+			t.Errorf("expected error for %q", bad)
+		}
+	}
+}
@@ -0,0 +1,400 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+	"text/template"
+)
+
+const (
+	defaultBaseTopic         = "zaehler2mqtt"
+	defaultDiscoveryPrefix   = "homeassistant"
+	defaultStateTopic        = "{{.Base}}/{{.Meter}}/{{.Value}}/state"
+	defaultAvailabilityTopic = "{{.Base}}/{{.Meter}}/availability"
+	defaultMeterStateTopic   = "{{.Base}}/{{.Meter}}/state"
+	defaultDiagnosticsTopic  = "{{.Base}}/{{.Meter}}/diagnostics"
+	defaultHomiePrefix       = "homie"
+)
+
+// topicVars are the variables available in topic templates. Meter, Value,
+// OBIS and Serial are sanitized before use.
+type topicVars struct {
+	Base   string
+	Meter  string
+	Value  string
+	OBIS   string
+	Serial string
+}
+
+// errSerialUnknown is returned for topics that contain the serial number of a
+// meter that has not reported it yet.
+var errSerialUnknown = errors.New("serial number not known yet")
+
+// topicTemplate is a parsed topic template.
+type topicTemplate struct {
+	*template.Template
+	// serial is set if the template uses the meter's serial number.
+	serial bool
+}
+
+// TopicLayout builds every MQTT topic zaehler2mqtt publishes to or
+// subscribes on.
+type TopicLayout struct {
+	base            string
+	discoveryPrefix string
+	state           *topicTemplate
+	availability    *topicTemplate
+	meterState      *topicTemplate
+	diagnostics     *topicTemplate
+	// deviceDiscovery announces one device config per meter instead of one
+	// sensor config per value.
+	deviceDiscovery bool
+	// commands subscribes to commands and announces their buttons.
+	commands bool
+	// homie is the Homie convention version meters are announced with, 0 if
+	// disabled.
+	homie       int
+	homiePrefix string
+}
+
+func NewTopicLayout(cfg MQTTConfig) (*TopicLayout, error) {
+	l := &TopicLayout{
+		base:            strings.Trim(cfg.BaseTopic, "/"),
+		discoveryPrefix: strings.Trim(cfg.DiscoveryPrefix, "/"),
+		deviceDiscovery: cfg.DiscoveryMode == DiscoveryModeDevice,
+		commands:        cfg.commands(),
+		homie:           cfg.Homie,
+		homiePrefix:     strings.Trim(cfg.HomiePrefix, "/"),
+	}
+	if l.base == "" {
+		l.base = defaultBaseTopic
+	}
+	if l.discoveryPrefix == "" {
+		l.discoveryPrefix = defaultDiscoveryPrefix
+	}
+	if l.homiePrefix == "" {
+		l.homiePrefix = defaultHomiePrefix
+	}
+	if err := checkTopic(l.base); err != nil {
+		return nil, fmt.Errorf("mqtt.base_topic: %w", err)
+	}
+	if err := checkTopic(l.discoveryPrefix); err != nil {
+		return nil, fmt.Errorf("mqtt.discovery_prefix: %w", err)
+	}
+	if err := checkTopic(l.homiePrefix); err != nil {
+		return nil, fmt.Errorf("mqtt.homie_prefix: %w", err)
+	}
+
+	var err error
+	if l.state, err = parseTopicTemplate("state_topic", cfg.StateTopic, defaultStateTopic); err != nil {
+		return nil, err
+	}
+	if l.availability, err = parseTopicTemplate("availability_topic", cfg.AvailabilityTopic, defaultAvailabilityTopic); err != nil {
+		return nil, err
+	}
+	if l.meterState, err = parseTopicTemplate("meter_state_topic", cfg.MeterStateTopic, defaultMeterStateTopic); err != nil {
+		return nil, err
+	}
+	if l.diagnostics, err = parseTopicTemplate("diagnostics_topic", cfg.DiagnosticsTopic, defaultDiagnosticsTopic); err != nil {
+		return nil, err
+	}
+	return l, nil
+}
+
+// parseTopicTemplate parses a topic template and renders it once with sample
+// values so that mistakes are reported at config load.
+func parseTopicTemplate(name, text, fallback string) (*topicTemplate, error) {
+	if text == "" {
+		text = fallback
+	}
+	tmpl, err := template.New(name).Option("missingkey=error").Parse(text)
+	if err != nil {
+		return nil, fmt.Errorf("mqtt.%s: %w", name, err)
+	}
+	sample := topicVars{Base: "base", Meter: "meter", Value: "value", OBIS: "1.0.1.8.0", Serial: "0a01"}
+	var buf bytes.Buffer
+	if err := tmpl.Execute(&buf, sample); err != nil {
+		return nil, fmt.Errorf("mqtt.%s: %w", name, err)
+	}
+	if err := checkTopic(buf.String()); err != nil {
+		return nil, fmt.Errorf("mqtt.%s: %w", name, err)
+	}
+	return &topicTemplate{Template: tmpl, serial: strings.Contains(text, ".Serial")}, nil
+}
+
+// checkTopic rejects topics that cannot be published to.
+func checkTopic(topic string) error {
+	if topic == "" {
+		return fmt.Errorf("topic is empty")
+	}
+	if strings.ContainsAny(topic, "+#") {
+		return fmt.Errorf("topic %q contains a wildcard", topic)
+	}
+	if slices.Contains(strings.Split(topic, "/"), "") {
+		return fmt.Errorf("topic %q has an empty level", topic)
+	}
+	return nil
+}
+
+// sanitizeTopicLevel makes a name usable as a single topic level.
+func sanitizeTopicLevel(s string) string {
+	return strings.Map(func(r rune) rune {
+		switch r {
+		case '/', '+', '#', ' ', '\t':
+			return '_'
+		}
+		return r
+	}, s)
+}
+
+// sanitizeObjectID makes a name usable as a Home Assistant object ID, which
+// only allows letters, digits, underscores and hyphens.
+func sanitizeObjectID(s string) string {
+	return strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9', r == '_', r == '-':
+			return r
+		}
+		return '_'
+	}, s)
+}
+
+// sanitizeHomieID makes a name usable as a Homie device or node ID, which
+// only allows lowercase letters, digits and inner hyphens.
+func sanitizeHomieID(s string) string {
+	id := strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z', r >= '0' && r <= '9':
+			return r
+		case r >= 'A' && r <= 'Z':
+			return r - 'A' + 'a'
+		}
+		return '-'
+	}, s)
+	return strings.Trim(id, "-")
+}
+
+// render executes a topic template. Topics that contain the serial number
+// fail with errSerialUnknown until the meter has reported it, so that nothing
+// is published to a topic that changes with the first frame.
+func (l *TopicLayout) render(tmpl *topicTemplate, meterName, valueName, obis, serial string) (string, error) {
+	if tmpl.serial && serial == "" {
+		return "", errSerialUnknown
+	}
+	var buf bytes.Buffer
+	err := tmpl.Execute(&buf, topicVars{
+		Base:   l.base,
+		Meter:  sanitizeTopicLevel(meterName),
+		Value:  sanitizeTopicLevel(valueName),
+		OBIS:   sanitizeTopicLevel(obis),
+		Serial: sanitizeTopicLevel(serial),
+	})
+	if err == nil {
+		err = checkTopic(buf.String())
+	}
+	if err != nil {
+		return "", fmt.Errorf("mqtt.%s: %w", tmpl.Name(), err)
+	}
+	return buf.String(), nil
+}
+
+func (l *TopicLayout) BridgeStatus() string {
+	return l.base + "/status"
+}
+
+func (l *TopicLayout) HAStatus() string {
+	return l.discoveryPrefix + "/status"
+}
+
+// Command is the topic a command is sent to.
+func (l *TopicLayout) Command(name string) string {
+	return l.base + "/cmd/" + name
+}
+
+// CommandFilter matches every command topic.
+func (l *TopicLayout) CommandFilter() string {
+	return l.Command("+")
+}
+
+// Response is the topic command results are published to, unless an MQTT 5
+// request names its own response topic.
+func (l *TopicLayout) Response() string {
+	return l.base + "/response"
+}
+
+func (l *TopicLayout) State(meterName string, val ValueConfig, serial string) (string, error) {
+	return l.render(l.state, meterName, val.Name, val.OBIS, serial)
+}
+
+// MeterState is the topic of the aggregated JSON state of a meter.
+func (l *TopicLayout) MeterState(meterName, serial string) (string, error) {
+	return l.render(l.meterState, meterName, "", "", serial)
+}
+
+// Diagnostics is the topic of the reader health of a meter.
+func (l *TopicLayout) Diagnostics(meterName, serial string) (string, error) {
+	return l.render(l.diagnostics, meterName, "", "", serial)
+}
+
+func (l *TopicLayout) Availability(meterName, serial string) (string, error) {
+	return l.render(l.availability, meterName, "", "", serial)
+}
+
+// sensorIDPrefix is the object ID prefix of every entity this instance
+// announces. It is derived from the base topic so that instances sharing a
+// broker do not overwrite each other.
+func (l *TopicLayout) sensorIDPrefix() string {
+	return sanitizeObjectID(l.base) + "_"
+}
+
+func (l *TopicLayout) SensorID(meterName, valueName string) string {
+	return l.sensorIDPrefix() + sanitizeObjectID(meterName) + "_" + sanitizeObjectID(valueName)
+}
+
+func (l *TopicLayout) Discovery(sensorID string) string {
+	return fmt.Sprintf("%s/sensor/%s/config", l.discoveryPrefix, sensorID)
+}
+
+// DeviceID is the object ID of a meter's device discovery config.
+func (l *TopicLayout) DeviceID(meterName string) string {
+	return l.sensorIDPrefix() + sanitizeObjectID(meterName)
+}
+
+func (l *TopicLayout) DeviceDiscovery(deviceID string) string {
+	return fmt.Sprintf("%s/device/%s/config", l.discoveryPrefix, deviceID)
+}
+
+// BridgeDeviceID is the object ID of the device that holds the buttons for
+// commands affecting all meters.
+func (l *TopicLayout) BridgeDeviceID() string {
+	return l.sensorIDPrefix() + "bridge"
+}
+
+// ButtonID is the object ID of a command button. Buttons of the bridge device
+// have an empty meter name.
+func (l *TopicLayout) ButtonID(meterName, command string) string {
+	if meterName == "" {
+		return l.BridgeDeviceID() + "_" + command
+	}
+	return l.sensorIDPrefix() + sanitizeObjectID(meterName) + "_" + command
+}
+
+func (l *TopicLayout) ButtonDiscovery(buttonID string) string {
+	return fmt.Sprintf("%s/button/%s/config", l.discoveryPrefix, buttonID)
+}
+
+// DiscoveryFilters match every sensor, button and device discovery topic
+// under the prefix.
+func (l *TopicLayout) DiscoveryFilters() []string {
+	return []string{
+		l.discoveryPrefix + "/sensor/+/config",
+		l.discoveryPrefix + "/button/+/config",
+		l.discoveryPrefix + "/device/+/config",
+	}
+}
+
+// ConfiguredDiscovery returns the discovery topics the given meters and the
+// bridge announce.
+func (l *TopicLayout) ConfiguredDiscovery(meters []MeterConfig) map[string]bool {
+	topics := make(map[string]bool)
+	for topic := range l.discoveryTopics(meters, l.deviceDiscovery) {
+		topics[topic] = true
+	}
+	return topics
+}
+
+// MigratedDiscovery returns the discovery topics the given meters and the
+// bridge announce in the other discovery mode, mapped to the meter they
+// belong to (empty for the bridge). Their entities are taken over by the
+// current configs instead of being removed.
+func (l *TopicLayout) MigratedDiscovery(meters []MeterConfig) map[string]string {
+	return l.discoveryTopics(meters, !l.deviceDiscovery)
+}
+
+func (l *TopicLayout) discoveryTopics(meters []MeterConfig, device bool) map[string]string {
+	topics := make(map[string]string)
+	// The bridge only has command buttons
+	if l.commands && device {
+		topics[l.DeviceDiscovery(l.BridgeDeviceID())] = ""
+	} else if l.commands {
+		for _, b := range bridgeButtons {
+			topics[l.ButtonDiscovery(l.ButtonID("", b.command))] = ""
+		}
+	}
+	for _, m := range meters {
+		if device {
+			topics[l.DeviceDiscovery(l.DeviceID(m.Name))] = m.Name
+			continue
+		}
+		for _, v := range meterEntities(m) {
+			topics[l.Discovery(l.SensorID(m.Name, v.Name))] = m.Name
+		}
+		if !l.commands {
+			continue
+		}
+		for _, b := range meterButtons {
+			topics[l.ButtonDiscovery(l.ButtonID(m.Name, b.command))] = m.Name
+		}
+	}
+	return topics
+}
+
+// discoveryRefs are the fields of a discovery config that point back to the
+// instance that published it.
+type discoveryRefs struct {
+	StateTopic   string `json:"state_topic"`
+	Availability []struct {
+		Topic string `json:"topic"`
+	} `json:"availability"`
+}
+
+// ownsDiscovery reports whether a retained discovery config was published by
+// this instance: its object ID carries our prefix and the payload, or one of
+// its device components, refers to our bridge status or base topic. Left-over
+// migration markers carry no references and are owned by their object ID.
+func (l *TopicLayout) ownsDiscovery(topic string, payload []byte) bool {
+	parts := strings.Split(topic, "/")
+	if len(parts) < 2 || !strings.HasPrefix(parts[len(parts)-2], l.sensorIDPrefix()) {
+		return false
+	}
+	var cfg struct {
+		discoveryRefs
+		Components       map[string]discoveryRefs `json:"components"`
+		MigrateDiscovery bool                     `json:"migrate_discovery"`
+	}
+	if err := json.Unmarshal(payload, &cfg); err != nil {
+		return false
+	}
+	if cfg.MigrateDiscovery || l.refersToUs(cfg.discoveryRefs) {
+		return true
+	}
+	for _, c := range cfg.Components {
+		if l.refersToUs(c) {
+			return true
+		}
+	}
+	return false
+}
+
+func (l *TopicLayout) refersToUs(refs discoveryRefs) bool {
+	for _, a := range refs.Availability {
+		if a.Topic == l.BridgeStatus() {
+			return true
+		}
+	}
+	return strings.HasPrefix(refs.StateTopic, l.base+"/")
+}
+
+// HomieDevice is the base topic of the Homie device of a meter. Homie 5
+// devices live below a version level.
+func (l *TopicLayout) HomieDevice(meterName string) string {
+	id := sanitizeHomieID(l.base + "-" + meterName)
+	if l.homie == 5 {
+		return l.homiePrefix + "/5/" + id
+	}
+	return l.homiePrefix + "/" + id
+}
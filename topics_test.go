@@ -0,0 +1,164 @@
+package main
+
+import (
+	"errors"
+	"testing"
+)
+
+// ---------------------------------------------------------------------------
+// TopicLayout
+// ---------------------------------------------------------------------------
+
+func TestTopicLayout_Defaults(t *testing.T) {
+	l, err := NewTopicLayout(MQTTConfig{})
+	if err != nil {
+		t.Fatalf("NewTopicLayout error: %v", err)
+	}
+	val := ValueConfig{OBIS: "1.0.1.8.0", Name: "Bezug"}
+	if got, _ := l.State("nutzstrom", val, ""); got != "zaehler2mqtt/nutzstrom/Bezug/state" {
+		t.Fatalf("state topic = %q", got)
+	}
+	if got, _ := l.Availability("nutzstrom", ""); got != "zaehler2mqtt/nutzstrom/availability" {
+		t.Fatalf("availability topic = %q", got)
+	}
+	if got := l.BridgeStatus(); got != "zaehler2mqtt/status" {
+		t.Fatalf("bridge status topic = %q", got)
+	}
+	if got := l.HAStatus(); got != "homeassistant/status" {
+		t.Fatalf("HA status topic = %q", got)
+	}
+	if got := l.Discovery(l.SensorID("nutzstrom", "Bezug")); got != "homeassistant/sensor/zaehler2mqtt_nutzstrom_Bezug/config" {
+		t.Fatalf("discovery topic = %q", got)
+	}
+}
+
+func TestTopicLayout_Custom(t *testing.T) {
+	l, err := NewTopicLayout(MQTTConfig{
+		BaseTopic:         "keller/strom/",
+		DiscoveryPrefix:   "ha",
+		StateTopic:        "{{.Base}}/{{.Serial}}/{{.OBIS}}",
+		AvailabilityTopic: "{{.Base}}/{{.Meter}}/online",
+	})
+	if err != nil {
+		t.Fatalf("NewTopicLayout error: %v", err)
+	}
+	val := ValueConfig{OBIS: "1.0.16.7.0", Name: "Leistung"}
+	if got, _ := l.State("nutzstrom", val, "0a01"); got != "keller/strom/0a01/1.0.16.7.0" {
+		t.Fatalf("state topic = %q", got)
+	}
+	if got, _ := l.Availability("nutzstrom", ""); got != "keller/strom/nutzstrom/online" {
+		t.Fatalf("availability topic = %q", got)
+	}
+	if _, err := l.State("nutzstrom", val, ""); !errors.Is(err, errSerialUnknown) {
+		t.Fatalf("state topic without serial: err = %v", err)
+	}
+	if got := l.SensorID("nutzstrom", "Leistung"); got != "keller_strom_nutzstrom_Leistung" {
+		t.Fatalf("sensor ID = %q", got)
+	}
+	if got := l.DiscoveryFilters(); len(got) != 3 || got[0] != "ha/sensor/+/config" || got[1] != "ha/button/+/config" || got[2] != "ha/device/+/config" {
+		t.Fatalf("discovery filters = %q", got)
+	}
+}
+
+func TestTopicLayout_Sanitizes(t *testing.T) {
+	l, err := NewTopicLayout(MQTTConfig{})
+	if err != nil {
+		t.Fatalf("NewTopicLayout error: %v", err)
+	}
+	val := ValueConfig{Name: "Bezug +/# Tarif 1"}
+	if got, _ := l.State("Haus/Keller", val, ""); got != "zaehler2mqtt/Haus_Keller/Bezug_____Tarif_1/state" {
+		t.Fatalf("state topic = %q", got)
+	}
+	if got := l.SensorID("Wärme strom", "Bezug"); got != "zaehler2mqtt_W_rme_strom_Bezug" {
+		t.Fatalf("sensor ID = %q", got)
+	}
+}
+
+func TestTopicLayout_Invalid(t *testing.T) {
+	tests := []struct {
+		name string
+		cfg  MQTTConfig
+	}{
+		{"wildcard base", MQTTConfig{BaseTopic: "zaehler/#"}},
+		{"wildcard prefix", MQTTConfig{DiscoveryPrefix: "+"}},
+		{"bad syntax", MQTTConfig{StateTopic: "{{.Base"}},
+		{"unknown variable", MQTTConfig{StateTopic: "{{.Base}}/{{.Zaehler}}"}},
+		{"wildcard in template", MQTTConfig{AvailabilityTopic: "{{.Base}}/+/availability"}},
+		{"empty level in base", MQTTConfig{BaseTopic: "zaehler//strom"}},
+		{"empty level in template", MQTTConfig{StateTopic: "{{.Base}}//{{.Value}}"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := NewTopicLayout(tt.cfg); err == nil {
+				t.Fatal("expected error")
+			}
+		})
+	}
+}
+
+func TestTopicLayout_EmptyLevel(t *testing.T) {
+	l, err := NewTopicLayout(MQTTConfig{MeterStateTopic: "{{.Base}}/{{.Meter}}/{{.Value}}"})
+	if err != nil {
+		t.Fatalf("NewTopicLayout error: %v", err)
+	}
+	if topic, err := l.MeterState("nutzstrom", ""); err == nil {
+		t.Fatalf("expected error for %q", topic)
+	}
+}
+
+func TestTopicLayout_OwnsDiscovery(t *testing.T) {
+	l, err := NewTopicLayout(MQTTConfig{})
+	if err != nil {
+		t.Fatalf("NewTopicLayout error: %v", err)
+	}
+	topic := "homeassistant/sensor/zaehler2mqtt_nutzstrom_Bezug/config"
+	if !l.ownsDiscovery(topic, []byte(`{"availability":[{"topic":"zaehler2mqtt/status"}]}`)) {
+		t.Fatal("expected config with our bridge status to be owned")
+	}
+	if !l.ownsDiscovery(topic, []byte(`{"state_topic":"zaehler2mqtt/nutzstrom/Bezug/state"}`)) {
+		t.Fatal("expected legacy config with our base topic to be owned")
+	}
+	if l.ownsDiscovery(topic, []byte(`{"state_topic":"other/nutzstrom/Bezug/state"}`)) {
+		t.Fatal("config of another instance must not be owned")
+	}
+	if l.ownsDiscovery(topic, []byte("not json")) {
+		t.Fatal("invalid payload must not be owned")
+	}
+	if !l.ownsDiscovery(topic, []byte(`{"migrate_discovery":true}`)) {
+		t.Fatal("expected left-over migration marker to be owned")
+	}
+
+	device := "homeassistant/device/zaehler2mqtt_nutzstrom/config"
+	if !l.ownsDiscovery(device, []byte(`{"components":{"x":{"availability":[{"topic":"zaehler2mqtt/status"}]}}}`)) {
+		t.Fatal("expected device config with our bridge status to be owned")
+	}
+	if l.ownsDiscovery(device, []byte(`{"components":{"x":{"state_topic":"other/x/state"}}}`)) {
+		t.Fatal("device config of another instance must not be owned")
+	}
+}
+
+func TestTopicLayout_DiscoveryModes(t *testing.T) {
+	meters := []MeterConfig{{Name: "nutzstrom", Values: []ValueConfig{{Name: "Bezug"}, {Name: "Leistung"}}}}
+	sensor := "homeassistant/sensor/zaehler2mqtt_nutzstrom_Bezug/config"
+	button := "homeassistant/button/zaehler2mqtt_nutzstrom_reconnect/config"
+	bridgeButton := "homeassistant/button/zaehler2mqtt_bridge_reload/config"
+	device := "homeassistant/device/zaehler2mqtt_nutzstrom/config"
+	bridge := "homeassistant/device/zaehler2mqtt_bridge/config"
+	perEntity := 2 + len(diagnosticValues) + len(meterButtons) + len(bridgeButtons)
+
+	l, _ := NewTopicLayout(MQTTConfig{})
+	if got := l.ConfiguredDiscovery(meters); len(got) != perEntity || !got[sensor] || !got[button] || !got[bridgeButton] {
+		t.Fatalf("sensor mode configured = %v", got)
+	}
+	if got := l.MigratedDiscovery(meters); len(got) != 2 || got[device] != "nutzstrom" || got[bridge] != "" {
+		t.Fatalf("sensor mode migrated = %v", got)
+	}
+
+	l, _ = NewTopicLayout(MQTTConfig{DiscoveryMode: DiscoveryModeDevice})
+	if got := l.ConfiguredDiscovery(meters); len(got) != 2 || !got[device] || !got[bridge] {
+		t.Fatalf("device mode configured = %v", got)
+	}
+	if got := l.MigratedDiscovery(meters); len(got) != perEntity || got[sensor] != "nutzstrom" || got[bridgeButton] != "" {
+		t.Fatalf("device mode migrated = %v", got)
+	}
+}
@@ -0,0 +1,167 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"net/url"
+	"regexp"
+	"slices"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// volkszaehlerTimeout bounds one request to the middleware.
+const volkszaehlerTimeout = 30 * time.Second
+
+// VolkszaehlerConfig configures a volkszaehler output.
+type VolkszaehlerConfig struct {
+	// URL is the middleware, e.g. http://host/middleware.php.
+	URL string `yaml:"url"`
+	// Channels map values to channels of the middleware. Other values are
+	// not pushed.
+	Channels []VolkszaehlerChannel `yaml:"channels"`
+
+	BatchConfig `yaml:",inline"`
+}
+
+// VolkszaehlerChannel maps a value to a channel.
+type VolkszaehlerChannel struct {
+	UUID string `yaml:"uuid"`
+	// Value is the name or OBIS code of the value.
+	Value string `yaml:"value"`
+	// Meter restricts the channel to one meter, for values that several
+	// meters have.
+	Meter string `yaml:"meter"`
+}
+
+var uuidPattern = regexp.MustCompile(`^[0-9a-fA-F]{8}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{12}$`)
+
+func (c VolkszaehlerConfig) validate() error {
+	u, err := url.Parse(c.URL)
+	if err != nil || u.Host == "" || (u.Scheme != "http" && u.Scheme != "https") {
+		return fmt.Errorf("volkszaehler url %q is invalid (use http or https)", c.URL)
+	}
+	if len(c.Channels) == 0 {
+		return fmt.Errorf("volkszaehler needs channels")
+	}
+	for _, ch := range c.Channels {
+		if !uuidPattern.MatchString(ch.UUID) {
+			return fmt.Errorf("volkszaehler channel %q is not a UUID", ch.UUID)
+		}
+		if ch.Value == "" {
+			return fmt.Errorf("volkszaehler channel %s needs a value", ch.UUID)
+		}
+	}
+	return c.BatchConfig.validate()
+}
+
+// volkszaehlerSink pushes readings to the data endpoint of the Volkszähler
+// middleware. Every channel has its own batcher, so a rejected channel does
+// not hold back the others and a retry never sends a tuple twice.
+type volkszaehlerSink struct {
+	cfg    VolkszaehlerConfig
+	client *http.Client
+
+	mu       sync.Mutex
+	channels map[string][]string // meter/value -> UUIDs
+	batches  map[string]*batcher
+}
+
+func newVolkszaehlerSink(cfg VolkszaehlerConfig) *volkszaehlerSink {
+	return &volkszaehlerSink{
+		cfg:      cfg,
+		client:   &http.Client{Timeout: volkszaehlerTimeout},
+		channels: make(map[string][]string),
+		batches:  make(map[string]*batcher),
+	}
+}
+
+func (s *volkszaehlerSink) Open(cfg MeterConfig) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, ch := range s.cfg.Channels {
+		if ch.Meter != "" && ch.Meter != cfg.Name {
+			continue
+		}
+		for _, v := range cfg.Values {
+			if ch.Value != v.Name && ch.Value != v.OBIS {
+				continue
+			}
+			key := cfg.Name + "/" + v.Name
+			if !slices.Contains(s.channels[key], ch.UUID) {
+				s.channels[key] = append(s.channels[key], ch.UUID)
+			}
+			s.openChannelLocked(ch.UUID)
+		}
+	}
+}
+
+// openChannelLocked starts the batcher of a channel. s.mu must be held.
+func (s *volkszaehlerSink) openChannelLocked(uuid string) {
+	if s.batches[uuid] != nil {
+		return
+	}
+	batch := s.cfg.BatchConfig
+	if batch.BufferFile != "" {
+		batch.BufferFile += "." + uuid
+	}
+	s.batches[uuid] = newBatcher("volkszaehler "+uuid, batch, func(ctx context.Context, tuples [][]byte) error {
+		return s.send(ctx, uuid, tuples)
+	})
+}
+
+func (s *volkszaehlerSink) Write(meter string, readings []Reading) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, r := range readings {
+		if r.Quality != QualityGood || math.IsNaN(r.Value) || math.IsInf(r.Value, 0) {
+			continue
+		}
+		for _, uuid := range s.channels[meter+"/"+r.Name] {
+			s.batches[uuid].Add(volkszaehlerTuple(r))
+		}
+	}
+}
+
+func (s *volkszaehlerSink) Status(string, MeterStatus)             {}
+func (s *volkszaehlerSink) Diagnostics(string, diagnosticsPayload) {}
+
+func (s *volkszaehlerSink) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var errs []error
+	for _, b := range s.batches {
+		if err := b.Close(); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// volkszaehlerTuple formats a reading as a [timestamp, value] tuple, the
+// timestamp in milliseconds.
+func volkszaehlerTuple(r Reading) []byte {
+	return []byte("[" + strconv.FormatInt(r.Time.UnixMilli(), 10) + "," + strconv.FormatFloat(r.Value, 'f', -1, 64) + "]")
+}
+
+func (s *volkszaehlerSink) send(ctx context.Context, uuid string, tuples [][]byte) error {
+	u, _ := url.Parse(s.cfg.URL)
+	u = u.JoinPath("data", uuid+".json")
+	body := append(append([]byte("["), bytes.Join(tuples, []byte(","))...), ']')
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, u.String(), bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	return checkResponse(resp)
+}
@@ -0,0 +1,170 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+const testChannel = "ab0e1bd0-4b45-11e4-8bca-b1e3a4d6f5c2"
+
+// vzStandIn records the data pushed to the middleware.
+type vzStandIn struct {
+	mu     sync.Mutex
+	paths  []string
+	bodies []string
+	status int
+}
+
+func newVZStandIn(t *testing.T) (*vzStandIn, *httptest.Server) {
+	s := &vzStandIn{status: http.StatusOK}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		data, _ := io.ReadAll(r.Body)
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		if r.Header.Get("Content-Type") != "application/json" {
+			t.Errorf("unexpected content type %q", r.Header.Get("Content-Type"))
+		}
+		s.paths = append(s.paths, r.URL.Path)
+		s.bodies = append(s.bodies, string(data))
+		w.WriteHeader(s.status)
+	}))
+	t.Cleanup(srv.Close)
+	return s, srv
+}
+
+func (s *vzStandIn) count() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.bodies)
+}
+
+// vzTestChannels maps Bezug to the test channel.
+var vzTestChannels = []VolkszaehlerChannel{{UUID: testChannel, Value: "Bezug"}}
+
+// ---------------------------------------------------------------------------
+// Push
+// ---------------------------------------------------------------------------
+
+func TestVolkszaehlerSink(t *testing.T) {
+	standIn, srv := newVZStandIn(t)
+	sink := newVolkszaehlerSink(VolkszaehlerConfig{URL: srv.URL + "/middleware.php", Channels: vzTestChannels})
+	sink.Open(sinkTestMeter)
+
+	at := time.UnixMilli(1700000000123)
+	sink.Write("nutzstrom", testReadings(at, 8782400, 246))
+	sink.Write("nutzstrom", testReadings(at.Add(time.Second), 8782400.5, 250))
+	sink.Write("nutzstrom", []Reading{{Name: "Bezug", Quality: QualityInvalid, Time: at}})
+	sink.Close()
+
+	// Leistung has no channel and is not pushed
+	if standIn.count() != 1 {
+		t.Fatalf("expected one request, got %v", standIn.paths)
+	}
+	if standIn.paths[0] != "/middleware.php/data/"+testChannel+".json" {
+		t.Fatalf("unexpected path %s", standIn.paths[0])
+	}
+	if want := "[[1700000000123,8782400],[1700000001123,8782400.5]]"; standIn.bodies[0] != want {
+		t.Fatalf("got body %s, want %s", standIn.bodies[0], want)
+	}
+}
+
+func TestVolkszaehlerSink_Retries(t *testing.T) {
+	standIn, srv := newVZStandIn(t)
+	standIn.status = http.StatusServiceUnavailable
+	sink := newVolkszaehlerSink(VolkszaehlerConfig{URL: srv.URL, Channels: vzTestChannels,
+		BatchConfig: BatchConfig{FlushInterval: 10 * time.Millisecond}})
+	defer sink.Close()
+	sink.Open(sinkTestMeter)
+
+	sink.Write("nutzstrom", testReadings(influxTestTime, 1, 2))
+	waitFor(t, "the first attempt", func() bool { return standIn.count() == 1 })
+	standIn.mu.Lock()
+	standIn.status = http.StatusOK
+	standIn.mu.Unlock()
+	waitFor(t, "the retry", func() bool { return standIn.count() == 2 && sink.batches[testChannel].len() == 0 })
+}
+
+func TestVolkszaehlerSink_Channels(t *testing.T) {
+	standIn, srv := newVZStandIn(t)
+	const other = "0f8a2c40-4b45-11e4-8bca-b1e3a4d6f5c2"
+	sink := newVolkszaehlerSink(VolkszaehlerConfig{URL: srv.URL, Channels: []VolkszaehlerChannel{
+		{UUID: testChannel, Value: "1.0.1.8.0"},
+		{UUID: other, Value: "Bezug", Meter: "nutzstrom"},
+		{UUID: other, Value: "Leistung", Meter: "waermestrom"},
+	}})
+	sink.Open(sinkTestMeter)
+	sink.Write("nutzstrom", testReadings(influxTestTime, 8782400, 246))
+	sink.Close()
+
+	// Bezug goes to both channels, Leistung of this meter to none
+	if standIn.count() != 2 {
+		t.Fatalf("expected two requests, got %v %v", standIn.paths, standIn.bodies)
+	}
+	for _, body := range standIn.bodies {
+		if body != "[[1700000000123,8782400]]" {
+			t.Fatalf("unexpected body %s", body)
+		}
+	}
+}
+
+// ---------------------------------------------------------------------------
+// Config
+// ---------------------------------------------------------------------------
+
+func TestLoadConfig_Volkszaehler(t *testing.T) {
+	base := `
+meters:
+  - name: nutzstrom
+    device: /dev/ttyUSB0
+    values:
+      - name: Bezug
+        obis: "1.0.1.8.0"
+  - name: waermestrom
+    device: /dev/ttyUSB1
+    values:
+      - name: Heizung
+        obis: "1.0.1.8.1"
+outputs:
+`
+	// a local and a remote middleware with their own channels
+	cfg, err := LoadConfig(writeTestConfig(t, base+`
+  - type: volkszaehler
+    url: "http://localhost/middleware.php"
+    flush_interval: 1m
+    channels:
+      - uuid: "`+testChannel+`"
+        value: Bezug
+  - type: volkszaehler
+    url: "https://demo.volkszaehler.org/middleware.php"
+    channels:
+      - uuid: "0f8a2c40-4b45-11e4-8bca-b1e3a4d6f5c2"
+        value: "1.0.1.8.0"
+        meter: nutzstrom
+`))
+	if err != nil {
+		t.Fatalf("LoadConfig error: %v", err)
+	}
+	o := cfg.Outputs[0]
+	if o.Volkszaehler == nil || o.Volkszaehler.FlushInterval != time.Minute || len(o.Volkszaehler.Channels) != 1 ||
+		o.Volkszaehler.Channels[0].UUID != testChannel || cfg.Outputs[1].Volkszaehler.Channels[0].Meter != "nutzstrom" {
+		t.Fatalf("unexpected config %+v", o)
+	}
+
+	// the last two: a meter without the value, and an unknown meter
+	for _, bad := range []string{
+		"  - type: volkszaehler\n    url: \"http://localhost\"\n",
+		"  - type: volkszaehler\n    url: \"localhost\"\n    channels: [{uuid: \"" + testChannel + "\", value: Bezug}]\n",
+		"  - type: volkszaehler\n    url: \"http://localhost\"\n    channels: [{uuid: kanal-1, value: Bezug}]\n",
+		"  - type: volkszaehler\n    url: \"http://localhost\"\n    channels: [{uuid: \"" + testChannel + "\", value: Leistung}]\n",
+		"  - type: volkszaehler\n    url: \"http://localhost\"\n    channels: [{uuid: \"" + testChannel + "\", value: Bezug, meter: waermestrom}]\n",
+		"  - type: volkszaehler\n    url: \"http://localhost\"\n    channels: [{uuid: \"" + testChannel + "\", value: Bezug, meter: gas}]\n",
+	} {
+		if _, err := LoadConfig(writeTestConfig(t, base+bad)); err == nil {
+			t.Errorf("expected error for %q", bad)
+		}
+	}
+}
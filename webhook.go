@@ -0,0 +1,338 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"net/url"
+	"slices"
+	"sync"
+	"text/template"
+	"time"
+)
+
+const (
+	// webhookTimeout bounds one request.
+	webhookTimeout = 30 * time.Second
+
+	// webhookSignatureHeader carries the HMAC of the body when a secret is
+	// set.
+	webhookSignatureHeader = "X-Zaehler2mqtt-Signature"
+)
+
+// Webhook event types.
+const (
+	EventReading   = "reading"
+	EventOffline   = "offline"
+	EventOnline    = "online"
+	EventThreshold = "threshold"
+)
+
+var webhookEvents = []string{EventReading, EventOffline, EventOnline, EventThreshold}
+
+// WebhookConfig configures a webhook output.
+type WebhookConfig struct {
+	URL string `yaml:"url"`
+	// Method is POST (the default), PUT or PATCH.
+	Method  string            `yaml:"method"`
+	Headers map[string]string `yaml:"headers"`
+	// Template renders the body from a batch of events; without it the
+	// events are sent as a JSON array.
+	Template string `yaml:"template"`
+	// Secret signs the body with HMAC-SHA256.
+	Secret string `yaml:"secret"`
+	// Events selects the event types sent, default: all of them.
+	Events     []string           `yaml:"events"`
+	Thresholds []WebhookThreshold `yaml:"thresholds"`
+
+	BatchConfig `yaml:",inline"`
+}
+
+// WebhookThreshold raises a threshold event when a value rises above Above,
+// and again when it falls back below Above minus Hysteresis.
+type WebhookThreshold struct {
+	// Meter restricts the threshold to one meter.
+	Meter string `yaml:"meter"`
+	// Value is the name or OBIS code of the value.
+	Value      string  `yaml:"value"`
+	Above      float64 `yaml:"above"`
+	Hysteresis float64 `yaml:"hysteresis"`
+}
+
+func (c WebhookConfig) method() string {
+	if c.Method == "" {
+		return http.MethodPost
+	}
+	return c.Method
+}
+
+func (c WebhookConfig) sends(event string) bool {
+	return len(c.Events) == 0 || slices.Contains(c.Events, event)
+}
+
+func (c WebhookConfig) validate() error {
+	u, err := url.Parse(c.URL)
+	if err != nil || u.Host == "" || (u.Scheme != "http" && u.Scheme != "https") {
+		return fmt.Errorf("webhook url %q is invalid (use http or https)", c.URL)
+	}
+	switch c.method() {
+	case http.MethodPost, http.MethodPut, http.MethodPatch:
+	default:
+		return fmt.Errorf("webhook method %q is invalid (use POST, PUT or PATCH)", c.Method)
+	}
+	if _, err := parseWebhookTemplate(c.Template); err != nil {
+		return fmt.Errorf("webhook template: %w", err)
+	}
+	for _, e := range c.Events {
+		if !slices.Contains(webhookEvents, e) {
+			return fmt.Errorf("webhook event %q is unknown", e)
+		}
+	}
+	for _, th := range c.Thresholds {
+		if th.Value == "" {
+			return fmt.Errorf("webhook thresholds need a value")
+		}
+		if th.Hysteresis < 0 {
+			return fmt.Errorf("webhook threshold on %s: hysteresis must not be negative", th.Value)
+		}
+	}
+	return c.BatchConfig.validate()
+}
+
+var webhookFuncs = template.FuncMap{
+	"json": func(v any) (string, error) {
+		data, err := json.Marshal(v)
+		return string(data), err
+	},
+}
+
+func parseWebhookTemplate(text string) (*template.Template, error) {
+	if text == "" {
+		return nil, nil
+	}
+	return template.New("webhook").Funcs(webhookFuncs).Option("missingkey=error").Parse(text)
+}
+
+// webhookEvent is what a webhook reports. Events are buffered as single
+// JSON lines.
+type webhookEvent struct {
+	Type  string    `json:"type"`
+	Meter string    `json:"meter"`
+	Time  time.Time `json:"time"`
+	// Reading and threshold events
+	Name  string   `json:"name,omitempty"`
+	OBIS  string   `json:"obis,omitempty"`
+	Unit  string   `json:"unit,omitempty"`
+	Value *float64 `json:"value,omitempty"`
+	// Threshold events
+	Threshold *float64 `json:"threshold,omitempty"`
+	Direction string   `json:"direction,omitempty"`
+	// Offline and online events
+	Serial string `json:"serial,omitempty"`
+}
+
+// webhookThresholdState tracks one threshold on one meter.
+type webhookThresholdState struct {
+	WebhookThreshold
+	// above is nil until the first reading.
+	above *bool
+}
+
+// webhookSink sends events to a webhook in batches.
+type webhookSink struct {
+	cfg    WebhookConfig
+	tmpl   *template.Template
+	client *http.Client
+	batch  *batcher
+
+	mu         sync.Mutex
+	thresholds map[string][]*webhookThresholdState // meter/value -> thresholds
+	// wasOnline is set once a meter delivered values, so the offline
+	// report when its reader starts is not sent.
+	wasOnline map[string]bool
+}
+
+func newWebhookSink(cfg WebhookConfig) (*webhookSink, error) {
+	tmpl, err := parseWebhookTemplate(cfg.Template)
+	if err != nil {
+		return nil, err
+	}
+	s := &webhookSink{
+		cfg:        cfg,
+		tmpl:       tmpl,
+		client:     &http.Client{Timeout: webhookTimeout},
+		thresholds: make(map[string][]*webhookThresholdState),
+		wasOnline:  make(map[string]bool),
+	}
+	u, _ := url.Parse(cfg.URL)
+	s.batch = newBatcher("webhook "+u.Host, cfg.BatchConfig, s.send)
+	return s, nil
+}
+
+func (s *webhookSink) Open(meter MeterConfig) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, v := range meter.Values {
+		key := meter.Name + "/" + v.Name
+		s.thresholds[key] = nil
+		for _, th := range s.cfg.Thresholds {
+			if (th.Meter == "" || th.Meter == meter.Name) && (th.Value == v.Name || th.Value == v.OBIS) {
+				s.thresholds[key] = append(s.thresholds[key], &webhookThresholdState{WebhookThreshold: th})
+			}
+		}
+	}
+}
+
+func (s *webhookSink) Write(meter string, readings []Reading) {
+	var events []webhookEvent
+	s.mu.Lock()
+	for _, r := range readings {
+		if r.Quality != QualityGood || math.IsNaN(r.Value) || math.IsInf(r.Value, 0) {
+			continue
+		}
+		value := r.Value
+		if s.cfg.sends(EventReading) {
+			events = append(events, webhookEvent{Type: EventReading, Meter: meter, Time: r.Time,
+				Name: r.Name, OBIS: r.OBIS, Unit: r.Unit, Value: &value})
+		}
+		for _, th := range s.thresholds[meter+"/"+r.Name] {
+			if direction := th.cross(value); direction != "" && s.cfg.sends(EventThreshold) {
+				above := th.Above
+				events = append(events, webhookEvent{Type: EventThreshold, Meter: meter, Time: r.Time,
+					Name: r.Name, OBIS: r.OBIS, Unit: r.Unit, Value: &value, Threshold: &above, Direction: direction})
+			}
+		}
+	}
+	s.mu.Unlock()
+	s.add(events...)
+}
+
+// cross updates the state with a reading and returns "above" or "below"
+// when it crossed the threshold. A first reading above it counts as a
+// crossing, so the receiver learns about it after a restart.
+func (th *webhookThresholdState) cross(value float64) string {
+	switch {
+	case value > th.Above && (th.above == nil || !*th.above):
+		th.above = ptr(true)
+		return "above"
+	case value < th.Above-th.Hysteresis && (th.above == nil || *th.above):
+		crossed := th.above != nil
+		th.above = ptr(false)
+		if crossed {
+			return "below"
+		}
+	}
+	return ""
+}
+
+func ptr[T any](v T) *T { return &v }
+
+func (s *webhookSink) Status(meter string, status MeterStatus) {
+	s.mu.Lock()
+	event := ""
+	switch {
+	case status.Stopped:
+		// a shutdown or reload is no outage, and the restarted reader
+		// starts over
+		delete(s.wasOnline, meter)
+	case status.Online && !s.wasOnline[meter]:
+		// the first values after the start are not worth an event
+		if _, seen := s.wasOnline[meter]; seen {
+			event = EventOnline
+		}
+		s.wasOnline[meter] = true
+	case !status.Online && s.wasOnline[meter]:
+		event = EventOffline
+		s.wasOnline[meter] = false
+	}
+	s.mu.Unlock()
+	if event != "" && s.cfg.sends(event) {
+		s.add(webhookEvent{Type: event, Meter: meter, Time: time.Now(), Serial: status.Serial})
+	}
+}
+
+func (s *webhookSink) Diagnostics(string, diagnosticsPayload) {}
+
+func (s *webhookSink) Close() error {
+	return s.batch.Close()
+}
+
+func (s *webhookSink) add(events ...webhookEvent) {
+	records := make([][]byte, 0, len(events))
+	for _, e := range events {
+		data, err := json.Marshal(e)
+		if err != nil {
+			log.Printf("[webhook] Failed to encode event: %v", err)
+			continue
+		}
+		records = append(records, data)
+	}
+	if len(records) > 0 {
+		s.batch.Add(records...)
+	}
+}
+
+// webhookBatch is what the template renders.
+type webhookBatch struct {
+	Events []webhookEvent
+}
+
+// body renders a batch of buffered events.
+func (s *webhookSink) body(records [][]byte) ([]byte, error) {
+	if s.tmpl == nil {
+		return append(append([]byte("["), bytes.Join(records, []byte(","))...), ']'), nil
+	}
+	var batch webhookBatch
+	for _, r := range records {
+		var e webhookEvent
+		if err := json.Unmarshal(r, &e); err != nil {
+			return nil, err
+		}
+		batch.Events = append(batch.Events, e)
+	}
+	var body bytes.Buffer
+	if err := s.tmpl.Execute(&body, batch); err != nil {
+		return nil, err
+	}
+	return body.Bytes(), nil
+}
+
+func (s *webhookSink) send(ctx context.Context, records [][]byte) error {
+	body, err := s.body(records)
+	if err != nil {
+		// rendering the same events again will fail again
+		return permanentError{fmt.Errorf("template: %w", err)}
+	}
+	req, err := http.NewRequestWithContext(ctx, s.cfg.method(), s.cfg.URL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for k, v := range s.cfg.Headers {
+		req.Header.Set(k, v)
+	}
+	if s.cfg.Secret != "" {
+		req.Header.Set(webhookSignatureHeader, webhookSignature(s.cfg.Secret, body))
+	}
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	return checkResponse(resp)
+}
+
+// webhookSignature is the hex HMAC-SHA256 of the body, prefixed with the
+// algorithm as GitHub does.
+func webhookSignature(secret string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
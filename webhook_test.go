@@ -0,0 +1,213 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+// webhookReceiver records the requests a webhook receives.
+type webhookReceiver struct {
+	mu       sync.Mutex
+	requests []*http.Request
+	bodies   []string
+}
+
+func newWebhookReceiver(t *testing.T) (*webhookReceiver, *httptest.Server) {
+	rec := &webhookReceiver{}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		data, _ := io.ReadAll(r.Body)
+		rec.mu.Lock()
+		defer rec.mu.Unlock()
+		rec.requests = append(rec.requests, r)
+		rec.bodies = append(rec.bodies, string(data))
+	}))
+	t.Cleanup(srv.Close)
+	return rec, srv
+}
+
+func (rec *webhookReceiver) events(t *testing.T) []webhookEvent {
+	t.Helper()
+	rec.mu.Lock()
+	defer rec.mu.Unlock()
+	var all []webhookEvent
+	for _, body := range rec.bodies {
+		var events []webhookEvent
+		if err := json.Unmarshal([]byte(body), &events); err != nil {
+			t.Fatalf("invalid body %q: %v", body, err)
+		}
+		all = append(all, events...)
+	}
+	return all
+}
+
+func newTestWebhook(t *testing.T, cfg WebhookConfig) *webhookSink {
+	t.Helper()
+	if err := cfg.validate(); err != nil {
+		t.Fatal(err)
+	}
+	sink, err := newWebhookSink(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sink.Open(sinkTestMeter)
+	return sink
+}
+
+// ---------------------------------------------------------------------------
+// Events
+// ---------------------------------------------------------------------------
+
+func TestWebhookSink_Readings(t *testing.T) {
+	rec, srv := newWebhookReceiver(t)
+	sink := newTestWebhook(t, WebhookConfig{URL: srv.URL, Secret: "geheim",
+		Headers: map[string]string{"Authorization": "Bearer abc"}})
+
+	sink.Write("nutzstrom", testReadings(influxTestTime, 8782400, 246))
+	sink.Close()
+
+	events := rec.events(t)
+	if len(events) != 2 || events[0].Type != EventReading || events[0].Name != "Bezug" || *events[0].Value != 8782400 ||
+		!events[1].Time.Equal(influxTestTime) {
+		t.Fatalf("unexpected events %+v", events)
+	}
+	req := rec.requests[0]
+	if req.Method != http.MethodPost || req.Header.Get("Authorization") != "Bearer abc" || req.Header.Get("Content-Type") != "application/json" {
+		t.Fatalf("unexpected request %s %v", req.Method, req.Header)
+	}
+	if got, want := req.Header.Get(webhookSignatureHeader), webhookSignature("geheim", []byte(rec.bodies[0])); got != want {
+		t.Fatalf("signature %q, want %q", got, want)
+	}
+}
+
+func TestWebhookSink_Thresholds(t *testing.T) {
+	rec, srv := newWebhookReceiver(t)
+	sink := newTestWebhook(t, WebhookConfig{URL: srv.URL, Events: []string{EventThreshold},
+		Thresholds: []WebhookThreshold{{Value: "1.0.16.7.0", Above: 3000, Hysteresis: 500}}})
+
+	for i, power := range []float64{1000, 3500, 2800, 4000, 2400, 2000, 3100} {
+		sink.Write("nutzstrom", testReadings(influxTestTime.Add(time.Duration(i)*time.Second), 1, power))
+	}
+	sink.Close()
+
+	var got []string
+	for _, e := range rec.events(t) {
+		got = append(got, e.Direction)
+		if e.Type != EventThreshold || e.Name != "Leistung" || *e.Threshold != 3000 {
+			t.Fatalf("unexpected event %+v", e)
+		}
+	}
+	// 2800 stays within the hysteresis
+	if len(got) != 3 || got[0] != "above" || got[1] != "below" || got[2] != "above" {
+		t.Fatalf("got crossings %v", got)
+	}
+}
+
+func TestWebhookSink_Offline(t *testing.T) {
+	rec, srv := newWebhookReceiver(t)
+	sink := newTestWebhook(t, WebhookConfig{URL: srv.URL, Events: []string{EventOffline, EventOnline}})
+
+	// the reader starts offline, which is not an event
+	sink.Status("nutzstrom", MeterStatus{})
+	sink.Status("nutzstrom", MeterStatus{Online: true, Serial: "1EBZ0100000001"})
+	sink.Write("nutzstrom", testReadings(influxTestTime, 1, 2))
+	sink.Status("nutzstrom", MeterStatus{Serial: "1EBZ0100000001"})
+	sink.Status("nutzstrom", MeterStatus{Online: true, Serial: "1EBZ0100000001"})
+	sink.Close()
+
+	events := rec.events(t)
+	if len(events) != 2 || events[0].Type != EventOffline || events[0].Serial != "1EBZ0100000001" || events[1].Type != EventOnline {
+		t.Fatalf("unexpected events %+v", events)
+	}
+}
+
+func TestWebhookSink_Reload(t *testing.T) {
+	rec, srv := newWebhookReceiver(t)
+	sink := newTestWebhook(t, WebhookConfig{URL: srv.URL, Events: []string{EventOffline, EventOnline}})
+
+	// a reload stops the reader and starts a new one, as RunMeter does
+	status := &statusTracker{meter: "nutzstrom", sink: sink}
+	status.setOnline(false)
+	status.setOnline(true)
+	status.stop()
+	status = &statusTracker{meter: "nutzstrom", sink: sink}
+	status.setOnline(false)
+	status.setOnline(true)
+
+	// an outage after the reload is still reported
+	status.setOnline(false)
+	status.stop()
+	sink.Close()
+
+	events := rec.events(t)
+	if len(events) != 1 || events[0].Type != EventOffline {
+		t.Fatalf("unexpected events %+v", events)
+	}
+}
+
+func TestWebhookSink_Template(t *testing.T) {
+	rec, srv := newWebhookReceiver(t)
+	sink := newTestWebhook(t, WebhookConfig{URL: srv.URL, Method: http.MethodPut,
+		Template: `{"points":[{{range $i, $e := .Events}}{{if $i}},{{end}}{"ts":{{$e.Time.Unix}},"{{$e.Name}}":{{$e.Value}}}{{end}}],"raw":{{json (index .Events 0).Unit}}}`})
+
+	sink.Write("nutzstrom", testReadings(influxTestTime, 8782400, 246))
+	sink.Close()
+
+	want := `{"points":[{"ts":1700000000,"Bezug":8.7824e+06},{"ts":1700000000,"Leistung":246}],"raw":"Wh"}`
+	if len(rec.bodies) != 1 || rec.bodies[0] != want || rec.requests[0].Method != http.MethodPut {
+		t.Fatalf("got %v, want %s", rec.bodies, want)
+	}
+}
+
+// ---------------------------------------------------------------------------
+// Config
+// ---------------------------------------------------------------------------
+
+func TestLoadConfig_Webhook(t *testing.T) {
+	base := `
+meters:
+  - name: nutzstrom
+    device: /dev/ttyUSB0
+    values:
+      - name: Leistung
+        obis: "1.0.16.7.0"
+outputs:
+`
+	cfg, err := LoadConfig(writeTestConfig(t, base+`
+  - type: webhook
+    url: "https://energie.example.com/ingest"
+    headers:
+      Authorization: "Bearer abc"
+    events: [threshold, offline]
+    thresholds:
+      - value: Leistung
+        above: 5000
+        hysteresis: 200
+    max_retries: 5
+    max_backoff: 1m
+`))
+	if err != nil {
+		t.Fatalf("LoadConfig error: %v", err)
+	}
+	w := cfg.Outputs[0].Webhook
+	if w == nil || w.Headers["Authorization"] != "Bearer abc" || len(w.Thresholds) != 1 || w.Thresholds[0].Above != 5000 ||
+		w.MaxRetries != 5 || w.MaxBackoff != time.Minute {
+		t.Fatalf("unexpected webhook %+v", w)
+	}
+
+	for _, bad := range []string{
+		"  - type: webhook\n    url: \"ftp://localhost\"\n",
+		"  - type: webhook\n    url: \"http://localhost\"\n    method: GET\n",
+		"  - type: webhook\n    url: \"http://localhost\"\n    template: \"{{.Events\"\n",
+		"  - type: webhook\n    url: \"http://localhost\"\n    events: [alarm]\n",
+		"  - type: webhook\n    url: \"http://localhost\"\n    thresholds:\n      - value: Bezug\n        above: 1\n",
+	} {
+		if _, err := LoadConfig(writeTestConfig(t, base+bad)); err == nil {
+			t.Errorf("expected error for %q", bad)
+		}
+	}
+}